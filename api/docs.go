@@ -17,6 +17,28 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/cache/quotas": {
+            "get": {
+                "summary": "Get the usage of the cache quota groups",
+                "responses": {
+                    "200": {
+                        "description": "The usage of each quota group",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "object"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Quotas are disabled",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/blobs/{url}": {
             "get": {
                 "summary": "Get a blob by URL",
@@ -2,13 +2,52 @@
 // Licensed under the MIT License.
 package main
 
+import "time"
+
 type ServerCmd struct {
 	HttpAddr        string `arg:"--http-addr" help:"address of the server" default:"127.0.0.1:5000"`
 	HttpsAddr       string `arg:"--https-addr" help:"address of the server" default:"0.0.0.0:5001"`
-	RouterAddr      string `arg:"--router-addr" help:"address of the router (p2p)" default:"0.0.0.0:5003"`
+	RouterAddr      string `arg:"--router-addr" help:"address of the router (p2p), listening on both IPv4 and IPv6 when the host is empty" default:"0.0.0.0:5003"`
 	PromAddr        string `arg:"--prom-addr" help:"address of prometheus metrics endpoint" default:"0.0.0.0:5004"`
 	PrefetchWorkers int    `arg:"--prefetch-workers" help:"number of workers to prefetch content" default:"50"`
 
+	// Router configuration.
+	AddressFamily  string        `arg:"--address-family" help:"preferred IP address family of peers" default:"ipv4" valid:"ipv4,ipv6"`
+	AllowCIDRs     []string      `arg:"--allow-cidrs" help:"networks whose addresses are advertised and used to reach peers, in order of preference"`
+	DenyCIDRs      []string      `arg:"--deny-cidrs" help:"networks whose addresses are never advertised or used to reach peers"`
+	Discovery      string        `arg:"--discovery" help:"how providers of content are found: dht lookups, gossip announcements indexed by every node, or an elected tracker that indexes the reports of every node" default:"dht" valid:"dht,gossip,tracker"`
+	Bootstrap      []string      `arg:"--bootstrap" help:"sources of the peers to bootstrap from, combined: leader, static=<multiaddr>[,...], dns=<name>, srv=<name>, endpointslices=<service> or mdns (default: leader)"`
+	Topology       string        `arg:"--topology" help:"how strictly peers close to this node are used: off, prefer closest first, or only those in the same region or zone" default:"prefer" valid:"off,prefer,region,zone"`
+	NodePoolLabel  string        `arg:"--node-pool-label" help:"label of the node pool of a node, whose peers are preferred" default:"kubernetes.azure.com/agentpool"`
+	RankWindow     time.Duration `arg:"--rank-window" help:"how long providers are collected to use the fastest first, at most a quarter of the resolve timeout, 0 to use them as they are found" default:"1ms"`
+	QUIC           bool          `arg:"--quic" help:"also listen for peers over QUIC on the UDP ports of the router and https addresses, serving and fetching peer data over HTTP/3 with fallback to TCP" default:"false"`
+	Role           string        `arg:"--role" help:"role of this node: a peer reads content that no peer has from a super-peer, which reads it from the upstream once for all peers; nodes labelled with the super-peer label are super-peers" default:"peer" valid:"peer,super-peer"`
+	SuperPeerLabel string        `arg:"--super-peer-label" help:"label of the nodes that run as super-peers, with the value true" default:"peerd.azure.com/super-peer"`
+
+	// Download configuration.
+	ResolvePercentile             float64       `arg:"--resolve-percentile" help:"percentile of the durations of recent discoveries of a peer that a key is resolved for, within the budget of its traffic, 0 to always use the ceiling" default:"0.99"`
+	ResolveTimeoutFloor           time.Duration `arg:"--resolve-timeout-floor" help:"minimum time to resolve a key for a client read" default:"5ms"`
+	ResolveTimeoutCeiling         time.Duration `arg:"--resolve-timeout-ceiling" help:"maximum time to resolve a key for a client read before reading from the upstream" default:"50ms"`
+	PrefetchResolveTimeoutFloor   time.Duration `arg:"--prefetch-resolve-timeout-floor" help:"minimum time to resolve a key for prefetching" default:"20ms"`
+	PrefetchResolveTimeoutCeiling time.Duration `arg:"--prefetch-resolve-timeout-ceiling" help:"maximum time to resolve a key for prefetching before reading from the upstream" default:"500ms"`
+	HedgePercentile               float64       `arg:"--hedge-percentile" help:"percentile of the durations of recent reads from peers after which a read is raced by another peer or the upstream, 0 to disable" default:"0.95"`
+	SwarmSources                  int           `arg:"--swarm-sources" help:"maximum number of peers a prefetched file is downloaded from concurrently, 0 to prefetch each chunk from its first provider" default:"8"`
+	SwarmOriginLimit              int           `arg:"--swarm-origin-limit" help:"maximum number of chunks of a prefetched file downloaded concurrently from the upstream, which downloads the rarest chunks first, 0 to be limited only by the prefetch workers shared by all files" default:"0"`
+	MaxHops                       int           `arg:"--max-hops" help:"maximum number of peers a request is forwarded through; nodes with more than 1 pull content they do not hold through from other peers on behalf of the requester, 0 to never read from peers" default:"1"`
+
+	// Advertisement configuration.
+	Advertise         string        `arg:"--advertise" help:"granularity at which cached content is advertised: each chunk, or each blob with its chunks served on request; must match on every node, so blob requires every node to support it" default:"chunk" valid:"chunk,blob"`
+	ReprovideInterval time.Duration `arg:"--reprovide-interval" help:"interval at which cached content is advertised again, 0 to disable" default:"10m"`
+	ReprovideRate     int           `arg:"--reprovide-rate" help:"maximum number of chunks advertised per second when re-advertising, 0 for no limit" default:"100"`
+	ProvideWorkers    int           `arg:"--provide-workers" help:"number of workers advertising content concurrently" default:"8"`
+
+	// Cache configuration.
+	CacheEvictionPolicy string        `arg:"--cache-eviction-policy" help:"eviction policy of the files cache" default:"tinylfu" valid:"tinylfu,lru,lfu,arc,ttl"`
+	CacheEvictionTTL    time.Duration `arg:"--cache-eviction-ttl" help:"time to live of cached files when the ttl eviction policy is used" default:"1h"`
+	CacheLayout         string        `arg:"--cache-layout" help:"storage layout of the files cache" default:"chunks" valid:"chunks,sparse"`
+	CacheQuotaConfig    string        `arg:"--cache-quota-config" help:"path of a JSON file that configures quota groups of the files cache"`
+	SuperPeerCacheSize  int64         `arg:"--super-peer-cache-size" help:"capacity in bytes of the files cache when this node is a super-peer, 0 to use the capacity of a peer" default:"0"`
+
 	// Mirror configuration.
 	Hosts                     []string `arg:"--hosts" help:"list of hosts to mirror"`
 	AddMirrorConfiguration    bool     `arg:"--add-mirror-configuration" help:"add mirror configuration to containerd host configuration" default:"false"`
@@ -16,8 +55,26 @@ type ServerCmd struct {
 	ContainerdHostsConfigPath string   `arg:"--containerd-hosts-config-path" help:"containerd hosts configuration path" default:"/etc/containerd/certs.d"`
 }
 
+type CacheExportCmd struct {
+	Digests   []string `arg:"--digests,required" help:"digests of the blobs to export"`
+	Output    string   `arg:"-o,--output,required" help:"path of the archive to write, or - for stdout"`
+	CachePath string   `arg:"--cache-path" help:"path of the files cache" default:"/tmp/distribution/peerd/cache"`
+}
+
+type CacheImportCmd struct {
+	Input       string `arg:"-i,--input,required" help:"path of the archive to read, or - for stdin"`
+	CachePath   string `arg:"--cache-path" help:"path of the files cache" default:"/tmp/distribution/peerd/cache"`
+	CacheLayout string `arg:"--cache-layout" help:"storage layout of the files cache" default:"chunks" valid:"chunks,sparse"`
+}
+
+type CacheCmd struct {
+	Export *CacheExportCmd `arg:"subcommand:export" help:"export cached blobs to an archive"`
+	Import *CacheImportCmd `arg:"subcommand:import" help:"import blobs from an archive into the cache"`
+}
+
 type Arguments struct {
 	Server   *ServerCmd `arg:"subcommand:run" help:"run the server"`
+	Cache    *CacheCmd  `arg:"subcommand:cache" help:"manage the files cache"`
 	Version  bool       `arg:"-v" help:"show version and exit"`
 	LogLevel string     `arg:"--log-level" help:"set the log level" default:"info" valid:"debug,info,warn,error,fatal,panic"`
 }
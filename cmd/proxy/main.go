@@ -14,15 +14,21 @@ import (
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/azure/peerd/pkg/cache"
 	pcontext "github.com/azure/peerd/pkg/context"
 	"github.com/azure/peerd/pkg/discovery/content/provider"
+	"github.com/azure/peerd/pkg/discovery/content/reader"
 	"github.com/azure/peerd/pkg/discovery/routing"
+	"github.com/azure/peerd/pkg/files"
 	"github.com/azure/peerd/pkg/files/store"
 	"github.com/azure/peerd/pkg/handlers"
 	"github.com/azure/peerd/pkg/k8s"
 	"github.com/azure/peerd/pkg/k8s/events"
 	"github.com/azure/peerd/pkg/metrics"
+	"github.com/azure/peerd/pkg/peernet"
+	"github.com/opencontainers/go-digest"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
 )
@@ -68,15 +74,163 @@ func run(ctx context.Context, args *Arguments) error {
 		return nil
 	case args.Server != nil:
 		return serverCommand(ctx, args.Server)
+	case args.Cache != nil:
+		return cacheCommand(ctx, args.Cache)
 	default:
 		return fmt.Errorf("unknown subcommand")
 	}
 }
 
+func cacheCommand(ctx context.Context, args *CacheCmd) error {
+	l := zerolog.Ctx(ctx)
+
+	switch {
+	case args.Export != nil:
+		digests := make([]digest.Digest, len(args.Export.Digests))
+		for i, d := range args.Export.Digests {
+			digests[i] = digest.Digest(d)
+		}
+
+		w := os.Stdout
+		if args.Export.Output != "-" {
+			f, err := os.Create(args.Export.Output)
+			if err != nil {
+				return err
+			}
+			w = f
+		}
+
+		err := cache.Export(args.Export.CachePath, digests, w)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			if args.Export.Output != "-" {
+				_ = os.Remove(args.Export.Output)
+			}
+			return err
+		}
+
+		l.Info().Strs("digests", args.Export.Digests).Str("output", args.Export.Output).Msg("cache export")
+		return nil
+
+	case args.Import != nil:
+		r := os.Stdin
+		if args.Import.Input != "-" {
+			f, err := os.Open(args.Import.Input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		if args.Import.CacheLayout != "" {
+			cache.StorageLayout = args.Import.CacheLayout
+		}
+
+		imported, err := cache.Import(args.Import.CachePath, int64(files.CacheBlockSize), r)
+		if err != nil {
+			return err
+		}
+
+		l.Info().Int("blobs", len(imported)).Str("input", args.Import.Input).Msg("cache import")
+		return nil
+
+	default:
+		return fmt.Errorf("unknown cache subcommand")
+	}
+}
+
 func serverCommand(ctx context.Context, args *ServerCmd) (err error) {
 	l := zerolog.Ctx(ctx)
 
 	store.PrefetchWorkers = args.PrefetchWorkers
+	if args.AddressFamily != "" {
+		if routing.PreferredAddressFamily, err = routing.ParseAddressFamily(args.AddressFamily); err != nil {
+			return err
+		}
+	}
+	if routing.AllowedCIDRs, err = routing.ParseCIDRs(args.AllowCIDRs); err != nil {
+		return err
+	}
+	if routing.DeniedCIDRs, err = routing.ParseCIDRs(args.DenyCIDRs); err != nil {
+		return err
+	}
+	if args.Discovery != "" {
+		if routing.Discovery, err = routing.ParseDiscoveryMode(args.Discovery); err != nil {
+			return err
+		}
+	}
+	if len(args.Bootstrap) > 0 {
+		routing.Bootstrap = args.Bootstrap
+	}
+	if args.Topology != "" {
+		if routing.Topology, err = routing.ParseTopologyMode(args.Topology); err != nil {
+			return err
+		}
+	}
+	if args.NodePoolLabel != "" {
+		k8s.NodePoolLabel = args.NodePoolLabel
+	}
+	if args.Role != "" {
+		if routing.NodeRole, err = routing.ParseRole(args.Role); err != nil {
+			return err
+		}
+	}
+	if args.SuperPeerLabel != "" {
+		k8s.SuperPeerLabel = args.SuperPeerLabel
+	}
+	routing.RankWindow = args.RankWindow
+	routing.QUIC = args.QUIC
+	peernet.HTTP3 = args.QUIC
+	if args.HedgePercentile < 0 || args.HedgePercentile > 1 {
+		return fmt.Errorf("invalid hedge percentile: %v", args.HedgePercentile)
+	}
+	reader.HedgePercentile = args.HedgePercentile
+	if args.ResolvePercentile < 0 || args.ResolvePercentile > 1 {
+		return fmt.Errorf("invalid resolve percentile: %v", args.ResolvePercentile)
+	}
+	reader.ResolvePercentile = args.ResolvePercentile
+	if args.ResolveTimeoutFloor > args.ResolveTimeoutCeiling || args.PrefetchResolveTimeoutFloor > args.PrefetchResolveTimeoutCeiling {
+		return fmt.Errorf("resolve timeout floor exceeds its ceiling")
+	}
+	reader.InteractiveResolve = reader.ResolveBudget{Floor: args.ResolveTimeoutFloor, Ceiling: args.ResolveTimeoutCeiling}
+	reader.PrefetchResolve = reader.ResolveBudget{Floor: args.PrefetchResolveTimeoutFloor, Ceiling: args.PrefetchResolveTimeoutCeiling}
+	store.SwarmSources = args.SwarmSources
+	store.SwarmOriginLimit = args.SwarmOriginLimit
+	if args.MaxHops < 0 {
+		return fmt.Errorf("invalid max hops: %v", args.MaxHops)
+	}
+	pcontext.MaxHops = args.MaxHops
+	if args.Advertise != "" {
+		if routing.Advertise, err = routing.ParseAdvertiseMode(args.Advertise); err != nil {
+			return err
+		}
+	}
+	store.ReprovideInterval = args.ReprovideInterval
+	store.ReprovideRate = args.ReprovideRate
+	provider.ProvideWorkers = args.ProvideWorkers
+	if store.ReprovideInterval >= routing.MaxRecordAge {
+		l.Warn().Dur("interval", store.ReprovideInterval).Dur("maxRecordAge", routing.MaxRecordAge).Msg("reprovide interval exceeds provider record age, cached content will periodically become undiscoverable")
+	}
+	if args.CacheEvictionPolicy != "" {
+		cache.EvictionPolicyName = args.CacheEvictionPolicy
+	}
+	if args.CacheEvictionTTL > 0 {
+		cache.EvictionTTL = args.CacheEvictionTTL
+	}
+	if args.CacheLayout != "" {
+		cache.StorageLayout = args.CacheLayout
+	}
+	if args.CacheQuotaConfig != "" {
+		if cache.Quotas, err = cache.LoadQuotaConfig(args.CacheQuotaConfig); err != nil {
+			return err
+		}
+	}
+	if args.SuperPeerCacheSize < 0 {
+		return fmt.Errorf("invalid super-peer cache size: %v", args.SuperPeerCacheSize)
+	}
 
 	_, httpsPort, err := net.SplitHostPort(args.HttpsAddr)
 	if err != nil {
@@ -100,6 +254,18 @@ func serverCommand(ctx context.Context, args *ServerCmd) (err error) {
 	}()
 	eventsRecorder.Initializing()
 
+	if routing.NodeRole != routing.RoleSuperPeer {
+		if superPeer, err := k8s.IsSuperPeerNode(ctx, clientset); err != nil {
+			l.Warn().Err(err).Msg("could not read super-peer label of node")
+		} else if superPeer {
+			routing.NodeRole = routing.RoleSuperPeer
+		}
+	}
+	l.Info().Str("role", string(routing.NodeRole)).Msg("node role")
+	if routing.NodeRole == routing.RoleSuperPeer && args.SuperPeerCacheSize > 0 {
+		cache.FilesCacheMaxCost = args.SuperPeerCacheSize
+	}
+
 	r, err := routing.NewRouter(ctx, clientset, args.RouterAddr, httpsPort)
 	if err != nil {
 		return err
@@ -113,7 +279,7 @@ func serverCommand(ctx context.Context, args *ServerCmd) (err error) {
 	g, ctx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
-		provider.Provide(ctx, r, filesStore.Subscribe())
+		provider.Provide(ctx, r, filesStore.Subscribe(), filesStore.Evicted())
 		return nil
 	})
 
@@ -140,6 +306,26 @@ func serverCommand(ctx context.Context, args *ServerCmd) (err error) {
 		return httpsSrv.Shutdown(shutdownCtx)
 	})
 
+	if args.QUIC {
+		http3Srv := &http3.Server{
+			Addr:      args.HttpsAddr,
+			Handler:   handler,
+			TLSConfig: http3.ConfigureTLSConfig(r.Net().DefaultTLSConfig()),
+		}
+		g.Go(func() error {
+			if err := http3Srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+		g.Go(func() error {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			return http3Srv.Shutdown(shutdownCtx)
+		})
+	}
+
 	httpSrv := &http.Server{
 		Addr:    args.HttpAddr,
 		Handler: handler,
@@ -157,8 +343,14 @@ func serverCommand(ctx context.Context, args *ServerCmd) (err error) {
 		return httpSrv.Shutdown(shutdownCtx)
 	})
 
+	adminHandler, err := handlers.AdminHandler(ctx, r, filesStore)
+	if err != nil {
+		return err
+	}
+
 	g.Go(func() error {
 		http.Handle("/metrics/prometheus", promhttp.Handler())
+		http.Handle("/admin/", adminHandler)
 		if err = http.ListenAndServe(args.PromAddr, nil); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
@@ -4,10 +4,16 @@ package main
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/azure/peerd/pkg/cache"
+	pcontext "github.com/azure/peerd/pkg/context"
+	"github.com/azure/peerd/pkg/files"
 	"github.com/azure/peerd/pkg/metrics"
+	"github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog"
 )
 
@@ -105,6 +111,60 @@ func TestServerCommand_InvalidHttpsAddr(t *testing.T) {
 	}
 }
 
+func TestServerCommand_InvalidSuperPeerCacheSize(t *testing.T) {
+	ctx := testCtx
+
+	args := &ServerCmd{
+		HttpAddr:           "127.0.0.1:8080",
+		HttpsAddr:          "127.0.0.1:8081",
+		RouterAddr:         "127.0.0.1:8082",
+		PromAddr:           "127.0.0.1:8083",
+		PrefetchWorkers:    10,
+		SuperPeerCacheSize: -1,
+	}
+
+	err := serverCommand(ctx, args)
+	if err == nil {
+		t.Error("Expected error for invalid super-peer cache size")
+	}
+
+	if !strings.Contains(err.Error(), "invalid super-peer cache size") {
+		t.Errorf("Expected 'invalid super-peer cache size' error, got %v", err)
+	}
+}
+
+func TestServerCommand_MaxHops(t *testing.T) {
+	defer func(m int) { pcontext.MaxHops = m }(pcontext.MaxHops)
+
+	for _, tc := range []struct {
+		maxHops  int
+		expected string
+	}{
+		{maxHops: -1, expected: "invalid max hops"},
+		{maxHops: 0, expected: "missing port"},
+		{maxHops: 3, expected: "missing port"},
+	} {
+		pcontext.MaxHops = 1
+		args := &ServerCmd{
+			HttpAddr:        "127.0.0.1:8080",
+			HttpsAddr:       "invalid-address",
+			RouterAddr:      "127.0.0.1:8082",
+			PromAddr:        "127.0.0.1:8083",
+			PrefetchWorkers: 10,
+			MaxHops:         tc.maxHops,
+		}
+
+		// The https address is validated after the max hops, which are applied when valid.
+		err := serverCommand(testCtx, args)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%v: expected: %v, got: %v", tc.maxHops, tc.expected, err)
+		}
+		if tc.maxHops >= 0 && pcontext.MaxHops != tc.maxHops {
+			t.Errorf("%v: expected: %v, got: %v", tc.maxHops, tc.maxHops, pcontext.MaxHops)
+		}
+	}
+}
+
 func TestLoggingConfiguration(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -134,3 +194,47 @@ func TestLoggingConfiguration(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheCommand(t *testing.T) {
+	ctx := testCtx
+
+	src, dst := t.TempDir(), t.TempDir()
+	content := []byte("hello world")
+	d := digest.FromBytes(content)
+
+	c := cache.NewCache(ctx, int64(files.CacheBlockSize), src)
+	if _, err := c.GetOrCreate(d.String(), 0, len(content), func() ([]byte, error) {
+		return content, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "cache.tar")
+
+	err := cacheCommand(ctx, &CacheCmd{Export: &CacheExportCmd{Digests: []string{digest.FromString("missing").String()}, Output: archive, CachePath: src}})
+	if err == nil {
+		t.Error("Expected error exporting a blob that is not cached")
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Errorf("Expected no archive to be left behind, got %v", err)
+	}
+
+	if err := cacheCommand(ctx, &CacheCmd{Export: &CacheExportCmd{Digests: []string{d.String()}, Output: archive, CachePath: src}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cacheCommand(ctx, &CacheCmd{Import: &CacheImportCmd{Input: archive, CachePath: dst}}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, d.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(got) != string(content) {
+		t.Errorf("Expected %q, got %q", content, got)
+	}
+
+	if err := cacheCommand(ctx, &CacheCmd{}); err == nil {
+		t.Error("Expected error for missing cache subcommand")
+	}
+}
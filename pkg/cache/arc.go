@@ -0,0 +1,125 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+// arcPolicy implements the Adaptive Replacement Cache algorithm (Megiddo and Modha, 2003).
+// Entries seen once live in t1 and entries seen at least twice live in t2. The ghost lists b1 and b2 remember keys
+// recently evicted from t1 and t2 respectively, and hits on them adapt the target size p of t1.
+// Unlike the original algorithm, sizes are measured by entry cost rather than by entry count.
+type arcPolicy struct {
+	capacity int64
+	p        int64
+
+	t1, t2 *keyList
+	b1, b2 *keyList
+}
+
+var _ EvictionPolicy = &arcPolicy{}
+
+// Name returns the name of the policy.
+func (p *arcPolicy) Name() string {
+	return PolicyARC
+}
+
+// Admit records a new entry and evicts entries from t1 or t2 until it fits.
+func (p *arcPolicy) Admit(key string, cost int64) []Eviction {
+	p.t1.remove(key)
+	p.t2.remove(key)
+
+	var evicted []Eviction
+	switch {
+	case p.b1.entries[key] != nil:
+		// Recently evicted from t1: favour recency by growing t1.
+		p.p = min(p.capacity, p.p+adaptDelta(cost, p.b2.size, p.b1.size))
+		p.b1.remove(key)
+		evicted = p.replace(cost, false)
+		p.t2.pushFront(&listEntry{key: key, cost: cost})
+
+	case p.b2.entries[key] != nil:
+		// Recently evicted from t2: favour frequency by shrinking t1.
+		p.p = max(0, p.p-adaptDelta(cost, p.b1.size, p.b2.size))
+		p.b2.remove(key)
+		evicted = p.replace(cost, true)
+		p.t2.pushFront(&listEntry{key: key, cost: cost})
+
+	default:
+		evicted = p.replace(cost, false)
+		p.t1.pushFront(&listEntry{key: key, cost: cost})
+	}
+
+	p.trimGhosts()
+	return evicted
+}
+
+// Touch promotes the entry to the frequently used list.
+func (p *arcPolicy) Touch(key string) bool {
+	if entry, ok := p.t1.remove(key); ok {
+		p.t2.pushFront(entry)
+		return true
+	}
+	return p.t2.moveToFront(key)
+}
+
+// Remove forgets the entry, including any ghost history.
+func (p *arcPolicy) Remove(key string) {
+	p.t1.remove(key)
+	p.t2.remove(key)
+	p.b1.remove(key)
+	p.b2.remove(key)
+}
+
+// Len returns the number of live entries.
+func (p *arcPolicy) Len() int {
+	return p.t1.len() + p.t2.len()
+}
+
+// replace evicts entries from t1 or t2 into their ghost lists until an entry of the given cost fits.
+func (p *arcPolicy) replace(cost int64, hitB2 bool) []Eviction {
+	var evicted []Eviction
+	for p.t1.size+p.t2.size+cost > p.capacity {
+		var entry *listEntry
+		var ok bool
+		if p.t1.len() > 0 && (p.t1.size > p.p || (hitB2 && p.t1.size == p.p) || p.t2.len() == 0) {
+			if entry, ok = p.t1.removeBack(); ok {
+				p.b1.pushFront(entry)
+			}
+		} else if entry, ok = p.t2.removeBack(); ok {
+			p.b2.pushFront(entry)
+		}
+
+		if !ok {
+			break
+		}
+		evicted = append(evicted, Eviction{Key: entry.key, Reason: EvictionReasonCapacity})
+	}
+	return evicted
+}
+
+// trimGhosts bounds the ghost lists so that t1+b1 fits in the capacity and all lists together fit in twice the capacity.
+func (p *arcPolicy) trimGhosts() {
+	for p.t1.size+p.b1.size > p.capacity && p.b1.len() > 0 {
+		p.b1.removeBack()
+	}
+	for p.t1.size+p.t2.size+p.b1.size+p.b2.size > 2*p.capacity && p.b2.len() > 0 {
+		p.b2.removeBack()
+	}
+}
+
+// adaptDelta returns how much the target size of t1 moves on a ghost hit.
+func adaptDelta(cost, other, hit int64) int64 {
+	if hit > 0 && other > hit {
+		return cost * other / hit
+	}
+	return cost
+}
+
+// newARCPolicy creates an adaptive replacement eviction policy.
+func newARCPolicy(capacity int64) *arcPolicy {
+	return &arcPolicy{
+		capacity: capacity,
+		t1:       newKeyList(),
+		t2:       newKeyList(),
+		b1:       newKeyList(),
+		b2:       newKeyList(),
+	}
+}
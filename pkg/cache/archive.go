@@ -0,0 +1,416 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/azure/peerd/pkg/math"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// archiveIndexName is the name of the archive entry that lists the blobs in the archive.
+	archiveIndexName = "index.json"
+
+	// archiveSchemaVersion is the version of the archive format.
+	archiveSchemaVersion = 1
+)
+
+// archiveIndex lists the blobs in an archive.
+type archiveIndex struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	Blobs         []archivedBlob `json:"blobs"`
+}
+
+// archivedBlob describes a blob in an archive.
+type archivedBlob struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// Export writes the given blobs from the cache at path to w as a tar archive.
+// The archive contains an index.json that lists the blobs and their sizes, followed by the content of each blob at
+// blobs/<algorithm>/<encoded>. Every blob must be fully cached and match its digest.
+func Export(path string, digests []digest.Digest, w io.Writer) error {
+	idx := archiveIndex{SchemaVersion: archiveSchemaVersion}
+	contents := make([]func(io.Writer) error, len(digests))
+	for i, d := range digests {
+		if err := d.Validate(); err != nil {
+			return err
+		}
+
+		size, content, err := blobContent(filepath.Join(path, d.String()))
+		if err != nil {
+			return fmt.Errorf("blob %v is not fully cached: %w", d, err)
+		}
+
+		contents[i] = content
+		idx.Blobs = append(idx.Blobs, archivedBlob{Digest: d, Size: size})
+	}
+
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: archiveIndexName, Mode: 0644, Size: int64(len(b))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	for i, blob := range idx.Blobs {
+		if err := tw.WriteHeader(&tar.Header{Name: blobEntryName(blob.Digest), Mode: 0644, Size: blob.Size}); err != nil {
+			return err
+		}
+
+		verifier := blob.Digest.Verifier()
+		if err := contents[i](io.MultiWriter(tw, verifier)); err != nil {
+			return fmt.Errorf("blob %v: %w", blob.Digest, err)
+		}
+
+		if !verifier.Verified() {
+			return fmt.Errorf("blob %v: cached content does not match digest", blob.Digest)
+		}
+	}
+
+	return tw.Close()
+}
+
+// Import reads a tar archive written by Export from r and stores its blobs in the cache at path in the layout named by
+// StorageLayout, split into chunks of the given size. Each blob is verified against its digest before it is moved
+// into the cache.
+// It returns the digests of the imported blobs.
+func Import(path string, blockSize int64, r io.Reader) ([]digest.Digest, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	var idx *archiveIndex
+	var imported []digest.Digest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return imported, err
+		}
+
+		if hdr.Name == archiveIndexName {
+			idx = &archiveIndex{}
+			if err := json.NewDecoder(tr).Decode(idx); err != nil {
+				return imported, fmt.Errorf("invalid archive index: %w", err)
+			}
+			if idx.SchemaVersion != archiveSchemaVersion {
+				return imported, fmt.Errorf("unsupported archive schema version: %v", idx.SchemaVersion)
+			}
+			continue
+		}
+
+		if idx == nil {
+			return imported, errors.New("archive index must precede blobs")
+		}
+
+		i := slices.IndexFunc(idx.Blobs, func(b archivedBlob) bool { return blobEntryName(b.Digest) == hdr.Name })
+		if i < 0 {
+			return imported, fmt.Errorf("unexpected archive entry: %v", hdr.Name)
+		}
+
+		blob := idx.Blobs[i]
+		if hdr.Size != blob.Size {
+			return imported, fmt.Errorf("blob %v: expected size %v, got %v", blob.Digest, blob.Size, hdr.Size)
+		}
+		importFunc := importBlob
+		if StorageLayout == LayoutSparse {
+			importFunc = importSparseBlob
+		}
+		if err := importFunc(path, blockSize, blob, tr); err != nil {
+			return imported, err
+		}
+		imported = append(imported, blob.Digest)
+	}
+
+	if idx == nil {
+		return imported, errors.New("archive index not found")
+	}
+	if len(imported) != len(idx.Blobs) {
+		return imported, fmt.Errorf("archive is missing blobs: expected %v, got %v", len(idx.Blobs), len(imported))
+	}
+
+	return imported, nil
+}
+
+// importBlob writes the blob into a temporary directory in chunks, verifies it against its digest and moves the
+// chunks into the cache.
+func importBlob(path string, blockSize int64, blob archivedBlob, r io.Reader) error {
+	if err := blob.Digest.Validate(); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(path, blob.Digest.Encoded()+tempInfix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	verifier := blob.Digest.Verifier()
+	buf := make([]byte, blockSize)
+	for offset := int64(0); offset < blob.Size; offset += blockSize {
+		n, err := io.ReadFull(r, buf[:min(blockSize, blob.Size-offset)])
+		if err != nil {
+			return fmt.Errorf("blob %v: %w", blob.Digest, err)
+		}
+		if _, err := verifier.Write(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := writeAtomic(filepath.Join(tmp, strconv.FormatInt(offset, 10)), buf[:n]); err != nil {
+			return err
+		}
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %v: content does not match digest", blob.Digest)
+	}
+
+	dir := filepath.Join(path, blob.Digest.String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// Move checksums first so that a chunk is never newer than its checksum.
+		if filepath.Ext(e.Name()) != checksumSuffix {
+			continue
+		}
+		if err := os.Rename(filepath.Join(tmp, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == checksumSuffix {
+			continue
+		}
+		if err := os.Rename(filepath.Join(tmp, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	if err := writeSize(dir, blob.Size); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// importSparseBlob writes the blob into a sparse file in a temporary directory, verifies it against its digest and
+// moves the sparse file and its presence into the cache.
+func importSparseBlob(path string, blockSize int64, blob archivedBlob, r io.Reader) error {
+	if err := blob.Digest.Validate(); err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp(path, blob.Digest.Encoded()+tempInfix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	sb, err := openSparseBlob(blob.Digest.String(), tmp, blockSize)
+	if err != nil {
+		return err
+	}
+	defer sb.close()
+
+	verifier := blob.Digest.Verifier()
+	buf := make([]byte, blockSize)
+	for offset := int64(0); offset < blob.Size; offset += blockSize {
+		n, err := io.ReadFull(r, buf[:min(blockSize, blob.Size-offset)])
+		if err != nil {
+			return fmt.Errorf("blob %v: %w", blob.Digest, err)
+		}
+		if _, err := verifier.Write(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := sb.file.WriteAt(buf[:n], offset); err != nil {
+			return err
+		}
+
+		idx := offset / blockSize
+		sb.chunks.Set(idx)
+		sb.sums[idx] = chunkSum{crc: crc32.Checksum(buf[:n], crcTable), length: uint32(n)}
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("blob %v: content does not match digest", blob.Digest)
+	}
+
+	if err := sb.file.Sync(); err != nil {
+		return err
+	}
+	if err := writePresence(tmp, &sb.presence); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(path, blob.Digest.String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// The journal of a previously cached copy of the blob would be replayed over the imported presence.
+	if err := os.Remove(filepath.Join(dir, presenceJournalFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Move the data first so that the presence never describes another file.
+	for _, name := range []string{sparseDataFile, presenceFile} {
+		if err := os.Rename(filepath.Join(tmp, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeSize(dir, blob.Size); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// blobContent returns the size of the blob cached in dir, in either layout, and a function that writes its content
+// after verifying the checksum of every chunk.
+func blobContent(dir string) (int64, func(io.Writer) error, error) {
+	if _, err := os.Stat(filepath.Join(dir, presenceFile)); err == nil {
+		return sparseContent(dir)
+	}
+
+	names, size, err := blobChunks(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return size, func(w io.Writer) error {
+		for _, name := range names {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			if err := verifyChecksum(name, f); err != nil {
+				f.Close()
+				return err
+			}
+			_, err = io.Copy(w, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// sparseContent returns the size of the blob cached as a sparse file in dir and a function that writes its content.
+// Every chunk of the blob must be present.
+func sparseContent(dir string) (int64, func(io.Writer) error, error) {
+	p, err := readPresence(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size := p.size()
+	if expected, err := readSize(dir); err == nil {
+		size = expected
+	}
+
+	segments, err := math.NewSegments(0, int(p.blockSize), size, size)
+	if err != nil {
+		return 0, nil, err
+	} else if size == 0 || !p.chunks.Covers(segments) {
+		return 0, nil, fmt.Errorf("missing chunks of %v bytes", size)
+	} else if p.size() != size {
+		return 0, nil, fmt.Errorf("expected size %v, got %v", size, p.size())
+	}
+
+	return size, func(w io.Writer) error {
+		f, err := os.Open(filepath.Join(dir, sparseDataFile))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		for _, idx := range p.chunks.All() {
+			sum := p.sums[idx]
+			buf := make([]byte, sum.length)
+			if _, err := f.ReadAt(buf, idx*p.blockSize); err != nil {
+				return err
+			}
+			if crc32.Checksum(buf, crcTable) != sum.crc {
+				return fmt.Errorf("%w: chunk at offset %v", errChecksumMismatch, idx*p.blockSize)
+			}
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// blobChunks returns the chunk files of the blob cached in dir, ordered by offset, and the size of the blob.
+// The chunks must be contiguous from offset zero.
+func blobChunks(dir string) ([]string, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var offsets []int64
+	for _, e := range entries {
+		if offset, err := strconv.ParseInt(e.Name(), 10, 64); err == nil && !e.IsDir() {
+			offsets = append(offsets, offset)
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, 0, fs.ErrNotExist
+	}
+	slices.Sort(offsets)
+
+	var size int64
+	names := make([]string, len(offsets))
+	for i, offset := range offsets {
+		if offset != size {
+			return nil, 0, fmt.Errorf("missing chunk at offset %v", size)
+		}
+
+		names[i] = filepath.Join(dir, strconv.FormatInt(offset, 10))
+		info, err := os.Stat(names[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		size += info.Size()
+	}
+
+	if expected, err := readSize(dir); err == nil && expected != size {
+		return nil, 0, fmt.Errorf("expected size %v, got %v", expected, size)
+	}
+
+	return names, size, nil
+}
+
+// blobEntryName returns the name of the archive entry of the blob.
+func blobEntryName(d digest.Digest) string {
+	return filepath.ToSlash(filepath.Join("blobs", d.Algorithm().String(), d.Encoded()))
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// cacheBlob caches the content in chunks of cacheBlockSize and returns its digest.
+func cacheBlob(t *testing.T, c Cache, content []byte) digest.Digest {
+	d := digest.FromBytes(content)
+	for offset := int64(0); offset < int64(len(content)); offset += cacheBlockSize {
+		chunk := content[offset:min(offset+cacheBlockSize, int64(len(content)))]
+		if _, err := c.GetOrCreate(d.String(), offset, len(chunk), func() ([]byte, error) {
+			return chunk, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.PutSize(d.String(), int64(len(content)))
+	return d
+}
+
+func TestExportImport(t *testing.T) {
+	src := t.TempDir()
+	c := NewCache(ctxWithMetrics, cacheBlockSize, src)
+
+	blobs := map[digest.Digest][]byte{}
+	for _, size := range []int{100, int(cacheBlockSize), int(2*cacheBlockSize + 17)} {
+		content, err := randomBytesN(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs[cacheBlob(t, c, content)] = content
+	}
+
+	var digests []digest.Digest
+	for d := range blobs {
+		digests = append(digests, d)
+	}
+
+	var archive bytes.Buffer
+	if err := Export(src, digests, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	imported, err := Import(dst, cacheBlockSize, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(imported) != len(blobs) {
+		t.Fatalf("expected %v blobs to be imported, got %v", len(blobs), len(imported))
+	}
+
+	// A new cache picks up the imported blobs and serves them without fetching.
+	restored := NewCache(ctxWithMetrics, cacheBlockSize, dst)
+	chunks := map[string]int{}
+	for _, chunk := range restored.Chunks() {
+		chunks[chunk.Name]++
+	}
+
+	for d, content := range blobs {
+		if size, ok := restored.Size(d.String()); !ok || size != int64(len(content)) {
+			t.Errorf("%v: expected size %v, got %v", d, len(content), size)
+		}
+
+		if want := (len(content) + int(cacheBlockSize) - 1) / int(cacheBlockSize); chunks[d.String()] != want {
+			t.Errorf("%v: expected %v chunks, got %v", d, want, chunks[d.String()])
+		}
+
+		var got []byte
+		for offset := int64(0); offset < int64(len(content)); offset += cacheBlockSize {
+			count := int(min(cacheBlockSize, int64(len(content))-offset))
+			b, err := restored.GetOrCreate(d.String(), offset, count, func() ([]byte, error) {
+				return nil, fmt.Errorf("imported chunk should not be fetched")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, b...)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%v: imported content does not match", d)
+		}
+	}
+
+	if entries, err := filepath.Glob(filepath.Join(dst, "*"+tempInfix+"*")); err != nil || len(entries) != 0 {
+		t.Errorf("expected no temporary files, got %v, %v", entries, err)
+	}
+}
+
+func TestExportIncomplete(t *testing.T) {
+	src := t.TempDir()
+	c := NewCache(ctxWithMetrics, cacheBlockSize, src)
+
+	content, err := randomBytesN(int(2*cacheBlockSize + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := cacheBlob(t, c, content)
+
+	if err := os.Remove(filepath.Join(src, d.String(), fmt.Sprint(cacheBlockSize))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Export(src, []digest.Digest{d}, &bytes.Buffer{}); err == nil {
+		t.Error("expected error exporting an incomplete blob")
+	}
+
+	if err := Export(src, []digest.Digest{digest.FromString("missing")}, &bytes.Buffer{}); err == nil {
+		t.Error("expected error exporting a missing blob")
+	}
+}
+
+func TestImportCorrupt(t *testing.T) {
+	content := []byte(newRandomStringN(100))
+	d := digest.FromString("something else")
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	index := fmt.Sprintf(`{"schemaVersion":1,"blobs":[{"digest":"%v","size":%v}]}`, d, len(content))
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{
+		{archiveIndexName, []byte(index)},
+		{blobEntryName(d), content},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if _, err := Import(dst, cacheBlockSize, &archive); err == nil {
+		t.Fatal("expected error importing content that does not match its digest")
+	}
+
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("expected nothing to be imported, got %v entries", len(entries))
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// EvictionReason describes why an entry was evicted from the cache.
+type EvictionReason string
+
+const (
+	// EvictionReasonCapacity indicates that the entry was evicted to make room for another entry.
+	EvictionReasonCapacity EvictionReason = "capacity"
+
+	// EvictionReasonExpired indicates that the entry outlived its time to live.
+	EvictionReasonExpired EvictionReason = "expired"
+
+	// EvictionReasonQuota indicates that the entry was evicted to keep its quota group within its quota.
+	EvictionReasonQuota EvictionReason = "quota"
+)
+
+// Eviction policy names.
+const (
+	PolicyTinyLFU = "tinylfu"
+	PolicyLRU     = "lru"
+	PolicyLFU     = "lfu"
+	PolicyARC     = "arc"
+	PolicyTTL     = "ttl"
+)
+
+// Eviction describes an entry that was evicted by an eviction policy.
+type Eviction struct {
+	Key    string
+	Reason EvictionReason
+}
+
+// EvictionPolicy decides which entries are evicted from a cache of bounded capacity.
+// Implementations are not safe for concurrent use; callers must synchronize access.
+type EvictionPolicy interface {
+	// Name returns the name of the policy.
+	Name() string
+
+	// Admit records a new entry of the given cost and returns the entries that must be evicted to make room for it.
+	// The admitted entry itself is never evicted by this call.
+	Admit(key string, cost int64) []Eviction
+
+	// Touch records an access of the entry and reports whether the entry is still live.
+	Touch(key string) bool
+
+	// Remove forgets the entry.
+	Remove(key string)
+
+	// Len returns the number of live entries.
+	Len() int
+}
+
+var (
+	// EvictionPolicyName is the name of the eviction policy used by the files cache.
+	EvictionPolicyName = PolicyTinyLFU
+
+	// EvictionTTL is the time to live of entries when the TTL eviction policy is used.
+	EvictionTTL = 1 * time.Hour
+)
+
+// NewEvictionPolicy creates the named eviction policy for a cache of the given capacity.
+func NewEvictionPolicy(name string, capacity int64) (EvictionPolicy, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid eviction policy capacity: %v", capacity)
+	}
+
+	switch name {
+	case PolicyTinyLFU:
+		return newTinyLFUPolicy(capacity), nil
+	case PolicyLRU:
+		return newLRUPolicy(capacity), nil
+	case PolicyLFU:
+		return newLFUPolicy(capacity), nil
+	case PolicyARC:
+		return newARCPolicy(capacity), nil
+	case PolicyTTL:
+		return newTTLPolicy(capacity, EvictionTTL, time.Now), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy: %v", name)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var allPolicies = []string{PolicyTinyLFU, PolicyLRU, PolicyLFU, PolicyARC, PolicyTTL}
+
+func TestNewEvictionPolicy(t *testing.T) {
+	for _, name := range allPolicies {
+		p, err := NewEvictionPolicy(name, 10)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if p.Name() != name {
+			t.Errorf("expected: %v, got: %v", name, p.Name())
+		}
+	}
+
+	if _, err := NewEvictionPolicy("unknown", 10); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+
+	if _, err := NewEvictionPolicy(PolicyLRU, 0); err == nil {
+		t.Error("expected error for zero capacity")
+	}
+}
+
+func TestEvictionPolicyCapacity(t *testing.T) {
+	for _, name := range allPolicies {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewEvictionPolicy(name, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			live := map[string]bool{}
+			for i := 0; i < 20; i++ {
+				key := strconv.Itoa(i)
+				for _, e := range p.Admit(key, 1) {
+					if e.Key == key {
+						t.Fatalf("admitted key %v was evicted", key)
+					}
+					if e.Reason != EvictionReasonCapacity {
+						t.Errorf("expected reason %v, got %v", EvictionReasonCapacity, e.Reason)
+					}
+					delete(live, e.Key)
+				}
+				live[key] = true
+
+				if p.Len() != len(live) {
+					t.Fatalf("expected %v live entries, got %v", len(live), p.Len())
+				}
+				if p.Len() > 5 {
+					t.Fatalf("capacity exceeded: %v", p.Len())
+				}
+			}
+
+			for key := range live {
+				if !p.Touch(key) {
+					t.Errorf("expected %v to be live", key)
+				}
+				p.Remove(key)
+				if p.Touch(key) {
+					t.Errorf("expected %v to be removed", key)
+				}
+			}
+
+			if p.Len() != 0 {
+				t.Errorf("expected no live entries, got %v", p.Len())
+			}
+		})
+	}
+}
+
+func TestTinyLFUPolicy(t *testing.T) {
+	p := newTinyLFUPolicy(5)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		p.Admit(k, 1)
+	}
+	for i := 0; i < 10; i++ {
+		p.Touch("a")
+	}
+
+	// Entries used once are evicted before the frequently used one.
+	for i := 0; i < 20; i++ {
+		for _, e := range p.Admit(strconv.Itoa(i), 1) {
+			if e.Key == "a" {
+				t.Fatalf("frequent entry %v evicted", e.Key)
+			}
+		}
+	}
+	if !p.Touch("a") {
+		t.Error("expected a to be live")
+	}
+
+	// Frequencies decay, so that entries that are no longer used are evicted eventually.
+	before := p.sketch.estimate("a")
+	for i := 0; i < tinyLFUCounters; i++ {
+		p.sketch.increment("other")
+	}
+	if after := p.sketch.estimate("a"); after >= before {
+		t.Errorf("expected the estimate to decay from %v, got: %v", before, after)
+	}
+}
+
+func TestLRUPolicy(t *testing.T) {
+	p := newLRUPolicy(3)
+	p.Admit("a", 1)
+	p.Admit("b", 1)
+	p.Admit("c", 1)
+	p.Touch("a")
+
+	evicted := p.Admit("d", 1)
+	if len(evicted) != 1 || evicted[0].Key != "b" {
+		t.Errorf("expected b to be evicted, got %v", evicted)
+	}
+
+	evicted = p.Admit("e", 2)
+	if len(evicted) != 2 || evicted[0].Key != "c" || evicted[1].Key != "a" {
+		t.Errorf("expected c and a to be evicted, got %v", evicted)
+	}
+}
+
+func TestLFUPolicy(t *testing.T) {
+	p := newLFUPolicy(3)
+	p.Admit("a", 1)
+	p.Admit("b", 1)
+	p.Admit("c", 1)
+	p.Touch("a")
+	p.Touch("a")
+	p.Touch("c")
+
+	evicted := p.Admit("d", 1)
+	if len(evicted) != 1 || evicted[0].Key != "b" {
+		t.Errorf("expected b to be evicted, got %v", evicted)
+	}
+
+	// d and c have been used less than a, d is the most recent of them.
+	evicted = p.Admit("e", 1)
+	if len(evicted) != 1 || evicted[0].Key != "d" {
+		t.Errorf("expected d to be evicted, got %v", evicted)
+	}
+}
+
+func TestARCPolicy(t *testing.T) {
+	p := newARCPolicy(4)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		p.Admit(k, 1)
+	}
+
+	// a and b are used twice and move to the frequent list.
+	p.Touch("a")
+	p.Touch("b")
+
+	// A scan of new keys only displaces the entries seen once.
+	for _, k := range []string{"e", "f", "g", "h"} {
+		for _, e := range p.Admit(k, 1) {
+			if e.Key == "a" || e.Key == "b" {
+				t.Fatalf("frequent entry %v evicted by scan", e.Key)
+			}
+		}
+	}
+
+	if !p.Touch("a") || !p.Touch("b") {
+		t.Error("expected frequent entries to survive the scan")
+	}
+
+	// A ghost hit on a key evicted from t1 grows the target size of t1.
+	if _, ok := p.b1.get("e"); !ok {
+		t.Fatal("expected e to be remembered in b1")
+	}
+	before := p.p
+	p.Admit("e", 1)
+	if p.p <= before {
+		t.Errorf("expected target size to grow from %v, got %v", before, p.p)
+	}
+	if _, ok := p.t2.get("e"); !ok {
+		t.Error("expected e to be admitted to t2 after a ghost hit")
+	}
+
+	if p.t1.size+p.b1.size > p.capacity {
+		t.Errorf("t1+b1 exceeds capacity: %v", p.t1.size+p.b1.size)
+	}
+	if p.t1.size+p.t2.size+p.b1.size+p.b2.size > 2*p.capacity {
+		t.Errorf("directory exceeds twice the capacity")
+	}
+}
+
+func TestTTLPolicy(t *testing.T) {
+	now := time.Now()
+	p := newTTLPolicy(10, time.Minute, func() time.Time { return now })
+
+	p.Admit("a", 1)
+	now = now.Add(30 * time.Second)
+	p.Admit("b", 1)
+
+	if !p.Touch("a") {
+		t.Error("expected a to be live")
+	}
+
+	now = now.Add(31 * time.Second)
+	if p.Touch("a") {
+		t.Error("expected a to be expired")
+	}
+	if !p.Touch("b") {
+		t.Error("expected b to be live")
+	}
+
+	evicted := p.Admit("c", 1)
+	if len(evicted) != 1 || evicted[0].Key != "a" || evicted[0].Reason != EvictionReasonExpired {
+		t.Errorf("expected a to be evicted as expired, got %v", evicted)
+	}
+
+	evicted = p.Admit("d", 9)
+	if len(evicted) != 1 || evicted[0].Key != "b" || evicted[0].Reason != EvictionReasonCapacity {
+		t.Errorf("expected b to be evicted for capacity, got %v", evicted)
+	}
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	prevCost, prevPolicy := FilesCacheMaxCost, EvictionPolicyName
+	defer func() {
+		FilesCacheMaxCost, EvictionPolicyName = prevCost, prevPolicy
+	}()
+
+	FilesCacheMaxCost = 2 * cacheBlockSize
+	EvictionPolicyName = PolicyLRU
+
+	c := NewCache(ctxWithMetrics, cacheBlockSize, t.TempDir())
+	name := newRandomStringN(10)
+	for i := int64(0); i < 3; i++ {
+		if _, err := c.GetOrCreate(name, i, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c.Exists(name, 0) {
+		t.Error("expected the least recently used item to be evicted")
+	}
+	if _, err := os.Stat(c.(*fileCache).getKey(name, 0)); !os.IsNotExist(err) {
+		t.Errorf("expected evicted file to be removed, got %v", err)
+	}
+
+	for i := int64(1); i < 3; i++ {
+		if !c.Exists(name, i) {
+			t.Errorf("expected item %v to exist", i)
+		}
+	}
+}
+
+// traceAccess is a single access in a trace.
+type traceAccess struct {
+	key  string
+	cost int64
+}
+
+// loadTrace loads a trace of chunk accesses from a file.
+// Each line of a trace is a single chunk access formatted as "<blob> <chunk> <bytes>".
+func loadTrace(b *testing.B, path string) []traceAccess {
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	var trace []traceAccess
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		cost, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			b.Fatal(err)
+		}
+		trace = append(trace, traceAccess{key: fields[0] + "_" + fields[1], cost: cost})
+	}
+	if err := scanner.Err(); err != nil {
+		b.Fatal(err)
+	}
+
+	return trace
+}
+
+// generateTrace generates a trace of image pulls. Images are pulled with a Zipf popularity, and each pull reads every
+// chunk of the layers of the image in order. Images share a few popular base layers, and most of their other layers
+// are their own.
+func generateTrace(pulls int) []traceAccess {
+	const (
+		images      = 50
+		baseLayers  = 5
+		imageLayers = 4
+		maxChunks   = 8
+	)
+
+	r := rand.New(rand.NewSource(1))
+	chunks := func() int { return 1 + r.Intn(maxChunks) }
+
+	base := make([]int, baseLayers)
+	for i := range base {
+		base[i] = chunks()
+	}
+
+	type layer struct {
+		name   string
+		chunks int
+	}
+	layers := make([][]layer, images)
+	for i := range layers {
+		b := r.Intn(baseLayers)
+		layers[i] = append(layers[i], layer{fmt.Sprintf("base%v", b), base[b]})
+		for j := 0; j < imageLayers; j++ {
+			layers[i] = append(layers[i], layer{fmt.Sprintf("image%v-%v", i, j), chunks()})
+		}
+	}
+
+	var trace []traceAccess
+	popularity := rand.NewZipf(r, 1.2, 1, images-1)
+	for i := 0; i < pulls; i++ {
+		for _, l := range layers[popularity.Uint64()] {
+			for c := 0; c < l.chunks; c++ {
+				trace = append(trace, traceAccess{key: fmt.Sprintf("%v_%v", l.name, c), cost: 1024 * 1024})
+			}
+		}
+	}
+	return trace
+}
+
+// BenchmarkEvictionPolicies replays a generated trace against every policy and reports the hit ratio. No other trace is
+// committed, but any .trace file placed in testdata, in the format of loadTrace, is replayed too.
+func BenchmarkEvictionPolicies(b *testing.B) {
+	traces := map[string][]traceAccess{"generated": generateTrace(500)}
+	paths, err := filepath.Glob("testdata/*.trace")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, path := range paths {
+		traces[filepath.Base(path)] = loadTrace(b, path)
+	}
+
+	for traceName, trace := range traces {
+		var workingSet int64
+		seen := map[string]bool{}
+		for _, a := range trace {
+			if !seen[a.key] {
+				seen[a.key] = true
+				workingSet += a.cost
+			}
+		}
+
+		for _, pct := range []int64{10, 25, 50} {
+			for _, name := range allPolicies {
+				b.Run(fmt.Sprintf("%v/%v/%v%%", traceName, name, pct), func(b *testing.B) {
+					var hits, total int
+					for i := 0; i < b.N; i++ {
+						p, err := NewEvictionPolicy(name, workingSet*pct/100)
+						if err != nil {
+							b.Fatal(err)
+						}
+
+						for _, a := range trace {
+							total++
+							if p.Touch(a.key) {
+								hits++
+								continue
+							}
+							p.Admit(a.key, a.cost)
+						}
+					}
+					b.ReportMetric(float64(hits)/float64(total), "hit-ratio")
+				})
+			}
+		}
+	}
+}
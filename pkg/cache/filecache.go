@@ -5,25 +5,31 @@ package cache
 import (
 	"context"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strconv"
-	"sync"
 	"sync/atomic"
-	"time"
 
-	"github.com/dgraph-io/ristretto"
+	"github.com/azure/peerd/pkg/metrics"
 	"github.com/rs/zerolog"
 )
 
-// fileCache implements FileCache.
+// sizes stores the sizes of cached files, in memory and next to their chunks on disk.
+type sizes struct {
+	metadataCache   *SyncMap
+	path            string
+	log             zerolog.Logger
+	metricsRecorder metrics.Metrics
+}
+
+// fileCache implements Cache using the chunk layout.
 type fileCache struct {
-	fileCache     *ristretto.Cache
-	metadataCache *SyncMap
-	path          string
-	lock          sync.RWMutex
-	log           zerolog.Logger
+	sizes
+	index      *index[*item]
+	quotas     *quotas
+	policyName string
+	blockSize  int64
+	evicted    chan Chunk
 }
 
 var _ Cache = &fileCache{}
@@ -31,9 +37,12 @@ var _ Cache = &fileCache{}
 // Exists checks if the file exists in the cache.
 func (c *fileCache) Exists(name string, offset int64) bool {
 	key := c.getKey(name, offset)
-	val, found := c.fileCache.Get(key)
+	cacheItem, found := c.lookup(key)
 	if found {
-		cacheItem := val.(*item)
+		if err := cacheItem.validate(c.log); err != nil {
+			return false
+		}
+
 		cacheItem.lock.Lock()
 		defer cacheItem.lock.Unlock()
 
@@ -49,32 +58,25 @@ func (c *fileCache) Exists(name string, offset int64) bool {
 // GetOrCreate gets the cached value if available, otherwise fetches it.
 func (c *fileCache) GetOrCreate(name string, alignedOffset int64, count int, fetch func() ([]byte, error)) ([]byte, error) {
 	key := c.getKey(name, alignedOffset)
-	val, found := c.fileCache.Get(key)
+	cacheItem, found := c.lookup(key)
 	if !found {
-		c.lock.Lock()
-		if val, found = c.fileCache.Get(key); found && val != nil {
-			c.lock.Unlock()
-		} else {
-			var err error
-			val, err = newItem(key, c.log)
-			if err != nil {
-				c.lock.Unlock()
-				return nil, err
-			}
-			ok := c.fileCache.Set(key, val, 0)
-			if !ok {
-				c.lock.Unlock()
-				return nil, io.ErrUnexpectedEOF
-			}
-
-			// wait for value to pass through buffers
-			waitForSet()
-
-			c.lock.Unlock()
+		var ev []evicted[*item]
+		var err error
+		cacheItem, ev, err = insert(c.index, c.quotas, name, key, c.blockSize, func() (*item, error) {
+			return newItem(key, c.log)
+		})
+		c.drop(ev)
+		if err == errQuotaExceeded {
+			c.metricsRecorder.RecordCacheMiss(metrics.TierFiles)
+			return fetch()
+		} else if err != nil {
+			return nil, err
 		}
 	}
 
-	cacheItem := val.(*item)
+	if err := cacheItem.validate(c.log); err != nil {
+		return nil, err
+	}
 
 	cacheItem.lock.RLock()
 	info, err := cacheItem.file.Stat()
@@ -84,6 +86,7 @@ func (c *fileCache) GetOrCreate(name string, alignedOffset int64, count int, fet
 		return nil, err
 	}
 
+	hit := true
 	if info.Size() != int64(count) {
 		cacheItem.lock.RUnlock()
 
@@ -95,13 +98,22 @@ func (c *fileCache) GetOrCreate(name string, alignedOffset int64, count int, fet
 			cacheItem.lock.Unlock()
 			return nil, err
 		} else if info.Size() != int64(count) {
+			hit = false
+			c.metricsRecorder.RecordCacheMiss(metrics.TierFiles)
 
-			n, err := cacheItem.fill(c.log, fetch)
+			var fetchErr error
+			n, err := cacheItem.fill(c.log, func() ([]byte, error) {
+				b, err := fetch()
+				fetchErr = err
+				return b, err
+			})
 			cacheItem.lock.Unlock()
 
 			if err != nil {
+				c.recordFillFailure(fetchErr)
 				return nil, err
 			} else if int64(n) != int64(count) {
+				c.metricsRecorder.RecordCacheFillFailure(metrics.FillFailureSize)
 				return nil, fmt.Errorf("fill did not retrieve expected number of bytes, expected: %v, got: %v", count, n)
 			}
 		} else {
@@ -117,37 +129,198 @@ func (c *fileCache) GetOrCreate(name string, alignedOffset int64, count int, fet
 		return result, fmt.Errorf("bytes did not retrieve expected number of bytes, expected: %v, got: %v", count, len(result))
 	}
 
+	if hit {
+		c.metricsRecorder.RecordCacheHit(metrics.TierFiles)
+	}
 	return result, nil
 }
 
 // Size gets the length of the file.
-func (c *fileCache) Size(name string) (int64, bool) {
-	key := filepath.Join(name, "metainfo")
+func (c *sizes) Size(name string) (int64, bool) {
+	key := filepath.Join(name, metainfoFile)
 	// c.metadataCache.Wait()
 	val, found := c.metadataCache.Get(key)
 	if !found {
+		c.metricsRecorder.RecordCacheMiss(metrics.TierMetadata)
 		return 0, false
 	}
+	c.metricsRecorder.RecordCacheHit(metrics.TierMetadata)
 	return val.(int64), true
 }
 
 // PutSize puts the length of the file.
-func (c *fileCache) PutSize(name string, len int64) bool {
-	key := filepath.Join(name, "metainfo")
+// The length is also persisted next to the chunks of the file so that it survives restarts.
+func (c *sizes) PutSize(name string, len int64) bool {
+	key := filepath.Join(name, metainfoFile)
 	c.metadataCache.Set(key, len)
 	c.log.Debug().Str("key", key).Int64("len", len).Msg("put len")
+
+	if err := writeSize(filepath.Join(c.path, name), len); err != nil {
+		c.log.Error().Err(err).Str("key", key).Msg("failed to persist len")
+	}
 	return true
 }
 
+// loadSize loads the persisted size of the named file.
+func (c *sizes) loadSize(name string) {
+	if size, err := readSize(filepath.Join(c.path, name)); err == nil {
+		c.metadataCache.Set(filepath.Join(name, metainfoFile), size)
+	}
+}
+
+// recordFillFailure records a failed fill, given the error of its fetch.
+// A fill whose fetch succeeded failed to write the chunk.
+func (c *sizes) recordFillFailure(fetchErr error) {
+	if fetchErr != nil {
+		c.metricsRecorder.RecordCacheFillFailure(metrics.FillFailureFetch)
+	} else {
+		c.metricsRecorder.RecordCacheFillFailure(metrics.FillFailureWrite)
+	}
+}
+
+// Contains checks if the chunk is in the cache, without recording an access.
+func (c *fileCache) Contains(name string, offset int64) bool {
+	return c.index.contains(c.getKey(name, offset))
+}
+
+// Chunks returns the chunks currently in the cache.
+func (c *fileCache) Chunks() []Chunk {
+	return chunksOf(c.path, c.index.entries())
+}
+
+// Cached returns the number of chunks of the file in the cache.
+func (c *fileCache) Cached(name string) int {
+	return c.index.count(filepath.Join(c.path, name))
+}
+
+// Evicted returns a channel that receives the chunks evicted from the cache.
+func (c *fileCache) Evicted() <-chan Chunk {
+	return c.evicted
+}
+
+// SetGroup assigns the named file to a quota group.
+func (c *fileCache) SetGroup(name, group string) {
+	c.quotas.SetGroup(name, group)
+}
+
+// Usage returns the usage of the quota groups.
+func (c *fileCache) Usage() []GroupUsage {
+	return c.quotas.Usage()
+}
+
+// load indexes the files and sizes already present in the cache directory, such as those cached before a restart or
+// imported from an archive. The files are validated against their checksums when they are first read.
+func (c *fileCache) load() error {
+	dirs, err := os.ReadDir(c.path)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		name := d.Name()
+		c.loadSize(name)
+		c.quotas.loadGroup(name)
+
+		entries, err := os.ReadDir(filepath.Join(c.path, name))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			offset, err := strconv.ParseInt(e.Name(), 10, 64)
+			if err != nil || e.IsDir() {
+				continue
+			}
+
+			key := c.getKey(name, offset)
+			_, ev, err := insert(c.index, c.quotas, name, key, c.blockSize, func() (*item, error) {
+				return newItem(key, c.log)
+			})
+			c.drop(ev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *fileCache) getKey(name string, offset int64) string {
-	return filepath.Join(c.path, name, strconv.FormatInt(offset, 10))
+	return chunkKey(c.path, name, offset)
+}
+
+// lookup gets the item for the key and records the access with the eviction policy.
+// Items that the policy no longer considers live are evicted.
+func (c *fileCache) lookup(key string) (*item, bool) {
+	cacheItem, found, ev := c.index.get(key)
+	c.drop(ev)
+	if found {
+		c.quotas.touch(key)
+	}
+	return cacheItem, found
+}
+
+// drop deletes the files of evicted items.
+func (c *fileCache) drop(ev []evicted[*item]) {
+	for _, e := range ev {
+		c.metricsRecorder.RecordCacheEviction(c.policyName, string(e.reason))
+		c.log.Debug().Str("key", e.key).Str("reason", string(e.reason)).Msg("cache item evict")
+		c.quotas.release(e.key)
+		e.value.drop(c.log)
+		notifyEvicted(c.evicted, c.path, e.key, c.log)
+	}
+}
+
+// notifyEvicted reports the eviction of the chunk with the index key on the channel, unless the channel is full.
+func notifyEvicted(ch chan<- Chunk, path, key string, log zerolog.Logger) {
+	chunk, ok := chunkOf(path, key)
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- chunk:
+	default:
+		log.Debug().Str("key", key).Msg("eviction not reported, channel full")
+	}
 }
 
-func waitForSet() {
-	time.Sleep(10 * time.Millisecond)
+// chunkKey returns the index key of the chunk at the offset of the named file.
+func chunkKey(path, name string, offset int64) string {
+	return filepath.Join(path, name, strconv.FormatInt(offset, 10))
 }
 
-// NewCache creates a new cache of files.
+// chunkOf returns the chunk identified by the index key.
+func chunkOf(path, key string) (Chunk, bool) {
+	rel, err := filepath.Rel(path, key)
+	if err != nil {
+		return Chunk{}, false
+	}
+	offset, err := strconv.ParseInt(filepath.Base(rel), 10, 64)
+	if err != nil {
+		return Chunk{}, false
+	}
+	return Chunk{Name: filepath.Dir(rel), Offset: offset}, true
+}
+
+// chunksOf returns the chunks identified by the index entries.
+func chunksOf(path string, entries []indexEntry) []Chunk {
+	chunks := make([]Chunk, 0, len(entries))
+	for _, e := range entries {
+		if chunk, ok := chunkOf(path, e.key); ok {
+			chunk.Accessed = e.accessed
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// NewCache creates a new cache of files stored in the layout named by StorageLayout, that evicts chunks using the
+// policy named by EvictionPolicyName within the quota groups configured by Quotas.
 // cacheBlockSize is the fixed size of the cache block in bytes, and is used to evaluate the cost of each item in the cache.
 func NewCache(ctx context.Context, cacheBlockSize int64, path string) Cache {
 	log := zerolog.Ctx(ctx).With().Str("component", "cache").Logger()
@@ -158,30 +331,54 @@ func NewCache(ctx context.Context, cacheBlockSize int64, path string) Cache {
 		log.Fatal().Err(err).Str("path", path).Msg("failed to initialize cache directory")
 	}
 
-	cache := &fileCache{
-		log:           log,
-		path:          path,
-		metadataCache: NewSyncMap(1e7),
+	if err := removeTempFiles(path, log); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("failed to remove interrupted cache writes")
 	}
 
+	s := sizes{metadataCache: NewSyncMap(1e7), path: path, log: log, metricsRecorder: metrics.FromContext(ctx)}
+	q := newQuotas(Quotas, path, FilesCacheMaxCost, log, metrics.FromContext(ctx))
+	var c interface {
+		Cache
+		load() error
+	}
 	var err error
-	if cache.fileCache, err = ristretto.NewCache(&ristretto.Config{
-		NumCounters: 1e7,
-		MaxCost:     FilesCacheMaxCost,
-		BufferItems: 64,
-
-		OnExit: func(val interface{}) {
-			item := val.(*item)
-			item.drop(log)
-		},
-
-		Cost: func(val interface{}) int64 {
-			return cacheBlockSize
-		},
-	}); err != nil {
+	switch StorageLayout {
+	case LayoutChunks:
+		var ix *index[*item]
+		if ix, err = newIndex[*item](EvictionPolicyName, FilesCacheMaxCost, cacheBlockSize); err == nil {
+			c = &fileCache{
+				sizes:      s,
+				index:      ix,
+				quotas:     q,
+				policyName: EvictionPolicyName,
+				blockSize:  cacheBlockSize,
+				evicted:    make(chan Chunk, evictedBufferSize),
+			}
+		}
+	case LayoutSparse:
+		var ix *index[*sparseChunk]
+		if ix, err = newIndex[*sparseChunk](EvictionPolicyName, FilesCacheMaxCost, cacheBlockSize); err == nil {
+			c = &sparseCache{
+				sizes:      s,
+				index:      ix,
+				quotas:     q,
+				policyName: EvictionPolicyName,
+				blockSize:  cacheBlockSize,
+				evicted:    make(chan Chunk, evictedBufferSize),
+				blobs:      map[string]*sparseBlob{},
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown storage layout: %v", StorageLayout)
+	}
+	if err != nil {
 		// This will call os.Exit(1)
-		log.Fatal().Err(err).Msg("failed to initialize file cache")
+		log.Fatal().Err(err).Str("policy", EvictionPolicyName).Str("layout", StorageLayout).Msg("failed to initialize file cache")
+	}
+
+	if err := c.load(); err != nil {
+		log.Error().Err(err).Str("path", path).Msg("failed to load cached files")
 	}
 
-	return cache
+	return c
 }
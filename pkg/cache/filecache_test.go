@@ -7,13 +7,17 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/azure/peerd/pkg/math"
+	"github.com/azure/peerd/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
 )
@@ -57,7 +61,9 @@ func TestExists(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		c.(*fileCache).fileCache.Set(key, val, 0)
+		if _, _, err := c.(*fileCache).index.getOrInsert(key, cacheBlockSize, func() (*item, error) { return val, nil }); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	filesThatDoNotExist := []string{}
@@ -228,3 +234,267 @@ func TestGetOrCreate(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGetOrCreateAfterRestart(t *testing.T) {
+	path := t.TempDir()
+	name := newRandomStringN(10)
+	want := []byte(newRandomStringN(100))
+
+	c := NewCache(ctxWithMetrics, cacheBlockSize, path)
+	if _, err := c.GetOrCreate(name, 0, len(want), func() ([]byte, error) {
+		return want, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetOrCreate(name, cacheBlockSize, len(want), func() ([]byte, error) {
+		return want, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the second chunk as if the node crashed while it was written by an older version.
+	if err := os.WriteFile(c.(*fileCache).getKey(name, cacheBlockSize), want[:50], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewCache(ctxWithMetrics, cacheBlockSize, path)
+
+	got, err := restarted.GetOrCreate(name, 0, len(want), func() ([]byte, error) {
+		return nil, fmt.Errorf("intact chunk should not be fetched")
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if restarted.Exists(name, cacheBlockSize) {
+		t.Error("expected torn chunk to be discarded")
+	}
+
+	fetched := false
+	got, err = restarted.GetOrCreate(name, cacheBlockSize, len(want), func() ([]byte, error) {
+		fetched = true
+		return want, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !fetched {
+		t.Error("expected torn chunk to be fetched again")
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestGetOrCreateSingleFetch(t *testing.T) {
+	c := NewCache(ctxWithMetrics, cacheBlockSize, testFileCachePath)
+	name := newRandomStringN(10)
+	want := []byte(newRandomStringN(100))
+
+	var fetches atomic.Int32
+	var eg errgroup.Group
+	for i := 0; i < 50; i++ {
+		eg.Go(func() error {
+			got, err := c.GetOrCreate(name, 0, len(want), func() ([]byte, error) {
+				fetches.Add(1)
+				return want, nil
+			})
+			if err != nil {
+				return err
+			} else if !bytes.Equal(got, want) {
+				return fmt.Errorf("expected %v, got %v", want, got)
+			}
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected a single fetch, got %v", fetches.Load())
+	}
+}
+
+func TestGetOrCreateIndependentMisses(t *testing.T) {
+	c := NewCache(ctxWithMetrics, cacheBlockSize, testFileCachePath)
+	slow, fast := newRandomStringN(10), newRandomStringN(10)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		//nolint:errcheck
+		c.GetOrCreate(slow, 0, 10, func() ([]byte, error) {
+			close(started)
+			<-release
+			return []byte(newRandomStringN(10)), nil
+		})
+	}()
+	defer close(release)
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.GetOrCreate(fast, 0, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("miss was blocked by a fill of another key")
+	}
+}
+
+// BenchmarkGetOrCreateColdMiss measures concurrent misses of distinct keys, each of which fills a new item.
+func BenchmarkGetOrCreateColdMiss(b *testing.B) {
+	c := NewCache(ctxWithMetrics, cacheBlockSize, b.TempDir())
+	name := newRandomStringN(10)
+	data := []byte(newRandomStringN(64))
+
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.GetOrCreate(name, n.Add(1), len(data), func() ([]byte, error) {
+				return data, nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkGetOrCreateHit measures concurrent hits of cached items.
+func BenchmarkGetOrCreateHit(b *testing.B) {
+	c := NewCache(ctxWithMetrics, cacheBlockSize, b.TempDir())
+	name := newRandomStringN(10)
+	data := []byte(newRandomStringN(64))
+
+	for i := int64(0); i < 64; i++ {
+		if _, err := c.GetOrCreate(name, i, len(data), func() ([]byte, error) {
+			return data, nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.GetOrCreate(name, n.Add(1)%64, len(data), func() ([]byte, error) {
+				return nil, fmt.Errorf("unexpected fetch")
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// counterValue returns the value of the counter with the given name and label in the default registry.
+func counterValue(t *testing.T, name, label, value string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == label && l.GetValue() == value {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestGetOrCreateMetrics(t *testing.T) {
+	for _, layout := range []string{LayoutChunks, LayoutSparse} {
+		t.Run(layout, func(t *testing.T) {
+			useLayout(t, layout)
+			c := NewCache(ctxWithMetrics, cacheBlockSize, t.TempDir())
+			name := newRandomStringN(10)
+
+			hits := counterValue(t, "peerd_cache_hits_total", "tier", metrics.TierFiles)
+			misses := counterValue(t, "peerd_cache_misses_total", "tier", metrics.TierFiles)
+			fetchFailures := counterValue(t, "peerd_cache_fill_failures_total", "reason", metrics.FillFailureFetch)
+			sizeFailures := counterValue(t, "peerd_cache_fill_failures_total", "reason", metrics.FillFailureSize)
+
+			if _, err := c.GetOrCreate(name, 0, 10, func() ([]byte, error) {
+				return nil, fmt.Errorf("fetch failed")
+			}); err == nil {
+				t.Fatal("expected fetch error")
+			}
+			if _, err := c.GetOrCreate(name, 0, 10, func() ([]byte, error) {
+				return []byte("short"), nil
+			}); err == nil {
+				t.Fatal("expected size error")
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := c.GetOrCreate(name, cacheBlockSize, 10, func() ([]byte, error) {
+					return []byte(newRandomStringN(10)), nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, tc := range []struct {
+				name          string
+				before, after float64
+				expected      float64
+			}{
+				{"hits", hits, counterValue(t, "peerd_cache_hits_total", "tier", metrics.TierFiles), 2},
+				{"misses", misses, counterValue(t, "peerd_cache_misses_total", "tier", metrics.TierFiles), 3},
+				{"fetch failures", fetchFailures, counterValue(t, "peerd_cache_fill_failures_total", "reason", metrics.FillFailureFetch), 1},
+				{"size failures", sizeFailures, counterValue(t, "peerd_cache_fill_failures_total", "reason", metrics.FillFailureSize), 1},
+			} {
+				if got := tc.after - tc.before; got != tc.expected {
+					t.Errorf("%v: expected: %v, got: %v", tc.name, tc.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCached(t *testing.T) {
+	for _, layout := range []string{LayoutChunks, LayoutSparse} {
+		t.Run(layout, func(t *testing.T) {
+			useLayout(t, layout)
+			path := t.TempDir()
+			c := NewCache(ctxWithMetrics, cacheBlockSize, path)
+			name, other := newRandomStringN(10), newRandomStringN(10)
+
+			for _, chunk := range []Chunk{{Name: name}, {Name: name, Offset: cacheBlockSize}, {Name: other}} {
+				if _, err := c.GetOrCreate(chunk.Name, chunk.Offset, 10, func() ([]byte, error) {
+					return []byte(newRandomStringN(10)), nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := c.Cached(name); got != 2 {
+				t.Errorf("expected: %v, got: %v", 2, got)
+			}
+
+			// Chunks cached before a restart are counted once they are loaded.
+			restarted := NewCache(ctxWithMetrics, cacheBlockSize, path)
+			for _, tc := range []struct {
+				name     string
+				expected int
+			}{{name, 2}, {other, 1}, {newRandomStringN(10), 0}} {
+				if got := restarted.Cached(tc.name); got != tc.expected {
+					t.Errorf("%v: expected: %v, got: %v", tc.name, tc.expected, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"hash/maphash"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// maxIndexShards is the maximum number of shards of the index.
+	maxIndexShards = 64
+
+	// minShardBlocks is the minimum number of cache blocks each shard of the index can hold.
+	// Small caches use fewer shards so that eviction stays close to the global order of the policy.
+	minShardBlocks = 16
+)
+
+// evicted is a value evicted from the index.
+type evicted[V any] struct {
+	key    string
+	value  V
+	reason EvictionReason
+}
+
+// indexEntry is a key in the index and the time its value was last accessed.
+type indexEntry struct {
+	key      string
+	accessed time.Time
+}
+
+// index maps keys to cached values, such as the items of the chunk layout. It is split into shards, each with its own lock and eviction policy, so that
+// lookups and insertions of different keys rarely contend and never wait on each other's I/O.
+type index[V any] struct {
+	seed   maphash.Seed
+	shards []*indexShard[V]
+	files  *fileCounts
+}
+
+// indexShard is a shard of the index.
+type indexShard[V any] struct {
+	lock     sync.Mutex
+	items    map[string]V
+	accessed map[string]time.Time
+	pending  map[string]*pendingValue[V]
+	policy   EvictionPolicy
+	files    *fileCounts
+}
+
+// fileCounts counts the keys in the index per file, the directory of the key, across shards.
+type fileCounts struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// add adds n to the count of the file of the key.
+func (f *fileCounts) add(key string, n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	dir := filepath.Dir(key)
+	if f.counts[dir] += n; f.counts[dir] <= 0 {
+		delete(f.counts, dir)
+	}
+}
+
+// get returns the count of the file with the directory.
+func (f *fileCounts) get(dir string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.counts[dir]
+}
+
+// pendingValue is a value being created for a key outside the lock of its shard. Callers that need the key meanwhile
+// wait for done.
+type pendingValue[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// get gets the value for the key and records the access with the eviction policy.
+// If the policy no longer considers the value live, it is evicted and returned for the caller to drop.
+func (ix *index[V]) get(key string) (V, bool, []evicted[V]) {
+	s := ix.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var zero V
+	value, found := s.items[key]
+	if !found {
+		return zero, false, nil
+	}
+
+	if !s.policy.Touch(key) {
+		s.policy.Remove(key)
+		s.delete(key)
+		return zero, false, []evicted[V]{{key, value, EvictionReasonExpired}}
+	}
+
+	s.accessed[key] = time.Now()
+	return value, true, nil
+}
+
+// getOrInsert gets the value for the key, or inserts the value returned by create.
+// create runs outside the lock of the shard, so that other keys of the shard are not held up by its I/O. Concurrent
+// callers for the same key wait for it and get the same value or error. Values evicted to make room for the new value
+// are returned for the caller to drop.
+func (ix *index[V]) getOrInsert(key string, cost int64, create func() (V, error)) (V, []evicted[V], error) {
+	s := ix.shard(key)
+	s.lock.Lock()
+	if value, found := s.items[key]; found {
+		s.policy.Touch(key)
+		s.accessed[key] = time.Now()
+		s.lock.Unlock()
+		return value, nil, nil
+	}
+	if p, found := s.pending[key]; found {
+		s.lock.Unlock()
+		<-p.done
+		return p.value, nil, p.err
+	}
+	p := &pendingValue[V]{done: make(chan struct{})}
+	s.pending[key] = p
+	s.lock.Unlock()
+
+	p.value, p.err = create()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer close(p.done)
+
+	delete(s.pending, key)
+	if p.err != nil {
+		return p.value, nil, p.err
+	}
+	s.items[key] = p.value
+	s.accessed[key] = time.Now()
+	s.files.add(key, 1)
+
+	var ev []evicted[V]
+	for _, e := range s.policy.Admit(key, cost) {
+		if v, ok := s.items[e.Key]; ok {
+			s.delete(e.Key)
+			ev = append(ev, evicted[V]{e.Key, v, e.Reason})
+		}
+	}
+
+	return p.value, ev, nil
+}
+
+// remove removes the value for the key from the index and the eviction policy.
+func (ix *index[V]) remove(key string) (V, bool) {
+	s := ix.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	value, found := s.items[key]
+	if found {
+		s.delete(key)
+		s.policy.Remove(key)
+	}
+	return value, found
+}
+
+// contains checks if the key is in the index, without recording an access.
+func (ix *index[V]) contains(key string) bool {
+	s := ix.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, found := s.items[key]
+	return found
+}
+
+// count returns the number of keys in the index under the directory dir, such as the chunks of a file.
+func (ix *index[V]) count(dir string) int {
+	return ix.files.get(dir)
+}
+
+// entries returns the keys of all values in the index and the times they were last accessed.
+func (ix *index[V]) entries() []indexEntry {
+	var entries []indexEntry
+	for _, s := range ix.shards {
+		s.lock.Lock()
+		for key := range s.items {
+			entries = append(entries, indexEntry{key, s.accessed[key]})
+		}
+		s.lock.Unlock()
+	}
+	return entries
+}
+
+// delete deletes the value for the key from the shard.
+func (s *indexShard[V]) delete(key string) {
+	delete(s.items, key)
+	delete(s.accessed, key)
+	s.files.add(key, -1)
+}
+
+// shard returns the shard that holds the key.
+func (ix *index[V]) shard(key string) *indexShard[V] {
+	if len(ix.shards) == 1 {
+		return ix.shards[0]
+	}
+	return ix.shards[maphash.String(ix.seed, key)%uint64(len(ix.shards))]
+}
+
+// newIndex creates an index of the given capacity whose shards use the named eviction policy.
+func newIndex[V any](policyName string, capacity, blockSize int64) (*index[V], error) {
+	n := int64(1)
+	if blockSize > 0 {
+		n = min(max(capacity/(blockSize*minShardBlocks), 1), maxIndexShards)
+	}
+
+	ix := &index[V]{seed: maphash.MakeSeed(), shards: make([]*indexShard[V], n), files: &fileCounts{counts: map[string]int{}}}
+	for i := range ix.shards {
+		policy, err := NewEvictionPolicy(policyName, capacity/n)
+		if err != nil {
+			return nil, err
+		}
+		ix.shards[i] = &indexShard[V]{
+			items:    map[string]V{},
+			accessed: map[string]time.Time{},
+			pending:  map[string]*pendingValue[V]{},
+			policy:   policy,
+			files:    ix.files,
+		}
+	}
+
+	return ix, nil
+}
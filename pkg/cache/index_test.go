@@ -0,0 +1,217 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewIndexShards(t *testing.T) {
+	tests := []struct {
+		capacity int64
+		want     int
+	}{
+		{capacity: 2 * cacheBlockSize, want: 1},
+		{capacity: minShardBlocks * cacheBlockSize, want: 1},
+		{capacity: 4 * minShardBlocks * cacheBlockSize, want: 4},
+		{capacity: FilesCacheMaxCost, want: maxIndexShards},
+	}
+
+	for _, tt := range tests {
+		ix, err := newIndex[*item](PolicyLRU, tt.capacity, cacheBlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ix.shards) != tt.want {
+			t.Errorf("capacity %v: expected %v shards, got %v", tt.capacity, tt.want, len(ix.shards))
+		}
+	}
+}
+
+func TestIndexGetOrInsertConcurrent(t *testing.T) {
+	ix, err := newIndex[*item](PolicyLRU, FilesCacheMaxCost, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created atomic.Int32
+	items := make([]*item, 100)
+	var wg sync.WaitGroup
+	for i := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, _, err := ix.getOrInsert("key", cacheBlockSize, func() (*item, error) {
+				created.Add(1)
+				return &item{key: "key", lock: new(sync.RWMutex)}, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			items[i] = got
+		}()
+	}
+	wg.Wait()
+
+	if created.Load() != 1 {
+		t.Errorf("expected a single item to be created, got %v", created.Load())
+	}
+	for _, i := range items {
+		if i != items[0] {
+			t.Fatal("expected all callers to get the same item")
+		}
+	}
+}
+
+func TestIndexGetOrInsertDoesNotBlockShard(t *testing.T) {
+	ix, err := newIndex[int](PolicyLRU, 2*cacheBlockSize, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ix.shards) != 1 {
+		t.Fatalf("expected: %v, got: %v", 1, len(ix.shards))
+	}
+
+	creating, release := make(chan struct{}), make(chan struct{})
+	inserted := make(chan int)
+	go func() {
+		v, _, err := ix.getOrInsert("slow", cacheBlockSize, func() (int, error) {
+			close(creating)
+			<-release
+			return 1, nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		inserted <- v
+	}()
+	<-creating
+
+	// Other keys of the shard are not held up while the slow value is created.
+	if v, _, err := ix.getOrInsert("fast", cacheBlockSize, func() (int, error) { return 2, nil }); err != nil || v != 2 {
+		t.Errorf("expected: %v, got: %v, %v", 2, v, err)
+	}
+	if _, found, _ := ix.get("slow"); found {
+		t.Error("expected slow to be pending")
+	}
+
+	// Callers for the pending key wait for it and get its value.
+	waited := make(chan int)
+	go func() {
+		v, _, _ := ix.getOrInsert("slow", cacheBlockSize, func() (int, error) { return 3, nil })
+		waited <- v
+	}()
+
+	close(release)
+	if v := <-inserted; v != 1 {
+		t.Errorf("expected: %v, got: %v", 1, v)
+	}
+	if v := <-waited; v != 1 {
+		t.Errorf("expected: %v, got: %v", 1, v)
+	}
+}
+
+func TestIndexEviction(t *testing.T) {
+	ix, err := newIndex[*item](PolicyLRU, 2*cacheBlockSize, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		key := strconv.Itoa(i)
+		_, ev, err := ix.getOrInsert(key, cacheBlockSize, func() (*item, error) {
+			return &item{key: key, lock: new(sync.RWMutex)}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i < 2 && len(ev) != 0 {
+			t.Errorf("unexpected eviction: %v", ev)
+		} else if i == 2 && (len(ev) != 1 || ev[0].value.key != "0" || ev[0].reason != EvictionReasonCapacity) {
+			t.Errorf("expected key 0 to be evicted, got %v", ev)
+		}
+	}
+
+	if _, found, _ := ix.get("0"); found {
+		t.Error("expected key 0 to be evicted")
+	}
+	if _, found, _ := ix.get("2"); !found {
+		t.Error("expected key 2 to be cached")
+	}
+}
+
+// BenchmarkIndexGetOrInsert measures concurrent insertion of distinct keys into the index.
+func BenchmarkIndexGetOrInsert(b *testing.B) {
+	ix, err := newIndex[*item](PolicyLRU, FilesCacheMaxCost, cacheBlockSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := strconv.FormatInt(n.Add(1), 10)
+			if _, _, err := ix.getOrInsert(key, cacheBlockSize, func() (*item, error) {
+				return &item{key: key, lock: new(sync.RWMutex)}, nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestIndexEntriesAccessed(t *testing.T) {
+	ix, err := newIndex[int](PolicyLRU, 2*cacheBlockSize, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if _, _, err := ix.getOrInsert(key, cacheBlockSize, func() (int, error) { return 0, nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix.get("a")
+	ix.remove("b")
+
+	entries := ix.entries()
+	if len(entries) != 1 || entries[0].key != "a" {
+		t.Fatalf("expected only a, got %v", entries)
+	}
+	if accessed := ix.shard("a").accessed["a"]; !entries[0].accessed.Equal(accessed) || accessed.IsZero() {
+		t.Errorf("expected: %v, got: %v", accessed, entries[0].accessed)
+	}
+	if _, ok := ix.shard("b").accessed["b"]; ok {
+		t.Error("expected access time of removed key to be deleted")
+	}
+}
+
+func TestIndexCount(t *testing.T) {
+	ix, err := newIndex[int](PolicyLRU, 3*cacheBlockSize, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a/0", "a/1", "b/0", "a/2"} {
+		if _, _, err := ix.getOrInsert(key, cacheBlockSize, func() (int, error) { return 0, nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a/0 is evicted to make room for a/2, and a/1 is removed.
+	ix.remove("a/1")
+	for dir, expected := range map[string]int{"a": 1, "b": 1, "c": 0} {
+		if got := ix.count(dir); got != expected {
+			t.Errorf("%v: expected: %v, got: %v", dir, expected, got)
+		}
+	}
+
+	ix.remove("a/2")
+	if _, ok := ix.files.counts["a"]; ok {
+		t.Error("expected the count of a file without keys to be deleted")
+	}
+}
@@ -2,6 +2,8 @@
 // Licensed under the MIT License.
 package cache
 
+import "time"
+
 // Cache describes a cache of files.
 type Cache interface {
 	// Size gets the size of the file.
@@ -15,9 +17,55 @@ type Cache interface {
 
 	// GetOrCreate gets the cached value if available, otherwise downloads the file.
 	GetOrCreate(name string, offset int64, count int, fetch func() ([]byte, error)) ([]byte, error)
+
+	// Contains checks if the given chunk of the file is in the cache, without recording an access.
+	Contains(name string, offset int64) bool
+
+	// Chunks returns the chunks currently in the cache.
+	Chunks() []Chunk
+
+	// Cached returns the number of chunks of the file in the cache.
+	Cached(name string) int
+
+	// Evicted returns a channel that receives the chunks evicted from the cache.
+	// Evictions are not reported while the channel is full.
+	Evicted() <-chan Chunk
+
+	// SetGroup assigns the named file to a quota group.
+	SetGroup(name, group string)
+
+	// Usage returns the usage of the quota groups, or nil if quotas are disabled.
+	Usage() []GroupUsage
+}
+
+// Chunk identifies a cached chunk of a file.
+type Chunk struct {
+	// Name is the name of the file.
+	Name string
+
+	// Offset is the offset of the chunk in the file.
+	Offset int64
+
+	// Accessed is the time the chunk was last read or written, or loaded into the cache.
+	Accessed time.Time
 }
 
+const (
+	// LayoutChunks stores every chunk of a file in a separate file under <path>/<name>/<offset>.
+	LayoutChunks = "chunks"
+
+	// LayoutSparse stores every file in a single sparse file under <path>/<name>/data, with a bitmap of the chunks
+	// that are present.
+	LayoutSparse = "sparse"
+
+	// evictedBufferSize is the number of evictions buffered for the receiver of Evicted.
+	evictedBufferSize = 1000
+)
+
 var (
+	// StorageLayout is the layout of the files cache on disk.
+	StorageLayout = LayoutChunks
+
 	// FilesCacheMaxCost is the capacity of the files cache.
 	FilesCacheMaxCost int64 = 4 * 1024 * 1024 * 1024 // 4 Gib
 
@@ -3,23 +3,49 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
-var fdCnt int32
+const (
+	// checksumSuffix is the suffix of the sidecar file that stores the checksum of a cached chunk.
+	checksumSuffix = ".crc"
+
+	// tempInfix marks files that are being written and have not been renamed into place yet.
+	tempInfix = ".tmp"
+
+	// metainfoFile is the name of the file that stores the size of a cached file, next to its chunks.
+	metainfoFile = "metainfo"
+)
+
+var (
+	fdCnt int32
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errChecksumMismatch = errors.New("checksum mismatch")
+)
 
 // item is a cached item.
 type item struct {
 	key  string
 	file *os.File
 	lock *sync.RWMutex
+
+	// verified indicates that the file has been validated against its checksum, or was written by this process.
+	verified atomic.Bool
 }
 
 // drop deletes the underlying file.
@@ -38,9 +64,62 @@ func (i *item) drop(l zerolog.Logger) {
 		l.Error().Err(err).Str("name", i.file.Name()).Msg("failed to remove file")
 	}
 
+	if err := os.Remove(i.key + checksumSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		l.Error().Err(err).Str("name", i.key+checksumSuffix).Msg("failed to remove checksum")
+	}
+
 	i.file = nil
 }
 
+// validate checks the file against its checksum the first time the item is read.
+// A corrupt file, for example one torn by a crash before a restart, is discarded so that it is fetched again.
+func (i *item) validate(l zerolog.Logger) error {
+	if i.verified.Load() {
+		return nil
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.verified.Load() {
+		return nil
+	}
+
+	info, err := i.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > 0 {
+		if err := verifyChecksum(i.key, i.file); err != nil {
+			l.Warn().Err(err).Str("name", i.key).Msg("discarding corrupt cache item")
+			if err := i.discard(); err != nil {
+				return err
+			}
+		}
+	}
+
+	i.verified.Store(true)
+	return nil
+}
+
+// discard deletes the file and its checksum and replaces them with an empty file.
+func (i *item) discard() error {
+	if err := i.file.Close(); err != nil {
+		return err
+	}
+
+	for _, name := range []string{i.key, i.key + checksumSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	var err error
+	i.file, err = os.OpenFile(i.key, os.O_CREATE|os.O_RDWR, 0644)
+	return err
+}
+
 // bytes returns the file bytes.
 func (i *item) bytes(l zerolog.Logger) []byte {
 	b, err := readFromStart(i.file)
@@ -53,6 +132,8 @@ func (i *item) bytes(l zerolog.Logger) []byte {
 }
 
 // fill files the file with the given data.
+// The data is written to a temporary file with a checksum and atomically renamed into place, so that a crash never
+// leaves a partially written file behind.
 func (i *item) fill(log zerolog.Logger, fetch func() ([]byte, error)) (int, error) {
 	buffer, err := fetch()
 	if err != nil {
@@ -62,7 +143,23 @@ func (i *item) fill(log zerolog.Logger, fetch func() ([]byte, error)) (int, erro
 		return 0, err
 	}
 
-	return writeAll(i.file, buffer)
+	n, err := writeAtomic(i.key, buffer)
+	if err != nil {
+		return 0, err
+	}
+
+	// The open file refers to the replaced inode, reopen the new one.
+	f, err := os.Open(i.key)
+	if err != nil {
+		return 0, err
+	}
+	if err := i.file.Close(); err != nil {
+		log.Error().Err(err).Str("name", i.key).Msg("failed to close replaced file")
+	}
+	i.file = f
+	i.verified.Store(true)
+
+	return n, nil
 }
 
 // readFromStart reads the entire file from the beginning.
@@ -96,23 +193,117 @@ func readFromStart(file *os.File) ([]byte, error) {
 	return fileContent[:offset], nil
 }
 
-// writeAll writes the file.
-func writeAll(file *os.File, buff []byte) (int, error) {
-	offset := 0
-	err := file.Truncate(0)
+// writeAtomic writes the data and its checksum to the named file.
+// Both are written to temporary files, synced and then renamed into place.
+func writeAtomic(name string, buff []byte) (int, error) {
+	sum := fmt.Sprintf("%08x %d\n", crc32.Checksum(buff, crcTable), len(buff))
+	if _, err := writeFileAtomic(name+checksumSuffix, []byte(sum)); err != nil {
+		return 0, err
+	}
+
+	n, err := writeFileAtomic(name, buff)
 	if err != nil {
 		return 0, err
 	}
 
-	l, err := file.Write(buff[offset:])
+	return n, syncDir(filepath.Dir(name))
+}
+
+// writeFileAtomic writes the data to a synced temporary file and renames it to the named file.
+func writeFileAtomic(name string, buff []byte) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+tempInfix+"*")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := tmp.Write(buff)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+
 	if err != nil {
-		if err := os.Remove(file.Name()); err != nil {
-			log.Error().Err(err).Str("name", file.Name()).Msg("attempted to remove file because the size written did not match the file size")
+		if removeErr := os.Remove(tmp.Name()); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			return 0, errors.Join(err, removeErr)
 		}
 		return 0, err
 	}
 
-	return l, nil
+	return n, nil
+}
+
+// syncDir syncs the directory so that renames into it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// verifyChecksum verifies the content of the file against the checksum stored in its sidecar.
+func verifyChecksum(name string, file *os.File) error {
+	want, err := os.ReadFile(name + checksumSuffix)
+	if err != nil {
+		return err
+	}
+
+	b, err := readFromStart(file)
+	if err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("%08x %d\n", crc32.Checksum(b, crcTable), len(b)); got != string(want) {
+		return fmt.Errorf("%w: expected %q, got %q", errChecksumMismatch, strings.TrimSpace(string(want)), strings.TrimSpace(got))
+	}
+
+	return nil
+}
+
+// writeSize persists the size of the file whose chunks are stored in the given directory.
+func writeSize(dir string, size int64) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	_, err := writeFileAtomic(filepath.Join(dir, metainfoFile), []byte(strconv.FormatInt(size, 10)))
+	return err
+}
+
+// readSize reads the persisted size of the file whose chunks are stored in the given directory.
+func readSize(dir string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, metainfoFile))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// removeTempFiles removes temporary files and directories left behind by writes that were interrupted by a crash.
+func removeTempFiles(root string, l zerolog.Logger) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p != root && strings.Contains(d.Name(), tempInfix) {
+			l.Info().Str("name", p).Msg("removing interrupted cache write")
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+
+		return nil
+	})
 }
 
 // newItem creates a new cache item that is ready to be filled.
@@ -13,39 +13,26 @@ import (
 	"github.com/rs/zerolog"
 )
 
-func TestWriteAllTruncateFail(t *testing.T) {
-	td := t.TempDir()
-	filePath := path.Join(td, newRandomStringN(10))
-	f, err := os.OpenFile(filePath, os.O_CREATE, fs.ModePerm)
-	if err != nil {
-		t.Fatal(err)
-	}
-	_, err = writeAll(f, nil)
+func TestWriteAtomicFail(t *testing.T) {
+	filePath := path.Join(t.TempDir(), newRandomStringN(10), newRandomStringN(10))
+	_, err := writeAtomic(filePath, []byte("data"))
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
-	if err := f.Close(); err != nil {
-		t.Fatal(err)
-	}
 }
 
-func TestWriteAll(t *testing.T) {
+func TestWriteAtomic(t *testing.T) {
 	// Setup
-	l := zerolog.Nop()
-	name := newRandomStringN(10)
-	filePath := path.Join(testFileCachePath, name)
+	td := t.TempDir()
+	filePath := path.Join(td, newRandomStringN(10))
 
-	i, err := newItem(filePath, l)
-	if err != nil {
-		t.Fatal(err)
-	}
 	data, err := randomBytesN(20)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Test
-	got, err := writeAll(i.file, data)
+	got, err := writeAtomic(filePath, data)
 
 	// Assert
 	if err != nil {
@@ -58,9 +45,116 @@ func TestWriteAll(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	} else if string(fileContent) != string(data) {
-		t.Fatalf("writeAll corrupted data: got %v, expected %v", fileContent, data)
+		t.Fatalf("writeAtomic corrupted data: got %v, expected %v", fileContent, data)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := verifyChecksum(filePath, f); err != nil {
+		t.Fatalf("expected valid checksum, got %v", err)
 	}
 
+	entries, err := os.ReadDir(td)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Fatalf("expected only the file and its checksum, got %v entries", len(entries))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	l := zerolog.Nop()
+
+	tests := []struct {
+		name    string
+		corrupt func(filePath string) error
+		want    int64
+	}{
+		{
+			name:    "valid",
+			corrupt: func(string) error { return nil },
+			want:    20,
+		},
+		{
+			name: "torn",
+			corrupt: func(filePath string) error {
+				return os.Truncate(filePath, 10)
+			},
+			want: 0,
+		},
+		{
+			name: "missing checksum",
+			corrupt: func(filePath string) error {
+				return os.Remove(filePath + checksumSuffix)
+			},
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := path.Join(t.TempDir(), newRandomStringN(10))
+			data, err := randomBytesN(20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writeAtomic(filePath, data); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.corrupt(filePath); err != nil {
+				t.Fatal(err)
+			}
+
+			i, err := newItem(filePath, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := i.validate(l); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := i.file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			} else if info.Size() != tt.want {
+				t.Errorf("expected size %v, got %v", tt.want, info.Size())
+			}
+			if !i.verified.Load() {
+				t.Error("expected item to be verified")
+			}
+		})
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	td := t.TempDir()
+	dir := path.Join(td, newRandomStringN(10))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	keep := path.Join(dir, "0")
+	if _, err := writeAtomic(keep, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	interrupted := path.Join(dir, "1048576"+tempInfix+"123")
+	if err := os.WriteFile(interrupted, []byte("da"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeTempFiles(td, zerolog.Nop()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(interrupted); !os.IsNotExist(err) {
+		t.Errorf("expected interrupted write to be removed, got %v", err)
+	}
+	if _, err := os.Stat(keep); err != nil {
+		t.Errorf("expected file to be kept, got %v", err)
+	}
 }
 
 func TestReadFromStart(t *testing.T) {
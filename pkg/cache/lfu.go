@@ -0,0 +1,121 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import "container/heap"
+
+// lfuEntry is an entry tracked by the LFU policy.
+type lfuEntry struct {
+	key   string
+	cost  int64
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+// lfuHeap is a min-heap of entries ordered by access frequency, then by recency.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+// lfuPolicy evicts the least frequently used entries first.
+// Ties are broken by evicting the least recently used entry.
+type lfuPolicy struct {
+	capacity int64
+	size     int64
+	tick     uint64
+	heap     lfuHeap
+	entries  map[string]*lfuEntry
+}
+
+var _ EvictionPolicy = &lfuPolicy{}
+
+// Name returns the name of the policy.
+func (p *lfuPolicy) Name() string {
+	return PolicyLFU
+}
+
+// Admit records a new entry and evicts the least frequently used entries until it fits.
+func (p *lfuPolicy) Admit(key string, cost int64) []Eviction {
+	p.Remove(key)
+
+	var evicted []Eviction
+	for p.size+cost > p.capacity && p.heap.Len() > 0 {
+		e := heap.Pop(&p.heap).(*lfuEntry)
+		delete(p.entries, e.key)
+		p.size -= e.cost
+		evicted = append(evicted, Eviction{Key: e.key, Reason: EvictionReasonCapacity})
+	}
+
+	p.tick++
+	e := &lfuEntry{key: key, cost: cost, freq: 1, tick: p.tick}
+	heap.Push(&p.heap, e)
+	p.entries[key] = e
+	p.size += cost
+
+	return evicted
+}
+
+// Touch increments the access frequency of the entry.
+func (p *lfuPolicy) Touch(key string) bool {
+	e, ok := p.entries[key]
+	if !ok {
+		return false
+	}
+
+	p.tick++
+	e.freq++
+	e.tick = p.tick
+	heap.Fix(&p.heap, e.index)
+	return true
+}
+
+// Remove forgets the entry.
+func (p *lfuPolicy) Remove(key string) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&p.heap, e.index)
+	delete(p.entries, key)
+	p.size -= e.cost
+}
+
+// Len returns the number of live entries.
+func (p *lfuPolicy) Len() int {
+	return len(p.entries)
+}
+
+// newLFUPolicy creates a least frequently used eviction policy.
+func newLFUPolicy(capacity int64) *lfuPolicy {
+	return &lfuPolicy{capacity: capacity, entries: map[string]*lfuEntry{}}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import "container/list"
+
+// listEntry is an entry of a keyList.
+type listEntry struct {
+	key     string
+	cost    int64
+	expires int64
+}
+
+// keyList is an ordered list of keys, most recent first, that keeps track of the total cost of its entries.
+type keyList struct {
+	ll      *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// newKeyList creates an empty keyList.
+func newKeyList() *keyList {
+	return &keyList{ll: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the entry for the key.
+func (l *keyList) get(key string) (*listEntry, bool) {
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*listEntry), true
+}
+
+// pushFront adds the entry to the front of the list.
+func (l *keyList) pushFront(entry *listEntry) {
+	l.entries[entry.key] = l.ll.PushFront(entry)
+	l.size += entry.cost
+}
+
+// moveToFront moves the key to the front of the list.
+func (l *keyList) moveToFront(key string) bool {
+	e, ok := l.entries[key]
+	if ok {
+		l.ll.MoveToFront(e)
+	}
+	return ok
+}
+
+// remove removes the key from the list.
+func (l *keyList) remove(key string) (*listEntry, bool) {
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := l.ll.Remove(e).(*listEntry)
+	delete(l.entries, key)
+	l.size -= entry.cost
+	return entry, true
+}
+
+// back returns the least recent entry.
+func (l *keyList) back() (*listEntry, bool) {
+	e := l.ll.Back()
+	if e == nil {
+		return nil, false
+	}
+	return e.Value.(*listEntry), true
+}
+
+// removeBack removes the least recent entry.
+func (l *keyList) removeBack() (*listEntry, bool) {
+	entry, ok := l.back()
+	if !ok {
+		return nil, false
+	}
+	return l.remove(entry.key)
+}
+
+// len returns the number of entries in the list.
+func (l *keyList) len() int {
+	return l.ll.Len()
+}
+
+// lruPolicy evicts the least recently used entries first.
+type lruPolicy struct {
+	capacity int64
+	entries  *keyList
+}
+
+var _ EvictionPolicy = &lruPolicy{}
+
+// Name returns the name of the policy.
+func (p *lruPolicy) Name() string {
+	return PolicyLRU
+}
+
+// Admit records a new entry and evicts the least recently used entries until it fits.
+func (p *lruPolicy) Admit(key string, cost int64) []Eviction {
+	p.entries.remove(key)
+
+	var evicted []Eviction
+	for p.entries.size+cost > p.capacity {
+		entry, ok := p.entries.removeBack()
+		if !ok {
+			break
+		}
+		evicted = append(evicted, Eviction{Key: entry.key, Reason: EvictionReasonCapacity})
+	}
+
+	p.entries.pushFront(&listEntry{key: key, cost: cost})
+	return evicted
+}
+
+// Touch marks the entry as the most recently used.
+func (p *lruPolicy) Touch(key string) bool {
+	return p.entries.moveToFront(key)
+}
+
+// Remove forgets the entry.
+func (p *lruPolicy) Remove(key string) {
+	p.entries.remove(key)
+}
+
+// Len returns the number of live entries.
+func (p *lruPolicy) Len() int {
+	return p.entries.len()
+}
+
+// newLRUPolicy creates a least recently used eviction policy.
+func newLRUPolicy(capacity int64) *lruPolicy {
+	return &lruPolicy{capacity: capacity, entries: newKeyList()}
+}
@@ -3,11 +3,18 @@
 package cache
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"math/big"
 	"os"
 	"testing"
+
+	"github.com/azure/peerd/pkg/metrics"
+)
+
+var (
+	ctxWithMetrics, _ = metrics.WithContext(context.Background(), "test", "peerd")
 )
 
 var testFileCachePath string
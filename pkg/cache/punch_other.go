@@ -0,0 +1,13 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+//go:build !linux
+
+package cache
+
+import "os"
+
+// punchHole is a no-op on platforms without hole punching; the space of the file is released when it is truncated
+// after its last chunk is removed.
+func punchHole(f *os.File, offset, length int64) error {
+	return nil
+}
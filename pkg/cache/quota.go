@@ -0,0 +1,392 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/azure/peerd/pkg/metrics"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// DefaultQuotaGroup is the group of files that match no configured group.
+	DefaultQuotaGroup = "default"
+
+	// groupFile is the name of the file that stores the quota group of a cached file, next to its chunks.
+	groupFile = "group"
+)
+
+// errQuotaExceeded indicates that a chunk does not fit in the hard quota of its group.
+var errQuotaExceeded = errors.New("chunk exceeds the hard quota of its group")
+
+// QuotaGroup is a partition of the capacity of the files cache.
+// A file belongs to the first group that matches its upstream host, its registry or the tenant that requested it.
+type QuotaGroup struct {
+	// Name is the name of the group. A group named "default" sets the quotas of files that match no other group.
+	Name string `json:"name"`
+
+	// Hosts are patterns, in the syntax of path.Match, of the upstream hosts of the files in the group.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Registries are the ids of the registries of the files in the group.
+	Registries []string `json:"registries,omitempty"`
+
+	// Tenants are the values of the tenant header of the requests for the files in the group.
+	Tenants []string `json:"tenants,omitempty"`
+
+	// Soft is the number of bytes the group may use before its chunks are evicted first when the cache is full.
+	// Zero means no soft quota.
+	Soft int64 `json:"soft,omitempty"`
+
+	// Hard is the number of bytes the group may never exceed. Zero means no hard quota.
+	Hard int64 `json:"hard,omitempty"`
+}
+
+// QuotaConfig configures the quota groups of the files cache.
+type QuotaConfig struct {
+	// TenantHeader is the request header that identifies the tenant.
+	TenantHeader string `json:"tenantHeader,omitempty"`
+
+	// Groups are the quota groups, in order of precedence.
+	Groups []QuotaGroup `json:"groups"`
+}
+
+// GroupUsage is the usage of a quota group.
+type GroupUsage struct {
+	Group string `json:"group"`
+	Used  int64  `json:"used"`
+	Soft  int64  `json:"soft,omitempty"`
+	Hard  int64  `json:"hard,omitempty"`
+}
+
+// Quotas is the quota configuration of the files cache. Quotas are disabled when no groups are configured.
+var Quotas QuotaConfig
+
+// LoadQuotaConfig reads and validates a quota configuration from the JSON file at the path.
+func LoadQuotaConfig(path string) (QuotaConfig, error) {
+	var config QuotaConfig
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("invalid quota config: %w", err)
+	}
+
+	return config, config.Validate()
+}
+
+// Validate checks that the groups are named uniquely and their quotas are consistent.
+func (q QuotaConfig) Validate() error {
+	seen := map[string]bool{}
+	for _, g := range q.Groups {
+		if g.Name == "" {
+			return errors.New("quota group must have a name")
+		} else if seen[g.Name] {
+			return fmt.Errorf("duplicate quota group: %v", g.Name)
+		}
+		seen[g.Name] = true
+
+		if g.Soft < 0 || g.Hard < 0 {
+			return fmt.Errorf("quota group %v: quotas must not be negative", g.Name)
+		} else if g.Hard > 0 && g.Soft > g.Hard {
+			return fmt.Errorf("quota group %v: soft quota %v exceeds hard quota %v", g.Name, g.Soft, g.Hard)
+		}
+
+		for _, pattern := range g.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("quota group %v: invalid host pattern %q: %w", g.Name, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Classify returns the group of a file requested from the upstream host and registry by the tenant.
+func (q QuotaConfig) Classify(host, registry, tenant string) string {
+	for _, g := range q.Groups {
+		if g.Name == DefaultQuotaGroup {
+			continue
+		}
+		if registry != "" && slices.Contains(g.Registries, registry) {
+			return g.Name
+		}
+		if tenant != "" && slices.Contains(g.Tenants, tenant) {
+			return g.Name
+		}
+		for _, pattern := range g.Hosts {
+			if ok, _ := path.Match(pattern, strings.ToLower(host)); ok {
+				return g.Name
+			}
+		}
+	}
+	return DefaultQuotaGroup
+}
+
+// quotas tracks the usage of the quota groups of a cache and chooses the chunks to evict to keep them within their
+// quotas. A nil *quotas disables quotas.
+type quotas struct {
+	lock     sync.Mutex
+	path     string
+	capacity int64
+	total    int64
+	limits   map[string]QuotaGroup
+
+	// groups holds the chunks charged to each group, most recently used first.
+	groups map[string]*keyList
+
+	// charged maps the key of each chunk to the group it is charged to.
+	charged map[string]string
+
+	// names maps each file to its group.
+	names map[string]string
+
+	log             zerolog.Logger
+	metricsRecorder metrics.Metrics
+}
+
+// SetGroup assigns the named file to the quota group. Chunks already cached stay charged to their previous group.
+func (q *quotas) SetGroup(name, group string) {
+	if q == nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.groupOf(name) == group {
+		return
+	}
+	q.names[name] = group
+
+	dir := filepath.Join(q.path, name)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		_, err = writeFileAtomic(filepath.Join(dir, groupFile), []byte(group))
+	}
+	if err != nil {
+		q.log.Error().Err(err).Str("name", name).Str("group", group).Msg("failed to persist quota group")
+	}
+}
+
+// Usage returns the usage of every quota group, ordered by name.
+func (q *quotas) Usage() []GroupUsage {
+	if q == nil {
+		return nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var usage []GroupUsage
+	for name, limit := range q.limits {
+		u := GroupUsage{Group: name, Soft: limit.Soft, Hard: limit.Hard}
+		if l, ok := q.groups[name]; ok {
+			u.Used = l.size
+		}
+		usage = append(usage, u)
+	}
+	slices.SortFunc(usage, func(a, b GroupUsage) int { return strings.Compare(a.Group, b.Group) })
+	return usage
+}
+
+// loadGroup loads the persisted quota group of the named file.
+func (q *quotas) loadGroup(name string) {
+	if q == nil {
+		return
+	}
+
+	b, err := os.ReadFile(filepath.Join(q.path, name, groupFile))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			q.log.Error().Err(err).Str("name", name).Msg("failed to read quota group")
+		}
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if group := strings.TrimSpace(string(b)); group != "" {
+		q.names[name] = group
+	}
+}
+
+// admit charges the chunk of the named file to its group and returns the keys of the chunks that must be evicted to
+// keep the group within its hard quota and, when the cache is full, groups within their soft quotas.
+// It returns errQuotaExceeded if the chunk alone exceeds the hard quota of its group.
+func (q *quotas) admit(name, key string, cost int64) ([]string, error) {
+	if q == nil {
+		return nil, nil
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	group := q.groupOf(name)
+	limit := q.limits[group]
+	if limit.Hard > 0 && cost > limit.Hard {
+		return nil, errQuotaExceeded
+	}
+
+	if prev, ok := q.charged[key]; ok {
+		q.uncharge(prev, key)
+	}
+
+	l, ok := q.groups[group]
+	if !ok {
+		l = newKeyList()
+		q.groups[group] = l
+	}
+
+	var victims []string
+	for limit.Hard > 0 && l.size+cost > limit.Hard {
+		victims = append(victims, q.evictFrom(group))
+	}
+
+	for q.total+cost > q.capacity {
+		over := q.mostOverSoft()
+		if over == "" {
+			// The eviction policy makes room for the chunk.
+			break
+		}
+		victims = append(victims, q.evictFrom(over))
+	}
+
+	l.pushFront(&listEntry{key: key, cost: cost})
+	q.charged[key] = group
+	q.total += cost
+	q.metricsRecorder.RecordCacheGroupUsage(group, l.size)
+
+	return victims, nil
+}
+
+// touch marks the chunk as the most recently used of its group.
+func (q *quotas) touch(key string) {
+	if q == nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if group, ok := q.charged[key]; ok {
+		q.groups[group].moveToFront(key)
+	}
+}
+
+// release uncharges the chunk from its group.
+func (q *quotas) release(key string) {
+	if q == nil {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	group, ok := q.charged[key]
+	if !ok {
+		return
+	}
+	q.uncharge(group, key)
+}
+
+// evictFrom uncharges the least recently used chunk of the group and returns its key.
+func (q *quotas) evictFrom(group string) string {
+	entry, _ := q.groups[group].back()
+	q.uncharge(group, entry.key)
+	return entry.key
+}
+
+// uncharge removes the chunk from the group.
+func (q *quotas) uncharge(group, key string) {
+	l := q.groups[group]
+	if entry, ok := l.remove(key); ok {
+		q.total -= entry.cost
+	}
+	delete(q.charged, key)
+	q.metricsRecorder.RecordCacheGroupUsage(group, l.size)
+}
+
+// mostOverSoft returns the group that exceeds its soft quota by the most bytes, or empty if none does.
+func (q *quotas) mostOverSoft() string {
+	var group string
+	var most int64
+	for name, l := range q.groups {
+		if soft := q.limits[name].Soft; soft > 0 && l.size-soft > most {
+			group, most = name, l.size-soft
+		}
+	}
+	return group
+}
+
+// groupOf returns the group of the named file. Files of groups that are no longer configured are in the default group.
+func (q *quotas) groupOf(name string) string {
+	if group, ok := q.names[name]; ok {
+		if _, ok := q.limits[group]; ok {
+			return group
+		}
+	}
+	return DefaultQuotaGroup
+}
+
+// newQuotas creates a quota tracker for a cache of the given capacity at path, or nil if no groups are configured.
+func newQuotas(config QuotaConfig, path string, capacity int64, log zerolog.Logger, m metrics.Metrics) *quotas {
+	if len(config.Groups) == 0 {
+		return nil
+	}
+
+	q := &quotas{
+		path:            path,
+		capacity:        capacity,
+		limits:          map[string]QuotaGroup{DefaultQuotaGroup: {Name: DefaultQuotaGroup}},
+		groups:          map[string]*keyList{},
+		charged:         map[string]string{},
+		names:           map[string]string{},
+		log:             log,
+		metricsRecorder: m,
+	}
+	for _, g := range config.Groups {
+		q.limits[g.Name] = g
+	}
+	return q
+}
+
+// insert inserts the value created for the key of the named file into the index within the quota of the file's
+// group. The chunk is only charged to its group when the key is created, and chunks evicted for quotas are removed
+// before the value is inserted, so that the eviction policy only evicts for capacity what the quotas did not. The
+// returned evictions include both.
+func insert[V any](ix *index[V], q *quotas, name, key string, cost int64, create func() (V, error)) (V, []evicted[V], error) {
+	var ev []evicted[V]
+	value, policyEv, err := ix.getOrInsert(key, cost, func() (V, error) {
+		victims, err := q.admit(name, key, cost)
+		if err != nil {
+			var zero V
+			return zero, err
+		}
+
+		for _, k := range victims {
+			if v, ok := ix.remove(k); ok {
+				ev = append(ev, evicted[V]{k, v, EvictionReasonQuota})
+			}
+		}
+
+		value, err := create()
+		if err != nil {
+			q.release(key)
+		}
+		return value, err
+	})
+
+	return value, append(ev, policyEv...), err
+}
@@ -0,0 +1,241 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/azure/peerd/pkg/metrics"
+	"github.com/rs/zerolog"
+)
+
+// useQuotas sets the quota configuration and capacity of the files cache for the duration of the test.
+func useQuotas(t *testing.T, config QuotaConfig, capacity int64) {
+	prevQuotas, prevCost, prevPolicy := Quotas, FilesCacheMaxCost, EvictionPolicyName
+	Quotas, FilesCacheMaxCost, EvictionPolicyName = config, capacity, PolicyLRU
+	t.Cleanup(func() { Quotas, FilesCacheMaxCost, EvictionPolicyName = prevQuotas, prevCost, prevPolicy })
+}
+
+// fillChunks caches the first n chunks of the named file.
+func fillChunks(t *testing.T, c Cache, name string, n int64) {
+	for i := int64(0); i < n; i++ {
+		if _, err := c.GetOrCreate(name, i*cacheBlockSize, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQuotaConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		groups  []QuotaGroup
+		wantErr bool
+	}{
+		{name: "valid", groups: []QuotaGroup{{Name: "a", Soft: 1, Hard: 2}, {Name: "b", Soft: 5}}},
+		{name: "unnamed", groups: []QuotaGroup{{Soft: 1}}, wantErr: true},
+		{name: "duplicate", groups: []QuotaGroup{{Name: "a"}, {Name: "a"}}, wantErr: true},
+		{name: "soft exceeds hard", groups: []QuotaGroup{{Name: "a", Soft: 3, Hard: 2}}, wantErr: true},
+		{name: "negative", groups: []QuotaGroup{{Name: "a", Hard: -1}}, wantErr: true},
+		{name: "bad pattern", groups: []QuotaGroup{{Name: "a", Hosts: []string{"["}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := QuotaConfig{Groups: tt.groups}.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error: %v, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadQuotaConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	config := `{"tenantHeader":"X-Tenant","groups":[{"name":"models","hosts":["*.blob.core.windows.net"],"soft":10,"hard":20}]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LoadQuotaConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TenantHeader != "X-Tenant" || len(got.Groups) != 1 || got.Groups[0].Hard != 20 {
+		t.Errorf("unexpected config: %+v", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"groups":[{"name":"a","soft":2,"hard":1}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadQuotaConfig(path); err == nil {
+		t.Error("expected error for invalid config")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	config := QuotaConfig{Groups: []QuotaGroup{
+		{Name: DefaultQuotaGroup, Hosts: []string{"*"}},
+		{Name: "ml", Tenants: []string{"ml-team"}},
+		{Name: "acr", Registries: []string{"01031d61e1024861afee5d512651eb9f"}},
+		{Name: "storage", Hosts: []string{"*.blob.core.windows.net"}},
+	}}
+
+	tests := []struct {
+		host, registry, tenant string
+		want                   string
+	}{
+		{host: "eusreplstore28.blob.core.windows.net", want: "storage"},
+		{host: "EUSREPLSTORE28.BLOB.CORE.WINDOWS.NET", want: "storage"},
+		{host: "westus2.data.mcr.microsoft.com", registry: "01031d61e1024861afee5d512651eb9f", want: "acr"},
+		{host: "eusreplstore28.blob.core.windows.net", tenant: "ml-team", want: "ml"},
+		{host: "westus2.data.mcr.microsoft.com", want: DefaultQuotaGroup},
+	}
+
+	for _, tt := range tests {
+		if got := config.Classify(tt.host, tt.registry, tt.tenant); got != tt.want {
+			t.Errorf("%v %v %v: expected: %v, got: %v", tt.host, tt.registry, tt.tenant, tt.want, got)
+		}
+	}
+}
+
+func TestQuotaHard(t *testing.T) {
+	for _, layout := range []string{LayoutChunks, LayoutSparse} {
+		t.Run(layout, func(t *testing.T) {
+			useLayout(t, layout)
+			useQuotas(t, QuotaConfig{Groups: []QuotaGroup{{Name: "models", Hard: 2 * cacheBlockSize}}}, 8*cacheBlockSize)
+
+			c := NewCache(ctxWithMetrics, cacheBlockSize, t.TempDir())
+			model, layer := newRandomStringN(10), newRandomStringN(10)
+			c.SetGroup(model, "models")
+
+			fillChunks(t, c, layer, 2)
+			fillChunks(t, c, model, 3)
+
+			if c.Exists(model, 0) {
+				t.Error("expected the least recently used chunk of the group to be evicted")
+			}
+			for i := int64(1); i < 3; i++ {
+				if !c.Exists(model, i*cacheBlockSize) {
+					t.Errorf("expected chunk %v of the group to exist", i)
+				}
+			}
+			for i := int64(0); i < 2; i++ {
+				if !c.Exists(layer, i*cacheBlockSize) {
+					t.Errorf("expected chunk %v of another group to exist", i)
+				}
+			}
+
+			want := []GroupUsage{
+				{Group: DefaultQuotaGroup, Used: 2 * cacheBlockSize},
+				{Group: "models", Used: 2 * cacheBlockSize, Hard: 2 * cacheBlockSize},
+			}
+			if got := c.Usage(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+				t.Errorf("expected: %v, got: %v", want, got)
+			}
+		})
+	}
+}
+
+func TestQuotaSoft(t *testing.T) {
+	useQuotas(t, QuotaConfig{Groups: []QuotaGroup{{Name: "models", Soft: cacheBlockSize}}}, 4*cacheBlockSize)
+
+	c := NewCache(ctxWithMetrics, cacheBlockSize, t.TempDir())
+	model, layer := newRandomStringN(10), newRandomStringN(10)
+	c.SetGroup(model, "models")
+
+	// The group may exceed its soft quota while the cache has room.
+	fillChunks(t, c, layer, 1)
+	fillChunks(t, c, model, 3)
+	for i := int64(0); i < 3; i++ {
+		if !c.Exists(model, i*cacheBlockSize) {
+			t.Errorf("expected chunk %v of the group to exist", i)
+		}
+	}
+
+	// The least recently used chunk of the group is the first to go, even though the layer was cached before it.
+	other := newRandomStringN(10)
+	fillChunks(t, c, other, 1)
+	if c.Exists(model, 0) {
+		t.Error("expected the chunk of the group over its soft quota to be evicted")
+	}
+	if !c.Exists(layer, 0) {
+		t.Error("expected the chunk of the group within its quota to be kept")
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	useQuotas(t, QuotaConfig{Groups: []QuotaGroup{{Name: "tiny", Hard: cacheBlockSize / 2}}}, 4*cacheBlockSize)
+
+	c := NewCache(ctxWithMetrics, cacheBlockSize, t.TempDir())
+	name := newRandomStringN(10)
+	c.SetGroup(name, "tiny")
+
+	got, err := c.GetOrCreate(name, 0, 10, func() ([]byte, error) {
+		return []byte("0123456789"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if string(got) != "0123456789" {
+		t.Errorf("expected the chunk to be served, got %v", got)
+	}
+
+	if c.Exists(name, 0) {
+		t.Error("expected a chunk over the hard quota not to be cached")
+	}
+}
+
+func TestQuotaGroupAfterRestart(t *testing.T) {
+	useQuotas(t, QuotaConfig{Groups: []QuotaGroup{{Name: "models", Hard: 4 * cacheBlockSize}}}, 8*cacheBlockSize)
+
+	path := t.TempDir()
+	c := NewCache(ctxWithMetrics, cacheBlockSize, path)
+	name := newRandomStringN(10)
+	c.SetGroup(name, "models")
+	fillChunks(t, c, name, 2)
+
+	restarted := NewCache(ctxWithMetrics, cacheBlockSize, path)
+	for _, u := range restarted.Usage() {
+		if u.Group == "models" && u.Used != 2*cacheBlockSize {
+			t.Errorf("expected the group to be charged for its cached chunks, got %v", u.Used)
+		}
+	}
+}
+
+func TestQuotaInsertExisting(t *testing.T) {
+	q := newQuotas(QuotaConfig{Groups: []QuotaGroup{{Name: "models", Hard: 2 * cacheBlockSize}}}, t.TempDir(), 8*cacheBlockSize, zerolog.Nop(), metrics.FromContext(ctxWithMetrics))
+	ix, err := newIndex[string](PolicyLRU, 8*cacheBlockSize, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first chunk stays charged to the default group after the file moves to a group that is then filled.
+	keys := []string{"a", "b", "c"}
+	for i, key := range keys {
+		if i == 1 {
+			q.SetGroup("model", "models")
+		}
+		if _, _, err := insert(ix, q, "model", key, cacheBlockSize, func() (string, error) { return key, nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Inserting a key that already exists must not charge it to the full group and evict another chunk of it.
+	got, ev, err := insert(ix, q, "model", "a", cacheBlockSize, func() (string, error) { return "new", nil })
+	if err != nil {
+		t.Fatal(err)
+	} else if got != "a" {
+		t.Errorf("expected: %v, got: %v", "a", got)
+	} else if len(ev) != 0 {
+		t.Errorf("expected no evictions, got: %v", ev)
+	}
+
+	for _, key := range keys {
+		if !ix.contains(key) {
+			t.Errorf("expected chunk %v to be kept", key)
+		}
+	}
+}
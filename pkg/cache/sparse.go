@@ -0,0 +1,707 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/azure/peerd/pkg/math"
+	"github.com/azure/peerd/pkg/metrics"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// sparseDataFile is the name of the sparse file that stores the chunks of a file in the sparse layout.
+	sparseDataFile = "data"
+
+	// presenceFile is the name of the file that records the chunks present in the sparse file, with their checksums.
+	presenceFile = "presence"
+
+	// presenceJournalFile is the name of the file that records the changes to the presence since it was last written.
+	presenceJournalFile = "presence.journal"
+
+	// journalRecordSize is the size of a record of the presence journal: the little-endian index, checksum and length of
+	// the chunk, whether it is present, and the checksum of the record.
+	journalRecordSize = 24
+
+	// minJournalRecords is the number of records the presence journal may hold before it is folded into the presence,
+	// regardless of the number of present chunks.
+	minJournalRecords = 64
+)
+
+// errBlobClosed is returned when writing a chunk of a sparse file that was closed because all its chunks were evicted.
+var errBlobClosed = errors.New("sparse file closed")
+
+// chunkSum is the checksum and length of a chunk of a sparse file.
+type chunkSum struct {
+	crc    uint32
+	length uint32
+}
+
+// presence records the chunks of a sparse file that have been written and synced.
+// It is persisted as the little-endian block size, the bitmap of present chunks and the checksum and length of each
+// present chunk in ascending order.
+type presence struct {
+	blockSize int64
+	chunks    math.Bitmap
+	sums      map[int64]chunkSum
+}
+
+// marshal encodes the presence.
+func (p *presence) marshal() ([]byte, error) {
+	bitmap, err := p.chunks.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	b := binary.LittleEndian.AppendUint64(nil, uint64(p.blockSize))
+	b = append(b, bitmap...)
+	for _, idx := range p.chunks.All() {
+		b = binary.LittleEndian.AppendUint32(b, p.sums[idx].crc)
+		b = binary.LittleEndian.AppendUint32(b, p.sums[idx].length)
+	}
+	return b, nil
+}
+
+// unmarshal decodes a presence encoded by marshal.
+func (p *presence) unmarshal(b []byte) error {
+	if len(b) < 12 {
+		return fmt.Errorf("presence too short: %d bytes", len(b))
+	}
+	p.blockSize = int64(binary.LittleEndian.Uint64(b))
+
+	words := int(binary.LittleEndian.Uint32(b[8:]))
+	end := 12 + 8*words
+	if len(b) < end {
+		return fmt.Errorf("presence too short: %d bytes", len(b))
+	}
+	if err := p.chunks.UnmarshalBinary(b[8:end]); err != nil {
+		return err
+	}
+
+	all := p.chunks.All()
+	if len(b) != end+8*len(all) {
+		return fmt.Errorf("presence of %d chunks has %d bytes", len(all), len(b))
+	}
+	p.sums = make(map[int64]chunkSum, len(all))
+	for i, idx := range all {
+		off := end + 8*i
+		p.sums[idx] = chunkSum{crc: binary.LittleEndian.Uint32(b[off:]), length: binary.LittleEndian.Uint32(b[off+4:])}
+	}
+	return nil
+}
+
+// size returns the size of the file implied by its last present chunk.
+func (p *presence) size() int64 {
+	all := p.chunks.All()
+	if len(all) == 0 {
+		return 0
+	}
+	last := all[len(all)-1]
+	return last*p.blockSize + int64(p.sums[last].length)
+}
+
+// set records the chunk at the index as present with the checksum, or as absent if sum is nil.
+func (p *presence) set(idx int64, sum *chunkSum) {
+	if sum == nil {
+		p.chunks.Clear(idx)
+		delete(p.sums, idx)
+		return
+	}
+	p.chunks.Set(idx)
+	p.sums[idx] = *sum
+}
+
+// journalRecord encodes a record of the presence journal that sets the chunk at the index as present with the
+// checksum, or as absent if sum is nil.
+func journalRecord(idx int64, sum *chunkSum) []byte {
+	var present uint32
+	var s chunkSum
+	if sum != nil {
+		present, s = 1, *sum
+	}
+
+	b := binary.LittleEndian.AppendUint64(make([]byte, 0, journalRecordSize), uint64(idx))
+	b = binary.LittleEndian.AppendUint32(b, s.crc)
+	b = binary.LittleEndian.AppendUint32(b, s.length)
+	b = binary.LittleEndian.AppendUint32(b, present)
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// replay applies the records of a presence journal in order. It stops at the first record that is incomplete or does
+// not match its checksum, which a crash may leave at the end of the journal.
+func (p *presence) replay(journal []byte) {
+	for ; len(journal) >= journalRecordSize; journal = journal[journalRecordSize:] {
+		r := journal[:journalRecordSize]
+		if crc32.Checksum(r[:20], crcTable) != binary.LittleEndian.Uint32(r[20:]) {
+			return
+		}
+
+		idx := int64(binary.LittleEndian.Uint64(r))
+		if binary.LittleEndian.Uint32(r[16:]) == 0 {
+			p.set(idx, nil)
+		} else {
+			p.set(idx, &chunkSum{crc: binary.LittleEndian.Uint32(r[8:]), length: binary.LittleEndian.Uint32(r[12:])})
+		}
+	}
+}
+
+// writePresence persists the presence of the sparse file in dir.
+func writePresence(dir string, p *presence) error {
+	b, err := p.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := writeFileAtomic(filepath.Join(dir, presenceFile), b); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readPresence reads the presence of the sparse file in dir, with the changes recorded in its journal.
+func readPresence(dir string) (*presence, error) {
+	b, err := os.ReadFile(filepath.Join(dir, presenceFile))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &presence{}
+	if err := p.unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.ReadFile(filepath.Join(dir, presenceJournalFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	p.replay(journal)
+	return p, nil
+}
+
+// sparseBlob is a file cached as a single sparse file.
+// A chunk is written and synced before it is recorded as present, so a crash never leaves a partially written chunk
+// marked as present. Chunks are validated against their checksums when they are first read.
+// Changes to the presence are appended to a journal, which is folded into the presence once it holds more records than
+// there are present chunks, so that filling a blob costs a constant amount of I/O per chunk.
+type sparseBlob struct {
+	name    string
+	dir     string
+	lock    sync.RWMutex
+	file    *os.File
+	journal *os.File
+	closed  bool
+	presence
+
+	// refs is the number of chunks of the blob in the index, guarded by the lock of the cache.
+	refs int
+
+	// journaled is the number of records in the journal, or -1 if the presence has not been written since the blob was
+	// emptied, in which case the journal is not replayed and the presence is written instead.
+	journaled int
+
+	// verified records the chunks that have been validated against their checksums, or were written by this process.
+	verified math.Bitmap
+}
+
+// has checks whether the chunk at the offset is present and valid.
+func (b *sparseBlob) has(offset int64, l zerolog.Logger) bool {
+	idx := offset / b.blockSize
+	b.lock.RLock()
+	present, verified := !b.closed && b.chunks.Test(idx), b.verified.Test(idx)
+	b.lock.RUnlock()
+
+	if present && !verified {
+		_, present = b.read(offset, l)
+	}
+	return present
+}
+
+// read reads the chunk at the offset if it is present.
+// A chunk that does not match its checksum is removed so that it is fetched again.
+func (b *sparseBlob) read(offset int64, l zerolog.Logger) ([]byte, bool) {
+	idx := offset / b.blockSize
+
+	b.lock.RLock()
+	if b.closed || !b.chunks.Test(idx) {
+		b.lock.RUnlock()
+		return nil, false
+	}
+	sum, verified := b.sums[idx], b.verified.Test(idx)
+	buf := make([]byte, sum.length)
+	_, err := b.file.ReadAt(buf, offset)
+	b.lock.RUnlock()
+
+	if err != nil {
+		l.Error().Err(err).Str("name", b.dir).Int64("offset", offset).Msg("failed to read chunk")
+		return nil, false
+	}
+
+	if !verified {
+		if got := crc32.Checksum(buf, crcTable); got != sum.crc {
+			l.Warn().Err(errChecksumMismatch).Str("name", b.dir).Int64("offset", offset).Msg("discarding corrupt cache chunk")
+			if err := b.remove(offset); err != nil {
+				l.Error().Err(err).Str("name", b.dir).Int64("offset", offset).Msg("failed to remove chunk")
+			}
+			return nil, false
+		}
+
+		b.lock.Lock()
+		b.verified.Set(idx)
+		b.lock.Unlock()
+	}
+
+	return buf, true
+}
+
+// write writes the chunk at the offset, syncs it and records it as present.
+func (b *sparseBlob) write(offset int64, buf []byte) (int, error) {
+	if int64(len(buf)) > b.blockSize {
+		return 0, fmt.Errorf("chunk of %d bytes exceeds the block size %d", len(buf), b.blockSize)
+	}
+
+	b.lock.RLock()
+	if b.closed {
+		b.lock.RUnlock()
+		return 0, errBlobClosed
+	}
+	n, err := b.file.WriteAt(buf, offset)
+	if err == nil {
+		err = b.file.Sync()
+	}
+	b.lock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// The chunk is synced, so a record of it that survives a crash is correct even if the journal was not synced.
+	idx := offset / b.blockSize
+	if err := b.record(idx, &chunkSum{crc: crc32.Checksum(buf, crcTable), length: uint32(len(buf))}, false); err != nil {
+		return 0, err
+	}
+	b.verified.Set(idx)
+
+	return n, nil
+}
+
+// record sets the chunk at the index as present with the checksum, or as absent if sum is nil, and persists the
+// change to the journal, synced if sync is true, or by writing the presence. The caller must hold b.lock.
+func (b *sparseBlob) record(idx int64, sum *chunkSum, sync bool) error {
+	prev, wasPresent := b.sums[idx]
+	b.set(idx, sum)
+
+	var err error
+	if b.journaled < 0 || b.journaled >= max(minJournalRecords, b.chunks.Count()) {
+		err = b.compact()
+	} else if _, err = b.journal.Write(journalRecord(idx, sum)); err == nil {
+		b.journaled++
+		if sync {
+			err = b.journal.Sync()
+		}
+	}
+
+	if err != nil {
+		if wasPresent {
+			b.set(idx, &prev)
+		} else {
+			b.set(idx, nil)
+		}
+	}
+	return err
+}
+
+// compact writes the presence and empties the journal. A crash in between replays the journal over the presence that
+// already includes it, which yields the same presence. The caller must hold b.lock.
+func (b *sparseBlob) compact() error {
+	if err := writePresence(b.dir, &b.presence); err != nil {
+		return err
+	}
+	if err := b.journal.Truncate(0); err != nil {
+		return err
+	}
+	b.journaled = 0
+	return nil
+}
+
+// remove marks the chunk at the offset as absent and releases its space.
+// Once no chunks are left, the sparse file is truncated and the presence is removed.
+func (b *sparseBlob) remove(offset int64) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	idx := offset / b.blockSize
+	if b.closed || !b.chunks.Test(idx) {
+		return nil
+	}
+
+	sum := b.sums[idx]
+	b.verified.Clear(idx)
+
+	if b.chunks.Count() == 1 {
+		b.set(idx, nil)
+		b.journaled = -1
+		if err := os.Remove(filepath.Join(b.dir, presenceFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := b.journal.Truncate(0); err != nil {
+			return err
+		}
+		return b.file.Truncate(0)
+	}
+
+	// Forget the chunk durably before releasing its space, so that a crash in between never exposes a hole as data.
+	if err := b.record(idx, nil, true); err != nil {
+		return err
+	}
+	return punchHole(b.file, offset, int64(sum.length))
+}
+
+// openSparseBlob opens the sparse file of the named file in dir, creating it if needed.
+// The presence of a file cached with a different block size is discarded.
+func openSparseBlob(name, dir string, blockSize int64) (*sparseBlob, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, sparseDataFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(filepath.Join(dir, presenceJournalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	b := &sparseBlob{name: name, dir: dir, file: f, journal: journal, presence: presence{blockSize: blockSize, sums: map[int64]chunkSum{}}, journaled: -1}
+	if p, err := readPresence(dir); err == nil && p.blockSize == blockSize {
+		// Fold the journal into the presence, which also drops a record left incomplete by a crash.
+		b.presence = *p
+		err = b.compact()
+	} else if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		err = f.Truncate(0)
+	}
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// close closes the files of the blob. Chunks of a closed blob are absent and cannot be written.
+func (b *sparseBlob) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.closed {
+		b.file.Close()
+		b.journal.Close()
+		b.closed = true
+	}
+}
+
+// sparseChunk is a chunk of a sparse file in the index.
+type sparseChunk struct {
+	blob   *sparseBlob
+	offset int64
+
+	// lock serializes fetches of the chunk.
+	lock sync.Mutex
+
+	// state guards the fields below. It is never held during I/O, so that evicting a chunk never waits for its fetch.
+	state    sync.Mutex
+	fetching bool
+	evicted  bool
+	released bool
+}
+
+// beginFetch records that the chunk is being fetched, and reports whether it is still cached.
+func (ch *sparseChunk) beginFetch() bool {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	ch.fetching = true
+	return !ch.evicted
+}
+
+// endFetch records that the fetch of the chunk is done, and reports whether the chunk was evicted during the fetch, in
+// which case the caller must release it.
+func (ch *sparseChunk) endFetch() bool {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	ch.fetching = false
+	return ch.release()
+}
+
+// evict records that the chunk was evicted, and reports whether the caller must release it. A chunk that is being
+// fetched is released by its fetcher when the fetch is done.
+func (ch *sparseChunk) evict() bool {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	ch.evicted = true
+	return !ch.fetching && ch.release()
+}
+
+// release reports whether an evicted chunk is to be released, at most once. The caller must hold ch.state.
+func (ch *sparseChunk) release() bool {
+	if !ch.evicted || ch.released {
+		return false
+	}
+	ch.released = true
+	return true
+}
+
+// sparseCache implements Cache using the sparse layout.
+type sparseCache struct {
+	sizes
+	index      *index[*sparseChunk]
+	quotas     *quotas
+	policyName string
+	blockSize  int64
+	evicted    chan Chunk
+
+	lock  sync.Mutex
+	blobs map[string]*sparseBlob
+}
+
+var _ Cache = &sparseCache{}
+
+// Exists checks if the chunk exists in the cache.
+func (c *sparseCache) Exists(name string, offset int64) bool {
+	chunk, found := c.lookup(c.getKey(name, offset))
+	return found && chunk.blob.has(offset, c.log)
+}
+
+// GetOrCreate gets the cached value if available, otherwise fetches it.
+func (c *sparseCache) GetOrCreate(name string, alignedOffset int64, count int, fetch func() ([]byte, error)) ([]byte, error) {
+	if alignedOffset%c.blockSize != 0 {
+		return nil, fmt.Errorf("offset %v is not aligned to the block size %v", alignedOffset, c.blockSize)
+	}
+
+	key := c.getKey(name, alignedOffset)
+	chunk, found := c.lookup(key)
+	if !found {
+		var ev []evicted[*sparseChunk]
+		var err error
+		chunk, ev, err = insert(c.index, c.quotas, name, key, c.blockSize, func() (*sparseChunk, error) {
+			blob, err := c.blob(name)
+			if err != nil {
+				return nil, err
+			}
+			return &sparseChunk{blob: blob, offset: alignedOffset}, nil
+		})
+		c.drop(ev)
+		if err == errQuotaExceeded {
+			c.metricsRecorder.RecordCacheMiss(metrics.TierFiles)
+			return fetch()
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if b, ok := chunk.blob.read(alignedOffset, c.log); ok && len(b) == count {
+		c.metricsRecorder.RecordCacheHit(metrics.TierFiles)
+		return b, nil
+	}
+
+	chunk.lock.Lock()
+	defer chunk.lock.Unlock()
+
+	// check again after acquiring lock
+	if b, ok := chunk.blob.read(alignedOffset, c.log); ok && len(b) == count {
+		c.metricsRecorder.RecordCacheHit(metrics.TierFiles)
+		return b, nil
+	}
+
+	cached := chunk.beginFetch()
+	defer func() {
+		if chunk.endFetch() {
+			c.releaseChunk(chunk)
+		}
+	}()
+
+	c.metricsRecorder.RecordCacheMiss(metrics.TierFiles)
+	buffer, err := fetch()
+	if err != nil {
+		c.recordFillFailure(err)
+		return nil, err
+	} else if !cached {
+		// The chunk was evicted before it was fetched, serve it without caching it.
+		return buffer, nil
+	}
+
+	n, err := chunk.blob.write(alignedOffset, buffer)
+	if errors.Is(err, errBlobClosed) {
+		// Every chunk of the blob was evicted while this one was fetched, serve it without caching it.
+		return buffer, nil
+	} else if err != nil {
+		c.recordFillFailure(nil)
+		return nil, err
+	} else if n != count {
+		c.metricsRecorder.RecordCacheFillFailure(metrics.FillFailureSize)
+		return nil, fmt.Errorf("fill did not retrieve expected number of bytes, expected: %v, got: %v", count, n)
+	}
+
+	return buffer, nil
+}
+
+// Contains checks if the chunk is in the cache, without recording an access.
+func (c *sparseCache) Contains(name string, offset int64) bool {
+	return c.index.contains(c.getKey(name, offset))
+}
+
+// Chunks returns the chunks currently in the cache.
+func (c *sparseCache) Chunks() []Chunk {
+	return chunksOf(c.path, c.index.entries())
+}
+
+// Cached returns the number of chunks of the file in the cache.
+func (c *sparseCache) Cached(name string) int {
+	return c.index.count(filepath.Join(c.path, name))
+}
+
+// Evicted returns a channel that receives the chunks evicted from the cache.
+func (c *sparseCache) Evicted() <-chan Chunk {
+	return c.evicted
+}
+
+// SetGroup assigns the named file to a quota group.
+func (c *sparseCache) SetGroup(name, group string) {
+	c.quotas.SetGroup(name, group)
+}
+
+// Usage returns the usage of the quota groups.
+func (c *sparseCache) Usage() []GroupUsage {
+	return c.quotas.Usage()
+}
+
+// load indexes the chunks of the sparse files already present in the cache directory.
+func (c *sparseCache) load() error {
+	dirs, err := os.ReadDir(c.path)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		name := d.Name()
+		c.loadSize(name)
+		c.quotas.loadGroup(name)
+
+		if _, err := os.Stat(filepath.Join(c.path, name, presenceFile)); err != nil {
+			continue
+		}
+
+		blob, err := c.blob(name)
+		if err != nil {
+			return err
+		}
+		err = c.loadChunks(name, blob)
+		c.release(blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadChunks indexes the chunks present in the sparse file of the named file.
+func (c *sparseCache) loadChunks(name string, blob *sparseBlob) error {
+	for _, idx := range blob.chunks.All() {
+		offset := idx * c.blockSize
+		_, ev, err := insert(c.index, c.quotas, name, c.getKey(name, offset), c.blockSize, func() (*sparseChunk, error) {
+			if _, err := c.blob(name); err != nil {
+				return nil, err
+			}
+			return &sparseChunk{blob: blob, offset: offset}, nil
+		})
+		c.drop(ev)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blob gets the sparse file of the named file, opening it if needed, and takes a reference to it that must be released
+// with release. Each chunk in the index holds a reference to its sparse file.
+func (c *sparseCache) blob(name string) (*sparseBlob, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b, ok := c.blobs[name]
+	if !ok {
+		var err error
+		if b, err = openSparseBlob(name, filepath.Join(c.path, name), c.blockSize); err != nil {
+			return nil, err
+		}
+		c.blobs[name] = b
+	}
+	b.refs++
+	return b, nil
+}
+
+// release releases a reference to the sparse file, and closes it once it has none.
+func (c *sparseCache) release(b *sparseBlob) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if b.refs--; b.refs == 0 {
+		delete(c.blobs, b.name)
+		b.close()
+	}
+}
+
+func (c *sparseCache) getKey(name string, offset int64) string {
+	return chunkKey(c.path, name, offset)
+}
+
+// lookup gets the chunk for the key and records the access with the eviction policy.
+// Chunks that the policy no longer considers live are evicted.
+func (c *sparseCache) lookup(key string) (*sparseChunk, bool) {
+	chunk, found, ev := c.index.get(key)
+	c.drop(ev)
+	if found {
+		c.quotas.touch(key)
+	}
+	return chunk, found
+}
+
+// drop releases the space of evicted chunks.
+func (c *sparseCache) drop(ev []evicted[*sparseChunk]) {
+	for _, e := range ev {
+		c.metricsRecorder.RecordCacheEviction(c.policyName, string(e.reason))
+		c.log.Debug().Str("name", e.value.blob.dir).Int64("offset", e.value.offset).Str("reason", string(e.reason)).Msg("cache chunk evict")
+
+		c.quotas.release(e.key)
+		if e.value.evict() {
+			c.releaseChunk(e.value)
+		}
+
+		notifyEvicted(c.evicted, c.path, e.key, c.log)
+	}
+}
+
+// releaseChunk releases the space of an evicted chunk and its reference to its sparse file.
+func (c *sparseCache) releaseChunk(chunk *sparseChunk) {
+	if err := chunk.blob.remove(chunk.offset); err != nil {
+		c.log.Error().Err(err).Str("name", chunk.blob.dir).Int64("offset", chunk.offset).Msg("failed to remove chunk")
+	}
+	c.release(chunk.blob)
+}
@@ -0,0 +1,380 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// useLayout sets the storage layout for the duration of the test.
+func useLayout(t *testing.T, layout string) {
+	prev := StorageLayout
+	StorageLayout = layout
+	t.Cleanup(func() { StorageLayout = prev })
+}
+
+func TestPresenceMarshal(t *testing.T) {
+	p := &presence{blockSize: cacheBlockSize, sums: map[int64]chunkSum{}}
+	for _, idx := range []int64{0, 2, 70} {
+		p.chunks.Set(idx)
+		p.sums[idx] = chunkSum{crc: uint32(idx + 1), length: uint32(cacheBlockSize)}
+	}
+	p.sums[70] = chunkSum{crc: 71, length: 5}
+
+	b, err := p.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := &presence{}
+	if err := got.unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if got.blockSize != p.blockSize || !slices.Equal(got.chunks.All(), p.chunks.All()) || got.sums[70] != p.sums[70] {
+		t.Errorf("expected: %+v, got: %+v", p, got)
+	}
+	if want := 70*cacheBlockSize + 5; got.size() != want {
+		t.Errorf("expected: %v, got: %v", want, got.size())
+	}
+
+	if err := got.unmarshal(b[:len(b)-1]); err == nil {
+		t.Error("expected error for truncated presence")
+	}
+}
+
+func TestPresenceJournal(t *testing.T) {
+	dir := t.TempDir()
+	b, err := openSparseBlob("blob", dir, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	// The first chunk writes the presence, and the following ones are only appended to the journal.
+	chunk := []byte("chunk")
+	for i := int64(0); i < 4; i++ {
+		if _, err := b.write(i*cacheBlockSize, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, err := os.ReadFile(filepath.Join(dir, presenceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &presence{}
+	if err := p.unmarshal(written); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{0}; !slices.Equal(p.chunks.All(), want) {
+		t.Errorf("expected: %v, got: %v", want, p.chunks.All())
+	}
+	if info, err := os.Stat(filepath.Join(dir, presenceJournalFile)); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 3*journalRecordSize {
+		t.Errorf("expected: %v, got: %v", 3*journalRecordSize, info.Size())
+	}
+
+	if err := b.remove(2 * cacheBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record left incomplete by a crash is ignored.
+	if _, err := b.journal.Write(journalRecord(5, &chunkSum{crc: 1, length: 1})[:10]); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int64{0, 1, 3}
+	got, err := readPresence(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.chunks.All(), want) || got.sums[3] != (chunkSum{crc: crc32.Checksum(chunk, crcTable), length: uint32(len(chunk))}) {
+		t.Errorf("expected: %v, got: %+v", want, got)
+	}
+
+	// Reopening the blob folds the journal into the presence.
+	reopened, err := openSparseBlob("blob", dir, cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.close()
+	if !slices.Equal(reopened.chunks.All(), want) {
+		t.Errorf("expected: %v, got: %v", want, reopened.chunks.All())
+	}
+	if info, err := os.Stat(filepath.Join(dir, presenceJournalFile)); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Errorf("expected: %v, got: %v", 0, info.Size())
+	}
+}
+
+func TestSparseCache(t *testing.T) {
+	useLayout(t, LayoutSparse)
+	path := t.TempDir()
+
+	content, err := randomBytesN(int(2*cacheBlockSize + 17))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache(ctxWithMetrics, cacheBlockSize, path)
+	if _, ok := c.(*sparseCache); !ok {
+		t.Fatalf("expected a sparse cache, got %T", c)
+	}
+	d := cacheBlob(t, c, content)
+
+	entries, err := os.ReadDir(filepath.Join(path, d.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{sparseDataFile, metainfoFile, presenceFile, presenceJournalFile}; !slices.Equal(names, want) {
+		t.Errorf("expected: %v, got: %v", want, names)
+	}
+
+	if _, err := c.GetOrCreate(d.String(), 1, 1, nil); err == nil {
+		t.Error("expected error for an unaligned offset")
+	}
+
+	// Corrupt the second chunk in place, as if the disk flipped a bit while the node was down.
+	f, err := os.OpenFile(filepath.Join(path, d.String(), sparseDataFile), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{^content[cacheBlockSize]}, cacheBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	restarted := NewCache(ctxWithMetrics, cacheBlockSize, path)
+	if len(restarted.Chunks()) != 3 {
+		t.Errorf("expected 3 chunks, got %v", restarted.Chunks())
+	}
+	if size, ok := restarted.Size(d.String()); !ok || size != int64(len(content)) {
+		t.Errorf("expected size %v, got %v", len(content), size)
+	}
+
+	got, err := restarted.GetOrCreate(d.String(), 0, int(cacheBlockSize), func() ([]byte, error) {
+		return nil, fmt.Errorf("intact chunk should not be fetched")
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, content[:cacheBlockSize]) {
+		t.Error("unexpected content of intact chunk")
+	}
+
+	if restarted.Exists(d.String(), cacheBlockSize) {
+		t.Error("expected corrupt chunk to be discarded")
+	}
+
+	fetched := false
+	got, err = restarted.GetOrCreate(d.String(), cacheBlockSize, int(cacheBlockSize), func() ([]byte, error) {
+		fetched = true
+		return content[cacheBlockSize : 2*cacheBlockSize], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if !fetched || !bytes.Equal(got, content[cacheBlockSize:2*cacheBlockSize]) {
+		t.Error("expected corrupt chunk to be fetched again")
+	}
+}
+
+func TestSparseCacheEviction(t *testing.T) {
+	useLayout(t, LayoutSparse)
+	prevCost, prevPolicy := FilesCacheMaxCost, EvictionPolicyName
+	defer func() {
+		FilesCacheMaxCost, EvictionPolicyName = prevCost, prevPolicy
+	}()
+
+	FilesCacheMaxCost = 2 * cacheBlockSize
+	EvictionPolicyName = PolicyLRU
+
+	path := t.TempDir()
+	c := NewCache(ctxWithMetrics, cacheBlockSize, path)
+	name := newRandomStringN(10)
+	for i := int64(0); i < 3; i++ {
+		if _, err := c.GetOrCreate(name, i*cacheBlockSize, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c.Exists(name, 0) {
+		t.Error("expected the least recently used chunk to be evicted")
+	}
+
+	p, err := readPresence(filepath.Join(path, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2}; !slices.Equal(p.chunks.All(), want) {
+		t.Errorf("expected persisted chunks %v, got %v", want, p.chunks.All())
+	}
+
+	// Evicting the remaining chunks empties the sparse file.
+	other := newRandomStringN(10)
+	for i := int64(0); i < 2; i++ {
+		if _, err := c.GetOrCreate(other, i*cacheBlockSize, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(path, name, presenceFile)); !os.IsNotExist(err) {
+		t.Errorf("expected presence to be removed, got %v", err)
+	}
+
+	// The sparse file is closed and forgotten once none of its chunks is cached.
+	sc := c.(*sparseCache)
+	if _, ok := sc.blobs[name]; ok {
+		t.Error("expected the sparse file of the evicted blob to be released")
+	}
+	if b := sc.blobs[other]; b == nil || b.refs != 2 {
+		t.Errorf("expected: %v references, got: %+v", 2, b)
+	}
+	if info, err := os.Stat(filepath.Join(path, name, sparseDataFile)); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Errorf("expected empty sparse file, got %v bytes", info.Size())
+	}
+}
+
+func TestSparseCacheEvictionDuringFetch(t *testing.T) {
+	useLayout(t, LayoutSparse)
+	prevCost, prevPolicy := FilesCacheMaxCost, EvictionPolicyName
+	defer func() {
+		FilesCacheMaxCost, EvictionPolicyName = prevCost, prevPolicy
+	}()
+
+	FilesCacheMaxCost = 2 * cacheBlockSize
+	EvictionPolicyName = PolicyLRU
+
+	c := NewCache(ctxWithMetrics, cacheBlockSize, t.TempDir())
+	name := newRandomStringN(10)
+
+	fetching, release := make(chan struct{}), make(chan struct{})
+	fetched := make(chan error)
+	go func() {
+		_, err := c.GetOrCreate(name, 0, 10, func() ([]byte, error) {
+			close(fetching)
+			<-release
+			return []byte(newRandomStringN(10)), nil
+		})
+		fetched <- err
+	}()
+	<-fetching
+
+	// Evicting the chunk does not wait for its fetch.
+	evicted := make(chan error)
+	go func() {
+		other := newRandomStringN(10)
+		for i := int64(0); i < 2; i++ {
+			if _, err := c.GetOrCreate(other, i*cacheBlockSize, 10, func() ([]byte, error) {
+				return []byte(newRandomStringN(10)), nil
+			}); err != nil {
+				evicted <- err
+				return
+			}
+		}
+		evicted <- nil
+	}()
+	select {
+	case err := <-evicted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("eviction waited for the fetch of the evicted chunk")
+	}
+
+	// The fetcher releases the chunk when it is done.
+	close(release)
+	if err := <-fetched; err != nil {
+		t.Fatal(err)
+	}
+	if c.Exists(name, 0) {
+		t.Error("expected the evicted chunk not to be cached")
+	}
+	if _, ok := c.(*sparseCache).blobs[name]; ok {
+		t.Error("expected the sparse file of the evicted chunk to be released")
+	}
+}
+
+func TestExportImportLayouts(t *testing.T) {
+	content, err := randomBytesN(int(cacheBlockSize + 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ from, to string }{
+		{LayoutSparse, LayoutSparse},
+		{LayoutSparse, LayoutChunks},
+		{LayoutChunks, LayoutSparse},
+	} {
+		t.Run(tc.from+"-"+tc.to, func(t *testing.T) {
+			useLayout(t, tc.from)
+			src := t.TempDir()
+			d := cacheBlob(t, NewCache(ctxWithMetrics, cacheBlockSize, src), content)
+
+			var archive bytes.Buffer
+			if err := Export(src, []digest.Digest{d}, &archive); err != nil {
+				t.Fatal(err)
+			}
+
+			StorageLayout = tc.to
+			dst := t.TempDir()
+			if _, err := Import(dst, cacheBlockSize, &archive); err != nil {
+				t.Fatal(err)
+			}
+
+			restored := NewCache(ctxWithMetrics, cacheBlockSize, dst)
+			var got []byte
+			for offset := int64(0); offset < int64(len(content)); offset += cacheBlockSize {
+				b, err := restored.GetOrCreate(d.String(), offset, int(min(cacheBlockSize, int64(len(content))-offset)), func() ([]byte, error) {
+					return nil, fmt.Errorf("imported chunk should not be fetched")
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, b...)
+			}
+			if !bytes.Equal(got, content) {
+				t.Error("imported content does not match")
+			}
+		})
+	}
+}
+
+func TestSparseExportIncomplete(t *testing.T) {
+	useLayout(t, LayoutSparse)
+	src := t.TempDir()
+	c := NewCache(ctxWithMetrics, cacheBlockSize, src)
+
+	content, err := randomBytesN(int(2*cacheBlockSize + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := cacheBlob(t, c, content)
+
+	if err := c.(*sparseCache).blobs[d.String()].remove(cacheBlockSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Export(src, []digest.Digest{d}, &bytes.Buffer{}); err == nil {
+		t.Error("expected error exporting an incomplete blob")
+	}
+}
@@ -8,10 +8,11 @@ import (
 
 const defaultEvictionPercentage int = 5 // The default eviction percentage. Used when the map reaches its capacity at insertion.
 
-// SyncMap is a map that can be safely accessed concurrently.
+// SyncMap is a map that can be safely accessed concurrently, and evicts its least recently used entries when full.
 type SyncMap struct {
 	mapObj             *map[string]interface{}
-	lock               *sync.RWMutex
+	recent             *keyList
+	lock               *sync.Mutex
 	capacity           int
 	evictionPercentage int
 }
@@ -19,35 +20,39 @@ type SyncMap struct {
 // Get retrieves the value associated with the given key from the SyncMap.
 // It returns the value and a boolean indicating whether the key was found.
 func (sm *SyncMap) Get(key string) (entry interface{}, ok bool) {
-	sm.lock.RLock()
-	defer sm.lock.RUnlock()
-	entry, ok = (*sm.mapObj)[key]
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if entry, ok = (*sm.mapObj)[key]; ok {
+		sm.recent.moveToFront(key)
+	}
 	return
 }
 
 // Set sets a new entry or updates an existing one.
 // Set adds or updates an entry in the SyncMap with the specified key.
 // If the key already exists in the map, the entry will be updated.
-// If the key does not exist and the map is at capacity, some entries will be evicted first.
+// If the key does not exist and the map is at capacity, the least recently used entries will be evicted first.
 func (sm *SyncMap) Set(key string, entry interface{}) {
 	sm.lock.Lock()
 	defer sm.lock.Unlock()
 
-	if _, ok := (*sm.mapObj)[key]; !ok {
+	if _, ok := (*sm.mapObj)[key]; ok {
+		sm.recent.moveToFront(key)
+	} else {
 		if numEntries := len(*sm.mapObj); numEntries >= sm.capacity {
 			numToEvict := numEntries * sm.evictionPercentage / 100
 			if numToEvict <= 1 {
 				numToEvict = 1
 			}
-			numEvicted := 0
-			for k := range *sm.mapObj {
-				delete(*sm.mapObj, k)
-				numEvicted++
-				if numEvicted >= numToEvict {
+			for i := 0; i < numToEvict; i++ {
+				evicted, ok := sm.recent.removeBack()
+				if !ok {
 					break
 				}
+				delete(*sm.mapObj, evicted.key)
 			}
 		}
+		sm.recent.pushFront(&listEntry{key: key})
 	}
 
 	(*sm.mapObj)[key] = entry
@@ -59,6 +64,7 @@ func (sm *SyncMap) Delete(key string) {
 	sm.lock.Lock()
 	defer sm.lock.Unlock()
 	delete(*sm.mapObj, key)
+	sm.recent.remove(key)
 }
 
 // NewSyncMap creates a new SyncMap with the specified maximum number of entries.
@@ -68,7 +74,8 @@ func NewSyncMap(maxEntries int) *SyncMap {
 		maxEntries = 1
 	}
 	return &SyncMap{mapObj: &map[string]interface{}{},
-		lock:               &sync.RWMutex{},
+		recent:             newKeyList(),
+		lock:               &sync.Mutex{},
 		capacity:           maxEntries,
 		evictionPercentage: defaultEvictionPercentage}
 }
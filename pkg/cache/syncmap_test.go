@@ -40,6 +40,35 @@ func TestSyncMapAddEvict(t *testing.T) {
 	}
 }
 
+func TestSyncMapEvictsLeastRecentlyUsed(t *testing.T) {
+	sm := NewSyncMap(3)
+	sm.Set("a", 1)
+	sm.Set("b", 2)
+	sm.Set("c", 3)
+	sm.Get("a")
+
+	sm.Set("d", 4)
+	if _, ok := sm.Get("b"); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := sm.Get(key); !ok {
+			t.Errorf("expected %v to exist", key)
+		}
+	}
+
+	// Deleted entries are no longer candidates for eviction.
+	sm.Delete("c")
+	sm.Set("e", 5)
+	sm.Set("f", 6)
+	if _, ok := sm.Get("a"); ok {
+		t.Error("expected a to be evicted")
+	}
+	if mapLen := len(*sm.mapObj); mapLen != 3 || sm.recent.len() != 3 {
+		t.Errorf("expected: %v, got: %v and %v", 3, mapLen, sm.recent.len())
+	}
+}
+
 func TestSyncMapAddDelete(t *testing.T) {
 	sm := NewSyncMap(10)
 	var wg sync.WaitGroup
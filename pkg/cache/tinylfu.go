@@ -0,0 +1,159 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import "hash/maphash"
+
+const (
+	// tinyLFUCounters is the number of counters in each row of the frequency sketch of the TinyLFU policy. Each shard of
+	// the index has its own sketch, so it is kept small.
+	tinyLFUCounters = 1 << 12
+
+	// tinyLFUDepth is the number of rows of the frequency sketch, each indexed by a different hash of the key.
+	tinyLFUDepth = 4
+
+	// tinyLFUSamples is the number of entries sampled to find the one to evict, as in ristretto.
+	tinyLFUSamples = 5
+
+	// tinyLFUMaxCount is the largest value of a counter of the frequency sketch.
+	tinyLFUMaxCount = 15
+)
+
+// frequencySketch is a count-min sketch that estimates how often keys were accessed recently. Its counters are halved
+// after every tinyLFUCounters increments, so that the estimates follow changes in popularity.
+type frequencySketch struct {
+	seed       maphash.Seed
+	rows       [tinyLFUDepth][]uint8
+	increments int
+}
+
+// newFrequencySketch creates an empty frequency sketch.
+func newFrequencySketch() *frequencySketch {
+	s := &frequencySketch{seed: maphash.MakeSeed()}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, tinyLFUCounters)
+	}
+	return s
+}
+
+// indexes returns the counter of the key in each row.
+func (s *frequencySketch) indexes(key string) [tinyLFUDepth]uint32 {
+	h := maphash.String(s.seed, key)
+	lo, hi := uint32(h), uint32(h>>32)
+
+	var idx [tinyLFUDepth]uint32
+	for i := range idx {
+		idx[i] = (lo + uint32(i)*hi) % tinyLFUCounters
+	}
+	return idx
+}
+
+// increment records an access of the key.
+func (s *frequencySketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < tinyLFUMaxCount {
+			s.rows[i][j]++
+		}
+	}
+
+	s.increments++
+	if s.increments >= tinyLFUCounters {
+		s.reset()
+	}
+}
+
+// estimate returns the estimated number of recent accesses of the key.
+func (s *frequencySketch) estimate(key string) uint8 {
+	est := uint8(tinyLFUMaxCount)
+	for i, j := range s.indexes(key) {
+		est = min(est, s.rows[i][j])
+	}
+	return est
+}
+
+// reset halves every counter.
+func (s *frequencySketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.increments = 0
+}
+
+// tinyLFUPolicy evicts the entry estimated to be the least frequently used recently among a few sampled entries, as
+// ristretto does. Frequencies are estimated by a count-min sketch of accesses that outlives the entries, so that an entry
+// that is admitted again shortly after it was evicted is kept longer.
+// Unlike ristretto, a new entry is always admitted, since its content has already been fetched for a reader.
+type tinyLFUPolicy struct {
+	capacity int64
+	size     int64
+	costs    map[string]int64
+	sketch   *frequencySketch
+}
+
+var _ EvictionPolicy = &tinyLFUPolicy{}
+
+// Name returns the name of the policy.
+func (p *tinyLFUPolicy) Name() string {
+	return PolicyTinyLFU
+}
+
+// Admit records a new entry and evicts sampled entries of the lowest estimated frequency until it fits.
+func (p *tinyLFUPolicy) Admit(key string, cost int64) []Eviction {
+	p.Remove(key)
+	p.sketch.increment(key)
+
+	var evicted []Eviction
+	for p.size+cost > p.capacity && len(p.costs) > 0 {
+		victim := p.victim()
+		p.Remove(victim)
+		evicted = append(evicted, Eviction{Key: victim, Reason: EvictionReasonCapacity})
+	}
+
+	p.costs[key] = cost
+	p.size += cost
+	return evicted
+}
+
+// victim returns the entry of the lowest estimated frequency among tinyLFUSamples entries. The iteration order of the
+// map samples them.
+func (p *tinyLFUPolicy) victim() string {
+	var victim string
+	var lowest uint8
+	sampled := 0
+	for key := range p.costs {
+		if est := p.sketch.estimate(key); sampled == 0 || est < lowest {
+			victim, lowest = key, est
+		}
+		if sampled++; sampled == tinyLFUSamples {
+			break
+		}
+	}
+	return victim
+}
+
+// Touch records an access of the key, and reports whether it is cached.
+func (p *tinyLFUPolicy) Touch(key string) bool {
+	p.sketch.increment(key)
+	_, ok := p.costs[key]
+	return ok
+}
+
+// Remove forgets the entry.
+func (p *tinyLFUPolicy) Remove(key string) {
+	if cost, ok := p.costs[key]; ok {
+		delete(p.costs, key)
+		p.size -= cost
+	}
+}
+
+// Len returns the number of live entries.
+func (p *tinyLFUPolicy) Len() int {
+	return len(p.costs)
+}
+
+// newTinyLFUPolicy creates a TinyLFU eviction policy.
+func newTinyLFUPolicy(capacity int64) *tinyLFUPolicy {
+	return &tinyLFUPolicy{capacity: capacity, costs: map[string]int64{}, sketch: newFrequencySketch()}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package cache
+
+import "time"
+
+// ttlPolicy expires entries a fixed duration after they are admitted.
+// When the cache is full, the oldest entries are evicted first.
+type ttlPolicy struct {
+	capacity int64
+	ttl      time.Duration
+	now      func() time.Time
+	entries  *keyList
+}
+
+var _ EvictionPolicy = &ttlPolicy{}
+
+// Name returns the name of the policy.
+func (p *ttlPolicy) Name() string {
+	return PolicyTTL
+}
+
+// Admit records a new entry, evicting expired entries and then the oldest entries until it fits.
+func (p *ttlPolicy) Admit(key string, cost int64) []Eviction {
+	p.entries.remove(key)
+
+	now := p.now().UnixNano()
+	var evicted []Eviction
+	for {
+		entry, ok := p.entries.back()
+		if !ok || entry.expires > now {
+			break
+		}
+		p.entries.remove(entry.key)
+		evicted = append(evicted, Eviction{Key: entry.key, Reason: EvictionReasonExpired})
+	}
+
+	for p.entries.size+cost > p.capacity {
+		entry, ok := p.entries.removeBack()
+		if !ok {
+			break
+		}
+		evicted = append(evicted, Eviction{Key: entry.key, Reason: EvictionReasonCapacity})
+	}
+
+	p.entries.pushFront(&listEntry{key: key, cost: cost, expires: now + p.ttl.Nanoseconds()})
+	return evicted
+}
+
+// Touch reports whether the entry has not yet expired.
+// Accesses do not extend the lifetime of an entry.
+func (p *ttlPolicy) Touch(key string) bool {
+	entry, ok := p.entries.get(key)
+	return ok && entry.expires > p.now().UnixNano()
+}
+
+// Remove forgets the entry.
+func (p *ttlPolicy) Remove(key string) {
+	p.entries.remove(key)
+}
+
+// Len returns the number of entries, including expired entries that have not been evicted yet.
+func (p *ttlPolicy) Len() int {
+	return p.entries.len()
+}
+
+// newTTLPolicy creates a time to live eviction policy.
+func newTTLPolicy(capacity int64, ttl time.Duration, now func() time.Time) *ttlPolicy {
+	return &ttlPolicy{capacity: capacity, ttl: ttl, now: now, entries: newKeyList()}
+}
@@ -5,8 +5,10 @@ package context
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -35,7 +37,15 @@ const (
 
 // Request headers.
 const (
-	P2PHeaderKey         = "X-MS-Peerd-RequestFromPeer"
+	// HopsHeaderKey is the number of peers a request was forwarded through, absent for requests from clients.
+	HopsHeaderKey = "X-MS-Peerd-Hops"
+	// P2PHeaderKey marks requests from peers that predate the hop count. It is read as one hop when the hop count is
+	// absent, and still sent alongside it so that those peers treat the requests as from a peer.
+	//
+	// Deprecated: use HopsHeaderKey. It will be removed in the next release.
+	P2PHeaderKey = "X-MS-Peerd-RequestFromPeer"
+	// ViaHeaderKey lists the nodes a request was forwarded through, comma separated, to detect loops.
+	ViaHeaderKey         = "X-MS-Peerd-Via"
 	CorrelationHeaderKey = "X-MS-Peerd-CorrelationId"
 	NodeHeaderKey        = "X-MS-Peerd-Node"
 )
@@ -51,8 +61,16 @@ const (
 
 var (
 	NodeName, _ = os.Hostname()
+
+	// MaxHops is the maximum number of peers a request is forwarded through. A node forwards a request from a peer to
+	// other peers only while it has passed through fewer, so with 1 a node serves peers from its cache alone, and nodes
+	// with more pull content through from other peers on behalf of the requester. With 0, no request is sent to peers.
+	MaxHops = 1
 )
 
+// unboundedHops is the number of hops of a request with a malformed hop count, so that it is not forwarded.
+const unboundedHops = math.MaxInt32
+
 // Context is the request context that can be passed around to various components to provide request specific information.
 type Context struct {
 	*gin.Context
@@ -71,7 +89,40 @@ func (c Context) Copy() Context {
 
 // IsRequestFromAPeer indicates if the current request is from a peer.
 func IsRequestFromAPeer(c Context) bool {
-	return c.Request.Header.Get(P2PHeaderKey) == "true"
+	return Hops(c) > 0
+}
+
+// Hops returns the number of peers the current request was forwarded through, 0 for a request from a client. A request
+// with only the legacy P2PHeaderKey counts as forwarded through one peer.
+func Hops(c Context) int {
+	v := c.Request.Header.Get(HopsHeaderKey)
+	if v == "" {
+		if c.Request.Header.Get(P2PHeaderKey) == "true" {
+			return 1
+		}
+		return 0
+	}
+
+	hops, err := strconv.Atoi(v)
+	if err != nil || hops < 0 {
+		return unboundedHops
+	}
+	return min(hops, unboundedHops)
+}
+
+// via returns the nodes the current request was forwarded through.
+func via(c Context) []string {
+	v := c.Request.Header.Get(ViaHeaderKey)
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// CanForward indicates if the current request may be forwarded to a peer: it was forwarded through fewer than MaxHops
+// peers, and not through this node before.
+func CanForward(c Context) bool {
+	return Hops(c) < MaxHops && !slices.Contains(via(c), NodeName)
 }
 
 // FillCorrelationId fills the correlation ID in the context.
@@ -85,7 +136,9 @@ func FillCorrelationId(c Context) {
 
 // SetOutboundHeaders sets the mandatory headers for all outbound requests.
 func SetOutboundHeaders(r *http.Request, c Context) {
+	r.Header.Set(HopsHeaderKey, strconv.Itoa(Hops(c)+1))
 	r.Header.Set(P2PHeaderKey, "true")
+	r.Header.Set(ViaHeaderKey, strings.Join(append(via(c), NodeName), ","))
 	r.Header.Set(CorrelationHeaderKey, c.GetString(CorrelationIdCtxKey))
 	r.Header.Set(NodeHeaderKey, NodeName)
 }
@@ -102,7 +155,7 @@ func Logger(c Context) zerolog.Logger {
 		l = *ctxLog
 	}
 
-	return l.With().Str("correlationid", c.GetString(CorrelationIdCtxKey)).Str("url", c.Request.URL.String()).Str("range", c.Request.Header.Get("Range")).Bool("requestfrompeer", IsRequestFromAPeer(c)).Str("clientip", c.ClientIP()).Str("clientname", c.Request.Header.Get(NodeHeaderKey)).Logger()
+	return l.With().Str("correlationid", c.GetString(CorrelationIdCtxKey)).Str("url", c.Request.URL.String()).Str("range", c.Request.Header.Get("Range")).Bool("requestfrompeer", IsRequestFromAPeer(c)).Int("hops", Hops(c)).Str("clientip", c.ClientIP()).Str("clientname", c.Request.Header.Get(NodeHeaderKey)).Logger()
 }
 
 // BlobUrl extracts the blob URL from the incoming request URL.
@@ -60,10 +60,35 @@ func TestSetOutboundHeaders(t *testing.T) {
 
 	SetOutboundHeaders(req, pc)
 
+	if req.Header.Get(HopsHeaderKey) != "1" {
+		t.Errorf("expected: %v, got: %v", "1", req.Header.Get(HopsHeaderKey))
+	}
+
 	if req.Header.Get(P2PHeaderKey) != "true" {
 		t.Errorf("expected: %v, got: %v", "true", req.Header.Get(P2PHeaderKey))
 	}
 
+	if req.Header.Get(ViaHeaderKey) != NodeName {
+		t.Errorf("expected: %v, got: %v", NodeName, req.Header.Get(ViaHeaderKey))
+	}
+
+	// A forwarded request counts another hop and adds this node to those it passed through.
+	ctx.Request.Header.Set(HopsHeaderKey, "1")
+	ctx.Request.Header.Set(ViaHeaderKey, "node-a")
+	out, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetOutboundHeaders(out, pc)
+
+	if out.Header.Get(HopsHeaderKey) != "2" {
+		t.Errorf("expected: %v, got: %v", "2", out.Header.Get(HopsHeaderKey))
+	}
+
+	if expected := "node-a," + NodeName; out.Header.Get(ViaHeaderKey) != expected {
+		t.Errorf("expected: %v, got: %v", expected, out.Header.Get(ViaHeaderKey))
+	}
+
 	if req.Header.Get(CorrelationHeaderKey) == "" {
 		t.Errorf("expected: %v, got: %v", "not empty", req.Header.Get(CorrelationHeaderKey))
 	}
@@ -147,12 +172,72 @@ func TestIsRequestFromPeer(t *testing.T) {
 		t.Fatal("expected request to not be from a peer")
 	}
 
-	ctx.Request.Header.Set(P2PHeaderKey, "true")
+	ctx.Request.Header.Set(HopsHeaderKey, "1")
 	if !IsRequestFromAPeer(pc) {
 		t.Fatal("expected request to be from a peer")
 	}
 }
 
+func TestHops(t *testing.T) {
+	for _, tc := range []struct {
+		hops     string
+		legacy   string
+		expected int
+	}{
+		{hops: "", expected: 0},
+		{hops: "2", expected: 2},
+		{hops: "-1", expected: unboundedHops},
+		{hops: "true", expected: unboundedHops},
+		{hops: "", legacy: "true", expected: 1},
+		{hops: "", legacy: "false", expected: 0},
+		{hops: "2", legacy: "true", expected: 2},
+	} {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("GET", "http://127.0.0.1:5000/blobs/fdsfsdsd", nil)
+		ctx.Request.Header.Set(HopsHeaderKey, tc.hops)
+		ctx.Request.Header.Set(P2PHeaderKey, tc.legacy)
+
+		if got := Hops(FromContext(ctx)); got != tc.expected {
+			t.Errorf("%v/%v: expected: %v, got: %v", tc.hops, tc.legacy, tc.expected, got)
+		}
+	}
+}
+
+func TestCanForward(t *testing.T) {
+	defer func(m int) { MaxHops = m }(MaxHops)
+	MaxHops = 2
+
+	for _, tc := range []struct {
+		name     string
+		hops     string
+		via      string
+		expected bool
+	}{
+		{name: "client", expected: true},
+		{name: "peer", hops: "1", via: "node-a", expected: true},
+		{name: "max hops", hops: "2", via: "node-a,node-b", expected: false},
+		{name: "loop", hops: "1", via: NodeName, expected: false},
+		{name: "malformed", hops: "x", via: "node-a", expected: false},
+	} {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("GET", "http://127.0.0.1:5000/blobs/fdsfsdsd", nil)
+		ctx.Request.Header.Set(HopsHeaderKey, tc.hops)
+		ctx.Request.Header.Set(ViaHeaderKey, tc.via)
+
+		if got := CanForward(FromContext(ctx)); got != tc.expected {
+			t.Errorf("%v: expected: %v, got: %v", tc.name, tc.expected, got)
+		}
+	}
+
+	// With no hops, not even requests from clients are sent to peers.
+	MaxHops = 0
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest("GET", "http://127.0.0.1:5000/blobs/fdsfsdsd", nil)
+	if CanForward(FromContext(ctx)) {
+		t.Errorf("expected: %v, got: %v", false, true)
+	}
+}
+
 func TestRangeStartIndex(t *testing.T) {
 	for _, tc := range []struct {
 		name          string
@@ -0,0 +1,195 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Package bootstrap finds the peers through which a node joins the p2p network.
+// Sources of peers can be used individually or combined: the leader of a Kubernetes lease, static addresses, the DNS
+// records of a headless service, the endpoint slices of a Kubernetes service, and mDNS for local development.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/azure/peerd/pkg/k8s"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// KindLeader is the kind of source of the leader of the Kubernetes lease.
+	KindLeader = "leader"
+
+	// KindStatic is the kind of source of static addresses.
+	KindStatic = "static"
+
+	// KindDNS is the kind of source of the A and AAAA records of a name.
+	KindDNS = "dns"
+
+	// KindSRV is the kind of source of the SRV records of a name.
+	KindSRV = "srv"
+
+	// KindEndpointSlices is the kind of source of the endpoint slices of a Kubernetes service.
+	KindEndpointSlices = "endpointslices"
+
+	// KindMDNS is the kind of source of the peers announced with mDNS.
+	KindMDNS = "mdns"
+)
+
+// Source finds the addresses of peers to bootstrap from.
+type Source interface {
+	// Addrs returns the addresses of peers.
+	// An address without a /p2p component has no known peer ID, and the peer is identified when it is dialed.
+	Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error)
+
+	// String describes the source.
+	String() string
+}
+
+// Env is the node that sources find peers for.
+type Env struct {
+	// Host is the libp2p host of the node.
+	Host host.Host
+
+	// ClientSet is the Kubernetes client of the node.
+	ClientSet *k8s.ClientSet
+
+	// Port is the port the routers of peers listen on, used for addresses found without one.
+	Port string
+}
+
+// New creates the sources of the specifications and combines them.
+// A specification is a kind of source, with an argument after '=' for some kinds:
+//   - leader: the leader of the Kubernetes lease.
+//   - static=<multiaddr>[,<multiaddr>...]: the given addresses.
+//   - dns=<name>: the A and AAAA records of the name, such as a headless service, at Env.Port.
+//   - srv=<name>: the SRV records of the name.
+//   - endpointslices=<service>: the ready endpoints of the Kubernetes service in the namespace of Env.ClientSet, at
+//     Env.Port.
+//   - mdns: the peers announced with mDNS on the local network.
+func New(ctx context.Context, specs []string, env Env) (Source, error) {
+	var sources []Source
+	for _, spec := range specs {
+		s, err := newSource(ctx, spec, env)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("no bootstrap source configured")
+	} else if len(sources) == 1 {
+		return sources[0], nil
+	}
+	return Combine(sources...), nil
+}
+
+// newSource creates the source of a specification.
+func newSource(ctx context.Context, spec string, env Env) (Source, error) {
+	kind, arg, _ := strings.Cut(spec, "=")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	arg = strings.TrimSpace(arg)
+
+	needsArg := kind == KindStatic || kind == KindDNS || kind == KindSRV || kind == KindEndpointSlices
+	if needsArg && arg == "" {
+		return nil, fmt.Errorf("bootstrap source %v requires an argument: %v=<value>", kind, kind)
+	} else if !needsArg && arg != "" {
+		return nil, fmt.Errorf("bootstrap source %v takes no argument", kind)
+	}
+
+	switch kind {
+	case KindLeader:
+		if env.ClientSet == nil || env.Host == nil {
+			return nil, fmt.Errorf("bootstrap source %v requires a kubernetes client and a host", kind)
+		}
+		return Leader(ctx, env.ClientSet, env.Host)
+
+	case KindStatic:
+		var addrs []multiaddr.Multiaddr
+		for _, s := range strings.Split(arg, ",") {
+			addr, err := multiaddr.NewMultiaddr(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid static bootstrap address %q: %w", s, err)
+			}
+			addrs = append(addrs, addr)
+		}
+		return Static(addrs...), nil
+
+	case KindDNS:
+		if env.Port == "" {
+			return nil, fmt.Errorf("bootstrap source %v requires a port", kind)
+		}
+		return DNS(arg, env.Port), nil
+
+	case KindSRV:
+		return SRV(arg), nil
+
+	case KindEndpointSlices:
+		if env.ClientSet == nil || env.Port == "" {
+			return nil, fmt.Errorf("bootstrap source %v requires a kubernetes client and a port", kind)
+		}
+		return EndpointSlices(ctx, env.ClientSet.Interface, env.ClientSet.Namespace, arg, env.Port), nil
+
+	case KindMDNS:
+		if env.Host == nil {
+			return nil, fmt.Errorf("bootstrap source %v requires a host", kind)
+		}
+		return MDNS(ctx, env.Host)
+
+	default:
+		return nil, fmt.Errorf("unknown bootstrap source: %v", kind)
+	}
+}
+
+// combined is a source that returns the addresses of several sources.
+type combined []Source
+
+var _ Source = combined{}
+
+// Combine returns a source of the addresses of all the sources, without duplicates.
+// A source that fails does not prevent the addresses of the others from being returned; an error is only returned if
+// every source fails.
+func Combine(sources ...Source) Source {
+	return combined(sources)
+}
+
+// Addrs implements Source.
+func (c combined) Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	log := zerolog.Ctx(ctx)
+
+	var addrs []multiaddr.Multiaddr
+	var errs []error
+	seen := map[string]bool{}
+	for _, s := range c {
+		found, err := s.Addrs(ctx)
+		if err != nil {
+			log.Warn().Err(err).Str("source", s.String()).Msg("bootstrap source failed")
+			errs = append(errs, fmt.Errorf("%v: %w", s, err))
+			continue
+		}
+
+		for _, addr := range found {
+			if !seen[addr.String()] {
+				seen[addr.String()] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if len(errs) == len(c) {
+		return nil, errors.Join(errs...)
+	}
+	return addrs, nil
+}
+
+// String implements Source.
+func (c combined) String() string {
+	names := make([]string, 0, len(c))
+	for _, s := range c {
+		names = append(names, s.String())
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestNew(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name        string
+		specs       []string
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:     "static",
+			specs:    []string{"static=/ip4/10.0.0.1/tcp/5003,/ip4/10.0.0.2/tcp/5003"},
+			expected: "static=[/ip4/10.0.0.1/tcp/5003 /ip4/10.0.0.2/tcp/5003]",
+		},
+		{
+			name:     "combined",
+			specs:    []string{"dns=peerd.peerd-ns.svc.cluster.local", "srv=_router._tcp.peerd.peerd-ns.svc.cluster.local"},
+			expected: "dns=peerd.peerd-ns.svc.cluster.local,srv=_router._tcp.peerd.peerd-ns.svc.cluster.local",
+		},
+		{
+			name:        "none",
+			expectedErr: true,
+		},
+		{
+			name:        "unknown kind",
+			specs:       []string{"consul=peerd"},
+			expectedErr: true,
+		},
+		{
+			name:        "missing argument",
+			specs:       []string{"dns"},
+			expectedErr: true,
+		},
+		{
+			name:        "unexpected argument",
+			specs:       []string{"mdns=peerd"},
+			expectedErr: true,
+		},
+		{
+			name:        "invalid static address",
+			specs:       []string{"static=10.0.0.1:5003"},
+			expectedErr: true,
+		},
+		{
+			name:        "leader without kubernetes",
+			specs:       []string{"leader"},
+			expectedErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := New(ctx, tc.specs, Env{Port: "5003"})
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected error, got source %v", s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.String() != tc.expected {
+				t.Errorf("expected: %v, got: %v", tc.expected, s.String())
+			}
+		})
+	}
+}
+
+func TestCombine(t *testing.T) {
+	a := multiaddr.StringCast("/ip4/10.0.0.1/tcp/5003")
+	b := multiaddr.StringCast("/ip4/10.0.0.2/tcp/5003")
+	failing := testSource{err: errors.New("unavailable")}
+
+	got, err := Combine(Static(a, b), failing, Static(b)).Addrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(got, []multiaddr.Multiaddr{a, b}, multiaddr.Multiaddr.Equal) {
+		t.Errorf("expected: %v, got: %v", []multiaddr.Multiaddr{a, b}, got)
+	}
+
+	if _, err := Combine(failing, failing).Addrs(context.Background()); err == nil {
+		t.Error("expected error when every source fails")
+	}
+}
+
+type testSource struct {
+	addrs []multiaddr.Multiaddr
+	err   error
+}
+
+// Addrs implements Source.
+func (s testSource) Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	return s.addrs, s.err
+}
+
+// String implements Source.
+func (s testSource) String() string {
+	return "test"
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// resolver looks up DNS records, such as net.DefaultResolver.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// dnsSource is a source of the peers at the DNS records of a name.
+type dnsSource struct {
+	// name is the name to look up.
+	name string
+
+	// port is the port of the peers at the A and AAAA records of the name, or empty to look up SRV records.
+	port string
+
+	resolver resolver
+}
+
+var _ Source = &dnsSource{}
+
+// DNS returns a source of the peers at the A and AAAA records of the name, such as a headless service, listening on
+// the port.
+func DNS(name, port string) Source {
+	return &dnsSource{name: name, port: port, resolver: net.DefaultResolver}
+}
+
+// SRV returns a source of the peers at the targets and ports of the SRV records of the name.
+func SRV(name string) Source {
+	return &dnsSource{name: name, resolver: net.DefaultResolver}
+}
+
+// Addrs implements Source.
+func (d *dnsSource) Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	if d.port != "" {
+		port, err := strconv.Atoi(d.port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %w", err)
+		}
+		return d.lookup(ctx, d.name, port)
+	}
+
+	_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []multiaddr.Multiaddr
+	var errs []error
+	for _, srv := range srvs {
+		found, err := d.lookup(ctx, srv.Target, int(srv.Port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addrs = append(addrs, found...)
+	}
+
+	if len(addrs) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return addrs, nil
+}
+
+// lookup returns the addresses of the A and AAAA records of the host, at the port.
+func (d *dnsSource) lookup(ctx context.Context, host string, port int) ([]multiaddr.Multiaddr, error) {
+	ips, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []multiaddr.Multiaddr
+	for _, ip := range ips {
+		addr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip.IP, Port: port})
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// String implements Source.
+func (d *dnsSource) String() string {
+	if d.port == "" {
+		return fmt.Sprintf("%v=%v", KindSRV, d.name)
+	}
+	return fmt.Sprintf("%v=%v", KindDNS, d.name)
+}
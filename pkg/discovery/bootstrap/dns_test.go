@@ -0,0 +1,82 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestDNS(t *testing.T) {
+	r := testResolver{
+		ips: map[string][]net.IPAddr{
+			"peerd.peerd-ns.svc.cluster.local": {{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fd00::1")}},
+		},
+	}
+	d := &dnsSource{name: "peerd.peerd-ns.svc.cluster.local", port: "5003", resolver: r}
+
+	got, err := d.Addrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"/ip4/10.0.0.1/tcp/5003", "/ip6/fd00::1/tcp/5003"}
+	if s := addrStrings(got); !slices.Equal(s, expected) {
+		t.Errorf("expected: %v, got: %v", expected, s)
+	}
+
+	if _, err := (&dnsSource{name: "unknown", port: "5003", resolver: r}).Addrs(context.Background()); err == nil {
+		t.Error("expected error for unknown name")
+	}
+}
+
+func TestSRV(t *testing.T) {
+	r := testResolver{
+		ips: map[string][]net.IPAddr{
+			"peerd-0.peerd.peerd-ns.svc.cluster.local.": {{IP: net.ParseIP("10.0.0.1")}},
+			"peerd-1.peerd.peerd-ns.svc.cluster.local.": {{IP: net.ParseIP("10.0.0.2")}},
+		},
+		srvs: map[string][]*net.SRV{
+			"_router._tcp.peerd.peerd-ns.svc.cluster.local": {
+				{Target: "peerd-0.peerd.peerd-ns.svc.cluster.local.", Port: 5003},
+				{Target: "peerd-1.peerd.peerd-ns.svc.cluster.local.", Port: 5013},
+				{Target: "gone.peerd.peerd-ns.svc.cluster.local.", Port: 5003},
+			},
+		},
+	}
+	d := &dnsSource{name: "_router._tcp.peerd.peerd-ns.svc.cluster.local", resolver: r}
+
+	got, err := d.Addrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"/ip4/10.0.0.1/tcp/5003", "/ip4/10.0.0.2/tcp/5013"}
+	if s := addrStrings(got); !slices.Equal(s, expected) {
+		t.Errorf("expected: %v, got: %v", expected, s)
+	}
+}
+
+type testResolver struct {
+	ips  map[string][]net.IPAddr
+	srvs map[string][]*net.SRV
+}
+
+// LookupIPAddr implements resolver.
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+// LookupSRV implements resolver.
+func (r testResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if srvs, ok := r.srvs[name]; ok {
+		return name, srvs, nil
+	}
+	return "", nil, errors.New("no such host")
+}
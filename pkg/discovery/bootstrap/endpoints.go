@@ -0,0 +1,96 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// endpointSlices is a source of the ready endpoints of a Kubernetes service, kept up to date by a watch.
+type endpointSlices struct {
+	service string
+	port    string
+	lister  listersv1.EndpointSliceNamespaceLister
+	synced  cache.InformerSynced
+}
+
+var _ Source = &endpointSlices{}
+
+// EndpointSlices returns a source of the ready endpoints of the service in the namespace, listening on the port.
+// The endpoint slices of the service are watched until ctx is done.
+func EndpointSlices(ctx context.Context, cs kubernetes.Interface, namespace, service, port string) Source {
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = labels.Set{discoveryv1.LabelServiceName: service}.String()
+		}),
+	)
+	informer := factory.Discovery().V1().EndpointSlices()
+
+	e := &endpointSlices{
+		service: service,
+		port:    port,
+		lister:  informer.Lister().EndpointSlices(namespace),
+		synced:  informer.Informer().HasSynced,
+	}
+	factory.Start(ctx.Done())
+
+	return e
+}
+
+// Addrs implements Source.
+func (e *endpointSlices) Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	if !cache.WaitForCacheSync(ctx.Done(), e.synced) {
+		return nil, errors.New("endpoint slices not synced")
+	}
+
+	port, err := strconv.Atoi(e.port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+
+	slices, err := e.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []multiaddr.Multiaddr
+	for _, slice := range slices {
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, a := range ep.Addresses {
+				ip := net.ParseIP(a)
+				if ip == nil {
+					continue
+				}
+				addr, err := manet.FromNetAddr(&net.TCPAddr{IP: ip, Port: port})
+				if err != nil {
+					return nil, err
+				}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// String implements Source.
+func (e *endpointSlices) String() string {
+	return fmt.Sprintf("%v=%v", KindEndpointSlices, e.service)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEndpointSlices(t *testing.T) {
+	ready, notReady := true, false
+	cs := fake.NewSimpleClientset(
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "peerd-abc",
+				Namespace: "peerd-ns",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "peerd"},
+			},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+				{Addresses: []string{"10.0.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+				{Addresses: []string{"10.0.0.3"}},
+			},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "other-abc",
+				Namespace: "peerd-ns",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "other"},
+			},
+			Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.4"}}},
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got, err := EndpointSlices(ctx, cs, "peerd-ns", "peerd", "5003").Addrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"/ip4/10.0.0.1/tcp/5003", "/ip4/10.0.0.3/tcp/5003"}
+	s := addrStrings(got)
+	slices.Sort(s)
+	if !slices.Equal(s, expected) {
+		t.Errorf("expected: %v, got: %v", expected, s)
+	}
+}
+
+// addrStrings returns the string representations of the addresses.
+func addrStrings(addrs []multiaddr.Multiaddr) []string {
+	var s []string
+	for _, addr := range addrs {
+		s = append(s, addr.String())
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/azure/peerd/pkg/k8s"
+	"github.com/azure/peerd/pkg/k8s/election"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// leaderElectionName is the name of the Kubernetes lease peerd nodes elect a leader with.
+const leaderElectionName = "peerd-leader-election"
+
+// leader is a source of the leader of a Kubernetes lease.
+type leader struct {
+	election election.LeaderElection
+}
+
+var _ Source = &leader{}
+
+// Leader runs for the leadership of the Kubernetes lease with the address of the host, and returns a source of the
+// elected leader, which may be the host itself.
+func Leader(ctx context.Context, cs *k8s.ClientSet, h host.Host) (Source, error) {
+	if len(h.Addrs()) == 0 {
+		return nil, errors.New("host has no address to run for leader with")
+	}
+	self := fmt.Sprintf("%s/p2p/%s", h.Addrs()[0].String(), h.ID().String())
+
+	le := election.New(leaderElectionName, cs)
+	if err := le.RunOrDie(ctx, self); err != nil {
+		return nil, err
+	}
+
+	return &leader{election: le}, nil
+}
+
+// Addrs implements Source.
+// It waits for a leader to be elected, or for ctx to be done.
+func (l *leader) Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	type result struct {
+		addr multiaddr.Multiaddr
+		err  error
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		addr, err := l.election.Leader()
+		ch <- result{addr, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		if r.err != nil {
+			return nil, fmt.Errorf("could not get leader: %w", r.err)
+		}
+		return []multiaddr.Multiaddr{r.addr}, nil
+	}
+}
+
+// String implements Source.
+func (l *leader) String() string {
+	return KindLeader
+}
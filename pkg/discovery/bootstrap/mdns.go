@@ -0,0 +1,74 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// mdnsServiceName is the mDNS service peerd nodes announce themselves with.
+const mdnsServiceName = "_peerd._udp"
+
+// mdnsSource is a source of the peers announced with mDNS on the local network.
+type mdnsSource struct {
+	self  peer.ID
+	lock  sync.Mutex
+	peers map[peer.ID]peer.AddrInfo
+}
+
+var _ Source = &mdnsSource{}
+
+// MDNS announces the host with mDNS and returns a source of the other peers announced on the local network, for
+// development clusters without Kubernetes or DNS. Announcing stops when ctx is done.
+func MDNS(ctx context.Context, h host.Host) (Source, error) {
+	m := &mdnsSource{self: h.ID(), peers: map[peer.ID]peer.AddrInfo{}}
+
+	svc := mdns.NewMdnsService(h, mdnsServiceName, m)
+	if err := svc.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = svc.Close()
+	}()
+
+	return m, nil
+}
+
+// HandlePeerFound implements mdns.Notifee.
+func (m *mdnsSource) HandlePeerFound(info peer.AddrInfo) {
+	if info.ID == m.self {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.peers[info.ID] = info
+}
+
+// Addrs implements Source.
+func (m *mdnsSource) Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var addrs []multiaddr.Multiaddr
+	for _, info := range m.peers {
+		found, err := peer.AddrInfoToP2pAddrs(&info)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, found...)
+	}
+	return addrs, nil
+}
+
+// String implements Source.
+func (m *mdnsSource) String() string {
+	return KindMDNS
+}
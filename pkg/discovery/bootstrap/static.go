@@ -0,0 +1,30 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// static is a source of fixed addresses.
+type static []multiaddr.Multiaddr
+
+var _ Source = static{}
+
+// Static returns a source of the given addresses, such as those of dedicated bootstrap nodes.
+func Static(addrs ...multiaddr.Multiaddr) Source {
+	return static(addrs)
+}
+
+// Addrs implements Source.
+func (s static) Addrs(ctx context.Context) ([]multiaddr.Multiaddr, error) {
+	return s, nil
+}
+
+// String implements Source.
+func (s static) String() string {
+	return fmt.Sprintf("%v=%v", KindStatic, []multiaddr.Multiaddr(s))
+}
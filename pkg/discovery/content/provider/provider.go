@@ -7,31 +7,238 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/azure/peerd/pkg/discovery/routing"
+	"github.com/azure/peerd/pkg/metrics"
 	"github.com/rs/zerolog"
 )
 
-// Provide advertises content availability to the DHT network.
+const (
+	// provideBatchSize is the maximum number of keys advertised by a worker at once.
+	provideBatchSize = 64
+
+	// provideBatchWait is how long keys are collected before they are advertised.
+	provideBatchWait = 50 * time.Millisecond
+
+	// provideDedupWindow is how long a key is not advertised again after it was advertised, unless it is withdrawn.
+	provideDedupWindow = time.Minute
+
+	// withdrawBatchSize is the maximum number of keys withdrawn at once.
+	withdrawBatchSize = 256
+
+	// withdrawBatchWait is how long evictions are collected before they are withdrawn.
+	withdrawBatchWait = 100 * time.Millisecond
+)
+
+// ProvideWorkers is the number of workers that advertise and withdraw content concurrently.
+var ProvideWorkers = 8
+
+// batch collects keys until it is full or its first key has waited long enough.
+type batch struct {
+	keys []string
+	seqs []uint64
+	size int
+	wait time.Duration
+	due  <-chan time.Time
+}
+
+// add adds the key, queued with the sequence number, to the batch and returns true if the batch is full.
+func (b *batch) add(key string, seq uint64) bool {
+	b.keys = append(b.keys, key)
+	b.seqs = append(b.seqs, seq)
+	if len(b.keys) == 1 {
+		b.due = time.After(b.wait)
+	}
+	return len(b.keys) >= b.size
+}
+
+// remove removes the key from the batch and returns how many times it was in it.
+func (b *batch) remove(key string) int {
+	n := 0
+	for i := 0; i < len(b.keys); {
+		if b.keys[i] == key {
+			b.keys = append(b.keys[:i], b.keys[i+1:]...)
+			b.seqs = append(b.seqs[:i], b.seqs[i+1:]...)
+			n++
+			continue
+		}
+		i++
+	}
+	if len(b.keys) == 0 {
+		b.due = nil
+	}
+	return n
+}
+
+// take empties the batch and returns it as a job.
+func (b *batch) take(withdraw bool) job {
+	j := job{keys: b.keys, seqs: b.seqs, withdraw: withdraw}
+	b.keys, b.seqs, b.due = nil, nil, nil
+	return j
+}
+
+// job is a batch of keys to advertise or withdraw, with the sequence numbers they were queued with.
+type job struct {
+	keys     []string
+	seqs     []uint64
+	withdraw bool
+}
+
+// order applies the jobs of a key in the order the key was queued, although jobs run concurrently: a job waits for the
+// jobs running for any of its keys, and skips the keys queued again since, whose later job has already run.
+type order struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	seq     uint64
+	queued  map[string]int
+	applied map[string]uint64
+	running map[string]bool
+}
+
+// newOrder creates an order with no keys queued.
+func newOrder() *order {
+	o := &order{queued: map[string]int{}, applied: map[string]uint64{}, running: map[string]bool{}}
+	o.cond = sync.NewCond(&o.lock)
+	return o
+}
+
+// queue returns the sequence number of a new job for the key.
+func (o *order) queue(key string) uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.seq++
+	o.queued[key]++
+	return o.seq
+}
+
+// drop forgets n jobs of the key that will not run.
+func (o *order) drop(key string, n int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.done(key, n)
+}
+
+// start waits until no job is running for the keys of the job, and returns the keys it is to apply.
+func (o *order) start(j job) []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for slices.ContainsFunc(j.keys, func(key string) bool { return o.running[key] }) {
+		o.cond.Wait()
+	}
+
+	var keys []string
+	for i, key := range j.keys {
+		if j.seqs[i] <= o.applied[key] || o.running[key] {
+			o.done(key, 1)
+			continue
+		}
+		o.applied[key] = j.seqs[i]
+		o.running[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// finish marks the keys returned by start as applied.
+func (o *order) finish(keys []string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, key := range keys {
+		delete(o.running, key)
+		o.done(key, 1)
+	}
+	o.cond.Broadcast()
+}
+
+// done forgets n jobs of the key, and the key once none is left. The lock must be held.
+func (o *order) done(key string, n int) {
+	if o.queued[key] -= n; o.queued[key] <= 0 {
+		delete(o.queued, key)
+		delete(o.applied, key)
+	}
+}
+
+// Provide advertises content availability to the DHT network, and withdraws
+// the advertisements of content evicted from the cache.
 // Runs in a blocking loop, listening for blob identifiers on filesChan and
-// advertising them via the routing system. Exits when ctx is cancelled.
+// evictedChan, and handing them in batches to a pool of ProvideWorkers
+// workers that advertise or withdraw them via the routing system. Keys
+// advertised recently are not advertised again, unless advertising them
+// failed. The advertisements and withdrawals of a key are applied in the
+// order it was received, and a key cached again before its eviction is
+// withdrawn is not withdrawn. While the workers are busy,
+// the loop stops receiving, so senders must not block on a full filesChan.
+// A nil or closed channel is ignored. Exits when ctx is cancelled.
 //
 // Parameters:
 //   - ctx: Context for cancellation and deadline propagation
 //   - r: Router for advertising content through the DHT
 //   - filesChan: Channel receiving blob identifiers (SHA256 digest, optionally
 //     with range suffix) to advertise
-func Provide(ctx context.Context, r routing.Router, filesChan <-chan string) {
+//   - evictedChan: Channel receiving identifiers of evicted blobs to withdraw
+func Provide(ctx context.Context, r routing.Router, filesChan <-chan string, evictedChan <-chan string) {
 	l := zerolog.Ctx(ctx).With().Str("component", "state").Logger()
+	m := metrics.FromContext(ctx)
 	l.Debug().Msg("advertising start")
 	s := time.Now()
 	defer func() {
 		l.Debug().Dur("duration", time.Since(s)).Msg("advertising stop")
 	}()
 
-	immediate := make(chan time.Time, 1)
-	immediate <- time.Now()
+	var lock sync.Mutex
+	provided := map[string]time.Time{}
+	ord := newOrder()
+
+	jobs := make(chan job, ProvideWorkers)
+	var wg sync.WaitGroup
+	for range max(ProvideWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				keys := ord.start(j)
+				if len(keys) == 0 {
+					continue
+				}
+
+				// A key that failed to be advertised is advertised again the next time it is sent.
+				failed := run(ctx, r, m, l, job{keys: keys, withdraw: j.withdraw})
+				ord.finish(keys)
+				lock.Lock()
+				for _, key := range failed {
+					delete(provided, key)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	send := func(j job) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case jobs <- j:
+			return true
+		}
+	}
+
+	sweep := time.NewTicker(provideDedupWindow)
+	defer sweep.Stop()
+
+	provide := batch{size: provideBatchSize, wait: provideBatchWait}
+	withdraw := batch{size: withdrawBatchSize, wait: withdrawBatchWait}
 
 	for {
 		select {
@@ -39,13 +246,90 @@ func Provide(ctx context.Context, r routing.Router, filesChan <-chan string) {
 		case <-ctx.Done():
 			return
 
-		case blob := <-filesChan:
-			l.Debug().Str("blob", blob).Msg("advertising file")
-			err := r.Provide(ctx, []string{blob})
-			if err != nil {
-				l.Error().Err(err).Str("blob", blob).Msg("file: advertising error")
+		case blob, ok := <-filesChan:
+			if !ok {
+				filesChan = nil
 				continue
 			}
+			m.RecordProvideQueueDepth(len(filesChan))
+			lock.Lock()
+			at, ok := provided[blob]
+			recent := ok && time.Since(at) < provideDedupWindow
+			if !recent {
+				provided[blob] = time.Now()
+			}
+			lock.Unlock()
+			if recent {
+				continue
+			}
+
+			// A key cached again before its eviction is withdrawn is not withdrawn.
+			if n := withdraw.remove(blob); n > 0 {
+				ord.drop(blob, n)
+			}
+			if provide.add(blob, ord.queue(blob)) && !send(provide.take(false)) {
+				return
+			}
+
+		case blob, ok := <-evictedChan:
+			if !ok {
+				evictedChan = nil
+				continue
+			}
+			// An evicted key is advertised again as soon as it is cached again.
+			lock.Lock()
+			delete(provided, blob)
+			lock.Unlock()
+
+			if withdraw.add(blob, ord.queue(blob)) && !send(withdraw.take(true)) {
+				return
+			}
+
+		case <-provide.due:
+			if !send(provide.take(false)) {
+				return
+			}
+
+		case <-withdraw.due:
+			if !send(withdraw.take(true)) {
+				return
+			}
+
+		case now := <-sweep.C:
+			lock.Lock()
+			for blob, at := range provided {
+				if now.Sub(at) >= provideDedupWindow {
+					delete(provided, blob)
+				}
+			}
+			lock.Unlock()
+		}
+	}
+}
+
+// run advertises or withdraws the keys of the job, and returns the keys that could not be advertised.
+func run(ctx context.Context, r routing.Router, m metrics.Metrics, l zerolog.Logger, j job) []string {
+	if j.withdraw {
+		l.Debug().Int("count", len(j.keys)).Msg("withdrawing files")
+		if err := r.Withdraw(ctx, j.keys); err != nil {
+			l.Error().Err(err).Int("count", len(j.keys)).Msg("file: withdrawing error")
 		}
+		return nil
+	}
+
+	l.Debug().Int("count", len(j.keys)).Msg("advertising files")
+	start := time.Now()
+	err := r.Provide(ctx, j.keys)
+	m.RecordProvide(time.Since(start).Seconds(), len(j.keys))
+	if err == nil {
+		return nil
+	}
+
+	failed := j.keys
+	var pe *routing.ProvideError
+	if errors.As(err, &pe) {
+		failed = pe.Keys
 	}
+	l.Error().Err(err).Strs("blobs", failed).Msg("file: advertising error")
+	return failed
 }
@@ -5,15 +5,23 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/azure/peerd/pkg/discovery/routing/mocks"
+	"github.com/azure/peerd/pkg/metrics"
 	"github.com/rs/zerolog"
 )
 
+var (
+	ctxWithMetrics, _ = metrics.WithContext(context.Background(), "test", "peerd")
+)
+
 func TestProvide_Success(t *testing.T) {
-	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(context.Background())
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(ctxWithMetrics)
 	pMap := map[string][]string{}
 	router := mocks.NewMockRouter(pMap)
 	filesChan := make(chan string, 2)
@@ -37,7 +45,7 @@ func TestProvide_Success(t *testing.T) {
 		defer close(done)
 		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
 		defer cancel()
-		Provide(ctx, router, filesChan)
+		Provide(ctx, router, filesChan, nil)
 	}()
 
 	// Wait for completion or timeout
@@ -56,7 +64,7 @@ func TestProvide_Success(t *testing.T) {
 }
 
 func TestProvide_ContextCancellation(t *testing.T) {
-	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(context.Background())
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(ctxWithMetrics)
 	pMap := map[string][]string{}
 	router := mocks.NewMockRouter(pMap)
 	filesChan := make(chan string)
@@ -67,7 +75,7 @@ func TestProvide_ContextCancellation(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		Provide(ctx, router, filesChan)
+		Provide(ctx, router, filesChan, nil)
 	}()
 
 	// Cancel context immediately
@@ -86,3 +94,283 @@ func TestProvide_ContextCancellation(t *testing.T) {
 		t.Errorf("Expected no blobs to be provided, but got %d", len(pMap))
 	}
 }
+
+func TestWithdraw_Batches(t *testing.T) {
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(ctxWithMetrics)
+	blobs := []string{
+		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855_0_1048576",
+		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855_1048576_1048576",
+	}
+	pMap := map[string][]string{}
+	for _, blob := range blobs {
+		pMap[blob] = []string{"localhost"}
+	}
+	router := mocks.NewMockRouter(pMap)
+	evictedChan := make(chan string, len(blobs))
+	for _, blob := range blobs {
+		evictedChan <- blob
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*withdrawBatchWait)
+	defer cancel()
+	Provide(ctx, router, nil, evictedChan)
+
+	for _, blob := range blobs {
+		if _, ok := router.LookupKey(blob); ok {
+			t.Errorf("Expected blob %s to be withdrawn, but it is still provided", blob)
+		}
+	}
+}
+
+func TestProvide_Deduplicates(t *testing.T) {
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(ctxWithMetrics)
+	blob := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	router := &countingRouter{MockRouter: mocks.NewMockRouter(map[string][]string{})}
+
+	filesChan := make(chan string, 3)
+	filesChan <- blob
+	filesChan <- blob
+	filesChan <- blob
+
+	ctx, cancel := context.WithTimeout(ctx, 10*provideBatchWait)
+	defer cancel()
+	Provide(ctx, router, filesChan, nil)
+
+	if router.provided != 1 {
+		t.Errorf("expected: %v, got: %v", 1, router.provided)
+	}
+}
+
+func TestProvide_ReprovidesWithdrawn(t *testing.T) {
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(ctxWithMetrics)
+	blob := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	router := mocks.NewMockRouter(map[string][]string{})
+
+	filesChan := make(chan string, 1)
+	evictedChan := make(chan string, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Provide(ctx, router, filesChan, evictedChan)
+	}()
+
+	steps := []struct {
+		ch       chan string
+		expected bool
+	}{
+		{filesChan, true},
+		{evictedChan, false},
+		{filesChan, true},
+	}
+	for i, step := range steps {
+		step.ch <- blob
+		time.Sleep(5 * withdrawBatchWait)
+		if _, ok := router.LookupKey(blob); ok != step.expected {
+			t.Errorf("step %d: expected provided: %v, got: %v", i, step.expected, ok)
+		}
+	}
+
+	cancel()
+	<-done
+}
+
+func TestProvide_ReprovidesFailed(t *testing.T) {
+	ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(ctxWithMetrics)
+	ok, failing := "sha256:ok", "sha256:failing"
+	router := &failingRouter{MockRouter: mocks.NewMockRouter(map[string][]string{}), fail: map[string]bool{failing: true}}
+
+	filesChan := make(chan string, 2)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Provide(ctx, router, filesChan, nil)
+	}()
+
+	// Only the key that failed is advertised again, the other is deduplicated.
+	for range 2 {
+		filesChan <- ok
+		filesChan <- failing
+		time.Sleep(5 * provideBatchWait)
+	}
+	cancel()
+	<-done
+
+	for _, key := range []string{ok, failing} {
+		if _, found := router.LookupKey(key); !found {
+			t.Errorf("expected %v to be provided", key)
+		}
+	}
+	if router.attempts[ok] != 1 || router.attempts[failing] != 2 {
+		t.Errorf("expected: %v, got: %v", map[string]int{ok: 1, failing: 2}, router.attempts)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	b := batch{size: 2, wait: time.Hour}
+	if b.due != nil {
+		t.Fatal("expected empty batch to have no deadline")
+	}
+
+	if b.add("a", 1) {
+		t.Error("expected batch not to be full")
+	}
+	if b.due == nil {
+		t.Error("expected batch to have a deadline")
+	}
+	if !b.add("b", 2) {
+		t.Error("expected batch to be full")
+	}
+
+	j := b.take(true)
+	if len(j.keys) != 2 || j.keys[0] != "a" || j.keys[1] != "b" {
+		t.Errorf("expected: %v, got: %v", []string{"a", "b"}, j.keys)
+	}
+	if len(j.seqs) != 2 || j.seqs[0] != 1 || j.seqs[1] != 2 || !j.withdraw {
+		t.Errorf("expected: %v, got: %v", []uint64{1, 2}, j.seqs)
+	}
+	if len(b.keys) != 0 || b.due != nil {
+		t.Error("expected batch to be empty")
+	}
+
+	b.add("a", 3)
+	b.add("a", 4)
+	if got := b.remove("a"); got != 2 {
+		t.Errorf("expected: %v, got: %v", 2, got)
+	}
+	if len(b.keys) != 0 || len(b.seqs) != 0 || b.due != nil {
+		t.Error("expected batch to be empty")
+	}
+}
+
+func TestOrder(t *testing.T) {
+	o := newOrder()
+	older := job{keys: []string{"a"}, seqs: []uint64{o.queue("a")}}
+	newer := job{keys: []string{"a", "b"}, seqs: []uint64{o.queue("a"), o.queue("b")}, withdraw: true}
+
+	// A running key holds back the jobs of the key until it is finished.
+	keys := o.start(newer)
+	started := make(chan []string)
+	go func() { started <- o.start(older) }()
+	select {
+	case <-started:
+		t.Fatal("expected the job to wait for the running key")
+	case <-time.After(10 * time.Millisecond):
+	}
+	o.finish(keys)
+
+	// The older job is then skipped, as the newer job has already been applied.
+	if got := <-started; len(got) != 0 {
+		t.Errorf("expected: %v, got: %v", []string{}, got)
+	}
+	if len(o.queued) != 0 || len(o.applied) != 0 || len(o.running) != 0 {
+		t.Errorf("expected no keys to be tracked, got: %v, %v, %v", o.queued, o.applied, o.running)
+	}
+}
+
+func TestProvide_RecachedWhileWithdrawing(t *testing.T) {
+	blob := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	for _, tc := range []struct {
+		name string
+		// wait is how long the key is evicted before it is cached again.
+		wait time.Duration
+	}{
+		{name: "before the withdrawal is sent", wait: withdrawBatchWait / 4},
+		{name: "while the withdrawal is running", wait: 2 * withdrawBatchWait},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := zerolog.New(zerolog.NewTestWriter(t)).WithContext(ctxWithMetrics)
+			router := &slowWithdrawRouter{MockRouter: mocks.NewMockRouter(map[string][]string{}), delay: 3 * withdrawBatchWait}
+
+			filesChan := make(chan string, 1)
+			evictedChan := make(chan string, 1)
+
+			ctx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				Provide(ctx, router, filesChan, evictedChan)
+			}()
+
+			filesChan <- blob
+			time.Sleep(5 * provideBatchWait)
+			evictedChan <- blob
+			time.Sleep(tc.wait)
+			filesChan <- blob
+			time.Sleep(10 * withdrawBatchWait)
+
+			if _, ok := router.LookupKey(blob); !ok {
+				t.Errorf("expected %v to be provided", blob)
+			}
+
+			cancel()
+			<-done
+		})
+	}
+}
+
+// countingRouter counts the keys advertised through it.
+type countingRouter struct {
+	*mocks.MockRouter
+	lock     sync.Mutex
+	provided int
+}
+
+// Provide implements routing.Router.
+func (r *countingRouter) Provide(ctx context.Context, keys []string) error {
+	r.lock.Lock()
+	r.provided += len(keys)
+	r.lock.Unlock()
+	return r.MockRouter.Provide(ctx, keys)
+}
+
+// failingRouter fails to advertise the keys to fail the first time they are advertised.
+type failingRouter struct {
+	*mocks.MockRouter
+	lock     sync.Mutex
+	fail     map[string]bool
+	attempts map[string]int
+}
+
+// Provide implements routing.Router.
+func (r *failingRouter) Provide(ctx context.Context, keys []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.attempts == nil {
+		r.attempts = map[string]int{}
+	}
+	var provided, failed []string
+	for _, key := range keys {
+		r.attempts[key]++
+		if r.fail[key] {
+			delete(r.fail, key)
+			failed = append(failed, key)
+		} else {
+			provided = append(provided, key)
+		}
+	}
+
+	if err := r.MockRouter.Provide(ctx, provided); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &routing.ProvideError{Keys: failed, Err: errors.New("failed")}
+	}
+	return nil
+}
+
+// slowWithdrawRouter withdraws keys after a delay.
+type slowWithdrawRouter struct {
+	*mocks.MockRouter
+	delay time.Duration
+}
+
+// Withdraw implements routing.Router.
+func (r *slowWithdrawRouter) Withdraw(ctx context.Context, keys []string) error {
+	time.Sleep(r.delay)
+	return r.MockRouter.Withdraw(ctx, keys)
+}
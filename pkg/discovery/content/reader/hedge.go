@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package reader
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// hedgeSamples is the number of recent reads from peers whose durations the hedge delay is computed from.
+	hedgeSamples = 256
+
+	// hedgeMinSamples is the number of reads from peers needed before the hedge delay is computed from their durations.
+	hedgeMinSamples = 32
+
+	// hedgeDefaultDelay is the hedge delay until enough reads from peers are measured.
+	hedgeDefaultDelay = time.Second
+
+	// hedgeMinDelay is the minimum hedge delay, so that fast reads are not hedged because of jitter.
+	hedgeMinDelay = 10 * time.Millisecond
+)
+
+// HedgePercentile is the percentile of the durations of recent reads from peers after which a read is hedged, between
+// 0 and 1. A read that takes longer is raced by a read from another peer or the upstream. 0 disables hedging.
+var HedgePercentile = 0.95
+
+// peerReads are the durations of recent reads from peers, shared by all readers.
+var peerReads = newDurations(hedgeSamples)
+
+// durations keeps the most recent durations of an operation.
+type durations struct {
+	lock    sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// newDurations creates durations that keep up to size samples.
+func newDurations(size int) *durations {
+	return &durations{samples: make([]time.Duration, 0, size)}
+}
+
+// record adds a duration, replacing the oldest one if full.
+func (d *durations) record(v time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.samples) < cap(d.samples) {
+		d.samples = append(d.samples, v)
+		return
+	}
+	d.samples[d.next] = v
+	d.next = (d.next + 1) % len(d.samples)
+}
+
+// percentile returns the duration that the fraction p of the samples do not exceed, if there are at least minSamples
+// samples.
+func (d *durations) percentile(p float64, minSamples int) (time.Duration, bool) {
+	d.lock.Lock()
+	sorted := slices.Clone(d.samples)
+	d.lock.Unlock()
+
+	if len(sorted) == 0 || len(sorted) < minSamples {
+		return 0, false
+	}
+
+	slices.Sort(sorted)
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(0, min(i, len(sorted)-1))], true
+}
+
+// hedgeDelay returns how long a read from a peer runs before it is hedged, and whether hedging is enabled.
+func hedgeDelay() (time.Duration, bool) {
+	if HedgePercentile <= 0 {
+		return 0, false
+	}
+
+	delay, ok := peerReads.percentile(HedgePercentile, hedgeMinSamples)
+	if !ok {
+		return hedgeDefaultDelay, true
+	}
+	return max(delay, hedgeMinDelay), true
+}
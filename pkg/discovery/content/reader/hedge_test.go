@@ -0,0 +1,203 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package reader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pcontext "github.com/azure/peerd/pkg/context"
+	"github.com/azure/peerd/pkg/discovery/routing/mocks"
+	"github.com/azure/peerd/pkg/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+func TestDurationsPercentile(t *testing.T) {
+	d := newDurations(100)
+
+	if _, ok := d.percentile(0.95, 1); ok {
+		t.Error("expected no percentile without samples")
+	}
+
+	for i := 1; i <= 100; i++ {
+		d.record(time.Duration(i) * time.Millisecond)
+	}
+
+	for _, tc := range []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{p: 0.5, expected: 50 * time.Millisecond},
+		{p: 0.95, expected: 95 * time.Millisecond},
+		{p: 1, expected: 100 * time.Millisecond},
+		{p: 0.001, expected: time.Millisecond},
+	} {
+		if got, ok := d.percentile(tc.p, 100); !ok || got != tc.expected {
+			t.Errorf("expected: %v, got: %v", tc.expected, got)
+		}
+	}
+
+	if _, ok := d.percentile(0.5, 101); ok {
+		t.Error("expected no percentile with too few samples")
+	}
+
+	// The oldest samples are replaced.
+	for i := 0; i < 100; i++ {
+		d.record(time.Second)
+	}
+	if got, _ := d.percentile(0.01, 1); got != time.Second {
+		t.Errorf("expected: %v, got: %v", time.Second, got)
+	}
+}
+
+func TestHedgeDelay(t *testing.T) {
+	defer func(p float64, d *durations) { HedgePercentile, peerReads = p, d }(HedgePercentile, peerReads)
+	peerReads = newDurations(hedgeSamples)
+
+	HedgePercentile = 0
+	if _, ok := hedgeDelay(); ok {
+		t.Error("expected hedging to be disabled")
+	}
+
+	HedgePercentile = 0.95
+	if got, ok := hedgeDelay(); !ok || got != hedgeDefaultDelay {
+		t.Errorf("expected: %v, got: %v", hedgeDefaultDelay, got)
+	}
+
+	for i := 0; i < hedgeMinSamples; i++ {
+		peerReads.record(time.Millisecond)
+	}
+	if got, _ := hedgeDelay(); got != hedgeMinDelay {
+		t.Errorf("expected: %v, got: %v", hedgeMinDelay, got)
+	}
+
+	for i := 0; i < hedgeMinSamples; i++ {
+		peerReads.record(100 * time.Millisecond)
+	}
+	if got, _ := hedgeDelay(); got != 100*time.Millisecond {
+		t.Errorf("expected: %v, got: %v", 100*time.Millisecond, got)
+	}
+}
+
+func TestP2pHedgeWithPeer(t *testing.T) {
+	defer func(d *durations) { peerReads = d }(peerReads)
+	peerReads = fastPeerReads()
+
+	l := zerolog.Nop()
+	key := "somekey"
+	expected := "expected-result"
+
+	var cancelled atomic.Bool
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled.Store(true)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// nolint:errcheck
+		w.Write([]byte(expected))
+	}))
+	defer fast.Close()
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mocks.NewMockRouter(map[string][]string{key: {slow.URL, fast.URL}})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	r := NewReader(pcontext.FromContext(c), router, 3, ResolveBudget{Floor: 5 * time.Second, Ceiling: 5 * time.Second}, mr).(*reader)
+	b := make([]byte, 10)
+
+	start := time.Now()
+	got, source, err := r.doP2p(l, key, 0, 10, operationPreadRemote, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != 10 || string(b) != expected[:10] || source != metrics.SourcePeer {
+		t.Fatalf("expected %v from %v, got %v from %v", expected[:10], metrics.SourcePeer, string(b[:got]), source)
+	} else if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the hedge to win quickly, took %v", elapsed)
+	}
+
+	// The slow peer lost the race and is not reported to have failed.
+	if failed := router.Failed(key); len(failed) != 0 {
+		t.Errorf("expected no failed peers, got %v", failed)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !cancelled.Load() {
+		t.Error("expected the read from the slow peer to be cancelled")
+	}
+}
+
+func TestPreadRemoteHedgeWithUpstream(t *testing.T) {
+	defer func(d *durations) { peerReads = d }(peerReads)
+	peerReads = fastPeerReads()
+
+	key := "somekey"
+	expected := "expected-result"
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	upstreamRequests := 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// nolint:errcheck
+		w.Write([]byte(expected))
+	}))
+	defer svr.Close()
+	p := svr.URL + "/some-path"
+	req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+p+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mocks.NewMockRouter(map[string][]string{key: {slow.URL}})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	c.Params = []gin.Param{{Key: "url", Value: p}}
+
+	pc := pcontext.FromContext(c)
+	pc.Set(pcontext.BlobUrlCtxKey, pcontext.BlobUrl(pc))
+	pc.Set(pcontext.FileChunkCtxKey, key)
+
+	r := NewReader(pc, router, 3, ResolveBudget{Floor: 5 * time.Second, Ceiling: 5 * time.Second}, mr).(*reader)
+	b := make([]byte, 10)
+
+	got, _, err := r.PreadRemote(b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != 10 || string(b) != expected[:10] {
+		t.Fatalf("expected %v, got %v", expected[:10], string(b[:got]))
+	} else if upstreamRequests != 1 {
+		t.Errorf("expected a single upstream request, got %v", upstreamRequests)
+	}
+}
+
+// fastPeerReads returns durations of reads from peers that make reads hedged after hedgeMinDelay.
+func fastPeerReads() *durations {
+	d := newDurations(hedgeSamples)
+	for i := 0; i < hedgeMinSamples; i++ {
+		d.record(time.Millisecond)
+	}
+	return d
+}
@@ -3,15 +3,25 @@
 package reader
 
 import (
+	"context"
 	"net/http"
 
+	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/rs/zerolog"
 )
 
 // Reader provides a read-only interface to a remote file.
 type Reader interface {
-	// PreadRemote is like pread but to a remote file.
-	PreadRemote(buf []byte, offset int64) (int, error)
+	// PreadRemote is like pread but to a remote file. It returns the source that served the bytes, one of
+	// metrics.SourcePeer, metrics.SourceSuperPeer or metrics.SourceUpstream.
+	PreadRemote(buf []byte, offset int64) (int, string, error)
+
+	// PreadPeer is like PreadRemote but reads only from the peer, which provides the chunk with the key.
+	// The read is cancelled with ctx.
+	PreadPeer(ctx context.Context, p routing.PeerInfo, key string, buf []byte, offset int64) (int, error)
+
+	// PreadOrigin is like PreadRemote but reads only from the upstream. The read is cancelled with ctx.
+	PreadOrigin(ctx context.Context, key string, buf []byte, offset int64) (int, error)
 
 	// FstatRemote stats a remote file.
 	FstatRemote() (int64, error)
@@ -3,7 +3,11 @@
 package mocks
 
 import (
+	"context"
+
 	"github.com/azure/peerd/pkg/discovery/content/reader"
+	"github.com/azure/peerd/pkg/discovery/routing"
+	"github.com/azure/peerd/pkg/metrics"
 	"github.com/rs/zerolog"
 )
 
@@ -26,11 +30,23 @@ func (*mockReader) Log() *zerolog.Logger {
 }
 
 // PreadRemote implements remote.Reader.
-func (m *mockReader) PreadRemote(buf []byte, offset int64) (int, error) {
+func (m *mockReader) PreadRemote(buf []byte, offset int64) (int, string, error) {
 	if offset >= int64(len(m.data)) {
-		return 0, nil
+		return 0, metrics.SourceUpstream, nil
 	}
-	return copy(buf, m.data[offset:]), nil
+	return copy(buf, m.data[offset:]), metrics.SourceUpstream, nil
+}
+
+// PreadPeer implements remote.Reader.
+func (m *mockReader) PreadPeer(ctx context.Context, p routing.PeerInfo, key string, buf []byte, offset int64) (int, error) {
+	n, _, err := m.PreadRemote(buf, offset)
+	return n, err
+}
+
+// PreadOrigin implements remote.Reader.
+func (m *mockReader) PreadOrigin(ctx context.Context, key string, buf []byte, offset int64) (int, error) {
+	n, _, err := m.PreadRemote(buf, offset)
+	return n, err
 }
 
 // NewMockReader creates a new mock reader for testing purposes.
@@ -34,7 +34,7 @@ func TestPreadRemote(t *testing.T) {
 	data := []byte("test data")
 	mr := NewMockReader(data)
 	buf := make([]byte, 4)
-	n, err := mr.PreadRemote(buf, 0)
+	n, _, err := mr.PreadRemote(buf, 0)
 	if err != nil {
 		t.Errorf("PreadRemote returned error: %v", err)
 	}
@@ -46,7 +46,7 @@ func TestPreadRemote(t *testing.T) {
 	}
 
 	// Test reading from offset
-	n, err = mr.PreadRemote(buf, 4)
+	n, _, err = mr.PreadRemote(buf, 4)
 	if err != nil {
 		t.Errorf("PreadRemote returned error: %v", err)
 	}
@@ -58,7 +58,7 @@ func TestPreadRemote(t *testing.T) {
 	}
 
 	buf = make([]byte, 1)
-	n, err = mr.PreadRemote(buf, 8)
+	n, _, err = mr.PreadRemote(buf, 8)
 	if err != nil {
 		t.Errorf("PreadRemote returned error: %v", err)
 	}
@@ -15,6 +15,7 @@ import (
 	pcontext "github.com/azure/peerd/pkg/context"
 	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/azure/peerd/pkg/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/rs/zerolog"
 )
 
@@ -29,8 +30,8 @@ var errPeerNotFound = errors.New("peer not found")
 
 // reader is a Reader implementation.
 type reader struct {
-	context        pcontext.Context
-	resolveTimeout time.Duration
+	context       pcontext.Context
+	resolveBudget ResolveBudget
 
 	router            routing.Router
 	resolveRetries    int
@@ -47,32 +48,96 @@ func (r *reader) Log() *zerolog.Logger {
 	return &l
 }
 
-// PreadRemote is like pread but to a remote file.
-func (r *reader) PreadRemote(buf []byte, offset int64) (int, error) {
+// PreadRemote is like pread but to a remote file. It returns the source that served the bytes.
+func (r *reader) PreadRemote(buf []byte, offset int64) (int, string, error) {
 	key := r.context.GetString(pcontext.FileChunkCtxKey)
 	start := offset
 	end := int64(len(buf)) + offset - 1
 
 	log := r.Log().With().Str("operation", "preadremote").Str("key", key).Int64("start", start).Int64("end", end).Logger()
 
-	count, err := r.doP2p(log, key, start, end, operationPreadRemote, buf)
+	count, source, err := r.doP2p(log, key, start, end, operationPreadRemote, buf)
 	if err == nil {
-		return int(count), nil
+		if source == metrics.SourcePeer {
+			r.metricsRecorder.RecordCacheHit(metrics.TierPeer)
+		} else {
+			// A hedge to the upstream won over the peer.
+			r.metricsRecorder.RecordCacheMiss(metrics.TierPeer)
+		}
+		return int(count), source, nil
+	} else if !pcontext.IsRequestFromAPeer(r.context) && pcontext.CanForward(r.context) {
+		r.metricsRecorder.RecordCacheMiss(metrics.TierPeer)
+
+		// Could not find a peer that has this file, request a super-peer, which reads it from origin once for all nodes.
+		if count, err = r.readSuperPeer(log, key, start, end, buf); err == nil {
+			return int(count), metrics.SourceSuperPeer, nil
+		}
+	}
+
+	// Could not read the file from a peer or super-peer, request origin.
+	count, err = r.readOrigin(r.context, log, key, start, end, buf)
+	return int(count), metrics.SourceUpstream, err
+}
+
+// PreadPeer is like PreadRemote but reads only from the peer, which provides the chunk with the key.
+// The read is cancelled with ctx, in which case the peer is not reported as failed.
+func (r *reader) PreadPeer(ctx context.Context, p routing.PeerInfo, key string, buf []byte, offset int64) (int, error) {
+	start := offset
+	end := int64(len(buf)) + offset - 1
+
+	log := r.Log().With().Str("operation", "preadpeer").Str("key", key).Str("peer", p.HttpHost).Int64("start", start).Int64("end", end).Logger()
+
+	count, err := r.tryPeer(ctx, log, key, p, start, end, operationPreadRemote, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	r.metricsRecorder.RecordCacheHit(metrics.TierPeer)
+	return int(count), nil
+}
+
+// PreadOrigin is like PreadRemote but reads only from the upstream. The read is cancelled with ctx.
+func (r *reader) PreadOrigin(ctx context.Context, key string, buf []byte, offset int64) (int, error) {
+	start := offset
+	end := int64(len(buf)) + offset - 1
+
+	log := r.Log().With().Str("operation", "preadorigin").Str("key", key).Int64("start", start).Int64("end", end).Logger()
+
+	count, err := r.readOrigin(ctx, log, key, start, end, buf)
+	if err != nil {
+		return 0, err
 	}
 
-	// Could not find a peer that has this file, request origin.
+	return int(count), nil
+}
+
+// readSuperPeer reads the range of the file into buf from the closest super-peer that serves it. It returns
+// errPeerNotFound if no super-peer is known.
+func (r *reader) readSuperPeer(log zerolog.Logger, key string, start, end int64, buf []byte) (int64, error) {
+	err := errPeerNotFound
+	for _, p := range r.router.SuperPeers() {
+		var count int64
+		if count, err = r.tryPeer(r.context, log.With().Str("superpeer", p.HttpHost).Logger(), key, p, start, end, operationPreadRemote, buf); err == nil {
+			return count, nil
+		}
+	}
+	return -1, err
+}
+
+// readOrigin reads the range of the file from the upstream into buf.
+func (r *reader) readOrigin(ctx context.Context, log zerolog.Logger, key string, start, end int64, buf []byte) (int64, error) {
 	startTime := time.Now()
-	originReq, err := r.originRequest(start, end)
+	originReq, err := r.originRequest(ctx, start, end)
 	if err != nil {
 		return -1, err
 	}
 
-	count32 := int(0)
+	count := int(0)
 	defer func() {
-		r.metricsRecorder.RecordUpstreamResponse(originReq.URL.Hostname(), key, "pread", time.Since(startTime).Seconds(), int64(count32))
+		r.metricsRecorder.RecordUpstreamResponse(originReq.URL.Hostname(), key, "pread", time.Since(startTime).Seconds(), int64(count))
 	}()
-	count32, err = r.preadRemote(log, originReq, r.defaultHttpClient, buf)
-	return count32, err
+	count, err = r.preadRemote(log, originReq, r.defaultHttpClient, buf)
+	return int64(count), err
 }
 
 // FstatRemote stats a remote file.
@@ -84,7 +149,7 @@ func (r *reader) FstatRemote() (int64, error) {
 	log := r.Log().With().Str("operation", "fstatremote").Int64("start", start).Int64("end", end).Str("key", key).Logger()
 
 	startTime := time.Now()
-	originReq, err := r.originRequest(start, end)
+	originReq, err := r.originRequest(r.context, start, end)
 	if err != nil {
 		return -1, err
 	}
@@ -98,16 +163,21 @@ func (r *reader) FstatRemote() (int64, error) {
 }
 
 // doP2p tries to resolve the key in the p2p network and if successful, it will perform the operation on the peer, and return the result.
-func (r *reader) doP2p(log zerolog.Logger, fileChunkKey string, start, end int64, o operation, buf []byte) (int64, error) {
-	if pcontext.IsRequestFromAPeer(r.context) {
-		log.Warn().Msg("refusing to propagate request from one peer to another")
-		return -1, errPeerNotFound
+// A read from a peer that does not complete within the hedge delay is raced by a read from another peer or the upstream,
+// and the source of the winner is returned. A request from a peer is forwarded to another peer only within
+// pcontext.MaxHops and if it has not passed through this node before, and no request is sent to a peer with no hops.
+func (r *reader) doP2p(log zerolog.Logger, fileChunkKey string, start, end int64, o operation, buf []byte) (int64, string, error) {
+	if !pcontext.CanForward(r.context) {
+		if pcontext.IsRequestFromAPeer(r.context) {
+			log.Warn().Int("hops", pcontext.Hops(r.context)).Msg("refusing to forward request beyond the maximum hops or in a loop")
+		}
+		return -1, "", errPeerNotFound
 	}
 
 	log.Debug().Msg(pcontext.PeerResolutionStartLog)
 	defer log.Debug().Msg(pcontext.PeerResolutionStopLog)
 
-	resolveCtx, cancel := context.WithTimeout(log.WithContext(r.context), r.resolveTimeout)
+	resolveCtx, cancel := context.WithTimeout(log.WithContext(r.context), r.resolveBudget.Timeout())
 	defer cancel()
 
 	startTime := time.Now()
@@ -116,7 +186,7 @@ func (r *reader) doP2p(log zerolog.Logger, fileChunkKey string, start, end int64
 	if err != nil {
 		//nolint:errcheck // ignore
 		log.Error().Err(err).Msg(pcontext.PeerRequestErrorLog)
-		return -1, err
+		return -1, "", err
 	}
 
 	// Request a peer for this file.
@@ -140,47 +210,182 @@ peerLoop:
 
 			if peerCount == 0 {
 				// Only report the time it took to discover the first peer.
+				RecordDiscovery(time.Since(startTime))
 				r.metricsRecorder.RecordPeerDiscovery(peer.HttpHost, time.Since(startTime).Seconds())
 				peerCount++
 			}
 
-			peerReq, err := r.peerRequest(peer.HttpHost, start, end)
-			if err != nil {
-				log.Error().Err(err).Msg(pcontext.PeerRequestErrorLog)
-				// try next peer
-				break
+			count, source, err := r.requestHedged(log, fileChunkKey, peer, peersCh, start, end, o, buf)
+			if err == nil {
+				return count, source, nil
 			}
+			// try next peer
+		}
+	}
+
+	return -1, "", errPeerNotFound
+}
+
+// requestHedged performs the operation on the peer. A read that does not complete within the hedge delay is raced by a
+// read from the next resolved peer if one is ready, or else from the upstream. The first read to succeed wins and the
+// other is cancelled. It returns the source of the winner.
+func (r *reader) requestHedged(log zerolog.Logger, fileChunkKey string, p routing.PeerInfo, peersCh <-chan routing.PeerInfo, start, end int64, o operation, buf []byte) (int64, string, error) {
+	delay, ok := hedgeDelay()
+	if o != operationPreadRemote || !ok {
+		count, err := r.tryPeer(r.context, log, fileChunkKey, p, start, end, o, buf)
+		return count, metrics.SourcePeer, err
+	}
+
+	type result struct {
+		count  int64
+		source string
+		err    error
+		hedge  bool
+	}
+	results := make(chan result, 2)
+
+	primaryCtx, cancelPrimary := context.WithCancel(r.context)
+	defer cancelPrimary()
+	primaryDone := make(chan struct{})
+	go func() {
+		defer close(primaryDone)
+		count, err := r.tryPeer(primaryCtx, log, fileChunkKey, p, start, end, o, buf)
+		results <- result{count: count, source: metrics.SourcePeer, err: err}
+	}()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
-			client := r.router.Net().HTTPClientFor(peer.ID)
-
-			var count int64
-			startTime = time.Now()
-			switch o {
-			case operationFstatRemote:
-				count, err = r.fstatRemote(log, peerReq, client)
-			case operationPreadRemote:
-				var c int
-				c, err = r.preadRemote(log, peerReq, client, buf)
-				count = int64(c)
+	hedgeCtx, cancelHedge := context.WithCancel(r.context)
+	defer cancelHedge()
+	var hedgeBuf []byte
+	var target string
+
+	var err error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			// The read is slow, race it.
+			hedgeBuf = make([]byte, len(buf))
+
+			var next routing.PeerInfo
+			hasNext := false
+			select {
+			case next, hasNext = <-peersCh:
 			default:
-				err = fmt.Errorf("unknown operation: %v", o)
 			}
 
-			if err != nil {
-				// try next peer
-				log.Error().Err(err).Msg(pcontext.PeerRequestErrorLog)
+			if hasNext {
+				target = metrics.SourcePeer
+				log.Debug().Dur("delay", delay).Str("peer", next.HttpHost).Msg("hedging read with another peer")
+				go func() {
+					count, err := r.tryPeer(hedgeCtx, log, fileChunkKey, next, start, end, o, hedgeBuf)
+					results <- result{count: count, source: metrics.SourcePeer, err: err, hedge: true}
+				}()
 			} else {
-				op := "fstat"
-				if o == operationPreadRemote {
-					op = "pread"
-				}
-				r.metricsRecorder.RecordPeerResponse(peer.HttpHost, fileChunkKey, op, time.Since(startTime).Seconds(), count)
-				return count, nil
+				target = metrics.SourceUpstream
+				log.Debug().Dur("delay", delay).Msg("hedging read with upstream")
+				go func() {
+					count, err := r.readOrigin(hedgeCtx, log, fileChunkKey, start, end, hedgeBuf)
+					results <- result{count: count, source: metrics.SourceUpstream, err: err, hedge: true}
+				}()
 			}
+			r.metricsRecorder.RecordHedge(target)
+			pending++
+
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				err = res.err
+				continue
+			}
+
+			if !res.hedge {
+				return res.count, res.source, nil
+			}
+
+			// The primary read writes to buf, so it must stop before the hedge result is copied over.
+			cancelPrimary()
+			<-primaryDone
+			copy(buf, hedgeBuf[:res.count])
+			r.metricsRecorder.RecordHedgeWin(target)
+			return res.count, res.source, nil
+		}
+	}
+
+	return -1, "", err
+}
+
+// tryPeer performs the operation on the peer, trying its addresses in order while they are unreachable.
+// Failures are reported to the router unless ctx is cancelled.
+func (r *reader) tryPeer(ctx context.Context, log zerolog.Logger, fileChunkKey string, peer routing.PeerInfo, start, end int64, o operation, buf []byte) (int64, error) {
+	var count int64
+	var err error
+	startTime := time.Now()
+	hosts := peer.HttpHosts()
+	for i, host := range hosts {
+		count, err = r.requestPeer(ctx, log, host, peer.ID, start, end, o, buf)
+		if !unreachable(err) || i == len(hosts)-1 || ctx.Err() != nil {
+			break
+		}
+		log.Warn().Err(err).Str("host", host).Msg("peer address unreachable, trying next address")
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			// The read lost a race, the peer did not fail.
+			return -1, err
 		}
+
+		var e Error
+		if errors.As(err, &e) && e.Response != nil && e.StatusCode == http.StatusNotFound {
+			// The peer no longer has the key cached, its provider record is stale.
+			r.router.ReportNotCached(fileChunkKey, peer.ID)
+		} else {
+			r.router.ReportFailed(fileChunkKey, peer.ID)
+		}
+
+		log.Error().Err(err).Msg(pcontext.PeerRequestErrorLog)
+		return -1, err
+	}
+
+	op := "fstat"
+	if o == operationPreadRemote {
+		op = "pread"
 	}
+	elapsed := time.Since(startTime)
+	r.metricsRecorder.RecordPeerResponse(peer.HttpHost, fileChunkKey, op, elapsed.Seconds(), count)
+	if o == operationPreadRemote {
+		r.router.ReportTransfer(peer.ID, count, elapsed)
+		peerReads.record(elapsed)
+	}
+	return count, nil
+}
+
+// requestPeer performs the operation on the peer at the HTTP host.
+func (r *reader) requestPeer(ctx context.Context, log zerolog.Logger, host string, id peer.ID, start, end int64, o operation, buf []byte) (int64, error) {
+	peerReq, err := r.peerRequest(ctx, host, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	client := r.router.Net().HTTPClientFor(id)
+
+	switch o {
+	case operationFstatRemote:
+		return r.fstatRemote(log, peerReq, client)
+	case operationPreadRemote:
+		c, err := r.preadRemote(log, peerReq, client, buf)
+		return int64(c), err
+	default:
+		return 0, fmt.Errorf("unknown operation: %v", o)
+	}
+}
 
-	return -1, errPeerNotFound
+// unreachable reports whether the error is a request that failed without a response.
+func unreachable(err error) bool {
+	var e Error
+	return errors.As(err, &e) && e.Response == nil
 }
 
 // fstatRemote stats the file.
@@ -256,18 +461,18 @@ func (r *reader) preadRemote(log zerolog.Logger, req *http.Request, client *http
 }
 
 // originRequest will create a new request to origin.
-func (r *reader) originRequest(start, end int64) (*http.Request, error) {
-	return r.remoteRequest(r.context.GetString(pcontext.BlobUrlCtxKey), start, end)
+func (r *reader) originRequest(ctx context.Context, start, end int64) (*http.Request, error) {
+	return r.remoteRequest(ctx, r.context.GetString(pcontext.BlobUrlCtxKey), start, end)
 }
 
 // perRequest will create a new request to a peer.
-func (r *reader) peerRequest(peer string, start, end int64) (*http.Request, error) {
-	return r.remoteRequest(fmt.Sprintf("%v/blobs/%v", peer, r.context.GetString(pcontext.BlobUrlCtxKey)), start, end)
+func (r *reader) peerRequest(ctx context.Context, peer string, start, end int64) (*http.Request, error) {
+	return r.remoteRequest(ctx, fmt.Sprintf("%v/blobs/%v", peer, r.context.GetString(pcontext.BlobUrlCtxKey)), start, end)
 }
 
-// remoteRequest creates a new HTTP request to a remote server.
-func (r *reader) remoteRequest(u string, start, end int64) (*http.Request, error) {
-	req, err := http.NewRequest("GET", u, nil)
+// remoteRequest creates a new HTTP request to a remote server, cancelled with ctx.
+func (r *reader) remoteRequest(ctx context.Context, u string, start, end int64) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -284,11 +489,11 @@ func (r *reader) remoteRequest(u string, start, end int64) (*http.Request, error
 	return req, nil
 }
 
-// NewReader creates a new remote reader.
-func NewReader(c pcontext.Context, router routing.Router, resolveRetries int, resolveTimeout time.Duration, metricsRecorder metrics.Metrics) Reader {
+// NewReader creates a new remote reader, which resolves keys within the budget.
+func NewReader(c pcontext.Context, router routing.Router, resolveRetries int, budget ResolveBudget, metricsRecorder metrics.Metrics) Reader {
 	return &reader{
 		context:           c.Copy(),
-		resolveTimeout:    resolveTimeout,
+		resolveBudget:     budget,
 		router:            router,
 		resolveRetries:    resolveRetries,
 		defaultHttpClient: router.Net().HTTPClientFor(""),
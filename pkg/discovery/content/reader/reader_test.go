@@ -3,12 +3,14 @@
 package reader
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	pcontext "github.com/azure/peerd/pkg/context"
+	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/azure/peerd/pkg/discovery/routing/mocks"
 	"github.com/azure/peerd/pkg/metrics"
 	"github.com/gin-gonic/gin"
@@ -77,11 +79,11 @@ func TestPreadRemoteUpstream(t *testing.T) {
 	pc.Set(pcontext.BlobRangeCtxKey, "bytes=0-10")
 	pc.Set(pcontext.FileChunkCtxKey, key)
 
-	r := NewReader(pc, router, 3, 500*time.Millisecond, mr).(*reader)
+	r := NewReader(pc, router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
 	b := make([]byte, 10)
 
 	// Test
-	got, err := r.PreadRemote(b, 0)
+	got, _, err := r.PreadRemote(b, 0)
 
 	// Assert
 	if err != nil {
@@ -93,6 +95,134 @@ func TestPreadRemoteUpstream(t *testing.T) {
 	} else if peersTried != 3 {
 		t.Fatalf("expected %v, got %v", 3, peersTried)
 	}
+
+	// Only the peer that answered it does not have the key cached is reported.
+	if notCached := router.NotCached(key); len(notCached) != 1 || string(notCached[0]) != svr2.URL {
+		t.Errorf("expected %v, got %v", []string{svr2.URL}, notCached)
+	}
+
+	// The other peers are reported to have failed.
+	if failed := router.Failed(key); len(failed) != 2 || string(failed[0]) != svr1.URL || string(failed[1]) != svr3.URL {
+		t.Errorf("expected %v, got %v", []string{svr1.URL, svr3.URL}, failed)
+	}
+}
+
+func TestPreadRemoteSuperPeer(t *testing.T) {
+	key := "somekey"
+	expected := "expected-result"
+	var hops string
+	superPeer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops = r.Header.Get(pcontext.HopsHeaderKey)
+		// nolint:errcheck
+		w.Write([]byte(expected))
+	}))
+	defer superPeer.Close()
+
+	upstreamReads := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamReads++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	p := upstream.URL + "/some-path"
+	req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+p+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No peer has the key, but a super-peer is known.
+	router := mocks.NewMockRouter(map[string][]string{routing.SuperPeerKey: {superPeer.URL}})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	c.Params = []gin.Param{
+		{Key: "url", Value: p},
+	}
+
+	pc := pcontext.FromContext(c)
+	pc.Set(pcontext.BlobUrlCtxKey, pcontext.BlobUrl(pc))
+	pc.Set(pcontext.BlobRangeCtxKey, "bytes=0-10")
+	pc.Set(pcontext.FileChunkCtxKey, key)
+
+	r := NewReader(pc, router, 3, ResolveBudget{Floor: 10 * time.Millisecond, Ceiling: 10 * time.Millisecond}, mr).(*reader)
+	b := make([]byte, 10)
+
+	got, _, err := r.PreadRemote(b, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if got != 10 {
+		t.Fatalf("expected %v, got %v", 10, got)
+	} else if string(b) != expected[:10] {
+		t.Fatalf("expected %v, got %v", expected[:10], string(b))
+	}
+
+	// The super-peer is asked as a peer, so that it reads the chunk from the upstream on behalf of this node.
+	if hops != "1" {
+		t.Errorf("expected: %v, got: %v", "1", hops)
+	}
+	if upstreamReads != 0 {
+		t.Errorf("expected: %v, got: %v", 0, upstreamReads)
+	}
+}
+
+func TestPreadRemoteNoHops(t *testing.T) {
+	defer func(m int) { pcontext.MaxHops = m }(pcontext.MaxHops)
+	pcontext.MaxHops = 0
+
+	key := "somekey"
+	expected := "expected-result"
+	peerReads := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerReads++
+		// nolint:errcheck
+		w.Write([]byte(expected))
+	}))
+	defer peer.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// nolint:errcheck
+		w.Write([]byte(expected))
+	}))
+	defer upstream.Close()
+
+	p := upstream.URL + "/some-path"
+	req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+p+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both a peer and a super-peer have the key, but requests are not sent to peers.
+	router := mocks.NewMockRouter(map[string][]string{key: {peer.URL}, routing.SuperPeerKey: {peer.URL}})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	c.Params = []gin.Param{
+		{Key: "url", Value: p},
+	}
+
+	pc := pcontext.FromContext(c)
+	pc.Set(pcontext.BlobUrlCtxKey, pcontext.BlobUrl(pc))
+	pc.Set(pcontext.BlobRangeCtxKey, "bytes=0-10")
+	pc.Set(pcontext.FileChunkCtxKey, key)
+
+	r := NewReader(pc, router, 3, ResolveBudget{Floor: 10 * time.Millisecond, Ceiling: 10 * time.Millisecond}, mr).(*reader)
+	b := make([]byte, 10)
+
+	got, source, err := r.PreadRemote(b, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if got != 10 {
+		t.Fatalf("expected %v, got %v", 10, got)
+	} else if string(b) != expected[:10] {
+		t.Fatalf("expected %v, got %v", expected[:10], string(b))
+	}
+
+	if source != metrics.SourceUpstream {
+		t.Errorf("expected: %v, got: %v", metrics.SourceUpstream, source)
+	}
+	if peerReads != 0 {
+		t.Errorf("expected: %v, got: %v", 0, peerReads)
+	}
 }
 
 func TestFstatRemote(t *testing.T) {
@@ -128,7 +258,7 @@ func TestFstatRemote(t *testing.T) {
 	pc.Set(pcontext.BlobUrlCtxKey, pcontext.BlobUrl(pc))
 	pc.Set(pcontext.BlobRangeCtxKey, "bytes=0-0")
 
-	r := NewReader(pc, router, 3, 500*time.Millisecond, mr).(*reader)
+	r := NewReader(pc, router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
 
 	got, err := r.FstatRemote()
 	if err != nil {
@@ -174,7 +304,7 @@ func TestFstatRemotePartialContent(t *testing.T) {
 	pc.Set(pcontext.BlobUrlCtxKey, pcontext.BlobUrl(pc))
 	pc.Set(pcontext.BlobRangeCtxKey, "bytes=0-0")
 
-	r := NewReader(pc, router, 3, 500*time.Millisecond, mr).(*reader)
+	r := NewReader(pc, router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
 
 	got, err := r.FstatRemote()
 	if err != nil {
@@ -214,10 +344,10 @@ func TestP2pRetries(t *testing.T) {
 	router := mocks.NewMockRouter(m)
 	c, _ := gin.CreateTestContext(httptest.NewRecorder())
 	c.Request = req
-	r := NewReader(pcontext.FromContext(c), router, 3, 500*time.Millisecond, mr).(*reader)
+	r := NewReader(pcontext.FromContext(c), router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
 	b := make([]byte, 10)
 
-	got, err := r.doP2p(l, key, 0, 10, operationPreadRemote, b)
+	got, _, err := r.doP2p(l, key, 0, 10, operationPreadRemote, b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -251,10 +381,155 @@ func TestP2pSuccess(t *testing.T) {
 	router := mocks.NewMockRouter(m)
 	c, _ := gin.CreateTestContext(httptest.NewRecorder())
 	c.Request = req
-	r := NewReader(pcontext.FromContext(c), router, 3, 500*time.Millisecond, mr).(*reader)
+	r := NewReader(pcontext.FromContext(c), router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
+	b := make([]byte, 10)
+
+	got, _, err := r.doP2p(l, key, 0, 10, operationPreadRemote, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != 10 {
+		t.Fatalf("expected %v, got %v", 10, got)
+	} else if string(b) != expected[:10] {
+		t.Fatalf("expected %v, got %v", expected[:10], string(b))
+	}
+}
+
+func TestP2pForwarding(t *testing.T) {
+	defer func(m int) { pcontext.MaxHops = m }(pcontext.MaxHops)
+	pcontext.MaxHops = 2
+
+	l := zerolog.Nop()
+	key := "somekey"
+	expected := "expected-result"
+	var hops, via string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops, via = r.Header.Get(pcontext.HopsHeaderKey), r.Header.Get(pcontext.ViaHeaderKey)
+		// nolint:errcheck
+		w.Write([]byte(expected))
+	}))
+	defer svr.Close()
+	router := mocks.NewMockRouter(map[string][]string{key: {svr.URL}})
+
+	for _, tc := range []struct {
+		name     string
+		via      string
+		expected error
+	}{
+		{name: "forwarded", via: "node-a"},
+		{name: "loop", via: "node-a," + pcontext.NodeName, expected: errPeerNotFound},
+	} {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(pcontext.HopsHeaderKey, "1")
+		req.Header.Set(pcontext.ViaHeaderKey, tc.via)
+
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = req
+		r := NewReader(pcontext.FromContext(c), router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
+
+		b := make([]byte, 10)
+		if _, _, err := r.doP2p(l, key, 0, 10, operationPreadRemote, b); err != tc.expected {
+			t.Errorf("%v: expected: %v, got: %v", tc.name, tc.expected, err)
+		}
+	}
+
+	// The request was forwarded as a second hop, through the requester and this node.
+	if hops != "2" {
+		t.Errorf("expected: %v, got: %v", "2", hops)
+	}
+	if expectedVia := "node-a," + pcontext.NodeName; via != expectedVia {
+		t.Errorf("expected: %v, got: %v", expectedVia, via)
+	}
+}
+
+func TestPreadPeerAndOrigin(t *testing.T) {
+	key := "somekey"
+
+	peerSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// nolint:errcheck
+		w.Write([]byte("peer-result-data"))
+	}))
+	defer peerSvr.Close()
+
+	missingSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer missingSvr.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// nolint:errcheck
+		w.Write([]byte("upstream-result"))
+	}))
+	defer upstream.Close()
+
+	p := upstream.URL + "/some-path"
+	req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+p+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mocks.NewMockRouter(map[string][]string{})
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	c.Params = []gin.Param{{Key: "url", Value: p}}
+
+	pc := pcontext.FromContext(c)
+	pc.Set(pcontext.BlobUrlCtxKey, pcontext.BlobUrl(pc))
+	pc.Set(pcontext.FileChunkCtxKey, "otherkey")
+
+	r := NewReader(pc, router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr)
+	b := make([]byte, 10)
+
+	if n, err := r.PreadPeer(context.Background(), routing.PeerInfo{ID: "peer", HttpHost: peerSvr.URL}, key, b, 0); err != nil || string(b[:n]) != "peer-resul" {
+		t.Errorf("expected: %v, got: %v (%v)", "peer-resul", string(b[:n]), err)
+	} else if router.Transferred("peer") != 10 {
+		t.Errorf("expected: %v, got: %v", 10, router.Transferred("peer"))
+	}
+
+	if _, err := r.PreadPeer(context.Background(), routing.PeerInfo{ID: "missing", HttpHost: missingSvr.URL}, key, b, 0); err == nil {
+		t.Error("expected error from peer without the key")
+	} else if got := router.NotCached(key); len(got) != 1 || got[0] != "missing" {
+		t.Errorf("expected: %v, got: %v", []string{"missing"}, got)
+	}
+
+	if n, err := r.PreadOrigin(context.Background(), key, b, 0); err != nil || string(b[:n]) != "upstream-r" {
+		t.Errorf("expected: %v, got: %v (%v)", "upstream-r", string(b[:n]), err)
+	}
+}
+
+func TestP2pFallbackAddress(t *testing.T) {
+	l := zerolog.Nop()
+	m := map[string][]string{}
+	key := "somekey"
+	expected := "expected-result"
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// nolint:errcheck
+		w.Write([]byte(expected))
+	}))
+	defer svr.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	// The first address of the peer is unreachable.
+	m[key] = []string{unreachable.URL + "," + svr.URL}
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mocks.NewMockRouter(m)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	r := NewReader(pcontext.FromContext(c), router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
 	b := make([]byte, 10)
 
-	got, err := r.doP2p(l, key, 0, 10, operationPreadRemote, b)
+	got, _, err := r.doP2p(l, key, 0, 10, operationPreadRemote, b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -264,6 +539,10 @@ func TestP2pSuccess(t *testing.T) {
 	} else if string(b) != expected[:10] {
 		t.Fatalf("expected %v, got %v", expected[:10], string(b))
 	}
+
+	if failed := router.Failed(key); len(failed) != 0 {
+		t.Errorf("expected no failed peers, got %v", failed)
+	}
 }
 
 func TestP2pPeerNotFound(t *testing.T) {
@@ -279,10 +558,10 @@ func TestP2pPeerNotFound(t *testing.T) {
 	c, _ := gin.CreateTestContext(httptest.NewRecorder())
 	c.Request = req
 
-	r := NewReader(pcontext.FromContext(c), router, 3, 500*time.Millisecond, mr).(*reader)
+	r := NewReader(pcontext.FromContext(c), router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
 
 	b := make([]byte, 10)
-	_, err = r.doP2p(l, "key", 0, 10, operationPreadRemote, b)
+	_, _, err = r.doP2p(l, "key", 0, 10, operationPreadRemote, b)
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -307,12 +586,12 @@ func TestP2pNoInfiniteLoops(t *testing.T) {
 	router := mocks.NewMockRouter(m)
 	c, _ := gin.CreateTestContext(httptest.NewRecorder())
 	c.Request = req
-	c.Request.Header.Add(pcontext.P2PHeaderKey, "true")
+	c.Request.Header.Add(pcontext.HopsHeaderKey, "1")
 
-	r := NewReader(pcontext.FromContext(c), router, 3, 500*time.Millisecond, mr).(*reader)
+	r := NewReader(pcontext.FromContext(c), router, 3, ResolveBudget{Floor: 500 * time.Millisecond, Ceiling: 500 * time.Millisecond}, mr).(*reader)
 
 	b := make([]byte, 10)
-	_, err = r.doP2p(l, key, 0, 10, operationPreadRemote, b)
+	_, _, err = r.doP2p(l, key, 0, 10, operationPreadRemote, b)
 	if err == nil {
 		t.Fatal("expected error")
 	}
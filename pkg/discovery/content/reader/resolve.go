@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package reader
+
+import (
+	"time"
+)
+
+const (
+	// discoverySamples is the number of recent discoveries whose durations the resolve timeout is computed from.
+	discoverySamples = 256
+
+	// discoveryMinSamples is the number of discoveries needed before the resolve timeout is computed from their durations.
+	discoveryMinSamples = 32
+)
+
+// ResolveBudget bounds the time spent resolving the providers of a key for a kind of traffic.
+type ResolveBudget struct {
+	// Floor is the minimum resolve timeout, so that resolution is not given up on because of jitter.
+	Floor time.Duration
+
+	// Ceiling is the maximum resolve timeout. It is used until enough discoveries are measured.
+	Ceiling time.Duration
+}
+
+var (
+	// ResolvePercentile is the percentile of the durations of recent discoveries of a first provider that a key is
+	// resolved for, between 0 and 1, within the budget of its traffic. 0 always uses the ceiling of the budget.
+	ResolvePercentile = 0.99
+
+	// InteractiveResolve is the resolve budget of reads on behalf of clients, which wait for the upstream when no peer is
+	// found in time.
+	InteractiveResolve = ResolveBudget{Floor: 5 * time.Millisecond, Ceiling: 50 * time.Millisecond}
+
+	// PrefetchResolve is the resolve budget of prefetching, which no client waits for.
+	PrefetchResolve = ResolveBudget{Floor: 20 * time.Millisecond, Ceiling: 500 * time.Millisecond}
+)
+
+// discoveries are the durations of recent discoveries of a first provider, shared by all readers.
+var discoveries = newDurations(discoverySamples)
+
+// RecordDiscovery records how long it took to find the first provider of a key.
+func RecordDiscovery(d time.Duration) {
+	discoveries.record(d)
+}
+
+// Timeout returns how long to resolve a key for: the ResolvePercentile of the durations of recent discoveries, within
+// the floor and ceiling of the budget.
+// Only resolutions that find a provider are measured, so keys that no peer has do not raise the timeout. Since
+// discoveries slower than the timeout of a budget are not measured, those of the larger prefetch budget let the
+// timeout of interactive traffic grow when peers get slower.
+func (b ResolveBudget) Timeout() time.Duration {
+	if ResolvePercentile <= 0 {
+		return b.Ceiling
+	}
+
+	d, ok := discoveries.percentile(ResolvePercentile, discoveryMinSamples)
+	if !ok {
+		return b.Ceiling
+	}
+	return min(max(d, b.Floor), b.Ceiling)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package reader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveBudgetTimeout(t *testing.T) {
+	defer func(p float64, d *durations) { ResolvePercentile, discoveries = p, d }(ResolvePercentile, discoveries)
+	discoveries = newDurations(discoverySamples)
+	ResolvePercentile = 0.99
+
+	interactive := ResolveBudget{Floor: 5 * time.Millisecond, Ceiling: 50 * time.Millisecond}
+	prefetch := ResolveBudget{Floor: 20 * time.Millisecond, Ceiling: 500 * time.Millisecond}
+
+	// The ceiling is used until enough discoveries are measured.
+	for range discoveryMinSamples - 1 {
+		RecordDiscovery(time.Millisecond)
+	}
+	if got := interactive.Timeout(); got != interactive.Ceiling {
+		t.Errorf("expected: %v, got: %v", interactive.Ceiling, got)
+	}
+
+	// Fast discoveries are bounded by the floor of each budget.
+	RecordDiscovery(time.Millisecond)
+	for _, tc := range []struct {
+		budget   ResolveBudget
+		expected time.Duration
+	}{
+		{budget: interactive, expected: 5 * time.Millisecond},
+		{budget: prefetch, expected: 20 * time.Millisecond},
+	} {
+		if got := tc.budget.Timeout(); got != tc.expected {
+			t.Errorf("expected: %v, got: %v", tc.expected, got)
+		}
+	}
+
+	// Slow discoveries are bounded by the ceiling of each budget.
+	for range discoverySamples {
+		RecordDiscovery(100 * time.Millisecond)
+	}
+	for _, tc := range []struct {
+		budget   ResolveBudget
+		expected time.Duration
+	}{
+		{budget: interactive, expected: 50 * time.Millisecond},
+		{budget: prefetch, expected: 100 * time.Millisecond},
+	} {
+		if got := tc.budget.Timeout(); got != tc.expected {
+			t.Errorf("expected: %v, got: %v", tc.expected, got)
+		}
+	}
+
+	ResolvePercentile = 0
+	if got := prefetch.Timeout(); got != prefetch.Ceiling {
+		t.Errorf("expected: %v, got: %v", prefetch.Ceiling, got)
+	}
+}
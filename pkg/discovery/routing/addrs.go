@@ -0,0 +1,204 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// AddressFamily is an IP address family.
+type AddressFamily string
+
+const (
+	IPv4 AddressFamily = "ipv4"
+	IPv6 AddressFamily = "ipv6"
+)
+
+// PreferredAddressFamily is the address family advertised first, and used to reach peers that advertise addresses of
+// both families. Addresses of the other family are used when a peer has none of the preferred family.
+var PreferredAddressFamily = IPv4
+
+// AllowedCIDRs, when not empty, are the only networks whose addresses are advertised and used to reach peers. Addresses
+// are preferred in the order of the first network they belong to.
+var AllowedCIDRs []netip.Prefix
+
+// DeniedCIDRs are the networks whose addresses are never advertised or used to reach peers.
+var DeniedCIDRs []netip.Prefix
+
+// QUIC makes the router listen for peers over QUIC as well as TCP, on the UDP port of the same number. Peers that
+// listen on both are reached over QUIC.
+var QUIC = false
+
+// ParseCIDRs parses networks in CIDR notation.
+func ParseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %w", err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// ParseAddressFamily parses an address family.
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch f := AddressFamily(s); f {
+	case IPv4, IPv6:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid address family: %v, must be %v or %v", s, IPv4, IPv6)
+	}
+}
+
+// listenAddrs returns the addresses to listen on for the host and port, over QUIC as well as TCP if QUIC is enabled.
+// An empty host listens on all addresses of both families.
+func listenAddrs(host, port string) ([]multiaddr.Multiaddr, error) {
+	var ips []string
+	if host == "" {
+		ips = []string{"/ip4/0.0.0.0", "/ip6/::"}
+	} else if ip := net.ParseIP(host); ip == nil {
+		return nil, fmt.Errorf("invalid ip address: %v", host)
+	} else if ip.To4() != nil {
+		ips = []string{fmt.Sprintf("/ip4/%s", ip)}
+	} else {
+		ips = []string{fmt.Sprintf("/ip6/%s", ip)}
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, fmt.Sprintf("%s/tcp/%s", ip, port))
+		if QUIC {
+			addrs = append(addrs, fmt.Sprintf("%s/udp/%s/quic-v1", ip, port))
+		}
+	}
+
+	var mas []multiaddr.Multiaddr
+	for _, a := range addrs {
+		ma, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, fmt.Errorf("could not create host multi address: %w", err)
+		}
+		mas = append(mas, ma)
+	}
+	return mas, nil
+}
+
+// ipOf returns the IP address of the multiaddr and its family.
+func ipOf(addr multiaddr.Multiaddr) (string, AddressFamily, bool) {
+	if v, err := addr.ValueForProtocol(multiaddr.P_IP4); err == nil && v != "" {
+		return v, IPv4, true
+	}
+	if v, err := addr.ValueForProtocol(multiaddr.P_IP6); err == nil && v != "" {
+		return v, IPv6, true
+	}
+	return "", "", false
+}
+
+// reachable reports whether peers can reach the IP address: it is not a loopback, unspecified or link-local address.
+func reachable(v string) bool {
+	ip := net.ParseIP(v)
+	return ip != nil && !ip.IsLoopback() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast()
+}
+
+// rank returns the position of the first allowed network the IP address belongs to, or false if the address is
+// denied or not allowed.
+func rank(v string) (int, bool) {
+	ip, err := netip.ParseAddr(v)
+	if err != nil {
+		return 0, false
+	}
+	ip = ip.Unmap()
+
+	for _, p := range DeniedCIDRs {
+		if p.Contains(ip) {
+			return 0, false
+		}
+	}
+
+	if len(AllowedCIDRs) == 0 {
+		return 0, true
+	}
+	for i, p := range AllowedCIDRs {
+		if p.Contains(ip) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// byPreference returns the IP addresses that are allowed, ordered by the allowed network they belong to, then with
+// those of the preferred family first.
+func byPreference(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	type ranked struct {
+		addr      multiaddr.Multiaddr
+		rank      int
+		preferred bool
+	}
+
+	var rs []ranked
+	for _, addr := range addrs {
+		v, family, ok := ipOf(addr)
+		if !ok {
+			continue
+		}
+		r, ok := rank(v)
+		if !ok {
+			continue
+		}
+		rs = append(rs, ranked{addr, r, family == PreferredAddressFamily})
+	}
+
+	slices.SortStableFunc(rs, func(a, b ranked) int {
+		switch {
+		case a.rank != b.rank:
+			return a.rank - b.rank
+		case a.preferred == b.preferred:
+			return 0
+		case a.preferred:
+			return -1
+		default:
+			return 1
+		}
+	})
+
+	sorted := make([]multiaddr.Multiaddr, 0, len(rs))
+	for _, r := range rs {
+		sorted = append(sorted, r.addr)
+	}
+	return sorted
+}
+
+// advertisedAddrs returns the reachable addresses that are allowed, in order of preference.
+func advertisedAddrs(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	var advertised []multiaddr.Multiaddr
+	for _, addr := range byPreference(addrs) {
+		if v, _, _ := ipOf(addr); reachable(v) {
+			advertised = append(advertised, addr)
+		}
+	}
+	return advertised
+}
+
+// httpHosts returns the base URLs of the peer at the allowed addresses, serving at the port, in order of preference.
+func httpHosts(addrs []multiaddr.Multiaddr, port string) []string {
+	var hosts []string
+	for _, addr := range byPreference(addrs) {
+		v, _, _ := ipOf(addr)
+		if h := httpHost(v, port); !slices.Contains(hosts, h) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// httpHost returns the base URL of the peer at the IP address and port, with IPv6 addresses in brackets.
+func httpHost(ip, port string) string {
+	return "https://" + net.JoinHostPort(ip, port)
+}
@@ -0,0 +1,218 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestParseAddressFamily(t *testing.T) {
+	for _, tc := range []struct {
+		s           string
+		expected    AddressFamily
+		expectedErr bool
+	}{
+		{"ipv4", IPv4, false},
+		{"ipv6", IPv6, false},
+		{"ipv5", "", true},
+		{"", "", true},
+	} {
+		got, err := ParseAddressFamily(tc.s)
+		if (err != nil) != tc.expectedErr {
+			t.Errorf("%v: expected error: %v, got: %v", tc.s, tc.expectedErr, err)
+		}
+		if got != tc.expected {
+			t.Errorf("expected: %v, got: %v", tc.expected, got)
+		}
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		host        string
+		expected    []string
+		expectedErr bool
+	}{
+		{"0.0.0.0", []string{"/ip4/0.0.0.0/tcp/5003"}, false},
+		{"10.0.0.1", []string{"/ip4/10.0.0.1/tcp/5003"}, false},
+		{"::", []string{"/ip6/::/tcp/5003"}, false},
+		{"fd00::1", []string{"/ip6/fd00::1/tcp/5003"}, false},
+		{"", []string{"/ip4/0.0.0.0/tcp/5003", "/ip6/::/tcp/5003"}, false},
+		{"localhost", nil, true},
+	} {
+		addrs, err := listenAddrs(tc.host, "5003")
+		if (err != nil) != tc.expectedErr {
+			t.Errorf("%v: expected error: %v, got: %v", tc.host, tc.expectedErr, err)
+		}
+
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("expected: %v, got: %v", tc.expected, got)
+		}
+	}
+}
+
+func TestListenAddrsQUIC(t *testing.T) {
+	defer func(q bool) { QUIC = q }(QUIC)
+	QUIC = true
+
+	addrs, err := listenAddrs("", "5003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, addr := range addrs {
+		got = append(got, addr.String())
+	}
+	expected := []string{"/ip4/0.0.0.0/tcp/5003", "/ip4/0.0.0.0/udp/5003/quic-v1", "/ip6/::/tcp/5003", "/ip6/::/udp/5003/quic-v1"}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+}
+
+func TestAdvertisedAddrs(t *testing.T) {
+	prev := PreferredAddressFamily
+	defer func() { PreferredAddressFamily = prev }()
+
+	addrs := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/127.0.0.1/tcp/5003"),
+		multiaddr.StringCast("/ip6/::1/tcp/5003"),
+		multiaddr.StringCast("/ip6/fe80::1/tcp/5003"),
+		multiaddr.StringCast("/ip6/fd00::1/tcp/5003"),
+		multiaddr.StringCast("/ip4/10.0.0.1/tcp/5003"),
+		multiaddr.StringCast("/ip4/10.0.0.2/tcp/5003"),
+		multiaddr.StringCast("/ip6/fd00::2/tcp/5003"),
+	}
+
+	for _, tc := range []struct {
+		family   AddressFamily
+		expected []string
+	}{
+		{IPv4, []string{"/ip4/10.0.0.1/tcp/5003", "/ip4/10.0.0.2/tcp/5003", "/ip6/fd00::1/tcp/5003", "/ip6/fd00::2/tcp/5003"}},
+		{IPv6, []string{"/ip6/fd00::1/tcp/5003", "/ip6/fd00::2/tcp/5003", "/ip4/10.0.0.1/tcp/5003", "/ip4/10.0.0.2/tcp/5003"}},
+	} {
+		PreferredAddressFamily = tc.family
+
+		var got []string
+		for _, addr := range advertisedAddrs(addrs) {
+			got = append(got, addr.String())
+		}
+		if !slices.Equal(got, tc.expected) {
+			t.Errorf("%v: expected: %v, got: %v", tc.family, tc.expected, got)
+		}
+	}
+
+	if got := advertisedAddrs(addrs[:3]); len(got) != 0 {
+		t.Errorf("expected no reachable addresses, got: %v", got)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	got, err := ParseCIDRs([]string{"10.0.0.1/8", "fd00::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/64")}
+	if !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+
+	if _, err := ParseCIDRs([]string{"10.0.0.1"}); err == nil {
+		t.Error("expected error for address without prefix length")
+	}
+}
+
+func TestByPreferenceCIDRs(t *testing.T) {
+	prevAllowed, prevDenied, prevFamily := AllowedCIDRs, DeniedCIDRs, PreferredAddressFamily
+	defer func() { AllowedCIDRs, DeniedCIDRs, PreferredAddressFamily = prevAllowed, prevDenied, prevFamily }()
+	PreferredAddressFamily = IPv4
+
+	addrs := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/192.168.0.1/tcp/5003"),
+		multiaddr.StringCast("/ip4/10.0.0.1/tcp/5003"),
+		multiaddr.StringCast("/ip6/fd00::1/tcp/5003"),
+		multiaddr.StringCast("/ip4/10.1.0.1/tcp/5003"),
+		multiaddr.StringCast("/dns4/example.com/tcp/5003"),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		allowed  []string
+		denied   []string
+		expected []string
+	}{
+		{
+			name:     "no lists",
+			expected: []string{"/ip4/192.168.0.1/tcp/5003", "/ip4/10.0.0.1/tcp/5003", "/ip4/10.1.0.1/tcp/5003", "/ip6/fd00::1/tcp/5003"},
+		},
+		{
+			name:     "denied",
+			denied:   []string{"10.0.0.0/16"},
+			expected: []string{"/ip4/192.168.0.1/tcp/5003", "/ip4/10.1.0.1/tcp/5003", "/ip6/fd00::1/tcp/5003"},
+		},
+		{
+			name:     "allowed in order",
+			allowed:  []string{"fd00::/8", "10.0.0.0/8"},
+			expected: []string{"/ip6/fd00::1/tcp/5003", "/ip4/10.0.0.1/tcp/5003", "/ip4/10.1.0.1/tcp/5003"},
+		},
+		{
+			name:     "denied overrides allowed",
+			allowed:  []string{"10.0.0.0/8"},
+			denied:   []string{"10.1.0.0/16"},
+			expected: []string{"/ip4/10.0.0.1/tcp/5003"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var err error
+			if AllowedCIDRs, err = ParseCIDRs(tc.allowed); err != nil {
+				t.Fatal(err)
+			}
+			if DeniedCIDRs, err = ParseCIDRs(tc.denied); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, addr := range byPreference(addrs) {
+				got = append(got, addr.String())
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("expected: %v, got: %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHttpHosts(t *testing.T) {
+	addrs := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip6/fd00::1/tcp/5003"),
+		multiaddr.StringCast("/ip4/10.0.0.1/tcp/5003"),
+		multiaddr.StringCast("/ip4/10.0.0.1/udp/5003/quic-v1"),
+	}
+
+	expected := []string{"https://10.0.0.1:5001", "https://[fd00::1]:5001"}
+	if got := httpHosts(addrs, "5001"); !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+}
+
+func TestHttpHost(t *testing.T) {
+	for _, tc := range []struct {
+		ip       string
+		expected string
+	}{
+		{"10.0.0.1", "https://10.0.0.1:5001"},
+		{"fd00::1", "https://[fd00::1]:5001"},
+	} {
+		if got := httpHost(tc.ip, "5001"); got != tc.expected {
+			t.Errorf("expected: %v, got: %v", tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/rs/zerolog"
+)
+
+// AdvertiseMode is the granularity at which cached content is advertised.
+type AdvertiseMode string
+
+const (
+	// AdvertiseChunks advertises every cached chunk of a blob under its own key, so that a lookup finds the providers of
+	// a chunk, at the cost of a provider record and a lookup per chunk.
+	AdvertiseChunks AdvertiseMode = "chunk"
+
+	// AdvertiseBlobs advertises a blob once while any of its chunks is cached. A lookup finds the providers of the blob,
+	// which are asked for the chunks they hold at AvailabilityPath.
+	AdvertiseBlobs AdvertiseMode = "blob"
+)
+
+// Advertise is the granularity at which cached content is advertised. Every node must use the same granularity, or
+// nodes will not find the content of each other, so blobs are advertised only once every node supports it.
+var Advertise = AdvertiseChunks
+
+// ParseAdvertiseMode parses an advertisement granularity.
+func ParseAdvertiseMode(s string) (AdvertiseMode, error) {
+	switch m := AdvertiseMode(s); m {
+	case AdvertiseChunks, AdvertiseBlobs:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid advertisement granularity: %v", s)
+	}
+}
+
+// Key returns the key under which the chunk with the key is advertised.
+func (m AdvertiseMode) Key(key string) string {
+	if m == AdvertiseBlobs {
+		return blobOf(key)
+	}
+	return key
+}
+
+const (
+	// AvailabilityPath is the path under which peers serve the availability of a blob, followed by its name.
+	AvailabilityPath = "/chunks/"
+
+	// availabilityTtl is how long the availability of a blob at a peer is reused without asking the peer again.
+	availabilityTtl = 5 * time.Second
+
+	// availabilityTimeout bounds asking a peer for the availability of a blob.
+	availabilityTimeout = 100 * time.Millisecond
+
+	// maxAvailabilitySize is the maximum size of the availability of a blob served by a peer.
+	maxAvailabilitySize = 1024 * 1024
+)
+
+// Availability describes the chunks of a blob that a node holds.
+type Availability struct {
+	// Size is the size of the blob, or zero if not known.
+	Size int64 `json:"size"`
+
+	// Ranges are the byte ranges held, as [start, end) pairs in increasing order.
+	Ranges [][2]int64 `json:"ranges"`
+}
+
+// NewAvailability returns the availability of the chunks of the size at the offsets, in increasing order.
+func NewAvailability(size, chunkSize int64, offsets []int64) Availability {
+	a := Availability{Size: size, Ranges: [][2]int64{}}
+	for _, off := range offsets {
+		end := off + chunkSize
+		if size > 0 {
+			end = min(end, size)
+		}
+
+		if n := len(a.Ranges); n > 0 && a.Ranges[n-1][1] == off {
+			a.Ranges[n-1][1] = end
+		} else {
+			a.Ranges = append(a.Ranges, [2]int64{off, end})
+		}
+	}
+	return a
+}
+
+// Holds returns whether the byte at the offset is held.
+func (a Availability) Holds(offset int64) bool {
+	i := sort.Search(len(a.Ranges), func(i int) bool { return a.Ranges[i][1] > offset })
+	return i < len(a.Ranges) && a.Ranges[i][0] <= offset
+}
+
+// chunkOf returns the blob and the offset of the chunk with the key, or false if the key is not a chunk key.
+func chunkOf(key string) (string, int64, bool) {
+	i := strings.LastIndex(key, chunkKeySep)
+	if i <= 0 {
+		return "", 0, false
+	}
+	off, err := strconv.ParseInt(key[i+len(chunkKeySep):], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:i], off, true
+}
+
+// availabilityEntry is the availability of a blob at a peer.
+type availabilityEntry struct {
+	a       Availability
+	expires time.Time
+}
+
+// availabilityCache caches the availability of blobs at peers. A nil *availabilityCache caches nothing.
+type availabilityCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]availabilityEntry
+	swept   time.Time
+}
+
+// newAvailabilityCache creates a cache whose entries expire after the ttl.
+func newAvailabilityCache(ttl time.Duration) *availabilityCache {
+	return &availabilityCache{ttl: ttl, entries: map[string]availabilityEntry{}, swept: time.Now()}
+}
+
+// add records the availability of the blob at the peer.
+func (c *availabilityCache) add(blob string, id peer.ID, a Availability) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.swept) > c.ttl {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[notCachedKey(blob, id)] = availabilityEntry{a: a, expires: now.Add(c.ttl)}
+}
+
+// get returns the availability of the blob at the peer, if known.
+func (c *availabilityCache) get(blob string, id peer.ID) (Availability, bool) {
+	if c == nil {
+		return Availability{}, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[notCachedKey(blob, id)]
+	if !ok || !time.Now().Before(e.expires) {
+		return Availability{}, false
+	}
+	return e.a, true
+}
+
+// forget removes the availability of the blob at the peer.
+func (c *availabilityCache) forget(blob string, id peer.ID) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.entries, notCachedKey(blob, id))
+}
+
+// holds returns whether the peer is expected to hold the chunk with the key. With blob advertisements, the peer is
+// skipped only if its cached availability shows that it does not hold the chunk. A peer whose availability is not known
+// is expected to hold the chunk, and is asked for it in the background, so that resolving is not held up by the peer.
+func (r *router) holds(ctx context.Context, info PeerInfo, key string) bool {
+	if r.advertise != AdvertiseBlobs || info.ID == r.host.ID() {
+		return true
+	}
+
+	blob, offset, ok := chunkOf(key)
+	if !ok {
+		return true
+	}
+
+	a, ok := r.availability.get(blob, info.ID)
+	if !ok {
+		r.refreshAvailability(ctx, info, blob)
+		return true
+	}
+
+	return a.Holds(offset)
+}
+
+// refreshAvailability asks the peer for the chunks of the blob it holds in the background, once for concurrent callers,
+// and caches the answer. The request outlives ctx, which usually ends with the resolution that needed it.
+func (r *router) refreshAvailability(ctx context.Context, info PeerInfo, blob string) {
+	ctx = context.WithoutCancel(ctx)
+	r.availabilityFetches.DoChan(notCachedKey(blob, info.ID), func() (any, error) {
+		a, err := r.fetchAvailability(ctx, info, blob)
+		if err != nil {
+			zerolog.Ctx(ctx).Debug().Err(err).Str("peer", info.ID.String()).Str("blob", blob).Msg("could not get availability")
+			return nil, err
+		}
+		r.availability.add(blob, info.ID, a)
+		return a, nil
+	})
+}
+
+// fetchAvailability asks the peer for the chunks of the blob it holds. A peer that holds none answers not found.
+func (r *router) fetchAvailability(ctx context.Context, info PeerInfo, blob string) (Availability, error) {
+	ctx, cancel := context.WithTimeout(ctx, availabilityTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.HttpHost+AvailabilityPath+blob, nil)
+	if err != nil {
+		return Availability{}, err
+	}
+
+	resp, err := r.p2pnet.HTTPClientFor(info.ID).Do(req)
+	if err != nil {
+		return Availability{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var a Availability
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxAvailabilitySize)).Decode(&a); err != nil {
+			return Availability{}, err
+		}
+		return a, nil
+
+	case http.StatusNotFound:
+		return Availability{}, nil
+
+	default:
+		return Availability{}, fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+}
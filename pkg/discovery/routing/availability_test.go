@@ -0,0 +1,302 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/azure/peerd/pkg/peernet"
+	"github.com/dgraph-io/ristretto"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+func TestParseAdvertiseMode(t *testing.T) {
+	for _, s := range []string{"chunk", "blob"} {
+		if m, err := ParseAdvertiseMode(s); err != nil || string(m) != s {
+			t.Errorf("expected: %v, got: %v (%v)", s, m, err)
+		}
+	}
+
+	if _, err := ParseAdvertiseMode("layer"); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+}
+
+func TestAdvertiseModeKey(t *testing.T) {
+	for _, tc := range []struct {
+		mode     AdvertiseMode
+		key      string
+		expected string
+	}{
+		{mode: AdvertiseChunks, key: "sha256:abc_1048576", expected: "sha256:abc_1048576"},
+		{mode: AdvertiseBlobs, key: "sha256:abc_1048576", expected: "sha256:abc"},
+		{mode: AdvertiseBlobs, key: "sha256:abc", expected: "sha256:abc"},
+	} {
+		if got := tc.mode.Key(tc.key); got != tc.expected {
+			t.Errorf("%v %v: expected: %v, got: %v", tc.mode, tc.key, tc.expected, got)
+		}
+	}
+}
+
+func TestNewAvailability(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		size     int64
+		offsets  []int64
+		expected [][2]int64
+	}{
+		{name: "none", size: 40, expected: [][2]int64{}},
+		{name: "contiguous", size: 40, offsets: []int64{0, 10, 20}, expected: [][2]int64{{0, 30}}},
+		{name: "gaps", size: 40, offsets: []int64{0, 20, 30}, expected: [][2]int64{{0, 10}, {20, 40}}},
+		{name: "last chunk", size: 35, offsets: []int64{30}, expected: [][2]int64{{30, 35}}},
+		{name: "unknown size", offsets: []int64{30}, expected: [][2]int64{{30, 40}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := NewAvailability(tc.size, 10, tc.offsets)
+			if !slices.Equal(got.Ranges, tc.expected) {
+				t.Errorf("expected: %v, got: %v", tc.expected, got.Ranges)
+			}
+		})
+	}
+
+	a := NewAvailability(40, 10, []int64{0, 20, 30})
+	for off, expected := range map[int64]bool{0: true, 9: true, 10: false, 19: false, 20: true, 39: true, 40: false} {
+		if got := a.Holds(off); got != expected {
+			t.Errorf("offset %v: expected: %v, got: %v", off, expected, got)
+		}
+	}
+}
+
+func TestChunkOf(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		blob   string
+		offset int64
+		ok     bool
+	}{
+		{key: "sha256:abc_1048576", blob: "sha256:abc", offset: 1048576, ok: true},
+		{key: "sha256:abc", ok: false},
+		{key: "sha256:abc_x", ok: false},
+	} {
+		blob, offset, ok := chunkOf(tc.key)
+		if blob != tc.blob || offset != tc.offset || ok != tc.ok {
+			t.Errorf("%v: expected: %v %v %v, got: %v %v %v", tc.key, tc.blob, tc.offset, tc.ok, blob, offset, ok)
+		}
+	}
+}
+
+func TestAvailabilityCache(t *testing.T) {
+	c := newAvailabilityCache(50 * time.Millisecond)
+	a := NewAvailability(20, 10, []int64{0})
+
+	c.add("blob", "peer-1", a)
+	if got, ok := c.get("blob", "peer-1"); !ok || !slices.Equal(got.Ranges, a.Ranges) {
+		t.Errorf("expected: %v, got: %v", a, got)
+	}
+	if _, ok := c.get("blob", "peer-2"); ok {
+		t.Error("expected no availability for another peer")
+	}
+
+	c.forget("blob", "peer-1")
+	if _, ok := c.get("blob", "peer-1"); ok {
+		t.Error("expected forgotten availability")
+	}
+
+	c.add("blob", "peer-1", a)
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("blob", "peer-1"); ok {
+		t.Error("expected expired availability")
+	}
+
+	var nilCache *availabilityCache
+	nilCache.add("blob", "peer-1", a)
+	nilCache.forget("blob", "peer-1")
+	if _, ok := nilCache.get("blob", "peer-1"); ok {
+		t.Error("expected nil cache to cache nothing")
+	}
+}
+
+func TestRouterHolds(t *testing.T) {
+	client, server := newLoopbackHost(t), newLoopbackHost(t)
+
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc(AvailabilityPath+"partial", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_ = json.NewEncoder(w).Encode(NewAvailability(40, 10, []int64{0, 10}))
+	})
+	mux.HandleFunc(AvailabilityPath+"broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	// The peer serves its availability over mutual TLS with the identity of its host.
+	serverNet, err := peernet.New(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = serverNet.DefaultTLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientNet, err := peernet.New(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &router{host: client, p2pnet: clientNet, advertise: AdvertiseBlobs, availability: newAvailabilityCache(time.Minute)}
+	info := PeerInfo{ID: server.ID(), HttpHost: srv.URL}
+
+	// A peer whose availability is not known yet is expected to hold the chunk, and is asked for it in the background.
+	for _, key := range []string{"partial_20", "missing_0", "broken_0"} {
+		if !r.holds(context.Background(), info, key) {
+			t.Errorf("%v: expected the chunk to be held until the availability is known", key)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, blob := range []string{"partial", "missing"} {
+		for _, ok := r.availability.get(blob, info.ID); !ok; _, ok = r.availability.get(blob, info.ID) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the availability of %v to be cached", blob)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for _, tc := range []struct {
+		key      string
+		expected bool
+	}{
+		{key: "partial_0", expected: true},
+		{key: "partial_10", expected: true},
+		{key: "partial_20", expected: false},
+		// A peer that holds none of the blob answers not found.
+		{key: "missing_0", expected: false},
+		// A peer whose availability could not be asked for is expected to hold the chunk.
+		{key: "broken_0", expected: true},
+		{key: "partial", expected: true},
+	} {
+		if got := r.holds(context.Background(), info, tc.key); got != tc.expected {
+			t.Errorf("%v: expected: %v, got: %v", tc.key, tc.expected, got)
+		}
+	}
+
+	// The availability is asked for once while it is cached.
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected: %v, got: %v", 1, got)
+	}
+
+	r.advertise = AdvertiseChunks
+	if !r.holds(context.Background(), info, "partial_20") {
+		t.Error("expected chunk advertisements to be trusted")
+	}
+}
+
+func TestResolveBlobs(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1000, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunk is resolved through the providers of its blob, of which one holds the chunk.
+	contentId, err := createContentId("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             &testHost{id: "host-id"},
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		resolved:         newResolvedCache(time.Minute),
+		advertise:        AdvertiseBlobs,
+		availability:     newAvailabilityCache(time.Minute),
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{contentId.String(): {"10.0.0.1", "10.0.0.2"}},
+		}),
+	}
+	r.availability.add("blob", "10.0.0.1", NewAvailability(20, 10, []int64{0}))
+	r.availability.add("blob", "10.0.0.2", NewAvailability(20, 10, []int64{10}))
+
+	expected := []string{"https://10.0.0.2:5000"}
+	if got := resolveHosts(t, r, "blob_10", 2); !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+
+	// The providers of the blob are reused for its other chunks.
+	if exact, _ := r.resolved.get("blob"); len(exact) != 2 {
+		t.Errorf("expected: %v, got: %v", 2, exact)
+	}
+	expected = []string{"https://10.0.0.1:5000"}
+	if got := resolveHosts(t, r, "blob_0", 2); !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+
+	// A peer that answers it does not have the chunk cached is asked for its availability again.
+	r.ReportNotCached("blob_10", "10.0.0.2")
+	if _, ok := r.availability.get("blob", "10.0.0.2"); ok {
+		t.Error("expected the availability of the peer to be forgotten")
+	}
+	if exact, _ := r.resolved.get("blob"); len(exact) != 1 {
+		t.Errorf("expected: %v, got: %v", 1, exact)
+	}
+}
+
+func TestResolveBlobsDoesNotWaitForAvailability(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1000, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentId, err := createContentId("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientNet, err := peernet.New(newLoopbackHost(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             &testHost{id: "host-id"},
+		p2pnet:           clientNet,
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		resolved:         newResolvedCache(time.Minute),
+		advertise:        AdvertiseBlobs,
+		availability:     newAvailabilityCache(time.Minute),
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{contentId.String(): {"10.0.0.1", "10.0.0.2"}},
+		}),
+	}
+
+	// The availability of a provider is being asked for, and does not arrive until the end of the test.
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go r.availabilityFetches.Do(notCachedKey("blob", "10.0.0.1"), func() (any, error) {
+		close(started)
+		<-release
+		return Availability{}, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	peers, err := r.Resolve(ctx, "blob_0", false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		select {
+		case <-peers:
+		case <-ctx.Done():
+			t.Fatal("expected the providers to be sent without waiting for their availability")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/azure/peerd/pkg/discovery/bootstrap"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multistream"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// identifyTimeout bounds identifying the peer at a bootstrap address.
+	identifyTimeout = 5 * time.Second
+
+	// identifyConcurrency is the number of bootstrap addresses identified concurrently.
+	identifyConcurrency = 8
+)
+
+// Bootstrap are the specifications of the sources of the peers the DHT bootstraps from, see bootstrap.New.
+var Bootstrap = []string{bootstrap.KindLeader}
+
+// bootstrapPeers returns the peers found by the source, other than the host itself.
+// Peers found at addresses without a peer ID are identified by dialing them.
+func bootstrapPeers(ctx context.Context, h host.Host, src bootstrap.Source) ([]peer.AddrInfo, error) {
+	log := zerolog.Ctx(ctx)
+
+	addrs, err := src.Addrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	byId := map[peer.ID][]multiaddr.Multiaddr{}
+	var order []peer.ID
+	add := func(id peer.ID, addr multiaddr.Multiaddr) {
+		lock.Lock()
+		defer lock.Unlock()
+		if _, ok := byId[id]; !ok {
+			order = append(order, id)
+		}
+		byId[id] = append(byId[id], addr)
+	}
+
+	g := errgroup.Group{}
+	g.SetLimit(identifyConcurrency)
+	for _, addr := range addrs {
+		transport, id := peer.SplitAddr(addr)
+		if transport == nil {
+			continue
+		}
+		if id != "" {
+			add(id, transport)
+			continue
+		}
+
+		g.Go(func() error {
+			id, err := identify(ctx, h, transport)
+			if err != nil {
+				log.Debug().Err(err).Str("addr", transport.String()).Msg("could not identify bootstrap peer")
+				return nil
+			}
+			add(id, transport)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	var infos []peer.AddrInfo
+	for _, id := range order {
+		if id != h.ID() {
+			infos = append(infos, peer.AddrInfo{ID: id, Addrs: byId[id]})
+		}
+	}
+	return infos, nil
+}
+
+// identify returns the ID of the peer listening at the address, which it proves in the noise handshake of a
+// connection that is closed right after.
+func identify(ctx context.Context, h host.Host, addr multiaddr.Multiaddr) (peer.ID, error) {
+	ctx, cancel := context.WithTimeout(ctx, identifyTimeout)
+	defer cancel()
+
+	var d manet.Dialer
+	conn, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if err := multistream.SelectProtoOrFail(noise.ID, conn); err != nil {
+		return "", err
+	}
+
+	tpt, err := noise.New(noise.ID, h.Peerstore().PrivKey(h.ID()), nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Any peer is accepted, but the handshake still verifies it holds the key of the ID it presents.
+	st, err := tpt.WithSessionOptions(noise.DisablePeerIDCheck())
+	if err != nil {
+		return "", err
+	}
+
+	sc, err := st.SecureOutbound(ctx, conn, "")
+	if err != nil {
+		return "", err
+	}
+	defer sc.Close()
+
+	return sc.RemotePeer(), nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/azure/peerd/pkg/discovery/bootstrap"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestBootstrapPeers(t *testing.T) {
+	h1 := newLoopbackHost(t)
+	h2 := newLoopbackHost(t)
+	h3 := newLoopbackHost(t)
+
+	h2Addr := tcpAddr(t, h2)
+	h3Addr := tcpAddr(t, h3)
+	h3P2pAddr, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: h3.ID(), Addrs: []multiaddr.Multiaddr{h3Addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := bootstrap.Static(
+		tcpAddr(t, h1), // self, identified and skipped
+		h2Addr,         // identified
+		h3P2pAddr[0],   // already identified
+		multiaddr.StringCast("/ip4/127.0.0.1/tcp/1"), // unreachable
+	)
+
+	got, err := bootstrapPeers(context.Background(), h1, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[peer.ID]multiaddr.Multiaddr{h2.ID(): h2Addr, h3.ID(): h3Addr}
+	if len(got) != len(expected) {
+		t.Fatalf("expected: %v peers, got: %v", len(expected), got)
+	}
+	for _, info := range got {
+		addr, ok := expected[info.ID]
+		if !ok {
+			t.Errorf("unexpected peer: %v", info.ID)
+			continue
+		}
+		if len(info.Addrs) != 1 || !info.Addrs[0].Equal(addr) {
+			t.Errorf("expected: %v, got: %v", addr, info.Addrs)
+		}
+	}
+}
+
+// newLoopbackHost returns a host listening on a loopback address, which is closed when the test ends.
+func newLoopbackHost(t *testing.T) host.Host {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+// tcpAddr returns the TCP address the host listens on.
+func tcpAddr(t *testing.T, h host.Host) multiaddr.Multiaddr {
+	for _, addr := range h.Network().ListenAddresses() {
+		if _, err := addr.ValueForProtocol(multiaddr.P_TCP); err == nil {
+			return addr
+		}
+	}
+	t.Fatal("host does not listen on TCP")
+	return nil
+}
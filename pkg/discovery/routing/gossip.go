@@ -0,0 +1,674 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	corerouting "github.com/libp2p/go-libp2p/core/routing"
+	"github.com/rs/zerolog"
+)
+
+// DiscoveryMode is how the providers of content are found.
+type DiscoveryMode string
+
+const (
+	// DiscoveryDHT finds providers in a Kademlia DHT, which scales to large clusters.
+	DiscoveryDHT DiscoveryMode = "dht"
+
+	// DiscoveryGossip announces cached and evicted content to every peer, each of which keeps an index of the providers
+	// of content, so that providers are found without a lookup. It suits small and medium clusters.
+	DiscoveryGossip DiscoveryMode = "gossip"
+
+	// DiscoveryTracker reports cached and evicted content to a tracker, a node elected with a Kubernetes lease, which
+	// keeps an index of the providers of content and answers lookups from it. It trades the resilience of a DHT for
+	// deterministic lookups.
+	DiscoveryTracker DiscoveryMode = "tracker"
+)
+
+// Discovery is how the providers of content are found.
+var Discovery = DiscoveryDHT
+
+// ParseDiscoveryMode parses a discovery mode.
+func ParseDiscoveryMode(s string) (DiscoveryMode, error) {
+	switch m := DiscoveryMode(s); m {
+	case DiscoveryDHT, DiscoveryGossip, DiscoveryTracker:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid discovery mode: %v", s)
+	}
+}
+
+const (
+	// gossipProtocol is the protocol used to announce the content provided and withdrawn by a peer, over a stream to
+	// the peer that carries one announcement per line and is kept open while announcements are sent.
+	gossipProtocol = protocol.ID("/peerd/gossip/1.1.0")
+
+	// gossipProtocolV1 is the protocol of nodes that carry one announcement per stream.
+	gossipProtocolV1 = protocol.ID("/peerd/gossip/1.0.0")
+
+	// gossipInterval is the interval at which the content provided and withdrawn by this node is announced.
+	gossipInterval = 100 * time.Millisecond
+
+	// gossipHops is the number of times an announcement is forwarded from peer to peer.
+	gossipHops = 6
+
+	// gossipFanout is the number of peers, chosen at random, that an announcement is sent or forwarded to.
+	gossipFanout = 6
+
+	// gossipQueue is the number of announcements queued for a peer, beyond which announcements to it are dropped.
+	gossipQueue = 64
+
+	// gossipIdleTtl is how long the stream to a peer is kept open without announcements.
+	gossipIdleTtl = time.Minute
+
+	// gossipPeers is the number of peers below which this node connects to the peers it hears announcements from.
+	gossipPeers = 16
+
+	// gossipTimeout bounds sending an announcement to a peer.
+	gossipTimeout = 5 * time.Second
+
+	// gossipSeenTtl is how long an announcement is remembered, so that it is not applied or forwarded again.
+	gossipSeenTtl = time.Minute
+
+	// maxGossipKeys is the maximum number of keys in a single announcement.
+	maxGossipKeys = 4096
+
+	// maxGossipSize is the maximum size of an announcement.
+	maxGossipSize = 1024 * 1024
+
+	// gossipBootstrapInterval is the interval at which the bootstrap peers are connected to.
+	gossipBootstrapInterval = time.Minute
+)
+
+// gossipMessage is an announcement of the content provided and withdrawn by its origin.
+type gossipMessage struct {
+	// Origin is the peer that provides or withdraws the content.
+	Origin peer.ID `json:"origin"`
+
+	// Addrs are the addresses of the origin.
+	Addrs []string `json:"addrs"`
+
+	// Seq identifies the announcement among those of the origin, which are numbered in increasing order.
+	Seq uint64 `json:"seq"`
+
+	// Hops is the number of times the announcement may still be forwarded.
+	Hops int `json:"hops"`
+
+	// Provide are the content IDs provided by the origin.
+	Provide []string `json:"provide,omitempty"`
+
+	// Withdraw are the content IDs withdrawn by the origin.
+	Withdraw []string `json:"withdraw,omitempty"`
+
+	// Key is the public key of the origin, if it cannot be extracted from its ID.
+	Key []byte `json:"key,omitempty"`
+
+	// Signature is the signature of the announcement by the origin, without Hops, which changes as it is forwarded.
+	Signature []byte `json:"sig,omitempty"`
+}
+
+// signedBytes returns the bytes of the announcement that its origin signs.
+func (m *gossipMessage) signedBytes() ([]byte, error) {
+	c := *m
+	c.Hops, c.Signature = 0, nil
+	return json.Marshal(&c)
+}
+
+// sign signs the announcement with the private key of its origin.
+func (m *gossipMessage) sign(key crypto.PrivKey) error {
+	if _, err := m.Origin.ExtractPublicKey(); err != nil {
+		if m.Key, err = crypto.MarshalPublicKey(key.GetPublic()); err != nil {
+			return err
+		}
+	}
+
+	b, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	m.Signature, err = key.Sign(b)
+	return err
+}
+
+// verify reports whether the announcement is signed by its origin.
+func (m *gossipMessage) verify() bool {
+	pub, err := m.Origin.ExtractPublicKey()
+	if err != nil {
+		if pub, err = crypto.UnmarshalPublicKey(m.Key); err != nil || !m.Origin.MatchesPublicKey(pub) {
+			return false
+		}
+	}
+
+	b, err := m.signedBytes()
+	if err != nil {
+		return false
+	}
+	ok, err := pub.Verify(b, m.Signature)
+	return err == nil && ok
+}
+
+// gossipRecord is the latest announcement by a peer of providing or withdrawing a content.
+type gossipRecord struct {
+	// at is when the announcement was applied.
+	at time.Time
+
+	// seq is the sequence number of the announcement.
+	seq uint64
+
+	// withdrawn is set if the content was withdrawn. The record is kept until it expires, so that an announcement of
+	// providing the content that was sent before and arrives late is ignored.
+	withdrawn bool
+}
+
+// gossip is content routing that announces the content provided and withdrawn by this node to its peers, which forward
+// it to theirs, and keeps an index of the providers of content from the announcements it receives. Providers are found
+// in the index without a lookup. Announcements of providing expire after MaxRecordAge, unless the content is provided
+// again. A peer that connects is sent the content provided by this node.
+//
+// Each peer forwards an announcement it has not seen to gossipFanout of its peers chosen at random, up to gossipHops
+// times. Announcements to a peer are queued and sent over one stream, and dropped while the queue is full.
+// Announcements are signed by their origin, and those that are not are dropped. Since announcements may arrive
+// out of order, one is only applied to the content and addresses of its origin that no later announcement was applied
+// to. A nil *gossip announces nothing.
+type gossip struct {
+	ctx  context.Context
+	host host.Host
+	seq  atomic.Uint64
+
+	lock     sync.Mutex
+	index    map[string]map[peer.ID]gossipRecord
+	origins  map[peer.ID]gossipRecord
+	seen     map[string]time.Time
+	swept    time.Time
+	provide  []string
+	withdraw []string
+	peers    map[peer.ID]chan *gossipMessage
+}
+
+var _ corerouting.ContentRouting = &gossip{}
+
+// newGossip creates gossip content routing for the host, which stops announcing when ctx is done.
+func newGossip(ctx context.Context, h host.Host) *gossip {
+	g := &gossip{
+		ctx:     ctx,
+		host:    h,
+		index:   map[string]map[peer.ID]gossipRecord{},
+		origins: map[peer.ID]gossipRecord{},
+		seen:    map[string]time.Time{},
+		swept:   time.Now(),
+		peers:   map[peer.ID]chan *gossipMessage{},
+	}
+	// Sequence numbers start from the time, so that the announcements of a restarted node are not taken as seen.
+	g.seq.Store(uint64(time.Now().UnixNano()))
+	return g
+}
+
+// start handles the announcements of peers, greets peers as they connect, and announces the content provided and
+// withdrawn by this node every gossipInterval until ctx is done.
+func (g *gossip) start() {
+	g.host.SetStreamHandler(gossipProtocol, g.handle)
+	g.host.SetStreamHandler(gossipProtocolV1, g.handle)
+
+	g.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			go g.greet(c.RemotePeer())
+		},
+	})
+
+	go func() {
+		ticker := time.NewTicker(gossipInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-g.ctx.Done():
+				return
+			case <-ticker.C:
+				g.announce()
+			}
+		}
+	}()
+}
+
+// Provide records that this node provides the content, and announces it to peers if announce is set.
+func (g *gossip) Provide(_ context.Context, c cid.Cid, announce bool) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.update(c.String(), g.host.ID(), gossipRecord{at: time.Now()})
+	if announce {
+		g.withdraw = slices.DeleteFunc(g.withdraw, func(s string) bool { return s == c.String() })
+		g.provide = append(g.provide, c.String())
+	}
+	return nil
+}
+
+// withdrawContent records that this node no longer provides the content, and announces it to peers.
+func (g *gossip) withdrawContent(c cid.Cid) {
+	if g == nil {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.remove(c.String(), g.host.ID())
+	g.provide = slices.DeleteFunc(g.provide, func(s string) bool { return s == c.String() })
+	g.withdraw = append(g.withdraw, c.String())
+}
+
+// FindProvidersAsync returns up to count providers of the content from the index, or all of them if count is 0.
+func (g *gossip) FindProvidersAsync(_ context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	g.lock.Lock()
+	now := time.Now()
+	var ids []peer.ID
+	for id, r := range g.index[c.String()] {
+		if !r.withdrawn && now.Sub(r.at) < MaxRecordAge {
+			ids = append(ids, id)
+		}
+	}
+	g.lock.Unlock()
+
+	if count > 0 && len(ids) > count {
+		ids = ids[:count]
+	}
+
+	ch := make(chan peer.AddrInfo, len(ids))
+	for _, id := range ids {
+		addrs := g.host.Peerstore().Addrs(id)
+		if id == g.host.ID() {
+			addrs = g.host.Addrs()
+		}
+		ch <- peer.AddrInfo{ID: id, Addrs: addrs}
+	}
+	close(ch)
+	return ch
+}
+
+// update records the announcement by the peer of providing or withdrawing the content, unless a later one was recorded.
+// It must be called with the lock held.
+func (g *gossip) update(c string, id peer.ID, r gossipRecord) {
+	provs, ok := g.index[c]
+	if !ok {
+		provs = map[peer.ID]gossipRecord{}
+		g.index[c] = provs
+	}
+	if prev, ok := provs[id]; ok && prev.seq > r.seq {
+		return
+	}
+	provs[id] = r
+}
+
+// remove records that the peer no longer provides the content. It must be called with the lock held.
+func (g *gossip) remove(c string, id peer.ID) {
+	delete(g.index[c], id)
+	if len(g.index[c]) == 0 {
+		delete(g.index, c)
+	}
+}
+
+// sweep removes expired announcements, and forgets the announcements seen. It must be called with the lock held.
+func (g *gossip) sweep(now time.Time) {
+	for c, provs := range g.index {
+		for id, r := range provs {
+			if now.Sub(r.at) >= MaxRecordAge {
+				delete(provs, id)
+			}
+		}
+		if len(provs) == 0 {
+			delete(g.index, c)
+		}
+	}
+
+	for id, r := range g.origins {
+		if now.Sub(r.at) >= MaxRecordAge {
+			delete(g.origins, id)
+		}
+	}
+
+	for k, at := range g.seen {
+		if now.Sub(at) >= gossipSeenTtl {
+			delete(g.seen, k)
+		}
+	}
+	g.swept = now
+}
+
+// see records that the announcement was seen, and returns whether it was seen before. It must be called with the lock
+// held.
+func (g *gossip) see(msg *gossipMessage) bool {
+	now := time.Now()
+	if now.Sub(g.swept) > gossipSeenTtl {
+		g.sweep(now)
+	}
+
+	k := msg.Origin.String() + "/" + strconv.FormatUint(msg.Seq, 10)
+	if _, ok := g.seen[k]; ok {
+		return true
+	}
+	g.seen[k] = now
+	return false
+}
+
+// message creates an announcement by this node of the content provided and withdrawn, forwarded up to hops times.
+// It must be called with the lock held.
+func (g *gossip) message(provide, withdraw []string, hops int) *gossipMessage {
+	var addrs []string
+	for _, a := range g.host.Addrs() {
+		addrs = append(addrs, a.String())
+	}
+
+	msg := &gossipMessage{
+		Origin:   g.host.ID(),
+		Addrs:    addrs,
+		Seq:      g.seq.Add(1),
+		Hops:     hops,
+		Provide:  provide,
+		Withdraw: withdraw,
+	}
+	if key := g.host.Peerstore().PrivKey(g.host.ID()); key == nil {
+		zerolog.Ctx(g.ctx).Error().Msg("no private key to sign announcements with")
+	} else if err := msg.sign(key); err != nil {
+		zerolog.Ctx(g.ctx).Error().Err(err).Msg("could not sign announcement")
+	}
+	g.see(msg)
+	return msg
+}
+
+// announce sends the content provided and withdrawn since the last announcement to gossipFanout connected peers.
+func (g *gossip) announce() {
+	g.lock.Lock()
+	var msgs []*gossipMessage
+	for len(g.provide) > 0 || len(g.withdraw) > 0 {
+		n := min(len(g.withdraw), maxGossipKeys)
+		withdraw := g.withdraw[:n]
+		g.withdraw = g.withdraw[n:]
+
+		m := min(len(g.provide), maxGossipKeys-n)
+		provide := g.provide[:m]
+		g.provide = g.provide[m:]
+
+		msgs = append(msgs, g.message(provide, withdraw, gossipHops))
+	}
+	g.provide, g.withdraw = nil, nil
+	g.lock.Unlock()
+
+	for _, msg := range msgs {
+		g.forward(msg, "")
+	}
+}
+
+// greet sends the peer the content provided by this node, so that a peer that connects learns of it before it is
+// provided again. The greeting is not forwarded.
+func (g *gossip) greet(id peer.ID) {
+	g.lock.Lock()
+	var provided []string
+	for c, provs := range g.index {
+		if r, ok := provs[g.host.ID()]; ok && !r.withdrawn {
+			provided = append(provided, c)
+		}
+	}
+
+	var msgs []*gossipMessage
+	for chunk := range slices.Chunk(provided, maxGossipKeys) {
+		msgs = append(msgs, g.message(chunk, nil, 0))
+	}
+	g.lock.Unlock()
+
+	for _, msg := range msgs {
+		if !g.enqueue(id, msg) {
+			zerolog.Ctx(g.ctx).Debug().Str("peer", id.String()).Msg("could not greet peer, queue full")
+			return
+		}
+	}
+}
+
+// forward sends the announcement to gossipFanout connected peers chosen at random, other than the one it was received
+// from and its origin.
+func (g *gossip) forward(msg *gossipMessage, from peer.ID) {
+	for _, id := range fanout(g.host.Network().Peers(), from, msg.Origin) {
+		if !g.enqueue(id, msg) {
+			zerolog.Ctx(g.ctx).Trace().Str("peer", id.String()).Msg("dropping announcement, queue full")
+		}
+	}
+}
+
+// fanout returns up to gossipFanout of the peers chosen at random, other than from and origin.
+func fanout(peers []peer.ID, from, origin peer.ID) []peer.ID {
+	peers = slices.DeleteFunc(slices.Clone(peers), func(id peer.ID) bool { return id == from || id == origin })
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	return peers[:min(len(peers), gossipFanout)]
+}
+
+// enqueue queues the announcement to be sent to the peer, and returns false if the queue of the peer is full.
+func (g *gossip) enqueue(id peer.ID, msg *gossipMessage) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	queue, ok := g.peers[id]
+	if !ok {
+		queue = make(chan *gossipMessage, gossipQueue)
+		g.peers[id] = queue
+		go g.deliver(id, queue)
+	}
+
+	select {
+	case queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver sends the announcements queued for the peer over one stream, which is opened again if it fails, until the
+// queue has been empty for gossipIdleTtl. Peers that speak gossipProtocolV1 are sent one announcement per stream.
+func (g *gossip) deliver(id peer.ID, queue chan *gossipMessage) {
+	var s network.Stream
+	defer func() {
+		if s != nil {
+			_ = s.Close()
+		}
+	}()
+
+	idle := time.NewTimer(gossipIdleTtl)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+
+		case <-idle.C:
+			g.lock.Lock()
+			if len(queue) == 0 {
+				delete(g.peers, id)
+				g.lock.Unlock()
+				return
+			}
+			g.lock.Unlock()
+			idle.Reset(gossipIdleTtl)
+
+		case msg := <-queue:
+			idle.Reset(gossipIdleTtl)
+
+			// A stream that failed, such as one closed by the peer, is opened again once.
+			var err error
+			for range 2 {
+				if s, err = g.send(s, id, msg); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				zerolog.Ctx(g.ctx).Trace().Err(err).Str("peer", id.String()).Msg("could not send announcement")
+			}
+		}
+	}
+}
+
+// send sends the announcement to the peer over the stream, opening one if s is nil, and returns the stream to send the
+// next announcement over, or nil if it is closed. The peer is not dialed if it is not connected.
+func (g *gossip) send(s network.Stream, id peer.ID, msg *gossipMessage) (network.Stream, error) {
+	if s == nil {
+		ctx, cancel := context.WithTimeout(network.WithNoDial(g.ctx, "gossip"), gossipTimeout)
+		defer cancel()
+
+		var err error
+		if s, err = g.host.NewStream(ctx, id, gossipProtocol, gossipProtocolV1); err != nil {
+			return nil, err
+		}
+	}
+
+	_ = s.SetWriteDeadline(time.Now().Add(gossipTimeout))
+	if err := json.NewEncoder(s).Encode(msg); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+
+	if s.Protocol() == gossipProtocolV1 {
+		return nil, s.Close()
+	}
+	return s, nil
+}
+
+// handle receives the announcements sent on the stream, one per line, until the peer closes it or sends none for
+// twice gossipIdleTtl.
+func (g *gossip) handle(s network.Stream) {
+	defer s.Close()
+
+	r := bufio.NewReader(s)
+	for {
+		_ = s.SetReadDeadline(time.Now().Add(2 * gossipIdleTtl))
+		line, err := readLine(r, maxGossipSize)
+		if len(bytes.TrimSpace(line)) > 0 {
+			var msg gossipMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				_ = s.Reset()
+				return
+			}
+			g.receive(&msg, s.Conn().RemotePeer())
+		}
+
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				_ = s.Reset()
+			}
+			return
+		}
+	}
+}
+
+// readLine reads a line of at most max bytes from the reader.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > max {
+			return nil, fmt.Errorf("line exceeds %v bytes", max)
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+// receive applies the announcement received from the peer to the index, and forwards it if it may be forwarded.
+// Announcements that are not signed by their origin are dropped.
+func (g *gossip) receive(msg *gossipMessage, from peer.ID) {
+	if msg.Origin == "" || msg.Origin == g.host.ID() || len(msg.Provide)+len(msg.Withdraw) > maxGossipKeys {
+		return
+	}
+	if !msg.verify() {
+		zerolog.Ctx(g.ctx).Debug().Str("origin", msg.Origin.String()).Str("peer", from.String()).Msg("dropping announcement not signed by its origin")
+		return
+	}
+
+	if !g.apply(msg) {
+		return
+	}
+
+	if msg.Hops > 0 {
+		msg.Hops--
+		g.forward(msg, from)
+	}
+}
+
+// apply records the content provided and withdrawn by the origin of the announcement, and the addresses of the origin,
+// unless later announcements by the origin were applied to them. It returns false if the announcement was seen before.
+func (g *gossip) apply(msg *gossipMessage) bool {
+	addrs := parseAddrs(msg.Addrs)
+
+	g.lock.Lock()
+	if g.see(msg) {
+		g.lock.Unlock()
+		return false
+	}
+
+	now := time.Now()
+	for _, c := range msg.Provide {
+		g.update(c, msg.Origin, gossipRecord{at: now, seq: msg.Seq})
+	}
+	for _, c := range msg.Withdraw {
+		g.update(c, msg.Origin, gossipRecord{at: now, seq: msg.Seq, withdrawn: true})
+	}
+
+	latest := true
+	if prev, ok := g.origins[msg.Origin]; ok && prev.seq > msg.Seq {
+		latest = false
+	} else {
+		g.origins[msg.Origin] = gossipRecord{at: now, seq: msg.Seq}
+	}
+	g.lock.Unlock()
+
+	if len(addrs) > 0 && latest {
+		g.host.Peerstore().AddAddrs(msg.Origin, addrs, MaxRecordAge)
+	}
+
+	// Peers heard of are connected to while there are few, so that announcements reach every peer.
+	if len(addrs) > 0 && g.host.Network().Connectedness(msg.Origin) != network.Connected && len(g.host.Network().Peers()) < gossipPeers {
+		go func() {
+			ctx, cancel := context.WithTimeout(g.ctx, gossipTimeout)
+			defer cancel()
+			_ = g.host.Connect(ctx, peer.AddrInfo{ID: msg.Origin, Addrs: addrs})
+		}()
+	}
+	return true
+}
+
+// connect connects to the peers returned by bootstrap now and every gossipBootstrapInterval until ctx is done.
+func (g *gossip) connect(bootstrap func() []peer.AddrInfo) {
+	for {
+		for _, info := range bootstrap() {
+			ctx, cancel := context.WithTimeout(g.ctx, gossipTimeout)
+			if err := g.host.Connect(ctx, info); err != nil {
+				zerolog.Ctx(g.ctx).Debug().Err(err).Str("peer", info.ID.String()).Msg("could not connect to bootstrap peer")
+			}
+			cancel()
+		}
+
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-time.After(gossipBootstrapInterval):
+		}
+	}
+}
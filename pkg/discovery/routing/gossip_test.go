@@ -0,0 +1,409 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+func TestParseDiscoveryMode(t *testing.T) {
+	for _, s := range []string{"dht", "gossip", "tracker"} {
+		if m, err := ParseDiscoveryMode(s); err != nil || string(m) != s {
+			t.Errorf("expected: %v, got: %v (%v)", s, m, err)
+		}
+	}
+
+	if _, err := ParseDiscoveryMode("pubsub"); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+}
+
+func TestGossipIndex(t *testing.T) {
+	h := newLoopbackHost(t)
+	g := newGossip(context.Background(), h)
+
+	contentId, err := createContentId("blob_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Provide(context.Background(), contentId, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexedProviders(g, contentId); !slices.Equal(got, []peer.ID{h.ID()}) {
+		t.Errorf("expected: %v, got: %v", []peer.ID{h.ID()}, got)
+	}
+	if !slices.Equal(g.provide, []string{contentId.String()}) {
+		t.Errorf("expected: %v, got: %v", []string{contentId.String()}, g.provide)
+	}
+
+	// A key withdrawn before it is announced is announced as withdrawn only.
+	g.withdrawContent(contentId)
+	if got := indexedProviders(g, contentId); len(got) != 0 {
+		t.Errorf("expected no providers, got: %v", got)
+	}
+	if len(g.provide) != 0 || !slices.Equal(g.withdraw, []string{contentId.String()}) {
+		t.Errorf("unexpected pending announcements, provide: %v, withdraw: %v", g.provide, g.withdraw)
+	}
+
+	// Announcements are applied once.
+	msg := &gossipMessage{Origin: "peer-1", Seq: 1, Provide: []string{contentId.String()}}
+	if !g.apply(msg) {
+		t.Error("expected announcement to be applied")
+	}
+	if g.apply(msg) {
+		t.Error("expected announcement seen before to be ignored")
+	}
+	if got := indexedProviders(g, contentId); !slices.Equal(got, []peer.ID{"peer-1"}) {
+		t.Errorf("expected: %v, got: %v", []peer.ID{"peer-1"}, got)
+	}
+
+	// Announcements expire.
+	g.index[contentId.String()]["peer-1"] = gossipRecord{at: time.Now().Add(-MaxRecordAge), seq: 1}
+	if got := indexedProviders(g, contentId); len(got) != 0 {
+		t.Errorf("expected no providers, got: %v", got)
+	}
+
+	var nilGossip *gossip
+	nilGossip.withdrawContent(contentId)
+}
+
+func TestGossipApplyInOrder(t *testing.T) {
+	g := newGossip(context.Background(), newLoopbackHost(t))
+
+	contentId, err := createContentId("blob_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An announcement of providing that arrives after a later withdrawal does not resurrect the record.
+	g.apply(&gossipMessage{Origin: "peer-1", Seq: 2, Withdraw: []string{contentId.String()}})
+	g.apply(&gossipMessage{Origin: "peer-1", Seq: 1, Provide: []string{contentId.String()}})
+	if got := indexedProviders(g, contentId); len(got) != 0 {
+		t.Errorf("expected no providers, got: %v", got)
+	}
+
+	g.apply(&gossipMessage{Origin: "peer-1", Seq: 3, Provide: []string{contentId.String()}})
+	if got := indexedProviders(g, contentId); !slices.Equal(got, []peer.ID{"peer-1"}) {
+		t.Errorf("expected: %v, got: %v", []peer.ID{"peer-1"}, got)
+	}
+}
+
+func TestGossipMessageSignature(t *testing.T) {
+	h, other := newLoopbackHost(t), newLoopbackHost(t)
+	g := newGossip(context.Background(), h)
+
+	g.lock.Lock()
+	msg := g.message([]string{"content"}, nil, gossipHops)
+	g.lock.Unlock()
+	if !msg.verify() {
+		t.Error("expected the announcement to be signed by its origin")
+	}
+
+	// Forwarding changes the hops only.
+	msg.Hops--
+	if !msg.verify() {
+		t.Error("expected a forwarded announcement to be signed by its origin")
+	}
+
+	for name, tamper := range map[string]func(m *gossipMessage){
+		"withdraw": func(m *gossipMessage) { m.Withdraw = []string{"content"} },
+		"addrs":    func(m *gossipMessage) { m.Addrs = []string{"/ip4/10.0.0.1/tcp/5000"} },
+		"seq":      func(m *gossipMessage) { m.Seq++ },
+		"origin":   func(m *gossipMessage) { m.Origin = other.ID() },
+		"unsigned": func(m *gossipMessage) { m.Signature = nil },
+	} {
+		t.Run(name, func(t *testing.T) {
+			tampered := *msg
+			tamper(&tampered)
+			if tampered.verify() {
+				t.Error("expected the tampered announcement not to verify")
+			}
+		})
+	}
+}
+
+func TestGossipMessageSignatureWithKey(t *testing.T) {
+	// The ID of a peer with an ECDSA key is a hash of the key, so the key is sent with the announcement.
+	key, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &gossipMessage{Origin: id, Seq: 1, Provide: []string{"content"}}
+	if err := msg.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Key) == 0 || !msg.verify() {
+		t.Error("expected the announcement to be signed by its origin")
+	}
+
+	other, _, err := crypto.GenerateKeyPair(crypto.ECDSA, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Key, err = crypto.MarshalPublicKey(other.GetPublic()); err != nil {
+		t.Fatal(err)
+	}
+	if msg.verify() {
+		t.Error("expected an announcement with the key of another peer not to verify")
+	}
+}
+
+func TestGossipDropsForgedAnnouncements(t *testing.T) {
+	h, forger, origin := newLoopbackHost(t), newLoopbackHost(t), newLoopbackHost(t)
+	g := newGossip(context.Background(), h)
+
+	contentId, err := createContentId("blob_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.receive(signedMessage(t, origin, 1, &gossipMessage{Provide: []string{contentId.String()}}), origin.ID())
+
+	// Withdrawals of the content of another peer, unsigned or signed by the forger, are dropped.
+	g.receive(&gossipMessage{Origin: origin.ID(), Seq: 2, Withdraw: []string{contentId.String()}}, forger.ID())
+	forged := signedMessage(t, forger, 3, &gossipMessage{Withdraw: []string{contentId.String()}})
+	forged.Origin = origin.ID()
+	g.receive(forged, forger.ID())
+	if got := indexedProviders(g, contentId); !slices.Equal(got, []peer.ID{origin.ID()}) {
+		t.Errorf("expected: %v, got: %v", []peer.ID{origin.ID()}, got)
+	}
+
+	g.receive(signedMessage(t, origin, 4, &gossipMessage{Withdraw: []string{contentId.String()}}), forger.ID())
+	if got := indexedProviders(g, contentId); len(got) != 0 {
+		t.Errorf("expected no providers, got: %v", got)
+	}
+}
+
+func TestGossipAnnouncements(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The hosts are connected in a line, so announcements from the first reach the last through the second.
+	hosts := []host.Host{newLoopbackHost(t), newLoopbackHost(t), newLoopbackHost(t)}
+	var gs []*gossip
+	for _, h := range hosts {
+		g := newGossip(ctx, h)
+		g.start()
+		gs = append(gs, g)
+	}
+	for i := 1; i < len(hosts); i++ {
+		if err := hosts[i].Connect(ctx, peer.AddrInfo{ID: hosts[i-1].ID(), Addrs: hosts[i-1].Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contentId, err := createContentId("blob_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gs[0].Provide(ctx, contentId, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "announcement", func() bool {
+		return slices.Equal(indexedProviders(gs[2], contentId), []peer.ID{hosts[0].ID()})
+	})
+
+	for info := range gs[2].FindProvidersAsync(ctx, contentId, 0) {
+		if len(info.Addrs) == 0 {
+			t.Errorf("expected the addresses of the provider")
+		}
+	}
+
+	gs[0].withdrawContent(contentId)
+	waitFor(t, "withdrawal", func() bool {
+		return len(indexedProviders(gs[2], contentId)) == 0
+	})
+}
+
+func TestGossipFanout(t *testing.T) {
+	var peers []peer.ID
+	for i := range 2 * gossipFanout {
+		peers = append(peers, peer.ID(fmt.Sprint("peer-", i)))
+	}
+	from, origin := peers[0], peers[1]
+
+	got := fanout(peers, from, origin)
+	if len(got) != gossipFanout {
+		t.Errorf("expected: %v, got: %v", gossipFanout, len(got))
+	}
+	for _, id := range got {
+		if id == from || id == origin {
+			t.Errorf("expected %v not to be sent the announcement", id)
+		}
+	}
+	seen := map[peer.ID]bool{}
+	for _, id := range got {
+		if seen[id] {
+			t.Errorf("expected distinct peers, got: %v", got)
+		}
+		seen[id] = true
+	}
+
+	if got := fanout(peers[:3], from, origin); !slices.Equal(got, peers[2:3]) {
+		t.Errorf("expected: %v, got: %v", peers[2:3], got)
+	}
+}
+
+func TestGossipReusesStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := newLoopbackHost(t), newLoopbackHost(t)
+	g1, g2 := newGossip(ctx, h1), newGossip(ctx, h2)
+	g1.start()
+	g2.start()
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		contentId, err := createContentId(fmt.Sprint("blob_", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := g1.Provide(ctx, contentId, true); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "announcement", func() bool { return len(indexedProviders(g2, contentId)) == 1 })
+	}
+
+	// The announcements, after the greeting, are sent over the one stream to the peer.
+	streams := 0
+	for _, c := range h1.Network().ConnsToPeer(h2.ID()) {
+		for _, s := range c.GetStreams() {
+			if s.Protocol() == gossipProtocol {
+				streams++
+			}
+		}
+	}
+	if streams != 1 {
+		t.Errorf("expected: %v, got: %v", 1, streams)
+	}
+}
+
+func TestGossipToV1Peer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The peer speaks only the protocol that carries one announcement per stream.
+	h1, h2 := newLoopbackHost(t), newLoopbackHost(t)
+	g1, g2 := newGossip(ctx, h1), newGossip(ctx, h2)
+	g1.start()
+	h2.SetStreamHandler(gossipProtocolV1, g2.handle)
+	if err := h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		contentId, err := createContentId(fmt.Sprint("blob_", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g1.Provide(ctx, contentId, true); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "announcement", func() bool { return len(indexedProviders(g2, contentId)) == 1 })
+	}
+}
+
+func TestGossipGreet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h1, h2 := newLoopbackHost(t), newLoopbackHost(t)
+	g1, g2 := newGossip(ctx, h1), newGossip(ctx, h2)
+	g1.start()
+	g2.start()
+
+	contentId, err := createContentId("blob_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is provided without being announced, such as before the peer joined.
+	if err := g1.Provide(ctx, contentId, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h2.Connect(ctx, peer.AddrInfo{ID: h1.ID(), Addrs: h1.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "greeting", func() bool {
+		return slices.Equal(indexedProviders(g2, contentId), []peer.ID{h1.ID()})
+	})
+}
+
+func TestRouterWithGossip(t *testing.T) {
+	h := newLoopbackHost(t)
+	g := newGossip(context.Background(), h)
+	r := &router{host: h, content: routing.NewRoutingDiscovery(g), gossip: g}
+
+	key := "blob_0"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Provide(context.Background(), []string{key}); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexedProviders(g, contentId); !slices.Equal(got, []peer.ID{h.ID()}) {
+		t.Errorf("expected: %v, got: %v", []peer.ID{h.ID()}, got)
+	}
+
+	if err := r.Withdraw(context.Background(), []string{key}); err != nil {
+		t.Fatal(err)
+	}
+	if got := indexedProviders(g, contentId); len(got) != 0 {
+		t.Errorf("expected no providers, got: %v", got)
+	}
+	if !slices.Equal(g.withdraw, []string{contentId.String()}) {
+		t.Errorf("expected: %v, got: %v", []string{contentId.String()}, g.withdraw)
+	}
+}
+
+// indexedProviders returns the IDs of the providers of the content ID in the index.
+// signedMessage returns the announcement by the host with the sequence number, signed by it.
+func signedMessage(t *testing.T, h host.Host, seq uint64, msg *gossipMessage) *gossipMessage {
+	msg.Origin, msg.Seq = h.ID(), seq
+	if err := msg.sign(h.Peerstore().PrivKey(h.ID())); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func indexedProviders(g *gossip, contentId cid.Cid) []peer.ID {
+	var ids []peer.ID
+	for info := range g.FindProvidersAsync(context.Background(), contentId, 0) {
+		ids = append(ids, info.ID)
+	}
+	return ids
+}
+
+// waitFor waits up to 5 seconds for the condition to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
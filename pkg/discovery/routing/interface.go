@@ -4,7 +4,9 @@ package routing
 
 import (
 	"context"
+	"time"
 
+	"github.com/azure/peerd/pkg/k8s"
 	"github.com/azure/peerd/pkg/peernet"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
@@ -22,8 +24,29 @@ type Router interface {
 
 	// Provide provides the given keys to the network.
 	// This lets the k-closest peers to the key know that we are providing it.
+	// A failure to provide one key does not stop the others, and a *ProvideError lists the keys that failed.
 	Provide(ctx context.Context, keys []string) error
 
+	// Withdraw withdraws the given keys from the network.
+	// This lets the k-closest peers to the key know that we no longer provide it.
+	Withdraw(ctx context.Context, keys []string) error
+
+	// ReportNotCached records that the peer does not have the key cached, so that the key is not resolved to it for a while.
+	ReportNotCached(key string, id peer.ID)
+
+	// ReportFailed records that a request to the peer for the key failed, so that the key is not resolved to it from cache.
+	ReportFailed(key string, id peer.ID)
+
+	// ReportTransfer records that n bytes were transferred from the peer in d, so that faster peers are resolved first.
+	ReportTransfer(id peer.ID, n int64, d time.Duration)
+
+	// SuperPeers returns the super-peers known to this node, closest first, which read chunks that no peer provides from
+	// the upstream on behalf of the node.
+	SuperPeers() []PeerInfo
+
+	// PeerStats returns the measurements of the known peers, in the order they are preferred as providers.
+	PeerStats() []PeerStats
+
 	// Close closes the router.
 	Close() error
 }
@@ -34,4 +57,31 @@ type PeerInfo struct {
 
 	// HttpHost is the HTTP host of the peer.
 	HttpHost string
+
+	// Fallbacks are the HTTP hosts of the other addresses of the peer, in order of preference, used when HttpHost is
+	// unreachable.
+	Fallbacks []string
+}
+
+// HttpHosts returns the HTTP hosts of the peer in order of preference.
+func (p PeerInfo) HttpHosts() []string {
+	return append([]string{p.HttpHost}, p.Fallbacks...)
+}
+
+// PeerStats are the measurements of a peer that providers are ranked by.
+type PeerStats struct {
+	peer.ID
+
+	// Topology is the location of the peer, if known.
+	Topology k8s.Topology
+
+	// Rtt is the moving average of the round trip time of pings to the peer, or zero if not measured.
+	Rtt time.Duration
+
+	// Throughput is the moving average of the throughput of transfers from the peer in bytes per second, or zero if not
+	// measured.
+	Throughput float64
+
+	// ExpectedTransfer is the expected time to transfer a chunk from the peer.
+	ExpectedTransfer time.Duration
 }
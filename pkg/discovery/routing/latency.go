@@ -0,0 +1,254 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/azure/peerd/pkg/k8s"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// pingInterval is the interval at which connected peers are pinged to keep their round trip time up to date.
+	pingInterval = time.Minute
+
+	// pingTimeout bounds pinging a peer.
+	pingTimeout = 5 * time.Second
+
+	// pingConcurrency is the number of peers pinged concurrently.
+	pingConcurrency = 8
+
+	// transferSize is the size of a typical transfer from a peer, a chunk of a blob.
+	transferSize = 1024 * 1024
+
+	// throughputWeight is the weight of the latest measurement in the moving average of the throughput of a peer.
+	throughputWeight = 0.2
+
+	// rankWindowShare is the inverse of the largest share of the time left to resolve a key that providers are held back.
+	rankWindowShare = 4
+)
+
+// RankWindow is how long providers found in the DHT are held back so that the best of them is used first.
+// Providers are sent as they are found once the window elapses, or once as many as requested are found. It is kept
+// short, since providers found together in a response of the DHT are ranked, and a client waits for the first one.
+var RankWindow = time.Millisecond
+
+// rankWindow returns how long providers are held back when resolving with ctx: the window, but no more than a
+// rankWindowShare of the time left before ctx expires, so that the best provider found is sent in time to be used.
+func rankWindow(ctx context.Context, window time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		window = min(window, time.Until(deadline)/rankWindowShare)
+	}
+	return window
+}
+
+// providerRank is how preferable a provider is, the lowest first.
+type providerRank struct {
+	// locality is how close the provider is to this node, which takes precedence.
+	locality locality
+
+	// transfer is the expected time to transfer a chunk from the provider.
+	transfer time.Duration
+}
+
+// compare orders ranks, the most preferable first.
+func (a providerRank) compare(b providerRank) int {
+	if c := cmp.Compare(a.locality, b.locality); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.transfer, b.transfer)
+}
+
+// sortByRank sorts the providers by their rank, keeping the order of equally ranked ones.
+func sortByRank(infos []PeerInfo, rankOf func(peer.ID) providerRank) {
+	if len(infos) < 2 {
+		return
+	}
+
+	slices.SortStableFunc(infos, func(a, b PeerInfo) int {
+		return rankOf(a.ID).compare(rankOf(b.ID))
+	})
+}
+
+// throughputs keeps a moving average of the throughput of the transfers from each peer, in bytes per second.
+type throughputs struct {
+	lock sync.Mutex
+	bps  map[peer.ID]float64
+}
+
+// newThroughputs creates empty throughputs.
+func newThroughputs() *throughputs {
+	return &throughputs{bps: map[peer.ID]float64{}}
+}
+
+// record adds a transfer of n bytes from the peer that took d.
+func (t *throughputs) record(id peer.ID, n int64, d time.Duration) {
+	if t == nil || n <= 0 || d <= 0 {
+		return
+	}
+
+	bps := float64(n) / d.Seconds()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if prev, ok := t.bps[id]; ok {
+		bps = throughputWeight*bps + (1-throughputWeight)*prev
+	}
+	t.bps[id] = bps
+}
+
+// get returns the throughput of the peer, if any transfer from it was recorded.
+func (t *throughputs) get(id peer.ID) (float64, bool) {
+	if t == nil {
+		return 0, false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	bps, ok := t.bps[id]
+	return bps, ok
+}
+
+// peers returns the peers any transfer was recorded from.
+func (t *throughputs) peers() []peer.ID {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ids := make([]peer.ID, 0, len(t.bps))
+	for id := range t.bps {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// ReportTransfer records that n bytes were transferred from the peer in d, to estimate its throughput.
+func (r *router) ReportTransfer(id peer.ID, n int64, d time.Duration) {
+	r.throughputs.record(id, n, d)
+}
+
+// expectedTransfer returns the expected time to transfer a chunk from the peer, from its round trip time measured by
+// pings and its throughput measured by transfers. Either is ignored when it has not been measured, so peers not
+// transferred from yet are tried before measured ones, and get measured.
+func (r *router) expectedTransfer(id peer.ID) (time.Duration, time.Duration, float64) {
+	rtt := r.host.Peerstore().LatencyEWMA(id)
+	bps, _ := r.throughputs.get(id)
+
+	expected := rtt
+	if bps > 0 {
+		expected += time.Duration(float64(transferSize) / bps * float64(time.Second))
+	}
+	return expected, rtt, bps
+}
+
+// rankProvider returns how preferable the peer is as a provider with the topology mode.
+func (r *router) rankProvider(ctx context.Context, id peer.ID, mode TopologyMode) providerRank {
+	l := localityRemote
+	if mode != TopologyOff {
+		l = r.locality(ctx, id)
+	}
+
+	transfer, _, _ := r.expectedTransfer(id)
+	return providerRank{locality: l, transfer: transfer}
+}
+
+// PeerStats returns the measurements of the peers in the peerstore and of those transferred from, the most preferable
+// first. Peers are not asked for their topology, so those it is not known of yet rank as remote.
+func (r *router) PeerStats() []PeerStats {
+	ids := append(r.host.Peerstore().Peers(), r.throughputs.peers()...)
+
+	seen := map[peer.ID]bool{}
+	ranks := map[peer.ID]providerRank{}
+	var stats []PeerStats
+	for _, id := range ids {
+		if seen[id] || id == r.host.ID() {
+			continue
+		}
+		seen[id] = true
+
+		var topology k8s.Topology
+		if v, err := r.host.Peerstore().Get(id, topologyKey); err == nil {
+			topology, _ = v.(k8s.Topology)
+		}
+
+		l := localityRemote
+		if Topology != TopologyOff {
+			l = localityOf(r.topology, topology)
+		}
+
+		transfer, rtt, bps := r.expectedTransfer(id)
+		ranks[id] = providerRank{locality: l, transfer: transfer}
+		stats = append(stats, PeerStats{
+			ID:               id,
+			Topology:         topology,
+			Rtt:              rtt,
+			Throughput:       bps,
+			ExpectedTransfer: transfer,
+		})
+	}
+
+	slices.SortStableFunc(stats, func(a, b PeerStats) int {
+		return ranks[a.ID].compare(ranks[b.ID])
+	})
+	return stats
+}
+
+// measureLatency pings peers as they connect, and the connected peers every pingInterval until ctx is done, which
+// records their round trip time in the peerstore.
+func (r *router) measureLatency(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+
+	r.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			go r.ping(ctx, c.RemotePeer())
+		},
+	})
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				g := errgroup.Group{}
+				g.SetLimit(pingConcurrency)
+				for _, id := range r.host.Network().Peers() {
+					g.Go(func() error {
+						r.ping(ctx, id)
+						return nil
+					})
+				}
+				_ = g.Wait()
+				log.Trace().Int("peers", len(r.host.Network().Peers())).Msg("pinged peers")
+			}
+		}
+	}()
+}
+
+// ping pings the peer once, which records its round trip time in the peerstore.
+func (r *router) ping(ctx context.Context, id peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	res := <-ping.Ping(ctx, r.host, id)
+	if res.Error != nil {
+		zerolog.Ctx(ctx).Trace().Err(res.Error).Str("peer", id.String()).Msg("could not ping peer")
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/azure/peerd/pkg/k8s"
+	"github.com/dgraph-io/ristretto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+func TestThroughputs(t *testing.T) {
+	tp := newThroughputs()
+
+	if _, ok := tp.get("peer-1"); ok {
+		t.Error("expected no throughput before any transfer")
+	}
+
+	tp.record("peer-1", 1000, time.Second)
+	if got, _ := tp.get("peer-1"); got != 1000 {
+		t.Errorf("expected: %v, got: %v", 1000, got)
+	}
+
+	// Later transfers are averaged in.
+	tp.record("peer-1", 2000, time.Second)
+	if got, _ := tp.get("peer-1"); got != 1200 {
+		t.Errorf("expected: %v, got: %v", 1200, got)
+	}
+
+	// Empty transfers are ignored.
+	tp.record("peer-2", 0, time.Second)
+	tp.record("peer-2", 1000, 0)
+	if _, ok := tp.get("peer-2"); ok {
+		t.Error("expected empty transfers to be ignored")
+	}
+
+	var nilTp *throughputs
+	nilTp.record("peer-1", 1000, time.Second)
+	if _, ok := nilTp.get("peer-1"); ok {
+		t.Error("expected no throughput from nil throughputs")
+	}
+}
+
+func TestProviderRankCompare(t *testing.T) {
+	ranks := []providerRank{
+		{locality: localityRemote, transfer: time.Millisecond},
+		{locality: localityZone, transfer: 10 * time.Millisecond},
+		{locality: localityZone, transfer: 2 * time.Millisecond},
+		{locality: localityNodePool, transfer: time.Second},
+	}
+	slices.SortFunc(ranks, providerRank.compare)
+
+	expected := []providerRank{
+		{locality: localityNodePool, transfer: time.Second},
+		{locality: localityZone, transfer: 2 * time.Millisecond},
+		{locality: localityZone, transfer: 10 * time.Millisecond},
+		{locality: localityRemote, transfer: time.Millisecond},
+	}
+	if !slices.Equal(ranks, expected) {
+		t.Errorf("expected: %v, got: %v", expected, ranks)
+	}
+}
+
+func TestResolveRanksByExpectedTransfer(t *testing.T) {
+	defer func(m TopologyMode, w time.Duration) { Topology, RankWindow = m, w }(Topology, RankWindow)
+	Topology, RankWindow = TopologyOff, time.Hour
+
+	key := "blob_0"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1000, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &testHost{id: "host-id"}
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             h,
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		resolved:         newResolvedCache(time.Minute),
+		throughputs:      newThroughputs(),
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{contentId.String(): {"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		}),
+	}
+
+	// 10.0.0.1 is close but slow, 10.0.0.2 is far but fast, and 10.0.0.3 is unmeasured.
+	h.Peerstore().RecordLatency("10.0.0.1", time.Millisecond)
+	r.ReportTransfer("10.0.0.1", 1024*1024, time.Second)
+	h.Peerstore().RecordLatency("10.0.0.2", 20*time.Millisecond)
+	r.ReportTransfer("10.0.0.2", 1024*1024, 10*time.Millisecond)
+
+	expected := []string{"https://10.0.0.3:5000", "https://10.0.0.2:5000", "https://10.0.0.1:5000"}
+	if got := resolveHosts(t, r, key, 3); !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+
+	stats := r.PeerStats()
+	var ids []peer.ID
+	for _, s := range stats {
+		ids = append(ids, s.ID)
+	}
+	if expectedIds := []peer.ID{"10.0.0.2", "10.0.0.1"}; !slices.Equal(ids, expectedIds) {
+		t.Errorf("expected: %v, got: %v", expectedIds, ids)
+	}
+	if stats[0].Rtt != 20*time.Millisecond || stats[0].Throughput != 100*1024*1024 || stats[0].ExpectedTransfer != 30*time.Millisecond {
+		t.Errorf("unexpected stats: %+v", stats[0])
+	}
+}
+
+func TestResolveRanksByLocalityFirst(t *testing.T) {
+	defer func(m TopologyMode, w time.Duration) { Topology, RankWindow = m, w }(Topology, RankWindow)
+	Topology, RankWindow = TopologyPrefer, time.Hour
+
+	key := "blob_0"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1000, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &testHost{id: "host-id"}
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             h,
+		topology:         k8s.Topology{Region: "eastus", Zone: "eastus-1"},
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		resolved:         newResolvedCache(time.Minute),
+		throughputs:      newThroughputs(),
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{contentId.String(): {"10.0.0.1", "10.0.0.2"}},
+		}),
+	}
+
+	// The faster provider is in another zone.
+	for id, zone := range map[peer.ID]string{"10.0.0.1": "eastus-1", "10.0.0.2": "eastus-2"} {
+		if err := h.Peerstore().Put(id, topologyKey, k8s.Topology{Region: "eastus", Zone: zone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Peerstore().RecordLatency("10.0.0.1", 10*time.Millisecond)
+	h.Peerstore().RecordLatency("10.0.0.2", time.Millisecond)
+
+	expected := []string{"https://10.0.0.1:5000", "https://10.0.0.2:5000"}
+	if got := resolveHosts(t, r, key, 2); !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+}
+
+func TestRankWindow(t *testing.T) {
+	if got := rankWindow(context.Background(), time.Second); got != time.Second {
+		t.Errorf("expected: %v, got: %v", time.Second, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if got := rankWindow(ctx, time.Second); got > 25*time.Millisecond {
+		t.Errorf("expected at most %v, got: %v", 25*time.Millisecond, got)
+	}
+	if got := rankWindow(ctx, time.Millisecond); got != time.Millisecond {
+		t.Errorf("expected: %v, got: %v", time.Millisecond, got)
+	}
+}
+
+func TestResolveSendsHeldProviderBeforeTimeout(t *testing.T) {
+	defer func(m TopologyMode, w time.Duration) { Topology, RankWindow = m, w }(Topology, RankWindow)
+	Topology, RankWindow = TopologyOff, time.Hour
+
+	key := "blob_0"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1000, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             &testHost{id: "host-id"},
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		resolved:         newResolvedCache(time.Minute),
+		throughputs:      newThroughputs(),
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{contentId.String(): {"10.0.0.1"}},
+		}),
+	}
+
+	// Fewer providers than requested are found, so the only one is sent once a share of the timeout has passed.
+	deadline := time.Now().Add(200 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	got, err := r.Resolve(ctx, key, false, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case info := <-got:
+		if info.HttpHost != "https://10.0.0.1:5000" {
+			t.Errorf("expected: %v, got: %v", "https://10.0.0.1:5000", info.HttpHost)
+		}
+		if remaining := time.Until(deadline); remaining < 100*time.Millisecond {
+			t.Errorf("expected the provider to be sent well before the timeout, %v was left", remaining)
+		}
+	case <-ctx.Done():
+		t.Error("expected the provider to be sent before the timeout")
+	}
+}
+
+func TestPing(t *testing.T) {
+	h1 := newLoopbackHost(t)
+	h2 := newLoopbackHost(t)
+	h1.Peerstore().AddAddr(h2.ID(), tcpAddr(t, h2), time.Minute)
+
+	r := &router{host: h1}
+	r.ping(context.Background(), h2.ID())
+
+	if rtt := h1.Peerstore().LatencyEWMA(h2.ID()); rtt <= 0 {
+		t.Errorf("expected a round trip time, got: %v", rtt)
+	}
+}
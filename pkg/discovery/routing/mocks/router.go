@@ -4,7 +4,9 @@ package mocks
 
 import (
 	"context"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/azure/peerd/pkg/peernet"
@@ -17,7 +19,10 @@ type MockRouter struct {
 	mx       sync.RWMutex
 	resolver map[string][]string
 
-	negCache map[string]struct{}
+	negCache  map[string]struct{}
+	notCached map[string][]peer.ID
+	failed    map[string][]peer.ID
+	transfers map[peer.ID]int64
 }
 
 // Net implements routing.Router.
@@ -44,9 +49,12 @@ func NewMockRouter(resolver map[string][]string) *MockRouter {
 	}
 
 	return &MockRouter{
-		p2pNet:   n,
-		resolver: resolver,
-		negCache: map[string]struct{}{},
+		p2pNet:    n,
+		resolver:  resolver,
+		negCache:  map[string]struct{}{},
+		notCached: map[string][]peer.ID{},
+		failed:    map[string][]peer.ID{},
+		transfers: map[peer.ID]int64{},
 	}
 }
 
@@ -66,7 +74,9 @@ func (m *MockRouter) Resolve(ctx context.Context, key string, allowSelf bool, co
 		m.mx.RLock()
 		defer m.mx.RUnlock()
 		for _, p := range peers {
-			peerCh <- routing.PeerInfo{ID: peer.ID(p), HttpHost: p}
+			// A comma-separated value lists the addresses of a peer in order of preference.
+			hosts := strings.Split(p, ",")
+			peerCh <- routing.PeerInfo{ID: peer.ID(p), HttpHost: hosts[0], Fallbacks: hosts[1:]}
 		}
 		close(peerCh)
 	}()
@@ -83,6 +93,80 @@ func (m *MockRouter) Provide(ctx context.Context, keys []string) error {
 	return nil
 }
 
+func (m *MockRouter) Withdraw(ctx context.Context, keys []string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for _, key := range keys {
+		delete(m.resolver, key)
+	}
+	return nil
+}
+
+func (m *MockRouter) ReportNotCached(key string, id peer.ID) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.notCached[key] = append(m.notCached[key], id)
+}
+
+// NotCached returns the peers reported not to have the key cached.
+func (m *MockRouter) NotCached(key string) []peer.ID {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.notCached[key]
+}
+
+func (m *MockRouter) ReportFailed(key string, id peer.ID) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.failed[key] = append(m.failed[key], id)
+}
+
+// Failed returns the peers reported to have failed a request for the key.
+func (m *MockRouter) Failed(key string) []peer.ID {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.failed[key]
+}
+
+func (m *MockRouter) ReportTransfer(id peer.ID, n int64, d time.Duration) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.transfers[id] += n
+}
+
+// Transferred returns the number of bytes reported to be transferred from the peer.
+func (m *MockRouter) Transferred(id peer.ID) int64 {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.transfers[id]
+}
+
+// PeerStats implements routing.Router.
+// Each peer reported to have transferred bytes is listed, without measurements.
+func (m *MockRouter) PeerStats() []routing.PeerStats {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	var stats []routing.PeerStats
+	for id := range m.transfers {
+		stats = append(stats, routing.PeerStats{ID: id})
+	}
+	return stats
+}
+
+// SuperPeers implements routing.Router.
+// The super-peers are the peers that resolve routing.SuperPeerKey.
+func (m *MockRouter) SuperPeers() []routing.PeerInfo {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	var peers []routing.PeerInfo
+	for _, p := range m.resolver[routing.SuperPeerKey] {
+		peers = append(peers, routing.PeerInfo{ID: peer.ID(p), HttpHost: p})
+	}
+	return peers
+}
+
 func (m *MockRouter) LookupKey(key string) ([]string, bool) {
 	m.mx.RLock()
 	defer m.mx.RUnlock()
@@ -47,6 +47,25 @@ func TestProvider(t *testing.T) {
 	}
 }
 
+func TestWithdraw(t *testing.T) {
+	r := NewMockRouter(map[string][]string{"key1": {"value1"}})
+	err := r.Withdraw(context.Background(), []string{"key1"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, ok := r.LookupKey("key1"); ok {
+		t.Errorf("expected key to be withdrawn")
+	}
+}
+
+func TestReportNotCached(t *testing.T) {
+	r := NewMockRouter(map[string][]string{})
+	r.ReportNotCached("key1", "peer1")
+	if got := r.NotCached("key1"); len(got) != 1 || got[0] != "peer1" {
+		t.Errorf("expected [peer1], got %v", got)
+	}
+}
+
 func TestResolve(t *testing.T) {
 	r := NewMockRouter(map[string][]string{"key1": {"value1"}})
 
@@ -0,0 +1,162 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// resolvedTtl is how long the providers a key resolved to are reused without looking the key up again.
+	resolvedTtl = 30 * time.Second
+
+	// chunkKeySep separates the name of a file from the offset of a chunk in its keys, see files.FileChunkKey.
+	chunkKeySep = "_"
+)
+
+// resolvedProvider is a peer that provides chunks of a blob.
+type resolvedProvider struct {
+	info PeerInfo
+
+	// chunks maps the keys of the chunks the peer was resolved for to when they expire.
+	chunks map[string]time.Time
+}
+
+// resolvedCache caches the providers keys recently resolved to, grouped by blob, so that a key is resolved without a
+// DHT lookup, and the providers of neighbouring chunks of the same blob are tried first. A nil *resolvedCache caches
+// nothing.
+type resolvedCache struct {
+	lock  sync.Mutex
+	ttl   time.Duration
+	blobs map[string]map[peer.ID]*resolvedProvider
+	swept time.Time
+}
+
+// add records that the key resolved to the peer.
+func (c *resolvedCache) add(key string, info PeerInfo) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.swept) > c.ttl {
+		c.sweep(now)
+	}
+
+	blob := blobOf(key)
+	provs, ok := c.blobs[blob]
+	if !ok {
+		provs = map[peer.ID]*resolvedProvider{}
+		c.blobs[blob] = provs
+	}
+	p, ok := provs[info.ID]
+	if !ok {
+		p = &resolvedProvider{chunks: map[string]time.Time{}}
+		provs[info.ID] = p
+	}
+	p.info = info
+	p.chunks[key] = now.Add(c.ttl)
+}
+
+// get returns the providers the key resolved to, and the providers of other chunks of the same blob.
+func (c *resolvedCache) get(key string) (exact, neighbours []PeerInfo) {
+	if c == nil {
+		return nil, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for _, p := range c.blobs[blobOf(key)] {
+		if expires, ok := p.chunks[key]; ok && now.Before(expires) {
+			exact = append(exact, p.info)
+			continue
+		}
+		for _, expires := range p.chunks {
+			if now.Before(expires) {
+				neighbours = append(neighbours, p.info)
+				break
+			}
+		}
+	}
+	return exact, neighbours
+}
+
+// forgetChunk removes the peer from the providers of the key.
+func (c *resolvedCache) forgetChunk(key string, id peer.ID) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	blob := blobOf(key)
+	if p, ok := c.blobs[blob][id]; ok {
+		delete(p.chunks, key)
+		if len(p.chunks) == 0 {
+			c.forget(blob, id)
+		}
+	}
+}
+
+// forgetPeer removes the peer from the providers of every chunk of the blob of the key.
+func (c *resolvedCache) forgetPeer(key string, id peer.ID) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.forget(blobOf(key), id)
+}
+
+// forget removes the peer from the providers of the blob.
+func (c *resolvedCache) forget(blob string, id peer.ID) {
+	delete(c.blobs[blob], id)
+	if len(c.blobs[blob]) == 0 {
+		delete(c.blobs, blob)
+	}
+}
+
+// sweep removes expired entries.
+func (c *resolvedCache) sweep(now time.Time) {
+	for blob, provs := range c.blobs {
+		for id, p := range provs {
+			for key, expires := range p.chunks {
+				if !now.Before(expires) {
+					delete(p.chunks, key)
+				}
+			}
+			if len(p.chunks) == 0 {
+				delete(provs, id)
+			}
+		}
+		if len(provs) == 0 {
+			delete(c.blobs, blob)
+		}
+	}
+	c.swept = now
+}
+
+// newResolvedCache creates a cache of resolved providers that expire after ttl.
+func newResolvedCache(ttl time.Duration) *resolvedCache {
+	return &resolvedCache{ttl: ttl, blobs: map[string]map[peer.ID]*resolvedProvider{}, swept: time.Now()}
+}
+
+// blobOf returns the name of the blob of the key of a chunk, or the key itself if it is not the key of a chunk.
+func blobOf(key string) string {
+	if i := strings.LastIndex(key, chunkKeySep); i > 0 {
+		return key[:i]
+	}
+	return key
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+func TestBlobOf(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"sha256:abc_0", "sha256:abc"},
+		{"sha256:abc_1048576", "sha256:abc"},
+		{"sha256:abc", "sha256:abc"},
+		{"_0", "_0"},
+	}
+
+	for _, tt := range tests {
+		if got := blobOf(tt.key); got != tt.expected {
+			t.Errorf("expected: %v, got: %v", tt.expected, got)
+		}
+	}
+}
+
+func TestResolvedCache(t *testing.T) {
+	c := newResolvedCache(time.Minute)
+	a := PeerInfo{ID: "a", HttpHost: "https://10.0.0.1:5000"}
+	b := PeerInfo{ID: "b", HttpHost: "https://10.0.0.2:5000"}
+
+	c.add("blob_0", a)
+	c.add("blob_1", b)
+
+	exact, neighbours := c.get("blob_0")
+	if len(exact) != 1 || exact[0].ID != a.ID {
+		t.Errorf("expected: %v, got: %v", []PeerInfo{a}, exact)
+	}
+	if len(neighbours) != 1 || neighbours[0].ID != b.ID {
+		t.Errorf("expected: %v, got: %v", []PeerInfo{b}, neighbours)
+	}
+
+	exact, neighbours = c.get("blob_2")
+	if len(exact) != 0 || len(neighbours) != 2 {
+		t.Errorf("expected no exact and 2 neighbours, got: %v, %v", exact, neighbours)
+	}
+
+	if exact, neighbours := c.get("other_0"); len(exact) != 0 || len(neighbours) != 0 {
+		t.Errorf("expected no providers, got: %v, %v", exact, neighbours)
+	}
+
+	// A peer without the chunk remains a neighbour for the rest of the blob.
+	c.add("blob_2", a)
+	c.forgetChunk("blob_0", "a")
+	if exact, neighbours := c.get("blob_0"); len(exact) != 0 || len(neighbours) != 2 {
+		t.Errorf("expected no exact and 2 neighbours, got: %v, %v", exact, neighbours)
+	}
+
+	// A failed peer is forgotten for the whole blob.
+	c.forgetPeer("blob_0", "a")
+	if exact, neighbours := c.get("blob_2"); len(exact) != 0 || len(neighbours) != 1 || neighbours[0].ID != b.ID {
+		t.Errorf("expected: %v, got: %v, %v", []PeerInfo{b}, exact, neighbours)
+	}
+}
+
+func TestResolvedCacheExpires(t *testing.T) {
+	c := newResolvedCache(10 * time.Millisecond)
+	c.add("blob_0", PeerInfo{ID: "a"})
+
+	time.Sleep(20 * time.Millisecond)
+	if exact, neighbours := c.get("blob_0"); len(exact) != 0 || len(neighbours) != 0 {
+		t.Errorf("expected no providers, got: %v, %v", exact, neighbours)
+	}
+
+	c.add("blob_1", PeerInfo{ID: "b"})
+	if _, ok := c.blobs["blob"]["a"]; ok {
+		t.Error("expected expired provider to be swept")
+	}
+}
+
+func TestResolvedCacheNil(t *testing.T) {
+	var c *resolvedCache
+	c.add("blob_0", PeerInfo{ID: "a"})
+	c.forgetChunk("blob_0", "a")
+	c.forgetPeer("blob_0", "a")
+	if exact, neighbours := c.get("blob_0"); exact != nil || neighbours != nil {
+		t.Errorf("expected no providers, got: %v, %v", exact, neighbours)
+	}
+}
+
+func TestResolveUsesResolvedCache(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := "blob_0", "blob_1048576"
+	firstId, err := createContentId(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondId, err := createContentId(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcr := &testCr{
+		m: map[string][]string{
+			firstId.String():  {"10.0.0.1"},
+			secondId.String(): {"10.0.0.2"},
+		},
+	}
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             &testHost{id: "host-id"},
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		resolved:         newResolvedCache(time.Minute),
+		content:          routing.NewRoutingDiscovery(tcr),
+	}
+
+	if got := resolveHosts(t, r, first, 2); !slices.Equal(got, []string{"https://10.0.0.1:5000"}) {
+		t.Errorf("expected: %v, got: %v", []string{"https://10.0.0.1:5000"}, got)
+	}
+
+	// The key resolves from cache without a DHT lookup.
+	delete(tcr.m, firstId.String())
+	if got := resolveHosts(t, r, first, 2); !slices.Equal(got, []string{"https://10.0.0.1:5000"}) {
+		t.Errorf("expected: %v, got: %v", []string{"https://10.0.0.1:5000"}, got)
+	}
+
+	// The provider of the neighbouring chunk is returned first.
+	expected := []string{"https://10.0.0.1:5000", "https://10.0.0.2:5000"}
+	if got := resolveHosts(t, r, second, 2); !slices.Equal(got, expected) {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+
+	// A failed provider is forgotten, leaving the provider of the neighbouring chunk.
+	r.ReportFailed(first, peer.ID("10.0.0.1"))
+	if got := resolveHosts(t, r, first, 2); !slices.Equal(got, []string{"https://10.0.0.2:5000"}) {
+		t.Errorf("expected: %v, got: %v", []string{"https://10.0.0.2:5000"}, got)
+	}
+}
+
+// resolveHosts returns the hosts the key resolves to within a short timeout, looking up count providers.
+func resolveHosts(t *testing.T, r *router, key string, count int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	got, err := r.Resolve(ctx, key, false, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+	for {
+		select {
+		case info := <-got:
+			hosts = append(hosts, info.HttpHost)
+		case <-ctx.Done():
+			return hosts
+		}
+	}
+}
@@ -5,26 +5,34 @@ package routing
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/azure/peerd/pkg/discovery/bootstrap"
 	"github.com/azure/peerd/pkg/k8s"
 	"github.com/azure/peerd/pkg/k8s/election"
 	"github.com/azure/peerd/pkg/k8s/events"
 	"github.com/azure/peerd/pkg/peernet"
 	"github.com/dgraph-io/ristretto"
 	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	corerouting "github.com/libp2p/go-libp2p/core/routing"
 	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
-	"github.com/multiformats/go-multiaddr"
 	mc "github.com/multiformats/go-multicodec"
 	mh "github.com/multiformats/go-multihash"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -32,6 +40,9 @@ const (
 
 	negCacheTtl     = 500 * time.Millisecond
 	strPeerNotFound = "PEER_NOT_FOUND"
+
+	// provideConcurrency is the number of keys of a batch that are provided concurrently.
+	provideConcurrency = 8
 )
 
 type router struct {
@@ -50,9 +61,42 @@ type router struct {
 	// lookupCache is a cache for storing the results of lookups, usually used to store negative results.
 	lookupCache *ristretto.Cache
 
+	// resolved caches the providers that keys recently resolved to.
+	resolved *resolvedCache
+
+	// advertise is the granularity at which content is advertised.
+	advertise AdvertiseMode
+
+	// availability caches the chunks of blobs that peers hold, if blobs are advertised.
+	availability *availabilityCache
+
+	// availabilityFetches deduplicates concurrent requests for the availability of a blob at a peer.
+	availabilityFetches singleflight.Group
+
+	// providers is the provider store of the DHT, which honours withdrawals, if the DHT is used.
+	providers *providerStore
+
+	// peers finds the peers that store the provider records of a key, if the DHT is used.
+	peers nearestPeers
+
+	// gossip announces the content provided and withdrawn by this node, if gossip is used.
+	gossip *gossip
+
+	// tracker reports the content provided and withdrawn by this node to the tracker, if a tracker is used.
+	tracker *tracker
+
+	// superPeers are the closest super-peers, looked up periodically unless this node is a super-peer.
+	superPeers *superPeers
+
 	// k8sClient is the k8s client.
 	k8sClient *k8s.ClientSet
 
+	// topology is the location of this node, which providers close to are preferred.
+	topology k8s.Topology
+
+	// throughputs are the throughputs of the transfers from peers, which faster providers are preferred by.
+	throughputs *throughputs
+
 	// active is a flag that indicates if this host is actively discovering content on the network.
 	active atomic.Bool
 }
@@ -67,6 +111,25 @@ type ContentNotFoundError struct {
 	key string
 }
 
+// ProvideError indicates that some of the keys could not be provided. The others were.
+type ProvideError struct {
+	// Keys are the keys that could not be provided.
+	Keys []string
+
+	// Err describes the failures.
+	Err error
+}
+
+// Error implements error.
+func (e *ProvideError) Error() string {
+	return fmt.Sprintf("failed to provide %d keys: %v", len(e.Keys), e.Err)
+}
+
+// Unwrap returns the failures.
+func (e *ProvideError) Unwrap() error {
+	return e.Err
+}
+
 // NewRouter creates a new Router.
 func NewRouter(ctx context.Context, clientset *k8s.ClientSet, hostAddr, peerRegistryPort string) (Router, error) {
 	log := zerolog.Ctx(ctx).With().Str("component", "router").Logger()
@@ -79,26 +142,21 @@ func NewRouter(ctx context.Context, clientset *k8s.ClientSet, hostAddr, peerRegi
 	self := fmt.Sprintf("%s/p2p/%s", host.Addrs()[0].String(), host.ID().String())
 	log.Debug().Str("id", self).Msg("starting p2p router")
 
-	leaderElection := election.New("peerd-leader-election", clientset)
-
-	err = leaderElection.RunOrDie(ctx, self)
+	_, routerPort, err := net.SplitHostPort(hostAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO avtakkar: reconsider the max record age for cached files. Or, ensure that the cached list is periodically advertised.
-	dhtOpts := []dht.Option{dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/peerd"), dht.DisableValues(), dht.MaxRecordAge(MaxRecordAge)}
-	bootstrapPeerOpt := dht.BootstrapPeersFunc(func() []peer.AddrInfo {
-		addr, err := leaderElection.Leader()
-		if err != nil {
-			events.FromContext(ctx).Disconnected()
-			log.Error().Err(err).Msg("could not get leader")
-			return nil
-		}
+	src, err := bootstrap.New(ctx, Bootstrap, bootstrap.Env{Host: host, ClientSet: clientset, Port: routerPort})
+	if err != nil {
+		return nil, fmt.Errorf("could not create bootstrap source: %w", err)
+	}
 
-		addrInfo, err := peer.AddrInfoFromP2pAddr(addr)
+	bootstrapFunc := func() []peer.AddrInfo {
+		peers, err := bootstrapPeers(ctx, host, src)
 		if err != nil {
-			log.Error().Err(err).Msg("could not get leader addr info")
+			events.FromContext(ctx).Disconnected()
+			log.Error().Err(err).Str("source", src.String()).Msg("could not get bootstrap peers")
 			return nil
 		}
 
@@ -106,24 +164,45 @@ func NewRouter(ctx context.Context, clientset *k8s.ClientSet, hostAddr, peerRegi
 			events.FromContext(ctx).Connected()
 		}()
 
-		if addrInfo.ID == host.ID() {
-			log.Debug().Msg("bootstrapped as leader")
+		if len(peers) == 0 {
+			log.Debug().Str("source", src.String()).Msg("no bootstrap peers, bootstrapped alone")
 			return nil
 		}
 
-		log.Debug().Str("leader", addrInfo.ID.String()).Msg("leader found")
-		return []peer.AddrInfo{*addrInfo}
-	})
-
-	dhtOpts = append(dhtOpts, bootstrapPeerOpt)
-	kdht, err := dht.New(ctx, host, dhtOpts...)
-	if err != nil {
-		return nil, fmt.Errorf("could not create distributed hash table: %w", err)
+		log.Debug().Str("source", src.String()).Int("peers", len(peers)).Msg("bootstrap peers found")
+		return peers
 	}
-	if err = kdht.Bootstrap(ctx); err != nil {
-		return nil, fmt.Errorf("could not boostrap distributed hash table: %w", err)
+
+	var content corerouting.ContentRouting
+	var ps *providerStore
+	var peers nearestPeers
+	var g *gossip
+	var t *tracker
+	switch Discovery {
+	case DiscoveryGossip:
+		g = newGossip(ctx, host)
+		g.start()
+		go g.connect(bootstrapFunc)
+		content = g
+
+	case DiscoveryTracker:
+		le := election.New(trackerElectionName, clientset)
+		if err := le.RunOrDie(ctx, self); err != nil {
+			return nil, fmt.Errorf("could not run for tracker: %w", err)
+		}
+		t = newTracker(ctx, host, le)
+		t.start()
+		content = t
+
+	default:
+		var kdht *dht.IpfsDHT
+		kdht, ps, err = newDHT(ctx, host, bootstrapFunc)
+		if err != nil {
+			return nil, err
+		}
+		content, peers = kdht, kdht.RoutingTable()
 	}
-	rd := routing.NewRoutingDiscovery(kdht)
+	rd := routing.NewRoutingDiscovery(content)
 
 	c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1073741824, BufferItems: 64})
 	if err != nil {
@@ -135,14 +214,63 @@ func NewRouter(ctx context.Context, clientset *k8s.ClientSet, hostAddr, peerRegi
 		return nil, err
 	}
 
-	return &router{
+	topology, err := k8s.NodeTopology(ctx, clientset)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not get node topology, providers will not be preferred by location")
+	}
+	log.Debug().Str("region", topology.Region).Str("zone", topology.Zone).Str("nodePool", topology.NodePool).Msg("node topology")
+
+	r := &router{
 		k8sClient:        clientset,
+		topology:         topology,
+		throughputs:      newThroughputs(),
 		p2pnet:           n,
 		host:             host,
 		content:          rd,
 		peerRegistryPort: peerRegistryPort,
 		lookupCache:      c,
-	}, nil
+		resolved:         newResolvedCache(resolvedTtl),
+		advertise:        Advertise,
+		availability:     newAvailabilityCache(availabilityTtl),
+		providers:        ps,
+		peers:            peers,
+		gossip:           g,
+		tracker:          t,
+		superPeers:       &superPeers{},
+	}
+	host.SetStreamHandler(withdrawProtocol, r.handleWithdraw)
+	host.SetStreamHandler(topologyProtocol, r.handleTopology)
+	r.learnTopology(ctx)
+	r.measureLatency(ctx)
+	if NodeRole == RoleSuperPeer {
+		r.advertiseSuperPeer(ctx)
+	} else {
+		r.watchSuperPeers(ctx)
+	}
+
+	return r, nil
+}
+
+// newDHT creates a DHT on the host that bootstraps from the peers returned by bootstrap, and the provider store it keeps
+// provider records in.
+func newDHT(ctx context.Context, host host.Host, bootstrap func() []peer.AddrInfo) (*dht.IpfsDHT, *providerStore, error) {
+	pm, err := providers.NewProviderManager(host.ID(), host.Peerstore(), dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create provider store: %w", err)
+	}
+	// Provider records expire after MaxRecordAge. The files store advertises its cached chunks again before they do, and
+	// withdraws the records of evicted chunks.
+	ps := newProviderStore(pm, MaxRecordAge)
+
+	dhtOpts := []dht.Option{dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/peerd"), dht.DisableValues(), dht.MaxRecordAge(MaxRecordAge), dht.ProviderStore(ps), dht.BootstrapPeersFunc(bootstrap)}
+	kdht, err := dht.New(ctx, host, dhtOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create distributed hash table: %w", err)
+	}
+	if err = kdht.Bootstrap(ctx); err != nil {
+		return nil, nil, fmt.Errorf("could not boostrap distributed hash table: %w", err)
+	}
+	return kdht, ps, nil
 }
 
 // Transport returns the transport.
@@ -158,7 +286,7 @@ func (r *router) Close() error {
 // ResolveWithNegativeCacheCallback is like Resolve but it also returns a function callback that can be used to cache that a key could not be resolved.
 func (r *router) ResolveWithNegativeCacheCallback(ctx context.Context, key string, allowSelf bool, count int) (<-chan PeerInfo, func(), error) {
 	if val, ok := r.lookupCache.Get(key); ok && val.(string) == strPeerNotFound {
-		// TODO avtakkar: currently only doing a negative cache, this could maybe become a positive cache as well.
+		// Keys that resolved are cached by Resolve, see resolvedCache.
 		return nil, nil, ContentNotFoundError{key: key, error: fmt.Errorf("(cached) peer not found for key")}
 	}
 
@@ -169,35 +297,72 @@ func (r *router) ResolveWithNegativeCacheCallback(ctx context.Context, key strin
 }
 
 // Resolve resolves the given key to a peer address.
+// Providers the key recently resolved to are returned without a DHT lookup. Otherwise, providers recently resolved for
+// other chunks of the same blob are returned first, while the DHT is searched for the rest.
+// Providers are ordered by how close they are to this node, then by how fast they are expected to transfer a chunk,
+// and with a strict Topology filtered by how close they are.
+// When blobs are advertised, the providers of the blob of the key are looked up, and those known not to hold the chunk
+// are skipped.
 func (r *router) Resolve(ctx context.Context, key string, allowSelf bool, count int) (<-chan PeerInfo, error) {
 	log := zerolog.Ctx(ctx).With().Str("selfId", r.host.ID().String()).Str("key", key).Logger()
-	contentId, err := createContentId(key)
+	// With blob advertisements, the providers of the blob are looked up and cached for every chunk.
+	lookup := r.advertise.Key(key)
+	contentId, err := createContentId(lookup)
 	if err != nil {
 		return nil, err
 	}
 
-	providersCh := r.content.FindProvidersAsync(ctx, contentId, count)
+	exact, neighbours := r.resolved.get(lookup)
+
+	var providersCh <-chan peer.AddrInfo
+	if len(exact) == 0 {
+		providersCh = r.content.FindProvidersAsync(ctx, contentId, count)
+	}
 	peersCh := make(chan PeerInfo, count)
+	mode, window := Topology, rankWindow(ctx, RankWindow)
 
 	go func() {
-		for info := range providersCh {
+		ranks := map[peer.ID]providerRank{}
+		rankOf := func(id peer.ID) providerRank {
+			rk, ok := ranks[id]
+			if !ok {
+				rk = r.rankProvider(ctx, id, mode)
+				ranks[id] = rk
+			}
+			return rk
+		}
+
+		seen := map[peer.ID]bool{}
+		send := func(info PeerInfo) bool {
+			if seen[info.ID] {
+				return true
+			}
+			seen[info.ID] = true
+
 			if !allowSelf && info.ID == r.host.ID() {
-				continue
+				return true
 			}
 
-			if len(info.Addrs) != 1 {
-				log.Debug().Msg("expected address list to only contain a single item")
-				continue
+			if _, ok := r.lookupCache.Get(notCachedKey(key, info.ID)); ok {
+				log.Debug().Str("peer", info.ID.String()).Msg("skipping peer that does not have the key cached")
+				return true
 			}
 
-			v, err := info.Addrs[0].ValueForProtocol(multiaddr.P_IP4)
-			if err != nil {
-				log.Error().Err(err).Str("peer", info.Addrs[0].String()).Msg("could not get IPV4 address")
-				continue
+			if mode.strict() && !mode.admits(rankOf(info.ID).locality) {
+				log.Debug().Str("peer", info.ID.String()).Msg("skipping peer outside of topology")
+				return true
 			}
 
-			// Combine peer with registry port to create mirror endpoint.
-			peersCh <- PeerInfo{info.ID, fmt.Sprintf("https://%s:%s", v, r.peerRegistryPort)}
+			if !r.holds(ctx, info, key) {
+				log.Debug().Str("peer", info.ID.String()).Msg("skipping peer that does not hold the chunk")
+				return true
+			}
+
+			select {
+			case <-ctx.Done():
+				return false
+			case peersCh <- info:
+			}
 
 			if r.active.CompareAndSwap(false, true) {
 				er, err := events.NewRecorder(ctx, r.k8sClient)
@@ -207,28 +372,117 @@ func (r *router) Resolve(ctx context.Context, key string, allowSelf bool, count
 					er.Active() // Report that p2p is active.
 				}
 			}
+			return true
+		}
+
+		cached := append(exact, neighbours...)
+		sortByRank(cached, rankOf)
+		for _, info := range cached {
+			if !send(info) {
+				return
+			}
+		}
+
+		if providersCh == nil {
+			return
+		}
+
+		// Providers found within the rank window are held back, and sent best first once the window elapses or as many
+		// as requested are found. Later ones are sent as they are found.
+		var held []PeerInfo
+		var windowCh <-chan time.Time
+		if window > 0 {
+			windowCh = time.After(window)
+		}
+		flush := func() bool {
+			windowCh = nil
+			sortByRank(held, rankOf)
+			for _, info := range held {
+				if !send(info) {
+					return false
+				}
+			}
+			held = nil
+			return true
+		}
+
+		for {
+			select {
+			case <-windowCh:
+				if !flush() {
+					return
+				}
+
+			case info, ok := <-providersCh:
+				if !ok {
+					flush()
+					return
+				}
+
+				// Combine peer with registry port to create mirror endpoints.
+				hosts := httpHosts(info.Addrs, r.peerRegistryPort)
+				if len(hosts) == 0 {
+					log.Error().Str("peer", info.ID.String()).Msg("could not get an allowed IP address")
+					continue
+				}
+				p := PeerInfo{ID: info.ID, HttpHost: hosts[0], Fallbacks: hosts[1:]}
+				if info.ID != r.host.ID() {
+					r.resolved.add(lookup, p)
+				}
+
+				if windowCh != nil {
+					held = append(held, p)
+					if len(held) >= count && !flush() {
+						return
+					}
+					continue
+				}
+				if !send(p) {
+					return
+				}
+			}
 		}
 	}()
 
 	return peersCh, nil
 }
 
+// ReportFailed records that a request to the peer for the key failed, so that the key is looked up again rather than
+// resolved to the peer from the cache of resolved providers.
+func (r *router) ReportFailed(key string, id peer.ID) {
+	r.resolved.forgetPeer(key, id)
+}
+
 // Provide advertises the given keys to the network.
+// The keys are provided concurrently and independently, and a *ProvideError lists those that could not be.
 func (r *router) Provide(ctx context.Context, keys []string) error {
 	zerolog.Ctx(ctx).Trace().Str("host", r.host.ID().String()).Strs("keys", keys).Msg("providing keys")
-	for _, key := range keys {
-
-		contentId, err := createContentId(key)
-		if err != nil {
-			return err
-		}
 
-		err = r.content.Provide(ctx, contentId, true)
-		if err != nil {
-			return err
-		}
+	var lock sync.Mutex
+	var failed []string
+	var errs []error
+	g := errgroup.Group{}
+	g.SetLimit(provideConcurrency)
+	for _, key := range keys {
+		g.Go(func() error {
+			contentId, err := createContentId(key)
+			if err == nil {
+				err = r.content.Provide(ctx, contentId, true)
+			}
+			if err != nil {
+				lock.Lock()
+				failed = append(failed, key)
+				errs = append(errs, fmt.Errorf("key %v: %w", key, err))
+				lock.Unlock()
+			}
+			return nil
+		})
 	}
+	_ = g.Wait()
 
+	if len(failed) > 0 {
+		return &ProvideError{Keys: failed, Err: errors.Join(errs...)}
+	}
 	return nil
 }
 
@@ -248,33 +502,21 @@ func createContentId(key string) (cid.Cid, error) {
 }
 
 // newHost creates a new Host from the given address.
+// An address without a host, such as ":5003", listens on both IPv4 and IPv6. The host advertises every reachable address
+// it listens on that is allowed, in order of preference, those of PreferredAddressFamily first within each rank. If QUIC
+// is enabled, the host also listens over QUIC on the UDP port of the same number.
 func newHost(addr string) (host.Host, error) {
 	h, p, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	hostAddr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%s", h, p))
+	hostAddrs, err := listenAddrs(h, p)
 	if err != nil {
-		return nil, fmt.Errorf("could not create host multi address: %w", err)
+		return nil, err
 	}
 
-	factory := libp2p.AddrsFactory(func(addrs []multiaddr.Multiaddr) []multiaddr.Multiaddr {
-		for _, addr := range addrs {
-			v, err := addr.ValueForProtocol(multiaddr.P_IP4)
-			if err != nil {
-				continue
-			}
-			if v == "" {
-				continue
-			}
-			if v == "127.0.0.1" {
-				continue
-			}
-			return []multiaddr.Multiaddr{addr}
-		}
-		return nil
-	})
+	factory := libp2p.AddrsFactory(advertisedAddrs)
 
-	return libp2p.New(libp2p.ListenAddrs(hostAddr), factory)
+	return libp2p.New(libp2p.ListenAddrs(hostAddrs...), factory)
 }
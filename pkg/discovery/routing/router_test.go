@@ -5,7 +5,10 @@ package routing
 import (
 	"context"
 	"errors"
+	"net"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +24,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/protocol"
 	corerouting "github.com/libp2p/go-libp2p/core/routing"
 	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
 	multiaddr "github.com/multiformats/go-multiaddr"
 	"k8s.io/client-go/kubernetes/fake"
 )
@@ -37,7 +41,7 @@ func TestResolveWithCache(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	h := &testHost{"host-id"}
+	h := &testHost{id: "host-id"}
 	key := "some-key"
 
 	tcr := &testCr{
@@ -76,7 +80,7 @@ func TestResolve(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	h := &testHost{"host-id"}
+	h := &testHost{id: "host-id"}
 	key := "some-key"
 	contentId, err := createContentId(key)
 	if err != nil {
@@ -119,6 +123,57 @@ func TestResolve(t *testing.T) {
 	}
 }
 
+func TestResolveAddressFamily(t *testing.T) {
+	prev := PreferredAddressFamily
+	defer func() { PreferredAddressFamily = prev }()
+
+	c, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "some-key"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             &testHost{id: "host-id"},
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{
+				contentId.String(): {"10.0.0.1,fd00::1"},
+			},
+		}),
+	}
+
+	for _, tc := range []struct {
+		family   AddressFamily
+		expected string
+	}{
+		{IPv4, "https://10.0.0.1:5000"},
+		{IPv6, "https://[fd00::1]:5000"},
+	} {
+		PreferredAddressFamily = tc.family
+
+		got, err := r.Resolve(context.Background(), key, false, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info := <-got; info.HttpHost != tc.expected {
+			t.Errorf("expected: %v, got: %v", tc.expected, info.HttpHost)
+		}
+	}
+}
+
 func TestProvide(t *testing.T) {
 	c, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1e7,
@@ -129,7 +184,7 @@ func TestProvide(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	h := &testHost{"host-id"}
+	h := &testHost{id: "host-id"}
 	key := "some-key"
 	contentId, err := createContentId(key)
 	if err != nil {
@@ -210,6 +265,45 @@ func TestNewHost(t *testing.T) {
 	}
 }
 
+func TestNewHostDualStack(t *testing.T) {
+	if !hasReachableIPv6(t) {
+		t.Skip("no reachable IPv6 address")
+	}
+
+	h, err := newHost(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var families []AddressFamily
+	for _, addr := range h.Addrs() {
+		_, family, ok := ipOf(addr)
+		if !ok {
+			t.Fatalf("expected IP address, got %s", addr)
+		}
+		families = append(families, family)
+	}
+
+	if len(families) < 2 || families[0] != PreferredAddressFamily || !slices.Contains(families, IPv6) {
+		t.Errorf("expected addresses of both families, preferred first, got %v", h.Addrs())
+	}
+}
+
+// hasReachableIPv6 reports whether the machine has an IPv6 address that peers could reach.
+func hasReachableIPv6(t *testing.T) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() == nil && reachable(ipNet.IP.String()) {
+			return true
+		}
+	}
+	return false
+}
+
 type testCr struct {
 	m        map[string][]string
 	provided []cid.Cid
@@ -220,7 +314,15 @@ func (t *testCr) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <
 	ch := make(chan peer.AddrInfo, count)
 	if val, ok := t.m[c.String()]; ok {
 		for _, addr := range val {
-			ch <- peer.AddrInfo{ID: peer.ID(addr), Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/" + addr + "/tcp/5005")}}
+			var addrs []multiaddr.Multiaddr
+			for _, ip := range strings.Split(addr, ",") {
+				if strings.Contains(ip, ":") {
+					addrs = append(addrs, multiaddr.StringCast("/ip6/"+ip+"/tcp/5005"))
+				} else {
+					addrs = append(addrs, multiaddr.StringCast("/ip4/"+ip+"/tcp/5005"))
+				}
+			}
+			ch <- peer.AddrInfo{ID: peer.ID(addr), Addrs: addrs}
 		}
 	}
 	return ch
@@ -239,6 +341,9 @@ var _ corerouting.ContentRouting = &testCr{}
 
 type testHost struct {
 	id peer.ID
+
+	once sync.Once
+	ps   peerstore.Peerstore
 }
 
 // Addrs implements host.Host.
@@ -282,13 +387,21 @@ func (*testHost) Network() network.Network {
 }
 
 // NewStream implements host.Host.
+// The test host has no network, so streams cannot be opened.
 func (*testHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
-	panic("unimplemented")
+	return nil, errors.New("no network")
 }
 
 // Peerstore implements host.Host.
-func (*testHost) Peerstore() peerstore.Peerstore {
-	panic("unimplemented")
+func (th *testHost) Peerstore() peerstore.Peerstore {
+	th.once.Do(func() {
+		ps, err := pstoremem.NewPeerstore()
+		if err != nil {
+			panic(err)
+		}
+		th.ps = ps
+	})
+	return th.ps
 }
 
 // RemoveStreamHandler implements host.Host.
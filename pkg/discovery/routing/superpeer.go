@@ -0,0 +1,152 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Role is the role of a node in the distribution of content.
+type Role string
+
+const (
+	// RolePeer reads chunks that no peer provides from the closest super-peer, or from the upstream if there is none.
+	RolePeer Role = "peer"
+
+	// RoleSuperPeer advertises itself under SuperPeerKey, and reads chunks requested by peers that it does not hold from
+	// the upstream, once for all of them.
+	RoleSuperPeer Role = "super-peer"
+)
+
+// NodeRole is the role of this node.
+var NodeRole = RolePeer
+
+// ParseRole parses a node role.
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RolePeer, RoleSuperPeer:
+		return r, nil
+	default:
+		return "", fmt.Errorf("invalid role: %v", s)
+	}
+}
+
+const (
+	// SuperPeerKey is the key under which super-peers advertise themselves.
+	SuperPeerKey = "peerd/super-peer"
+
+	// superPeerAdvertiseInterval is the interval at which a super-peer advertises itself again, within MaxRecordAge.
+	superPeerAdvertiseInterval = MaxRecordAge / 3
+
+	// superPeerRefreshInterval is the interval at which a node looks up the super-peers again, and at which a super-peer
+	// retries advertising itself after a failure.
+	superPeerRefreshInterval = 30 * time.Second
+
+	// superPeerResolveTimeout bounds looking up the super-peers.
+	superPeerResolveTimeout = time.Second
+
+	// maxSuperPeers is the number of super-peers a node keeps, closest first.
+	maxSuperPeers = 3
+)
+
+// superPeers are the super-peers known to a node, closest first. A nil *superPeers knows none.
+type superPeers struct {
+	lock  sync.Mutex
+	peers []PeerInfo
+}
+
+// set replaces the super-peers.
+func (s *superPeers) set(peers []PeerInfo) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.peers = peers
+}
+
+// get returns the super-peers.
+func (s *superPeers) get() []PeerInfo {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return slices.Clone(s.peers)
+}
+
+// SuperPeers returns the super-peers known to this node, closest first. A super-peer knows none.
+func (r *router) SuperPeers() []PeerInfo {
+	return r.superPeers.get()
+}
+
+// advertiseSuperPeer advertises this node as a super-peer until ctx is done.
+func (r *router) advertiseSuperPeer(ctx context.Context) {
+	go func() {
+		for {
+			next := superPeerAdvertiseInterval
+			if err := r.Provide(ctx, []string{SuperPeerKey}); err != nil {
+				zerolog.Ctx(ctx).Warn().Err(err).Msg("could not advertise super-peer")
+				next = superPeerRefreshInterval
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(next):
+			}
+		}
+	}()
+}
+
+// watchSuperPeers looks up the closest super-peers periodically until ctx is done.
+func (r *router) watchSuperPeers(ctx context.Context) {
+	go func() {
+		for {
+			r.refreshSuperPeers(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(superPeerRefreshInterval):
+			}
+		}
+	}()
+}
+
+// refreshSuperPeers looks up the closest super-peers, in the order they are resolved.
+func (r *router) refreshSuperPeers(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, superPeerResolveTimeout)
+	defer cancel()
+
+	peersCh, err := r.Resolve(ctx, SuperPeerKey, false, maxSuperPeers)
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("could not resolve super-peers")
+		return
+	}
+
+	var found []PeerInfo
+collect:
+	for len(found) < maxSuperPeers {
+		select {
+		case <-ctx.Done():
+			break collect
+		case p, ok := <-peersCh:
+			if !ok {
+				break collect
+			}
+			found = append(found, p)
+		}
+	}
+	r.superPeers.set(found)
+}
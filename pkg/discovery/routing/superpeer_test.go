@@ -0,0 +1,84 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+func TestParseRole(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected Role
+		err      bool
+	}{
+		{s: "peer", expected: RolePeer},
+		{s: "super-peer", expected: RoleSuperPeer},
+		{s: "superpeer", err: true},
+		{s: "", err: true},
+	} {
+		got, err := ParseRole(tc.s)
+		if (err != nil) != tc.err {
+			t.Errorf("%v: expected error: %v, got: %v", tc.s, tc.err, err)
+		}
+		if got != tc.expected {
+			t.Errorf("expected: %v, got: %v", tc.expected, got)
+		}
+	}
+}
+
+func TestSuperPeers(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contentId, err := createContentId(SuperPeerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             &testHost{id: "host-id"},
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{
+				contentId.String(): {"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			},
+		}),
+		superPeers: &superPeers{},
+	}
+
+	if got := r.SuperPeers(); len(got) != 0 {
+		t.Errorf("expected no super-peers, got: %v", got)
+	}
+
+	// The super-peers are kept in the order they are resolved, up to maxSuperPeers.
+	r.refreshSuperPeers(context.Background())
+	got := r.SuperPeers()
+	if len(got) != maxSuperPeers {
+		t.Fatalf("expected: %v, got: %v", maxSuperPeers, len(got))
+	}
+	for i, expected := range []string{"https://10.0.0.1:5000", "https://10.0.0.2:5000", "https://10.0.0.3:5000"} {
+		if got[i].HttpHost != expected {
+			t.Errorf("expected: %v, got: %v", expected, got[i].HttpHost)
+		}
+	}
+
+	// A node without super-peers, such as a super-peer itself, knows none.
+	r.superPeers = nil
+	r.refreshSuperPeers(context.Background())
+	if got := r.SuperPeers(); got != nil {
+		t.Errorf("expected no super-peers, got: %v", got)
+	}
+}
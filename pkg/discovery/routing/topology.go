@@ -0,0 +1,169 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/azure/peerd/pkg/k8s"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// TopologyMode is how strictly resolution keeps to providers close to this node.
+type TopologyMode string
+
+const (
+	// TopologyOff uses providers in the order they are found.
+	TopologyOff TopologyMode = "off"
+
+	// TopologyPrefer uses providers in the same node pool, zone and region first.
+	TopologyPrefer TopologyMode = "prefer"
+
+	// TopologyRegion uses only providers in the same region, closest first.
+	TopologyRegion TopologyMode = "region"
+
+	// TopologyZone uses only providers in the same zone, closest first.
+	TopologyZone TopologyMode = "zone"
+)
+
+// Topology is how strictly resolution keeps to providers close to this node.
+var Topology = TopologyPrefer
+
+// ParseTopologyMode parses a topology mode.
+func ParseTopologyMode(s string) (TopologyMode, error) {
+	switch m := TopologyMode(s); m {
+	case TopologyOff, TopologyPrefer, TopologyRegion, TopologyZone:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid topology mode: %v", s)
+	}
+}
+
+// locality is how close a peer is to this node, closest first.
+type locality int
+
+const (
+	localityNodePool locality = iota
+	localityZone
+	localityRegion
+	localityRemote
+)
+
+const (
+	// topologyProtocol is the protocol used to ask a peer for its topology.
+	topologyProtocol = protocol.ID("/peerd/topology/1.0.0")
+
+	// topologyKey is the key of the topology of a peer in the peerstore.
+	topologyKey = "peerd/topology"
+
+	// topologyTimeout bounds asking a peer for its topology.
+	topologyTimeout = 500 * time.Millisecond
+
+	// maxTopologySize is the maximum size of a topology sent by a peer.
+	maxTopologySize = 4096
+)
+
+// localityOf returns how close a node with the topology is to a node with the topology self.
+// Unknown locations are not close to anything.
+func localityOf(self, other k8s.Topology) locality {
+	switch {
+	case self.Zone != "" && self.Zone == other.Zone && self.NodePool != "" && self.NodePool == other.NodePool:
+		return localityNodePool
+	case self.Zone != "" && self.Zone == other.Zone:
+		return localityZone
+	case self.Region != "" && self.Region == other.Region:
+		return localityRegion
+	default:
+		return localityRemote
+	}
+}
+
+// admits returns whether resolution in the mode may use a provider with the locality.
+func (m TopologyMode) admits(l locality) bool {
+	switch m {
+	case TopologyZone:
+		return l <= localityZone
+	case TopologyRegion:
+		return l <= localityRegion
+	default:
+		return true
+	}
+}
+
+// strict returns whether resolution in the mode uses only providers close to this node.
+func (m TopologyMode) strict() bool {
+	return m == TopologyZone || m == TopologyRegion
+}
+
+// locality returns how close the peer is to this node, asking the peer for its topology if it is not known.
+func (r *router) locality(ctx context.Context, id peer.ID) locality {
+	if id == r.host.ID() {
+		return localityNodePool
+	}
+
+	t, err := r.topologyOf(ctx, id)
+	if err != nil {
+		return localityRemote
+	}
+	return localityOf(r.topology, t)
+}
+
+// topologyOf returns the topology of the peer from the peerstore, or asks the peer for it.
+func (r *router) topologyOf(ctx context.Context, id peer.ID) (k8s.Topology, error) {
+	if v, err := r.host.Peerstore().Get(id, topologyKey); err == nil {
+		if t, ok := v.(k8s.Topology); ok {
+			return t, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, topologyTimeout)
+	defer cancel()
+
+	s, err := r.host.NewStream(ctx, id, topologyProtocol)
+	if err != nil {
+		return k8s.Topology{}, err
+	}
+	defer s.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	var t k8s.Topology
+	if err := json.NewDecoder(io.LimitReader(s, maxTopologySize)).Decode(&t); err != nil {
+		return k8s.Topology{}, err
+	}
+
+	if err := r.host.Peerstore().Put(id, topologyKey, t); err != nil {
+		return k8s.Topology{}, err
+	}
+	return t, nil
+}
+
+// handleTopology sends the topology of this node to the remote peer of the stream.
+func (r *router) handleTopology(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(topologyTimeout))
+	_ = json.NewEncoder(s).Encode(r.topology)
+}
+
+// learnTopology asks peers for their topology as they connect, so that it is known by the time they are resolved.
+func (r *router) learnTopology(ctx context.Context) {
+	if Topology == TopologyOff {
+		return
+	}
+
+	r.host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			go func() {
+				_, _ = r.topologyOf(ctx, c.RemotePeer())
+			}()
+		},
+	})
+}
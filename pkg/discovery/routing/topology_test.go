@@ -0,0 +1,185 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/azure/peerd/pkg/k8s"
+	"github.com/dgraph-io/ristretto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+func TestLocalityOf(t *testing.T) {
+	self := k8s.Topology{Region: "eastus", Zone: "eastus-1", NodePool: "pool1"}
+
+	for _, tc := range []struct {
+		name     string
+		self     k8s.Topology
+		other    k8s.Topology
+		expected locality
+	}{
+		{
+			name:     "same node pool",
+			self:     self,
+			other:    k8s.Topology{Region: "eastus", Zone: "eastus-1", NodePool: "pool1"},
+			expected: localityNodePool,
+		},
+		{
+			name:     "same node pool in another zone",
+			self:     self,
+			other:    k8s.Topology{Region: "eastus", Zone: "eastus-2", NodePool: "pool1"},
+			expected: localityRegion,
+		},
+		{
+			name:     "same zone",
+			self:     self,
+			other:    k8s.Topology{Region: "eastus", Zone: "eastus-1", NodePool: "pool2"},
+			expected: localityZone,
+		},
+		{
+			name:     "same region",
+			self:     self,
+			other:    k8s.Topology{Region: "eastus", Zone: "eastus-3"},
+			expected: localityRegion,
+		},
+		{
+			name:     "other region",
+			self:     self,
+			other:    k8s.Topology{Region: "westus", Zone: "westus-1", NodePool: "pool1"},
+			expected: localityRemote,
+		},
+		{
+			name:     "unknown",
+			self:     self,
+			expected: localityRemote,
+		},
+		{
+			name:     "unknown self",
+			expected: localityRemote,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := localityOf(tc.self, tc.other); got != tc.expected {
+				t.Errorf("expected: %v, got: %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseTopologyMode(t *testing.T) {
+	for _, s := range []string{"off", "prefer", "region", "zone"} {
+		if m, err := ParseTopologyMode(s); err != nil || string(m) != s {
+			t.Errorf("expected: %v, got: %v (%v)", s, m, err)
+		}
+	}
+
+	if _, err := ParseTopologyMode("node"); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+}
+
+func TestResolveTopology(t *testing.T) {
+	defer func(m TopologyMode) { Topology = m }(Topology)
+
+	key := "blob_0"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topologies := map[peer.ID]k8s.Topology{
+		"10.0.0.1": {Region: "westus", Zone: "westus-1"},
+		"10.0.0.2": {Region: "eastus", Zone: "eastus-2"},
+		"10.0.0.3": {Region: "eastus", Zone: "eastus-1", NodePool: "pool2"},
+		"10.0.0.4": {Region: "eastus", Zone: "eastus-1", NodePool: "pool1"},
+	}
+
+	for _, tc := range []struct {
+		mode     TopologyMode
+		expected []string
+	}{
+		{
+			mode:     TopologyOff,
+			expected: []string{"https://10.0.0.1:5000", "https://10.0.0.2:5000", "https://10.0.0.3:5000", "https://10.0.0.4:5000", "https://10.0.0.5:5000"},
+		},
+		{
+			mode:     TopologyPrefer,
+			expected: []string{"https://10.0.0.4:5000", "https://10.0.0.3:5000", "https://10.0.0.2:5000", "https://10.0.0.1:5000", "https://10.0.0.5:5000"},
+		},
+		{
+			mode:     TopologyRegion,
+			expected: []string{"https://10.0.0.4:5000", "https://10.0.0.3:5000", "https://10.0.0.2:5000"},
+		},
+		{
+			mode:     TopologyZone,
+			expected: []string{"https://10.0.0.4:5000", "https://10.0.0.3:5000"},
+		},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			Topology = tc.mode
+
+			c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1000, BufferItems: 64})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := &testHost{id: "host-id"}
+			for id, topology := range topologies {
+				if err := h.Peerstore().Put(id, topologyKey, topology); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := &router{
+				k8sClient:        &fakeClientset,
+				host:             h,
+				topology:         k8s.Topology{Region: "eastus", Zone: "eastus-1", NodePool: "pool1"},
+				peerRegistryPort: "5000",
+				lookupCache:      c,
+				resolved:         newResolvedCache(time.Minute),
+				content: routing.NewRoutingDiscovery(&testCr{
+					m: map[string][]string{
+						// 10.0.0.5 has an unknown topology.
+						contentId.String(): {"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"},
+					},
+				}),
+			}
+
+			hosts := resolveHosts(t, r, key, 5)
+			if !slices.Equal(hosts, tc.expected) {
+				t.Errorf("expected: %v, got: %v", tc.expected, hosts)
+			}
+		})
+	}
+}
+
+func TestTopologyProtocol(t *testing.T) {
+	h1 := newLoopbackHost(t)
+	h2 := newLoopbackHost(t)
+
+	expected := k8s.Topology{Region: "eastus", Zone: "eastus-1", NodePool: "pool1"}
+	r1 := &router{host: h1}
+	r2 := &router{host: h2, topology: expected}
+	h2.SetStreamHandler(topologyProtocol, r2.handleTopology)
+
+	h1.Peerstore().AddAddr(h2.ID(), tcpAddr(t, h2), time.Minute)
+
+	got, err := r1.topologyOf(context.Background(), h2.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != expected {
+		t.Errorf("expected: %v, got: %v", expected, got)
+	}
+
+	// The topology is kept in the peerstore.
+	h2.RemoveStreamHandler(topologyProtocol)
+	if got, err := r1.topologyOf(context.Background(), h2.ID()); err != nil || got != expected {
+		t.Errorf("expected: %v, got: %v (%v)", expected, got, err)
+	}
+}
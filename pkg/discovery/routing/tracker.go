@@ -0,0 +1,514 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/azure/peerd/pkg/k8s/election"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	corerouting "github.com/libp2p/go-libp2p/core/routing"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// trackerProtocol is the protocol used to report content to the tracker and look up its providers.
+	trackerProtocol = protocol.ID("/peerd/tracker/1.0.0")
+
+	// trackerElectionName is the name of the Kubernetes lease the tracker is elected with.
+	trackerElectionName = "peerd-tracker"
+
+	// trackerInterval is the interval at which the content provided and withdrawn by this node is reported.
+	trackerInterval = 100 * time.Millisecond
+
+	// trackerHeartbeatInterval is the interval at which this node reports to the tracker when it has nothing to report,
+	// so that it learns the tracker lost its index.
+	trackerHeartbeatInterval = 10 * time.Second
+
+	// trackerTimeout bounds a request to the tracker.
+	trackerTimeout = 5 * time.Second
+
+	// maxTrackerKeys is the maximum number of keys in a single report.
+	maxTrackerKeys = 4096
+
+	// maxTrackerSize is the maximum size of a request to or a response from the tracker.
+	maxTrackerSize = 1024 * 1024
+)
+
+// errNotTracker is returned by a node asked to serve as tracker that is not the elected tracker.
+var errNotTracker = errors.New("not the tracker")
+
+// trackerRequest is a report of the content provided and withdrawn by a node, or a lookup of the providers of content.
+type trackerRequest struct {
+	// Addrs are the addresses of the node.
+	Addrs []string `json:"addrs,omitempty"`
+
+	// Full replaces the content indexed for the node by Provide.
+	Full bool `json:"full,omitempty"`
+
+	// Provide are the content IDs provided by the node.
+	Provide []string `json:"provide,omitempty"`
+
+	// Withdraw are the content IDs withdrawn by the node.
+	Withdraw []string `json:"withdraw,omitempty"`
+
+	// Find is the content ID whose providers are looked up.
+	Find string `json:"find,omitempty"`
+
+	// Count is the maximum number of providers returned, or 0 for all of them.
+	Count int `json:"count,omitempty"`
+}
+
+// trackerProvider is a provider of content returned by the tracker.
+type trackerProvider struct {
+	ID    peer.ID  `json:"id"`
+	Addrs []string `json:"addrs"`
+}
+
+// trackerResponse is the response of the tracker to a request.
+type trackerResponse struct {
+	// Epoch identifies the index of the tracker. It changes when the tracker starts leading with an empty index, so
+	// that nodes report all of their content again.
+	Epoch uint64 `json:"epoch"`
+
+	// Providers are the providers of the content looked up.
+	Providers []trackerProvider `json:"providers,omitempty"`
+
+	// Error is set if the request failed.
+	Error string `json:"error,omitempty"`
+}
+
+// tracker is content routing through a tracker: a node elected with a Kubernetes lease, which keeps an index of the
+// providers of content in memory. Every node reports the content it provides and withdraws to the tracker, and looks
+// up providers by asking it. A node elected tracker starts with an empty index, which is rebuilt from the full reports
+// that nodes send when the tracker changes, or when the tracker answers with a new epoch. Index entries expire after
+// MaxRecordAge, unless the content is provided again. A nil *tracker reports nothing.
+type tracker struct {
+	ctx      context.Context
+	host     host.Host
+	election election.LeaderElection
+
+	lock sync.Mutex
+
+	// leader is the elected tracker.
+	leader peer.ID
+
+	// provided maps the content provided by this node to when it was provided.
+	provided map[string]time.Time
+	provide  []string
+	withdraw []string
+
+	// reportedTo is the tracker this node has reported all of its content to, and epoch is the epoch of its index.
+	reportedTo peer.ID
+	epoch      uint64
+	reported   time.Time
+
+	// leading is set while this node is the tracker. The index maps content to its providers and when they provided it,
+	// and keys maps providers to their content.
+	leading    bool
+	indexEpoch uint64
+	index      map[string]map[peer.ID]time.Time
+	keys       map[peer.ID]map[string]bool
+	swept      time.Time
+}
+
+var _ corerouting.ContentRouting = &tracker{}
+
+// newTracker creates tracker content routing for the host, with the tracker elected by the election, which stops
+// reporting when ctx is done.
+func newTracker(ctx context.Context, h host.Host, e election.LeaderElection) *tracker {
+	return &tracker{
+		ctx:      ctx,
+		host:     h,
+		election: e,
+		provided: map[string]time.Time{},
+	}
+}
+
+// start serves the requests of nodes while this node is the tracker, and reports the content provided and withdrawn
+// by this node every trackerInterval until ctx is done.
+func (t *tracker) start() {
+	t.host.SetStreamHandler(trackerProtocol, t.handle)
+
+	go func() {
+		ticker := time.NewTicker(trackerInterval)
+		defer ticker.Stop()
+
+		for {
+			// The first tick waits for the tracker to be elected.
+			t.tick()
+
+			select {
+			case <-t.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Provide records that this node provides the content, and reports it to the tracker if announce is set.
+func (t *tracker) Provide(_ context.Context, c cid.Cid, announce bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.provided[c.String()] = time.Now()
+	if announce {
+		t.withdraw = slices.DeleteFunc(t.withdraw, func(s string) bool { return s == c.String() })
+		t.provide = append(t.provide, c.String())
+	}
+	return nil
+}
+
+// withdrawContent records that this node no longer provides the content, and reports it to the tracker.
+func (t *tracker) withdrawContent(c cid.Cid) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.provided, c.String())
+	t.provide = slices.DeleteFunc(t.provide, func(s string) bool { return s == c.String() })
+	t.withdraw = append(t.withdraw, c.String())
+}
+
+// FindProvidersAsync asks the tracker for up to count providers of the content, or all of them if count is 0.
+func (t *tracker) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	ch := make(chan peer.AddrInfo)
+	go func() {
+		defer close(ch)
+
+		t.lock.Lock()
+		leader := t.leader
+		t.lock.Unlock()
+		if leader == "" {
+			return
+		}
+
+		resp, err := t.request(ctx, leader, &trackerRequest{Find: c.String(), Count: count})
+		if err != nil {
+			zerolog.Ctx(ctx).Debug().Err(err).Str("tracker", leader.String()).Msg("could not look up providers")
+			return
+		}
+		t.observe(leader, resp.Epoch)
+
+		for _, p := range resp.Providers {
+			addrs := parseAddrs(p.Addrs)
+			if p.ID != t.host.ID() && len(addrs) > 0 {
+				t.host.Peerstore().AddAddrs(p.ID, addrs, MaxRecordAge)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- peer.AddrInfo{ID: p.ID, Addrs: addrs}:
+			}
+		}
+	}()
+	return ch
+}
+
+// tick follows the election of the tracker, taking over the index if this node was elected, and reports the content
+// provided and withdrawn by this node to the tracker. All of the content is reported when the tracker changed or lost
+// its index, and only the changes otherwise.
+func (t *tracker) tick() {
+	log := zerolog.Ctx(t.ctx)
+
+	addr, err := t.election.Leader()
+	if err != nil {
+		log.Debug().Err(err).Msg("could not get tracker")
+		return
+	}
+	info, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		log.Debug().Err(err).Str("addr", addr.String()).Msg("invalid tracker address")
+		return
+	}
+	if info.ID != t.host.ID() {
+		t.host.Peerstore().AddAddrs(info.ID, info.Addrs, MaxRecordAge)
+	}
+
+	t.lock.Lock()
+	t.lead(info.ID == t.host.ID())
+	t.leader = info.ID
+
+	full := t.reportedTo != info.ID
+	var reqs []*trackerRequest
+	switch {
+	case full:
+		now := time.Now()
+		var provided []string
+		for c, at := range t.provided {
+			if now.Sub(at) >= MaxRecordAge {
+				delete(t.provided, c)
+				continue
+			}
+			provided = append(provided, c)
+		}
+
+		req := &trackerRequest{Full: true}
+		for chunk := range slices.Chunk(provided, maxTrackerKeys) {
+			req.Provide = chunk
+			reqs = append(reqs, req)
+			req = &trackerRequest{}
+		}
+		if len(reqs) == 0 {
+			reqs = append(reqs, req)
+		}
+
+	case len(t.provide) > 0 || len(t.withdraw) > 0 || time.Since(t.reported) >= trackerHeartbeatInterval:
+		for len(t.provide) > 0 || len(t.withdraw) > 0 {
+			n := min(len(t.withdraw), maxTrackerKeys)
+			m := min(len(t.provide), maxTrackerKeys-n)
+			reqs = append(reqs, &trackerRequest{Withdraw: t.withdraw[:n], Provide: t.provide[:m]})
+			t.withdraw, t.provide = t.withdraw[n:], t.provide[m:]
+		}
+		if len(reqs) == 0 {
+			// A heartbeat, which learns the epoch of the index of the tracker.
+			reqs = append(reqs, &trackerRequest{})
+		}
+	}
+	// Changes not yet reported are covered by a full report.
+	t.provide, t.withdraw = nil, nil
+	t.lock.Unlock()
+
+	var addrs []string
+	for _, a := range t.host.Addrs() {
+		addrs = append(addrs, a.String())
+	}
+
+	for i, req := range reqs {
+		req.Addrs = addrs
+		resp, err := t.request(t.ctx, info.ID, req)
+		if err != nil {
+			log.Debug().Err(err).Str("tracker", info.ID.String()).Msg("could not report to tracker")
+			t.lock.Lock()
+			t.reportedTo = ""
+			t.lock.Unlock()
+			return
+		}
+
+		t.lock.Lock()
+		if full && i == 0 {
+			t.reportedTo, t.epoch = info.ID, resp.Epoch
+		}
+		t.reported = time.Now()
+		t.lock.Unlock()
+		t.observe(info.ID, resp.Epoch)
+	}
+}
+
+// observe records the epoch of the index of the tracker, so that all of the content of this node is reported again if
+// the tracker lost its index.
+func (t *tracker) observe(leader peer.ID, epoch uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.reportedTo == leader && t.epoch != epoch {
+		t.reportedTo = ""
+	}
+}
+
+// lead starts or stops serving as the tracker. A node that starts leading starts with an empty index in a new epoch.
+// It must be called with the lock held.
+func (t *tracker) lead(leading bool) {
+	switch {
+	case leading && !t.leading:
+		t.index = map[string]map[peer.ID]time.Time{}
+		t.keys = map[peer.ID]map[string]bool{}
+		t.indexEpoch = uint64(time.Now().UnixNano())
+		t.swept = time.Now()
+		zerolog.Ctx(t.ctx).Info().Uint64("epoch", t.indexEpoch).Msg("elected tracker")
+
+	case !leading && t.leading:
+		t.index, t.keys = nil, nil
+	}
+	t.leading = leading
+}
+
+// request sends the request to the tracker, or serves it if this node is the tracker.
+func (t *tracker) request(ctx context.Context, id peer.ID, req *trackerRequest) (*trackerResponse, error) {
+	if id == t.host.ID() {
+		return t.serve(id, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, trackerTimeout)
+	defer cancel()
+
+	s, err := t.host.NewStream(ctx, id, trackerProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return nil, err
+	}
+
+	var resp trackerResponse
+	if err := json.NewDecoder(io.LimitReader(s, maxTrackerSize)).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// handle serves the request received on the stream.
+func (t *tracker) handle(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(trackerTimeout))
+
+	var req trackerRequest
+	if err := json.NewDecoder(io.LimitReader(s, maxTrackerSize)).Decode(&req); err != nil {
+		_ = s.Reset()
+		return
+	}
+
+	from := s.Conn().RemotePeer()
+	resp, err := t.serve(from, &req)
+	if err != nil {
+		resp = &trackerResponse{Error: err.Error()}
+	}
+
+	if err := json.NewEncoder(s).Encode(resp); err != nil {
+		_ = s.Reset()
+	}
+}
+
+// serve applies the report of the node to the index and looks up providers in it, if this node is the tracker.
+func (t *tracker) serve(from peer.ID, req *trackerRequest) (*trackerResponse, error) {
+	if len(req.Provide)+len(req.Withdraw) > maxTrackerKeys {
+		return nil, errors.New("too many keys")
+	}
+
+	if addrs := parseAddrs(req.Addrs); from != t.host.ID() && len(addrs) > 0 {
+		t.host.Peerstore().AddAddrs(from, addrs, MaxRecordAge)
+	}
+
+	t.lock.Lock()
+	if !t.leading {
+		t.lock.Unlock()
+		return nil, errNotTracker
+	}
+
+	now := time.Now()
+	if now.Sub(t.swept) > MaxRecordAge {
+		t.sweep(now)
+	}
+
+	if req.Full {
+		for c := range t.keys[from] {
+			t.remove(c, from)
+		}
+	}
+	for _, c := range req.Provide {
+		t.add(c, from, now)
+	}
+	for _, c := range req.Withdraw {
+		t.remove(c, from)
+	}
+
+	var ids []peer.ID
+	if req.Find != "" {
+		for id, at := range t.index[req.Find] {
+			if now.Sub(at) < MaxRecordAge {
+				ids = append(ids, id)
+			}
+		}
+		if req.Count > 0 && len(ids) > req.Count {
+			ids = ids[:req.Count]
+		}
+	}
+	resp := &trackerResponse{Epoch: t.indexEpoch}
+	t.lock.Unlock()
+
+	for _, id := range ids {
+		addrs := t.host.Peerstore().Addrs(id)
+		if id == t.host.ID() {
+			addrs = t.host.Addrs()
+		}
+
+		p := trackerProvider{ID: id}
+		for _, a := range addrs {
+			p.Addrs = append(p.Addrs, a.String())
+		}
+		resp.Providers = append(resp.Providers, p)
+	}
+	return resp, nil
+}
+
+// add records that the peer provides the content. It must be called with the lock held.
+func (t *tracker) add(c string, id peer.ID, at time.Time) {
+	provs, ok := t.index[c]
+	if !ok {
+		provs = map[peer.ID]time.Time{}
+		t.index[c] = provs
+	}
+	provs[id] = at
+
+	keys, ok := t.keys[id]
+	if !ok {
+		keys = map[string]bool{}
+		t.keys[id] = keys
+	}
+	keys[c] = true
+}
+
+// remove records that the peer no longer provides the content. It must be called with the lock held.
+func (t *tracker) remove(c string, id peer.ID) {
+	delete(t.index[c], id)
+	if len(t.index[c]) == 0 {
+		delete(t.index, c)
+	}
+
+	delete(t.keys[id], c)
+	if len(t.keys[id]) == 0 {
+		delete(t.keys, id)
+	}
+}
+
+// sweep removes expired entries from the index. It must be called with the lock held.
+func (t *tracker) sweep(now time.Time) {
+	for c, provs := range t.index {
+		for id, at := range provs {
+			if now.Sub(at) >= MaxRecordAge {
+				t.remove(c, id)
+			}
+		}
+	}
+	t.swept = now
+}
+
+// parseAddrs parses the multiaddrs, skipping invalid ones.
+func parseAddrs(ss []string) []multiaddr.Multiaddr {
+	var addrs []multiaddr.Multiaddr
+	for _, s := range ss {
+		if ma, err := multiaddr.NewMultiaddr(s); err == nil {
+			addrs = append(addrs, ma)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,289 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/ristretto"
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	corerouting "github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestTrackerIndex(t *testing.T) {
+	h := newLoopbackHost(t)
+	tr := newTracker(context.Background(), h, nil)
+
+	// A node that is not the tracker does not serve requests.
+	if _, err := tr.serve("peer-1", &trackerRequest{Provide: []string{"c1"}}); !errors.Is(err, errNotTracker) {
+		t.Errorf("expected: %v, got: %v", errNotTracker, err)
+	}
+
+	tr.lead(true)
+	for _, req := range []*trackerRequest{
+		{Provide: []string{"c1", "c2"}},
+		{Provide: []string{"c3"}},
+		{Withdraw: []string{"c2"}},
+	} {
+		if _, err := tr.serve("peer-1", req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tr.serve("peer-2", &trackerRequest{Provide: []string{"c1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		find     string
+		expected []peer.ID
+	}{
+		{find: "c1", expected: []peer.ID{"peer-1", "peer-2"}},
+		{find: "c2"},
+		{find: "c3", expected: []peer.ID{"peer-1"}},
+	} {
+		if got := trackedProviders(t, tr, tc.find); !slices.Equal(got, tc.expected) {
+			t.Errorf("%v: expected: %v, got: %v", tc.find, tc.expected, got)
+		}
+	}
+
+	// A full report replaces the content indexed for the node.
+	if _, err := tr.serve("peer-1", &trackerRequest{Full: true, Provide: []string{"c2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := trackedProviders(t, tr, "c1"); !slices.Equal(got, []peer.ID{"peer-2"}) {
+		t.Errorf("expected: %v, got: %v", []peer.ID{"peer-2"}, got)
+	}
+	if got := trackedProviders(t, tr, "c2"); !slices.Equal(got, []peer.ID{"peer-1"}) {
+		t.Errorf("expected: %v, got: %v", []peer.ID{"peer-1"}, got)
+	}
+
+	// A node that stops leading drops its index, and starts a new epoch when it leads again.
+	resp, err := tr.serve("peer-1", &trackerRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.lead(false)
+	tr.lead(true)
+	if got := trackedProviders(t, tr, "c2"); len(got) != 0 {
+		t.Errorf("expected no providers, got: %v", got)
+	}
+	if next, err := tr.serve("peer-1", &trackerRequest{}); err != nil || next.Epoch == resp.Epoch {
+		t.Errorf("expected a new epoch, got: %v (%v)", next, err)
+	}
+
+	var nilTracker *tracker
+	nilTracker.withdrawContent(cidOf(t, "c1"))
+}
+
+func TestTrackerNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := &testElection{}
+	hosts, trackers := startTrackers(t, ctx, e, 4)
+	e.elect(hosts[0])
+
+	contentId := cidOf(t, "blob_0")
+	if err := trackers[1].Provide(ctx, contentId, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := trackers[2].Provide(ctx, contentId, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every node finds the providers through the tracker, including the tracker itself.
+	expected := []peer.ID{hosts[1].ID(), hosts[2].ID()}
+	slices.Sort(expected)
+	for i, tr := range trackers {
+		waitFor(t, fmt.Sprintf("providers at node %v", i), func() bool {
+			return slices.Equal(foundProviders(tr, contentId), expected)
+		})
+	}
+
+	for info := range trackers[3].FindProvidersAsync(ctx, contentId, 0) {
+		if len(info.Addrs) == 0 {
+			t.Errorf("expected the addresses of the provider")
+		}
+	}
+
+	trackers[1].withdrawContent(contentId)
+	waitFor(t, "withdrawal", func() bool {
+		return slices.Equal(foundProviders(trackers[3], contentId), []peer.ID{hosts[2].ID()})
+	})
+}
+
+func TestTrackerFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := &testElection{}
+	hosts, trackers := startTrackers(t, ctx, e, 3)
+	e.elect(hosts[0])
+
+	contentId := cidOf(t, "blob_0")
+	if err := trackers[1].Provide(ctx, contentId, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "providers", func() bool {
+		return slices.Equal(foundProviders(trackers[2], contentId), []peer.ID{hosts[1].ID()})
+	})
+
+	// The new tracker starts with an empty index, which is rebuilt from the full reports of the nodes.
+	e.elect(hosts[2])
+	waitFor(t, "index rebuilt by the new tracker", func() bool {
+		trackers[2].lock.Lock()
+		defer trackers[2].lock.Unlock()
+		_, ok := trackers[2].index[contentId.String()][hosts[1].ID()]
+		return ok
+	})
+	waitFor(t, "providers after failover", func() bool {
+		return slices.Equal(foundProviders(trackers[0], contentId), []peer.ID{hosts[1].ID()})
+	})
+
+	// The former tracker drops its index, and rebuilds it when elected again.
+	trackers[0].lock.Lock()
+	if trackers[0].index != nil {
+		t.Error("expected the former tracker to drop its index")
+	}
+	trackers[0].lock.Unlock()
+
+	e.elect(hosts[0])
+	waitFor(t, "providers after the former tracker is elected again", func() bool {
+		return slices.Equal(foundProviders(trackers[2], contentId), []peer.ID{hosts[1].ID()})
+	})
+}
+
+func TestRouterWithTracker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := &testElection{}
+	hosts, trackers := startTrackers(t, ctx, e, 2)
+	e.elect(hosts[0])
+
+	routers := make([]*router, len(hosts))
+	for i, h := range hosts {
+		routers[i] = &router{
+			k8sClient:        &fakeClientset,
+			host:             h,
+			peerRegistryPort: "5000",
+			lookupCache:      newTestLookupCache(t),
+			content:          routing.NewRoutingDiscovery(trackers[i]),
+			tracker:          trackers[i],
+		}
+	}
+
+	if err := routers[1].Provide(ctx, []string{"blob_0"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "resolution through the tracker", func() bool {
+		return len(resolveHosts(t, routers[0], "blob_0", 1)) == 1
+	})
+
+	if err := routers[1].Withdraw(ctx, []string{"blob_0"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "withdrawal through the tracker", func() bool {
+		return len(resolveHosts(t, routers[0], "blob_0", 1)) == 0
+	})
+}
+
+// testElection elects the host it was last told to.
+type testElection struct {
+	lock   sync.Mutex
+	leader multiaddr.Multiaddr
+}
+
+// RunOrDie implements election.LeaderElection.
+func (e *testElection) RunOrDie(context.Context, string) error {
+	return nil
+}
+
+// Leader implements election.LeaderElection.
+func (e *testElection) Leader() (multiaddr.Multiaddr, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.leader == nil {
+		return nil, errors.New("no leader elected")
+	}
+	return e.leader, nil
+}
+
+// elect elects the host.
+func (e *testElection) elect(h host.Host) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("%s/p2p/%s", h.Addrs()[0], h.ID()))
+	if err != nil {
+		panic(err)
+	}
+	e.leader = addr
+}
+
+// startTrackers starts tracker content routing on count loopback hosts, with the tracker elected by the election.
+func startTrackers(t *testing.T, ctx context.Context, e *testElection, count int) ([]host.Host, []*tracker) {
+	var hosts []host.Host
+	var trackers []*tracker
+	for range count {
+		h := newLoopbackHost(t)
+		tr := newTracker(ctx, h, e)
+		tr.start()
+		hosts = append(hosts, h)
+		trackers = append(trackers, tr)
+	}
+	return hosts, trackers
+}
+
+// trackedProviders returns the IDs of the providers of the content in the index of the tracker, in order.
+func trackedProviders(t *testing.T, tr *tracker, c string) []peer.ID {
+	resp, err := tr.serve(tr.host.ID(), &trackerRequest{Find: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []peer.ID
+	for _, p := range resp.Providers {
+		ids = append(ids, p.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// foundProviders returns the IDs of the providers of the content found by the content routing, in order.
+func foundProviders(cr corerouting.ContentRouting, c cid.Cid) []peer.ID {
+	var ids []peer.ID
+	for info := range cr.FindProvidersAsync(context.Background(), c, 0) {
+		ids = append(ids, info.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// cidOf returns the content ID of the key.
+func cidOf(t *testing.T, key string) cid.Cid {
+	c, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestLookupCache creates a lookup cache for a test router.
+func newTestLookupCache(t *testing.T) *ristretto.Cache {
+	c, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e7, MaxCost: 1000, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
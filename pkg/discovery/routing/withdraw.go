@@ -0,0 +1,247 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// withdrawProtocol is the protocol used to ask peers to stop resolving keys to this node.
+	withdrawProtocol = protocol.ID("/peerd/withdraw/1.0.0")
+
+	// withdrawPeers is the number of peers closest to a key that are asked to withdraw it.
+	// It is the bucket size of the DHT, which is the number of peers that store the provider records of a key.
+	withdrawPeers = 20
+
+	// withdrawConcurrency is the number of peers a withdrawal is sent to concurrently.
+	withdrawConcurrency = 8
+
+	// maxWithdrawKeys is the maximum number of keys accepted in a single withdrawal.
+	maxWithdrawKeys = 4096
+
+	// withdrawTimeout bounds sending a withdrawal to a peer.
+	withdrawTimeout = 5 * time.Second
+
+	// notCachedTtl is how long a key is not resolved to a peer that answered it does not have the key cached.
+	notCachedTtl = time.Minute
+)
+
+// nearestPeers finds the peers closest to a key, such as the routing table of the DHT.
+type nearestPeers interface {
+	NearestPeers(id kb.ID, count int) []peer.ID
+}
+
+// providerStore wraps the provider store of the DHT to expire records after their validity and honour withdrawals.
+// A record is returned until its validity has passed since the provider last advertised the key, unless the provider
+// withdrew it since. The wrapped store may keep records longer, but they are not returned.
+type providerStore struct {
+	providers.ProviderStore
+	validity time.Duration
+
+	lock  sync.Mutex
+	added map[string]map[peer.ID]time.Time
+	swept time.Time
+}
+
+// AddProvider adds a provider record, cancelling any withdrawal of the key by the provider.
+func (s *providerStore) AddProvider(ctx context.Context, key []byte, prov peer.AddrInfo) error {
+	s.lock.Lock()
+	now := time.Now()
+	if now.Sub(s.swept) > s.validity {
+		s.sweep(now)
+	}
+
+	a, ok := s.added[string(key)]
+	if !ok {
+		a = map[peer.ID]time.Time{}
+		s.added[string(key)] = a
+	}
+	a[prov.ID] = now
+	s.lock.Unlock()
+
+	return s.ProviderStore.AddProvider(ctx, key, prov)
+}
+
+// GetProviders returns the providers of the key whose records are valid and that have not withdrawn it.
+func (s *providerStore) GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error) {
+	provs, err := s.ProviderStore.GetProviders(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The returned slice is owned by the wrapped store, so filter into a new one.
+	now := time.Now()
+	a := s.added[string(key)]
+	filtered := make([]peer.AddrInfo, 0, len(provs))
+	for _, p := range provs {
+		if at, ok := a[p.ID]; ok && now.Sub(at) < s.validity {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered, nil
+}
+
+// withdraw hides the provider record of the key by the peer.
+func (s *providerStore) withdraw(key []byte, p peer.ID) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if a, ok := s.added[string(key)]; ok {
+		delete(a, p)
+		if len(a) == 0 {
+			delete(s.added, string(key))
+		}
+	}
+}
+
+// sweep forgets the records whose validity has passed. It must be called with the lock held.
+func (s *providerStore) sweep(now time.Time) {
+	for k, a := range s.added {
+		for id, at := range a {
+			if now.Sub(at) >= s.validity {
+				delete(a, id)
+			}
+		}
+		if len(a) == 0 {
+			delete(s.added, k)
+		}
+	}
+	s.swept = now
+}
+
+// newProviderStore wraps the provider store to expire records after the validity and honour withdrawals.
+func newProviderStore(ps providers.ProviderStore, validity time.Duration) *providerStore {
+	return &providerStore{ProviderStore: ps, validity: validity, added: map[string]map[peer.ID]time.Time{}, swept: time.Now()}
+}
+
+// Withdraw withdraws the provider records of this node for the given keys.
+// The records are hidden from lookups served by this node, and the peers closest to each key are asked to hide them
+// too. Records held by peers that miss the withdrawal expire after MaxRecordAge.
+func (r *router) Withdraw(ctx context.Context, keys []string) error {
+	log := zerolog.Ctx(ctx).With().Str("host", r.host.ID().String()).Logger()
+	log.Trace().Strs("keys", keys).Msg("withdrawing keys")
+
+	byPeer := map[peer.ID][]string{}
+	for _, key := range keys {
+		contentId, err := createContentId(key)
+		if err != nil {
+			return err
+		}
+
+		r.providers.withdraw(contentId.Hash(), r.host.ID())
+		r.gossip.withdrawContent(contentId)
+		r.tracker.withdrawContent(contentId)
+
+		if r.peers == nil {
+			continue
+		}
+		for _, p := range r.peers.NearestPeers(kb.ConvertKey(string(contentId.Hash())), withdrawPeers) {
+			if p != r.host.ID() {
+				byPeer[p] = append(byPeer[p], key)
+			}
+		}
+	}
+
+	var lock sync.Mutex
+	var errs []error
+	g := errgroup.Group{}
+	g.SetLimit(withdrawConcurrency)
+	for p, keys := range byPeer {
+		g.Go(func() error {
+			if err := r.sendWithdraw(ctx, p, keys); err != nil {
+				log.Debug().Err(err).Str("peer", p.String()).Msg("failed to send withdrawal")
+				lock.Lock()
+				errs = append(errs, fmt.Errorf("peer %v: %w", p, err))
+				lock.Unlock()
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	return errors.Join(errs...)
+}
+
+// sendWithdraw asks the peer to withdraw the provider records of this node for the keys, one key per line.
+func (r *router) sendWithdraw(ctx context.Context, p peer.ID, keys []string) error {
+	ctx, cancel := context.WithTimeout(ctx, withdrawTimeout)
+	defer cancel()
+
+	s, err := r.host.NewStream(ctx, p, withdrawProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(s)
+	for _, key := range keys {
+		if _, err := w.WriteString(key + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+
+	// The peer closes the stream once it has applied the withdrawal.
+	_, err = io.Copy(io.Discard, s)
+	return err
+}
+
+// handleWithdraw hides the provider records of the keys withdrawn by the remote peer of the stream.
+func (r *router) handleWithdraw(s network.Stream) {
+	defer s.Close()
+	_ = s.SetDeadline(time.Now().Add(withdrawTimeout))
+
+	from := s.Conn().RemotePeer()
+	scanner := bufio.NewScanner(s)
+	for n := 0; n < maxWithdrawKeys && scanner.Scan(); n++ {
+		contentId, err := createContentId(scanner.Text())
+		if err != nil {
+			continue
+		}
+		r.providers.withdraw(contentId.Hash(), from)
+	}
+}
+
+// ReportNotCached records that the peer answered it does not have the key cached, so that the key is not resolved to
+// the peer for a while.
+func (r *router) ReportNotCached(key string, id peer.ID) {
+	r.resolved.forgetChunk(r.advertise.Key(key), id)
+	r.availability.forget(blobOf(key), id)
+	r.lookupCache.SetWithTTL(notCachedKey(key, id), strPeerNotFound, 1, notCachedTtl)
+}
+
+// notCachedKey is the key of the lookup cache that records that the peer does not have the key cached.
+func notCachedKey(key string, id peer.ID) string {
+	return key + "@" + id.String()
+}
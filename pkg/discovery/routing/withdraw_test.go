@@ -0,0 +1,220 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package routing
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/libp2p/go-libp2p"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+func TestProviderStoreWithdraw(t *testing.T) {
+	ctx := context.Background()
+	ps := newProviderStore(&testProviderStore{m: map[string][]peer.AddrInfo{}}, MaxRecordAge)
+	key := []byte("key")
+
+	for _, id := range []peer.ID{"a", "b"} {
+		if err := ps.AddProvider(ctx, key, peer.AddrInfo{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ps.withdraw(key, "a")
+	if got := providerIds(t, ps, key); len(got) != 1 || got[0] != "b" {
+		t.Errorf("expected: %v, got: %v", []peer.ID{"b"}, got)
+	}
+
+	// Advertising the key again cancels the withdrawal.
+	if err := ps.AddProvider(ctx, key, peer.AddrInfo{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := providerIds(t, ps, key); len(got) != 2 {
+		t.Errorf("expected 2 providers, got: %v", got)
+	}
+}
+
+func TestProviderStoreValidity(t *testing.T) {
+	ctx := context.Background()
+	ps := newProviderStore(&testProviderStore{m: map[string][]peer.AddrInfo{}}, time.Minute)
+	key := []byte("key")
+
+	for _, id := range []peer.ID{"a", "b"} {
+		if err := ps.AddProvider(ctx, key, peer.AddrInfo{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The record of a is older than the validity, although the wrapped store still has it.
+	ps.added[string(key)]["a"] = time.Now().Add(-time.Minute)
+	if got := providerIds(t, ps, key); len(got) != 1 || got[0] != "b" {
+		t.Errorf("expected: %v, got: %v", []peer.ID{"b"}, got)
+	}
+
+	// Advertising the key again renews the record.
+	if err := ps.AddProvider(ctx, key, peer.AddrInfo{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := providerIds(t, ps, key); len(got) != 2 {
+		t.Errorf("expected 2 providers, got: %v", got)
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	ctx := context.Background()
+	key := "some-key"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h1, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+	h1.Peerstore().AddAddrs(h2.ID(), h2.Addrs(), peerstore.PermanentAddrTTL)
+
+	// The second host stores the provider record of the first.
+	remote := &router{host: h2, providers: newProviderStore(&testProviderStore{m: map[string][]peer.AddrInfo{}}, MaxRecordAge)}
+	if err := remote.providers.AddProvider(ctx, contentId.Hash(), peer.AddrInfo{ID: h1.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	h2.SetStreamHandler(withdrawProtocol, remote.handleWithdraw)
+
+	local := &router{
+		host:      h1,
+		providers: newProviderStore(&testProviderStore{m: map[string][]peer.AddrInfo{}}, MaxRecordAge),
+		peers:     testPeers{h2.ID()},
+	}
+	if err := local.providers.AddProvider(ctx, contentId.Hash(), peer.AddrInfo{ID: h1.ID()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := local.Withdraw(ctx, []string{key}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := providerIds(t, local.providers, contentId.Hash()); len(got) != 0 {
+		t.Errorf("expected local record to be withdrawn, got: %v", got)
+	}
+	if got := providerIds(t, remote.providers, contentId.Hash()); len(got) != 0 {
+		t.Errorf("expected remote record to be withdrawn, got: %v", got)
+	}
+}
+
+func TestResolveSkipsNotCached(t *testing.T) {
+	c, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "some-key"
+	contentId, err := createContentId(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &router{
+		k8sClient:        &fakeClientset,
+		host:             &testHost{id: "host-id"},
+		peerRegistryPort: "5000",
+		lookupCache:      c,
+		content: routing.NewRoutingDiscovery(&testCr{
+			m: map[string][]string{
+				contentId.String(): {"10.0.0.1", "10.0.0.2"},
+			},
+		}),
+	}
+
+	r.ReportNotCached(key, peer.ID("10.0.0.1"))
+	c.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	got, err := r.Resolve(ctx, key, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+resolveLoop:
+	for {
+		select {
+		case info := <-got:
+			hosts = append(hosts, info.HttpHost)
+		case <-ctx.Done():
+			break resolveLoop
+		}
+	}
+
+	if len(hosts) != 1 || hosts[0] != "https://10.0.0.2:5000" {
+		t.Errorf("expected: %v, got: %v", []string{"https://10.0.0.2:5000"}, hosts)
+	}
+}
+
+// providerIds returns the ids of the providers of the key.
+func providerIds(t *testing.T, ps *providerStore, key []byte) []peer.ID {
+	provs, err := ps.GetProviders(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []peer.ID
+	for _, p := range provs {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+type testProviderStore struct {
+	lock sync.Mutex
+	m    map[string][]peer.AddrInfo
+}
+
+// AddProvider implements providers.ProviderStore.
+func (s *testProviderStore) AddProvider(ctx context.Context, key []byte, prov peer.AddrInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, p := range s.m[string(key)] {
+		if p.ID == prov.ID {
+			return nil
+		}
+	}
+	s.m[string(key)] = append(s.m[string(key)], prov)
+	return nil
+}
+
+// GetProviders implements providers.ProviderStore.
+func (s *testProviderStore) GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.m[string(key)], nil
+}
+
+// Close implements providers.ProviderStore.
+func (s *testProviderStore) Close() error {
+	return nil
+}
+
+type testPeers []peer.ID
+
+// NearestPeers implements nearestPeers.
+func (p testPeers) NearestPeers(id kb.ID, count int) []peer.ID {
+	return p
+}
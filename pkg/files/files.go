@@ -22,18 +22,19 @@ func FileChunkKey(name string, offset, cacheBlockSize int64) string {
 	return name + FileChunkKeySep + fmt.Sprint(math.AlignDown(offset, cacheBlockSize))
 }
 
-// Fetchfile gets the content of a file from the given offset using a remote reader.
-func FetchFile(r reader.Reader, name string, offset int64, count int) ([]byte, error) {
+// Fetchfile gets the content of a file from the given offset using a remote reader, and returns the source that
+// served it.
+func FetchFile(r reader.Reader, name string, offset int64, count int) ([]byte, string, error) {
 	d := make([]byte, count)
 	l := r.Log().With().Str("name", name).Int64("offset", offset).Int("count", count).Logger()
 	l.Debug().Msg("fetch file start")
 
-	_, err := r.PreadRemote(d, offset)
+	_, source, err := r.PreadRemote(d, offset)
 	if err != nil && err != io.EOF {
 		l.Error().Err(err).Msg("fetch file error")
-		return nil, err
+		return nil, "", err
 	}
 
 	l.Debug().Msg("fetch file stop")
-	return d, nil
+	return d, source, nil
 }
@@ -3,12 +3,15 @@
 package files
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
 	"testing"
 
 	"github.com/azure/peerd/pkg/discovery/content/reader"
+	"github.com/azure/peerd/pkg/discovery/routing"
+	"github.com/azure/peerd/pkg/metrics"
 	"github.com/rs/zerolog"
 )
 
@@ -36,25 +39,25 @@ func TestFetchFile(t *testing.T) {
 
 	r := &mockReader{data: d}
 
-	if b, err := FetchFile(r, "test", 0, 3); err != nil {
+	if b, _, err := FetchFile(r, "test", 0, 3); err != nil {
 		t.Errorf("expected no error, got %v", err)
 	} else if string(b) != "abc" {
 		t.Errorf("expected %s, got %s", "abc", string(b))
 	}
 
-	if b, err := FetchFile(r, "test", 0, 4); err != nil {
+	if b, _, err := FetchFile(r, "test", 0, 4); err != nil {
 		t.Errorf("expected no error, got %v", err)
 	} else if string(b[:3]) != "abc" {
 		t.Errorf("expected %s, got %s", "abc", string(b))
 	}
 
-	if b, err := FetchFile(r, "test", 3, 3); err != nil {
+	if b, _, err := FetchFile(r, "test", 3, 3); err != nil {
 		t.Errorf("expected no error, got %v", err)
 	} else if string(b) != "def" {
 		t.Errorf("expected %s, got %s", "def", string(b))
 	}
 
-	if b, err := FetchFile(r, "test", 31, 4); err == nil {
+	if b, _, err := FetchFile(r, "test", 31, 4); err == nil {
 		t.Errorf("expected error, got %s", string(b))
 	}
 }
@@ -75,12 +78,24 @@ func (*mockReader) Log() *zerolog.Logger {
 }
 
 // PreadRemote implements remote.Reader.
-func (m *mockReader) PreadRemote(buf []byte, offset int64) (int, error) {
+func (m *mockReader) PreadRemote(buf []byte, offset int64) (int, string, error) {
 	if d, ok := m.data[strconv.FormatInt(offset, 10)]; ok {
-		return copy(buf, d), nil
+		return copy(buf, d), metrics.SourceUpstream, nil
 	} else {
-		return 0, os.ErrNotExist
+		return 0, "", os.ErrNotExist
 	}
 }
 
+// PreadPeer implements remote.Reader.
+func (m *mockReader) PreadPeer(ctx context.Context, p routing.PeerInfo, key string, buf []byte, offset int64) (int, error) {
+	n, _, err := m.PreadRemote(buf, offset)
+	return n, err
+}
+
+// PreadOrigin implements remote.Reader.
+func (m *mockReader) PreadOrigin(ctx context.Context, key string, buf []byte, offset int64) (int, error) {
+	n, _, err := m.PreadRemote(buf, offset)
+	return n, err
+}
+
 var _ reader.Reader = &mockReader{}
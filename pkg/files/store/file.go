@@ -11,6 +11,7 @@ import (
 	"github.com/azure/peerd/pkg/discovery/content/reader"
 	"github.com/azure/peerd/pkg/files"
 	"github.com/azure/peerd/pkg/math"
+	"github.com/azure/peerd/pkg/metrics"
 )
 
 var errOnlySingleChunkAvailable = fmt.Errorf("only single chunk available")
@@ -29,6 +30,9 @@ type file struct {
 
 	reader reader.Reader
 	store  *store
+
+	// prefetchReader reads the file like reader, within the resolve budget of prefetching.
+	prefetchReader reader.Reader
 }
 
 var _ File = &file{}
@@ -42,7 +46,7 @@ func (f *file) prefetch(offset int64, count int64) {
 			return
 		}
 
-		segs, err := math.NewSegments(offset, files.CacheBlockSize, count, fileSize)
+		segs, err := math.NewSegments(offset, f.store.blockSize, count, fileSize)
 		if err != nil {
 			f.reader.Log().Error().Err(err).Msg("prefetch error: failed to create segments")
 			return
@@ -51,7 +55,7 @@ func (f *file) prefetch(offset int64, count int64) {
 		for seg := range segs.All() {
 			f.store.prefetchChan <- prefetchableSegment{
 				name:   f.Name,
-				reader: f.reader,
+				reader: f.prefetchReader,
 				offset: seg.Index,
 				count:  seg.Count,
 			}
@@ -115,17 +119,20 @@ func (f *file) ReadAt(buff []byte, offset int64) (int, error) {
 		return 0, err
 	}
 
-	alignedOffset := math.AlignDown(offset, int64(files.CacheBlockSize))
+	alignedOffset := math.AlignDown(offset, int64(f.store.blockSize))
 
 	if f.chunkOffset != 0 && alignedOffset != f.chunkOffset {
 		f.reader.Log().Error().Err(errOnlySingleChunkAvailable).Int64("chunk", f.chunkOffset).Int64("alignedOffset", alignedOffset).Int64("requestedOffset", offset).Msg("file can only read chunk")
 		return -1, errOnlySingleChunkAvailable
 	}
 
-	count := int(math.Min64(int64(files.CacheBlockSize), fileSize-alignedOffset))
+	count := int(math.Min64(int64(f.store.blockSize), fileSize-alignedOffset))
 
+	source := metrics.SourceCache
 	data, err := f.store.cache.GetOrCreate(f.Name, alignedOffset, count, func() ([]byte, error) {
-		return files.FetchFile(f.reader, f.Name, alignedOffset, count)
+		b, s, err := files.FetchFile(f.reader, f.Name, alignedOffset, count)
+		source = s
+		return b, err
 	})
 	if err != nil {
 		f.reader.Log().Error().Err(err).Msg("readat error")
@@ -136,6 +143,8 @@ func (f *file) ReadAt(buff []byte, offset int64) (int, error) {
 	ret := math.Min(len(buff), len(data)-pos)
 	ret = copy(buff[:ret], data[pos:pos+ret])
 
+	f.store.metricsRecorder.RecordBytesServed(source, int64(ret))
+
 	if offset+int64(len(buff)) > fileSize {
 		err = io.EOF
 	}
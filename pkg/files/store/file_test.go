@@ -3,6 +3,7 @@
 package store
 
 import (
+	"context"
 	"crypto/rand"
 	"io"
 	"os"
@@ -12,6 +13,7 @@ import (
 	readermocks "github.com/azure/peerd/pkg/discovery/content/reader/mocks"
 	"github.com/azure/peerd/pkg/discovery/routing/mocks"
 	"github.com/azure/peerd/pkg/files"
+	"github.com/azure/peerd/pkg/metrics"
 )
 
 func TestReadAtWithChunkOffset(t *testing.T) {
@@ -19,7 +21,10 @@ func TestReadAtWithChunkOffset(t *testing.T) {
 
 	files.CacheBlockSize = 1 // 1 byte
 
-	s, err := NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -77,7 +82,10 @@ func TestReadAt(t *testing.T) {
 
 	files.CacheBlockSize = 1 // 1 byte
 
-	s, err := NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,7 +135,10 @@ func TestReadAt(t *testing.T) {
 func TestSeek(t *testing.T) {
 	data := []byte("hello world")
 
-	s, err := NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), t.TempDir())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -191,7 +202,10 @@ func TestFstat(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	s, err := NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), t.TempDir())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -224,6 +238,51 @@ func TestFstat(t *testing.T) {
 	}
 }
 
+func TestReadAtRecordsBytesServed(t *testing.T) {
+	files.CacheBlockSize = 4
+
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &servedMetrics{Metrics: metrics.FromContext(context.Background()), served: map[string]int64{}}
+	s.(*store).metricsRecorder = rec
+
+	f := &file{
+		Name:   "served",
+		reader: readermocks.NewMockReader([]byte("hello world")),
+		store:  s.(*store),
+		size:   11,
+	}
+
+	// Only the bytes read by the client are served, not the whole chunk fetched for them.
+	buf := make([]byte, 2)
+	for range 2 {
+		if _, err := f.ReadAt(buf, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]int64{metrics.SourceUpstream: 2, metrics.SourceCache: 2}
+	if len(rec.served) != len(want) || rec.served[metrics.SourceUpstream] != want[metrics.SourceUpstream] || rec.served[metrics.SourceCache] != want[metrics.SourceCache] {
+		t.Errorf("expected: %v, got: %v", want, rec.served)
+	}
+}
+
+// servedMetrics records the bytes served by source.
+type servedMetrics struct {
+	metrics.Metrics
+	served map[string]int64
+}
+
+// RecordBytesServed implements metrics.Metrics.
+func (m *servedMetrics) RecordBytesServed(source string, bytes int64) {
+	m.served[source] += bytes
+}
+
 func randomBytesN(n int) ([]byte, error) {
 	b := make([]byte, n)
 	_, err := rand.Read(b)
@@ -5,7 +5,9 @@ package store
 import (
 	"time"
 
+	"github.com/azure/peerd/pkg/cache"
 	"github.com/azure/peerd/pkg/context"
+	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -19,6 +21,15 @@ type FilesStore interface {
 
 	// Subscribe returns a channel that will be notified when a blob is added to the store.
 	Subscribe() chan string
+
+	// Evicted returns a channel that will be notified when a blob is evicted from the store.
+	Evicted() <-chan string
+
+	// Availability returns the chunks of the named file that are cached.
+	Availability(name string) routing.Availability
+
+	// CacheUsage returns the usage of the quota groups of the cache, or nil if quotas are disabled.
+	CacheUsage() []cache.GroupUsage
 }
 
 // File is an abstraction for a file that can be read from this store.
@@ -38,13 +49,29 @@ type File interface {
 }
 
 var (
-	// PrefetchWorkers is the number of workers that will be used to prefetch files.
+	// PrefetchWorkers is the number of workers that will be used to prefetch files, and the maximum number of chunks
+	// prefetched concurrently from the upstream across all files.
 	// To disable prefetch, set this to 0.
 	PrefetchWorkers = 50
 
+	// SwarmSources is the maximum number of peers the chunks of a file are downloaded from concurrently when it is
+	// prefetched. To prefetch chunks through the first provider found of each, set this to 0.
+	SwarmSources = 8
+
+	// SwarmOriginLimit is the maximum number of chunks of a file downloaded concurrently from the upstream when it is
+	// prefetched from peers, within the PrefetchWorkers shared by all files. When it is set, the upstream is taken to be
+	// constrained, and the chunks provided by the fewest peers are downloaded first so that they spread before their
+	// providers go away. To remove the limit, set this to 0.
+	SwarmOriginLimit = 0
+
 	// ResolveRetries is the number of times to attempt resolving a key before giving up.
 	ResolveRetries = 3
 
-	// ResolveTimeout is the timeout for resolving a key.
-	ResolveTimeout = 20 * time.Millisecond
+	// ReprovideInterval is the interval at which cached chunks are advertised again. It must be shorter than the
+	// maximum age of provider records, routing.MaxRecordAge. To disable re-advertising, set this to 0.
+	ReprovideInterval = 10 * time.Minute
+
+	// ReprovideRate is the maximum number of chunks advertised per second when re-advertising the cache.
+	// To remove the limit, set this to 0.
+	ReprovideRate = 100
 )
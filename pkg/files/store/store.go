@@ -4,9 +4,13 @@ package store
 
 import (
 	"context"
+	"math/rand/v2"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/azure/peerd/pkg/cache"
@@ -18,22 +22,39 @@ import (
 	"github.com/azure/peerd/pkg/urlparser"
 	"github.com/opencontainers/go-digest"
 	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
 )
 
-const DefaultFileCachePath = "/tmp/distribution/peerd/cache"
+const (
+	DefaultFileCachePath = "/tmp/distribution/peerd/cache"
+
+	// reprovideJitter is the fraction of ReprovideInterval by which each interval is randomly shortened or lengthened.
+	reprovideJitter = 0.1
+)
 
 // NewFilesStore creates a new store.
 func NewFilesStore(ctx context.Context, r routing.Router, fileCachePath string) (FilesStore, error) {
 	fs := &store{
-		metricsRecorder: metrics.FromContext(ctx),
-		cache:           cache.NewCache(ctx, int64(files.CacheBlockSize), fileCachePath),
-		prefetchChan:    make(chan prefetchableSegment, PrefetchWorkers),
-		prefetchable:    PrefetchWorkers > 0,
-		router:          r,
-		resolveRetries:  ResolveRetries,
-		resolveTimeout:  ResolveTimeout,
-		blobsChan:       make(chan string, 1000),
-		parser:          urlparser.New(),
+		ctx:              ctx,
+		blockSize:        files.CacheBlockSize,
+		metricsRecorder:  metrics.FromContext(ctx),
+		cache:            cache.NewCache(ctx, int64(files.CacheBlockSize), fileCachePath),
+		prefetchChan:     make(chan prefetchableSegment, PrefetchWorkers),
+		prefetchable:     PrefetchWorkers > 0,
+		originSlots:      make(chan struct{}, max(PrefetchWorkers, 1)),
+		router:           r,
+		resolveRetries:   ResolveRetries,
+		resolveBudget:    reader.InteractiveResolve,
+		prefetchBudget:   reader.PrefetchResolve,
+		reprovideEvery:   ReprovideInterval,
+		reprovideRate:    ReprovideRate,
+		advertiseMode:    routing.Advertise,
+		role:             routing.NodeRole,
+		swarmSources:     SwarmSources,
+		swarmOriginLimit: SwarmOriginLimit,
+		blobsChan:        make(chan string, 1000),
+		evictedChan:      make(chan string, 1000),
+		parser:           urlparser.New(),
 	}
 
 	go func() {
@@ -50,6 +71,9 @@ func NewFilesStore(ctx context.Context, r routing.Router, fileCachePath string)
 		go fs.prefetch()
 	}
 
+	go fs.reprovide(ctx)
+	go fs.forwardEvicted(ctx)
+
 	return fs, nil
 }
 
@@ -64,15 +88,27 @@ type prefetchableSegment struct {
 
 // store describes a content store whose contents can come from disk or a remote source.
 type store struct {
-	metricsRecorder metrics.Metrics
-	cache           cache.Cache
-	prefetchable    bool
-	prefetchChan    chan prefetchableSegment
-	router          routing.Router
-	resolveRetries  int
-	resolveTimeout  time.Duration
-	blobsChan       chan string
-	parser          urlparser.Parser
+	ctx              context.Context
+	blockSize        int
+	metricsRecorder  metrics.Metrics
+	cache            cache.Cache
+	prefetchable     bool
+	prefetchChan     chan prefetchableSegment
+	originSlots      chan struct{}
+	router           routing.Router
+	resolveRetries   int
+	resolveBudget    reader.ResolveBudget
+	prefetchBudget   reader.ResolveBudget
+	reprovideEvery   time.Duration
+	reprovideRate    int
+	advertiseMode    routing.AdvertiseMode
+	role             routing.Role
+	swarmSources     int
+	swarmOriginLimit int
+	swarms           sync.Map
+	blobsChan        chan string
+	evictedChan      chan string
+	parser           urlparser.Parser
 }
 
 var _ FilesStore = &store{}
@@ -82,6 +118,11 @@ func (s *store) Subscribe() chan string {
 	return s.blobsChan
 }
 
+// Evicted returns a channel that will be notified when a blob is evicted from the store.
+func (s *store) Evicted() <-chan string {
+	return s.evictedChan
+}
+
 // Open opens the requested file and starts prefetching it.
 func (s *store) Open(c pcontext.Context) (File, error) {
 
@@ -92,19 +133,23 @@ func (s *store) Open(c pcontext.Context) (File, error) {
 
 	log := pcontext.Logger(c)
 	if pcontext.IsRequestFromAPeer(c) {
-		// This request came from a peer. Don't serve it unless we have the requested range cached.
-		if ok := s.cache.Exists(name, alignedOff); !ok {
+		// This request came from a peer. Don't serve it unless we have the requested range cached, may forward it to
+		// another peer, or are a super-peer, which reads it from the upstream on behalf of the peer.
+		if ok := s.cache.Exists(name, alignedOff); !ok && !pcontext.CanForward(c) && s.role != routing.RoleSuperPeer {
 			log.Info().Str("name", name).Msg("peer request not cached")
 			return nil, os.ErrNotExist
 		}
+	} else {
+		s.cache.SetGroup(name, quotaGroup(c))
 	}
 
 	f := &file{
-		Name:   name,
-		store:  s,
-		cur:    0,
-		size:   0,
-		reader: reader.NewReader(c, s.router, s.resolveRetries, s.resolveTimeout, s.metricsRecorder),
+		Name:           name,
+		store:          s,
+		cur:            0,
+		size:           0,
+		reader:         reader.NewReader(c, s.router, s.resolveRetries, s.resolveBudget, s.metricsRecorder),
+		prefetchReader: reader.NewReader(c, s.router, s.resolveRetries, s.prefetchBudget, s.metricsRecorder),
 	}
 
 	if pcontext.IsRequestFromAPeer(c) {
@@ -116,12 +161,53 @@ func (s *store) Open(c pcontext.Context) (File, error) {
 	fileSize, err := f.Fstat() // Fstat sets up the file size appropriately.
 
 	if s.prefetchable {
-		f.prefetch(0, fileSize)
+		if s.swarmSources > 0 && !pcontext.IsRequestFromAPeer(c) && pcontext.CanForward(c) {
+			f.download()
+		} else {
+			f.prefetch(0, fileSize)
+		}
 	}
 
 	return f, err
 }
 
+// CacheUsage returns the usage of the quota groups of the cache.
+func (s *store) CacheUsage() []cache.GroupUsage {
+	return s.cache.Usage()
+}
+
+// Availability returns the chunks of the named file that are cached.
+func (s *store) Availability(name string) routing.Availability {
+	size, _ := s.cache.Size(name)
+	return routing.NewAvailability(size, int64(s.blockSize), s.cachedOffsets(name))
+}
+
+// cachedOffsets returns the offsets of the cached chunks of the named file, in increasing order.
+func (s *store) cachedOffsets(name string) []int64 {
+	if s.cache.Cached(name) == 0 {
+		return nil
+	}
+
+	var offsets []int64
+	if size, ok := s.cache.Size(name); ok {
+		for off := int64(0); off < size; off += int64(s.blockSize) {
+			if s.cache.Contains(name, off) {
+				offsets = append(offsets, off)
+			}
+		}
+		return offsets
+	}
+
+	// The size of a file is not known until it is opened, such as for chunks cached before a restart.
+	for _, chunk := range s.cache.Chunks() {
+		if chunk.Name == name {
+			offsets = append(offsets, chunk.Offset)
+		}
+	}
+	slices.Sort(offsets)
+	return offsets
+}
+
 // Key tries to find the cache key for the requested content or returns empty.
 func (s *store) Key(c pcontext.Context) (string, digest.Digest, error) {
 	log := pcontext.Logger(c)
@@ -139,22 +225,141 @@ func (s *store) Key(c pcontext.Context) (string, digest.Digest, error) {
 			return "", "", err
 		}
 	}
-	key := files.FileChunkKey(d.String(), startIndex, int64(files.CacheBlockSize))
+	key := files.FileChunkKey(d.String(), startIndex, int64(s.blockSize))
 
 	log.Info().Str("digest", d.String()).Str("key", key).Msg("store key")
 	return key, d, err
 }
 
+// quotaGroup returns the cache quota group of the requested file, based on its upstream host, its registry and the
+// tenant that requested it.
+func quotaGroup(c pcontext.Context) string {
+	var host, registry string
+	if u, err := url.Parse(pcontext.BlobUrl(c)); err == nil {
+		host, registry = u.Hostname(), u.Query().Get("regid")
+	}
+
+	var tenant string
+	if cache.Quotas.TenantHeader != "" {
+		tenant = c.Request.Header.Get(cache.Quotas.TenantHeader)
+	}
+
+	return cache.Quotas.Classify(host, registry, tenant)
+}
+
+// reprovide advertises the chunks that are already cached when the store starts, such as those cached before a restart
+// or imported from an archive, and advertises every cached chunk again every ReprovideInterval, so that the provider
+// records of chunks that are still cached do not expire.
+func (s *store) reprovide(ctx context.Context) {
+	limit := rate.Inf
+	if s.reprovideRate > 0 {
+		limit = rate.Limit(s.reprovideRate)
+	}
+	limiter := rate.NewLimiter(limit, 1)
+
+	for {
+		if !s.advertiseCached(ctx, limiter) || s.reprovideEvery <= 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(s.reprovideEvery)):
+		}
+	}
+}
+
+// advertiseCached advertises the cached chunks, most recently accessed first, at the rate allowed by the limiter.
+// It returns false if the context is done.
+func (s *store) advertiseCached(ctx context.Context, limiter *rate.Limiter) bool {
+	chunks := s.cache.Chunks()
+	slices.SortFunc(chunks, func(a, b cache.Chunk) int {
+		return b.Accessed.Compare(a.Accessed)
+	})
+
+	advertised := map[string]bool{}
+	for _, chunk := range chunks {
+		// A blob is advertised once, however many of its chunks are cached.
+		key := s.advertiseMode.Key(files.FileChunkKey(chunk.Name, chunk.Offset, int64(s.blockSize)))
+		if advertised[key] {
+			continue
+		}
+
+		if err := limiter.Wait(ctx); err != nil {
+			return false
+		}
+
+		// Chunks evicted since the walk started are no longer advertised.
+		if !s.cache.Contains(chunk.Name, chunk.Offset) {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case s.blobsChan <- key:
+			advertised[key] = true
+		}
+	}
+	return true
+}
+
+// forwardEvicted notifies the subscribers of Evicted of the chunks evicted from the cache. When blobs are advertised, a
+// blob is withdrawn once none of its chunks are cached.
+func (s *store) forwardEvicted(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case chunk := <-s.cache.Evicted():
+			key := files.FileChunkKey(chunk.Name, chunk.Offset, int64(s.blockSize))
+			if s.advertiseMode == routing.AdvertiseBlobs {
+				if s.cache.Cached(chunk.Name) > 0 {
+					continue
+				}
+				key = s.advertiseMode.Key(key)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case s.evictedChan <- key:
+			}
+		}
+	}
+}
+
+// jitter returns the duration randomly adjusted by up to reprovideJitter of its length, so that nodes started together
+// do not advertise in lockstep.
+func jitter(d time.Duration) time.Duration {
+	j := time.Duration(float64(d) * reprovideJitter)
+	return d - j + rand.N(2*j+1)
+}
+
 // prefetch prefetches files.
 func (s *store) prefetch() {
 	for p := range s.prefetchChan {
 		if _, err := s.cache.GetOrCreate(p.name, p.offset, p.count, func() ([]byte, error) {
-			return files.FetchFile(p.reader, p.name, p.offset, p.count)
+			b, source, err := files.FetchFile(p.reader, p.name, p.offset, p.count)
+			if err == nil {
+				s.metricsRecorder.RecordBytesPrefetched(source, int64(len(b)))
+			}
+			return b, err
 		}); err != nil {
 			p.reader.Log().Error().Err(err).Str("name", p.name).Msg("prefetch failed")
 		} else {
-			// Advertise the chunk.
-			s.blobsChan <- files.FileChunkKey(p.name, p.offset, int64(files.CacheBlockSize))
+			s.advertise(p.name, p.offset)
 		}
 	}
 }
+
+// advertise advertises the cached chunk of the file at the offset, or the file when blobs are advertised, without
+// blocking the data path. A dropped chunk is advertised when it is re-provided.
+func (s *store) advertise(name string, offset int64) {
+	select {
+	case s.blobsChan <- s.advertiseMode.Key(files.FileChunkKey(name, offset, int64(s.blockSize))):
+	default:
+		s.metricsRecorder.RecordProvideDropped()
+	}
+}
@@ -3,17 +3,22 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/azure/peerd/pkg/cache"
 	pcontext "github.com/azure/peerd/pkg/context"
+	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/azure/peerd/pkg/discovery/routing/mocks"
 	"github.com/azure/peerd/pkg/files"
 	"github.com/gin-gonic/gin"
 	"github.com/opencontainers/go-digest"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -29,7 +34,7 @@ func TestOpenP2p(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", files.CacheBlockSize, files.CacheBlockSize+172))
-	req.Header.Set(pcontext.P2PHeaderKey, "true")
+	req.Header.Set(pcontext.HopsHeaderKey, "1")
 
 	expD := "sha256:d18c7a64c5158179bdee531a663c5b487de57ff17cff3af29a51c7e70b491d9d"
 	expK := fmt.Sprintf("%v%v%v", expD, files.FileChunkKeySep, files.CacheBlockSize)
@@ -43,7 +48,10 @@ func TestOpenP2p(t *testing.T) {
 	ctx.Set(pcontext.FileChunkCtxKey, expK)
 
 	PrefetchWorkers = 0 // turn off prefetching
-	s, err := NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	storeCtx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(storeCtx, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -74,7 +82,10 @@ func TestOpenNonP2p(t *testing.T) {
 	ctx.Set(pcontext.FileChunkCtxKey, expK)
 
 	PrefetchWorkers = 0 // turn off prefetching
-	s, err := NewMockStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	storeCtx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewMockStore(storeCtx, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,7 +116,10 @@ func TestKey(t *testing.T) {
 		{Key: "url", Value: hostAndPath},
 	}
 
-	s, err := NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	storeCtx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(storeCtx, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,7 +139,10 @@ func TestKey(t *testing.T) {
 }
 
 func TestSubscribe(t *testing.T) {
-	s, err := NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,3 +151,332 @@ func TestSubscribe(t *testing.T) {
 		t.Fatal("expected channel, got nil")
 	}
 }
+
+func TestAdvertiseCached(t *testing.T) {
+	defer func(m routing.AdvertiseMode) { routing.Advertise = m }(routing.Advertise)
+	routing.Advertise = routing.AdvertiseChunks
+
+	path := t.TempDir()
+	c := cache.NewCache(ctxWithMetrics, int64(files.CacheBlockSize), path)
+	name := digest.FromString("cached").String()
+	if _, err := c.GetOrCreate(name, 0, 10, func() ([]byte, error) {
+		return []byte(newRandomStringN(10)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case key := <-s.Subscribe():
+		if want := files.FileChunkKey(name, 0, int64(files.CacheBlockSize)); key != want {
+			t.Errorf("expected %v, got %v", want, key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected cached chunk to be advertised")
+	}
+}
+
+func TestReprovide(t *testing.T) {
+	defer func(m routing.AdvertiseMode) { routing.Advertise = m }(routing.Advertise)
+	routing.Advertise = routing.AdvertiseChunks
+
+	prev := ReprovideInterval
+	defer func() { ReprovideInterval = prev }()
+	ReprovideInterval = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := digest.FromString("cached").String()
+	if _, err := s.(*store).cache.GetOrCreate(name, 0, 10, func() ([]byte, error) {
+		return []byte(newRandomStringN(10)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := files.FileChunkKey(name, 0, int64(files.CacheBlockSize))
+	for i := 0; i < 2; i++ {
+		select {
+		case key := <-s.Subscribe():
+			if key != want {
+				t.Errorf("advertisement %v: expected %v, got %v", i, want, key)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected cached chunk to be advertised again, got %v advertisements", i)
+		}
+	}
+}
+
+func TestAdvertiseCachedOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s := &store{
+		blockSize: files.CacheBlockSize,
+		cache:     cache.NewCache(ctx, int64(files.CacheBlockSize), t.TempDir()),
+		blobsChan: make(chan string, 2),
+	}
+
+	older, recent := digest.FromString("older").String(), digest.FromString("recent").String()
+	for _, name := range []string{older, recent, older} {
+		if _, err := s.cache.GetOrCreate(name, 0, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !s.advertiseCached(ctx, rate.NewLimiter(rate.Inf, 1)) {
+		t.Fatal("expected advertising to complete")
+	}
+
+	// The chunk of the older file was accessed last, so it is advertised first.
+	want := []string{
+		files.FileChunkKey(older, 0, int64(files.CacheBlockSize)),
+		files.FileChunkKey(recent, 0, int64(files.CacheBlockSize)),
+	}
+	for i, w := range want {
+		select {
+		case key := <-s.Subscribe():
+			if key != w {
+				t.Errorf("advertisement %v: expected %v, got %v", i, w, key)
+			}
+		default:
+			t.Fatalf("expected cached chunk to be advertised, got %v advertisements", i)
+		}
+	}
+}
+
+func TestEvicted(t *testing.T) {
+	defer func(m routing.AdvertiseMode) { routing.Advertise = m }(routing.Advertise)
+	routing.Advertise = routing.AdvertiseChunks
+
+	prevCost, prevPolicy := cache.FilesCacheMaxCost, cache.EvictionPolicyName
+	defer func() {
+		cache.FilesCacheMaxCost, cache.EvictionPolicyName = prevCost, prevPolicy
+	}()
+	cache.FilesCacheMaxCost = 2 * int64(files.CacheBlockSize)
+	cache.EvictionPolicyName = cache.PolicyLRU
+
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.(*store).cache
+
+	name := digest.FromString("evicted").String()
+	for i := int64(0); i < 3; i++ {
+		if _, err := c.GetOrCreate(name, i*int64(files.CacheBlockSize), 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c.Contains(name, 0) {
+		t.Error("expected the least recently used chunk to be evicted")
+	}
+
+	select {
+	case key := <-s.Evicted():
+		if want := files.FileChunkKey(name, 0, int64(files.CacheBlockSize)); key != want {
+			t.Errorf("expected %v, got %v", want, key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected evicted chunk to be reported")
+	}
+}
+
+func TestAdvertiseCachedBlobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s := &store{
+		blockSize:     files.CacheBlockSize,
+		cache:         cache.NewCache(ctx, int64(files.CacheBlockSize), t.TempDir()),
+		advertiseMode: routing.AdvertiseBlobs,
+		blobsChan:     make(chan string, 3),
+	}
+
+	older, recent := digest.FromString("older").String(), digest.FromString("recent").String()
+	for _, chunk := range []struct {
+		name   string
+		offset int64
+	}{{older, 0}, {recent, 0}, {older, int64(files.CacheBlockSize)}} {
+		if _, err := s.cache.GetOrCreate(chunk.name, chunk.offset, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !s.advertiseCached(ctx, rate.NewLimiter(rate.Inf, 1)) {
+		t.Fatal("expected advertising to complete")
+	}
+
+	// Every file is advertised once, however many of its chunks are cached.
+	want := []string{older, recent}
+	for i, w := range want {
+		select {
+		case key := <-s.Subscribe():
+			if key != w {
+				t.Errorf("advertisement %v: expected %v, got %v", i, w, key)
+			}
+		default:
+			t.Fatalf("expected cached file to be advertised, got %v advertisements", i)
+		}
+	}
+	if len(s.blobsChan) != 0 {
+		t.Errorf("expected: %v, got: %v", 0, len(s.blobsChan))
+	}
+}
+
+func TestEvictedBlobs(t *testing.T) {
+	defer func(m routing.AdvertiseMode) { routing.Advertise = m }(routing.Advertise)
+	routing.Advertise = routing.AdvertiseBlobs
+
+	prevCost, prevPolicy := cache.FilesCacheMaxCost, cache.EvictionPolicyName
+	defer func() {
+		cache.FilesCacheMaxCost, cache.EvictionPolicyName = prevCost, prevPolicy
+	}()
+	cache.FilesCacheMaxCost = 2 * int64(files.CacheBlockSize)
+	cache.EvictionPolicyName = cache.PolicyLRU
+
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(make(map[string][]string)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.(*store).cache
+
+	// The first chunk of the file is evicted while its second is cached, so the file is still advertised.
+	name, other := digest.FromString("evicted").String(), digest.FromString("other").String()
+	for _, chunk := range []struct {
+		name   string
+		offset int64
+	}{{name, 0}, {name, int64(files.CacheBlockSize)}, {other, 0}} {
+		if _, err := c.GetOrCreate(chunk.name, chunk.offset, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case key := <-s.Evicted():
+		t.Fatalf("expected no withdrawal while a chunk of the file is cached, got %v", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Evicting the last chunk of the file withdraws it.
+	if _, err := c.GetOrCreate(other, int64(files.CacheBlockSize), 10, func() ([]byte, error) {
+		return []byte(newRandomStringN(10)), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case key := <-s.Evicted():
+		if key != name {
+			t.Errorf("expected %v, got %v", name, key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected evicted file to be reported")
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	defer cancel()
+
+	s := &store{blockSize: files.CacheBlockSize, cache: cache.NewCache(ctx, int64(files.CacheBlockSize), t.TempDir())}
+
+	size := int64(files.CacheBlockSize)
+	name := digest.FromString("partial").String()
+	for _, off := range []int64{0, size, 3 * size} {
+		if _, err := s.cache.GetOrCreate(name, off, 10, func() ([]byte, error) {
+			return []byte(newRandomStringN(10)), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The size of the file is not known until it is opened.
+	want := [][2]int64{{0, 2 * size}, {3 * size, 4 * size}}
+	if got := s.Availability(name); fmt.Sprint(got.Ranges) != fmt.Sprint(want) {
+		t.Errorf("expected: %v, got: %v", want, got.Ranges)
+	}
+
+	s.cache.PutSize(name, 3*size+1)
+	want = [][2]int64{{0, 2 * size}, {3 * size, 3*size + 1}}
+	if got := s.Availability(name); got.Size != 3*size+1 || fmt.Sprint(got.Ranges) != fmt.Sprint(want) {
+		t.Errorf("expected: %v, got: %v", want, got)
+	}
+
+	if got := s.Availability(digest.FromString("missing").String()); len(got.Ranges) != 0 {
+		t.Errorf("expected no ranges, got: %v", got.Ranges)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 10 * time.Minute
+	for i := 0; i < 100; i++ {
+		if got := jitter(d); got < 9*time.Minute || got > 11*time.Minute {
+			t.Fatalf("expected jitter within 10%% of %v, got %v", d, got)
+		}
+	}
+}
+
+func TestQuotaGroup(t *testing.T) {
+	prev := cache.Quotas
+	defer func() { cache.Quotas = prev }()
+
+	cache.Quotas = cache.QuotaConfig{
+		TenantHeader: "X-Tenant",
+		Groups: []cache.QuotaGroup{
+			{Name: "ml", Tenants: []string{"ml-team"}},
+			{Name: "registry", Registries: []string{"01031d61e1024861afee5d512651eb9f"}},
+		},
+	}
+
+	tests := []struct {
+		tenant string
+		want   string
+	}{
+		{tenant: "ml-team", want: "ml"},
+		{tenant: "", want: "registry"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:5000/blobs/"+u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", tt.tenant)
+
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = req
+		ctx.Params = []gin.Param{{Key: "url", Value: hostAndPath}}
+
+		if got := quotaGroup(pcontext.Context{Context: ctx}); got != tt.want {
+			t.Errorf("tenant %q: expected: %v, got: %v", tt.tenant, tt.want, got)
+		}
+	}
+}
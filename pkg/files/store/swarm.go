@@ -0,0 +1,589 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package store
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/azure/peerd/pkg/discovery/content/reader"
+	"github.com/azure/peerd/pkg/discovery/routing"
+	"github.com/azure/peerd/pkg/files"
+	"github.com/azure/peerd/pkg/math"
+	"github.com/azure/peerd/pkg/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// swarmSourceConcurrency is the number of chunks of a blob read concurrently from each peer.
+	swarmSourceConcurrency = 4
+
+	// swarmResolveConcurrency is the number of chunks of a blob whose providers are resolved concurrently.
+	swarmResolveConcurrency = 16
+
+	// swarmRebalanceInterval is the interval at which idle sources look for chunks held up by slow sources.
+	swarmRebalanceInterval = 100 * time.Millisecond
+
+	// swarmSlowFactor is how many times longer than expected a source must take to read a chunk to be slow.
+	swarmSlowFactor = 2
+
+	// swarmSourceFailures is the number of consecutive failed reads after which a peer is no longer read from.
+	swarmSourceFailures = 3
+
+	// swarmDurationWeight is the weight of the latest read in the moving average of the read duration of a source.
+	swarmDurationWeight = 0.2
+)
+
+// swarmChunk is a chunk of a blob downloaded by a swarm.
+type swarmChunk struct {
+	offset int64
+	count  int
+
+	// providers are the peers that provide the chunk and have not failed to read it.
+	providers []peer.ID
+
+	// resolved is whether resolving the providers of the chunk is complete.
+	resolved bool
+
+	// done is whether the chunk is cached, or given up on.
+	done bool
+
+	// reads cancel the reads of the chunk in flight, by source.
+	reads map[*swarmSource]context.CancelFunc
+
+	// started is when the first read in flight started.
+	started time.Time
+}
+
+// swarmSource is a peer, or the upstream, that chunks are read from.
+type swarmSource struct {
+	info   routing.PeerInfo
+	origin bool
+
+	// reading is the number of chunks being read from the source.
+	reading int
+
+	// avg is the moving average of the time to read a chunk from the source, or zero until one is read.
+	avg time.Duration
+
+	// failures is the number of consecutive failed reads from the source.
+	failures int
+}
+
+// failed returns whether the source is no longer read from.
+func (s *swarmSource) failed() bool {
+	return !s.origin && s.failures >= swarmSourceFailures
+}
+
+// swarm downloads the chunks of a blob from all of their providers concurrently, and from the upstream those that no
+// peer provides. Each peer is read by its own workers, which take the chunks it provides in order, or the rarest first
+// when the upstream is constrained. Slow peers read one chunk at a time, and an idle source races the read of a chunk
+// that has taken much longer than the source is expected to take.
+type swarm struct {
+	name   string
+	store  *store
+	reader reader.Reader
+
+	maxSources    int
+	originWorkers int
+	rarestFirst   bool
+
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	lock      sync.Mutex
+	chunks    []*swarmChunk
+	remaining int
+	origin    *swarmSource
+	sources   map[peer.ID]*swarmSource
+
+	// standby are the providers found once the number of sources reached maxSources, in the order they were found.
+	standby []routing.PeerInfo
+	found   map[peer.ID]bool
+
+	// changed is closed when chunks or sources change, so that idle workers look for work again.
+	changed chan struct{}
+}
+
+// newSwarm creates a swarm to download the file with the name through the reader.
+func newSwarm(s *store, name string, r reader.Reader) *swarm {
+	originWorkers := s.swarmOriginLimit
+	if originWorkers <= 0 {
+		originWorkers = PrefetchWorkers
+	}
+
+	return &swarm{
+		name:          name,
+		store:         s,
+		reader:        r,
+		maxSources:    s.swarmSources,
+		originWorkers: max(originWorkers, 1),
+		rarestFirst:   s.swarmOriginLimit > 0,
+		origin:        &swarmSource{origin: true},
+		sources:       map[peer.ID]*swarmSource{},
+		found:         map[peer.ID]bool{},
+		changed:       make(chan struct{}),
+	}
+}
+
+// download downloads the file with a swarm in the background, unless it is already being downloaded.
+func (f *file) download() {
+	if _, running := f.store.swarms.LoadOrStore(f.Name, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer f.store.swarms.Delete(f.Name)
+
+		fileSize, err := f.Fstat()
+		if err != nil {
+			return
+		}
+
+		newSwarm(f.store, f.Name, f.prefetchReader).run(f.store.ctx, fileSize)
+	}()
+}
+
+// run downloads the chunks of the file of the size that are not cached, and returns once every chunk is cached or
+// given up on, or ctx is done.
+func (sw *swarm) run(ctx context.Context, size int64) {
+	segs, err := math.NewSegments(0, sw.store.blockSize, size, size)
+	if err != nil {
+		sw.reader.Log().Error().Err(err).Msg("swarm error: failed to create segments")
+		return
+	}
+
+	for seg := range segs.All() {
+		if sw.store.cache.Exists(sw.name, seg.Index) {
+			continue
+		}
+		sw.chunks = append(sw.chunks, &swarmChunk{offset: seg.Index, count: seg.Count, reads: map[*swarmSource]context.CancelFunc{}})
+	}
+	sw.remaining = len(sw.chunks)
+	if sw.remaining == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sw.ctx = ctx
+
+	start := time.Now()
+	sw.lock.Lock()
+	for range sw.originWorkers {
+		sw.wg.Add(1)
+		go sw.work(sw.origin)
+	}
+	sw.lock.Unlock()
+
+	sw.wg.Add(1)
+	go sw.resolve()
+
+	sw.wg.Wait()
+
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	sw.reader.Log().Info().Str("name", sw.name).Int("chunks", len(sw.chunks)).Int("sources", len(sw.sources)).Dur("duration", time.Since(start)).Msg("swarm download complete")
+}
+
+// resolve resolves the providers of the chunks, in order.
+func (sw *swarm) resolve() {
+	defer sw.wg.Done()
+
+	g := errgroup.Group{}
+	g.SetLimit(swarmResolveConcurrency)
+	for _, c := range sw.chunks {
+		if sw.ctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			sw.resolveChunk(c)
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
+
+// resolveChunk resolves the providers of the chunk within the resolve budget of prefetching, adding the peers found as
+// sources.
+func (sw *swarm) resolveChunk(c *swarmChunk) {
+	defer func() {
+		sw.lock.Lock()
+		defer sw.lock.Unlock()
+		c.resolved = true
+		sw.notify()
+	}()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(sw.ctx, sw.store.prefetchBudget.Timeout())
+	defer cancel()
+
+	key := files.FileChunkKey(sw.name, c.offset, int64(sw.store.blockSize))
+	peersCh, err := sw.store.router.Resolve(ctx, key, false, max(sw.maxSources, 1))
+	if err != nil {
+		sw.reader.Log().Debug().Err(err).Str("key", key).Msg("swarm resolve error")
+		return
+	}
+
+	first := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p, ok := <-peersCh:
+			if !ok {
+				return
+			}
+			if first {
+				reader.RecordDiscovery(time.Since(start))
+				first = false
+			}
+			sw.addProvider(c, p)
+		}
+	}
+}
+
+// addProvider records that the peer provides the chunk, and reads from the peer if there is room for another source.
+func (sw *swarm) addProvider(c *swarmChunk, p routing.PeerInfo) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if !slices.Contains(c.providers, p.ID) {
+		c.providers = append(c.providers, p.ID)
+	}
+
+	if !sw.found[p.ID] {
+		sw.found[p.ID] = true
+		if sw.liveSources() < sw.maxSources {
+			sw.addSource(p)
+		} else {
+			sw.standby = append(sw.standby, p)
+		}
+	}
+	sw.notify()
+}
+
+// addSource starts reading from the peer. It must be called with the lock held.
+func (sw *swarm) addSource(p routing.PeerInfo) {
+	if sw.remaining == 0 || sw.ctx.Err() != nil {
+		return
+	}
+
+	src := &swarmSource{info: p}
+	sw.sources[p.ID] = src
+	for range swarmSourceConcurrency {
+		sw.wg.Add(1)
+		go sw.work(src)
+	}
+}
+
+// liveSources returns the number of peers being read from. It must be called with the lock held.
+func (sw *swarm) liveSources() int {
+	n := 0
+	for _, src := range sw.sources {
+		if !src.failed() {
+			n++
+		}
+	}
+	return n
+}
+
+// work reads chunks from the source until every chunk is done, the source fails or the swarm stops.
+func (sw *swarm) work(src *swarmSource) {
+	defer sw.wg.Done()
+
+	for {
+		release, ok := sw.slot(src)
+		if !ok {
+			return
+		}
+
+		c, ctx, changed := sw.next(src)
+		if c == nil {
+			release()
+		}
+		if c == nil && changed == nil {
+			return
+		}
+
+		if c == nil {
+			select {
+			case <-sw.ctx.Done():
+				return
+			case <-changed:
+			case <-time.After(swarmRebalanceInterval):
+			}
+			continue
+		}
+
+		start := time.Now()
+		data, source, err := sw.read(ctx, src, c)
+		release()
+		sw.finish(src, c, data, source, err, time.Since(start))
+	}
+}
+
+// slot waits until the source may read a chunk, and returns the function that releases it. The upstream is read by at
+// most PrefetchWorkers workers across the swarms of the store, so that prefetching many files at once does not flood
+// it. It returns false if the swarm stops first.
+func (sw *swarm) slot(src *swarmSource) (func(), bool) {
+	if !src.origin {
+		return func() {}, true
+	}
+
+	select {
+	case <-sw.ctx.Done():
+		return nil, false
+	case sw.store.originSlots <- struct{}{}:
+		return func() { <-sw.store.originSlots }, true
+	}
+}
+
+// next assigns the source a chunk to read, and returns it with the context of the read. If there is none to read yet,
+// it returns a channel that is closed when that may have changed, and if there will be none, it returns neither.
+func (sw *swarm) next(src *swarmSource) (*swarmChunk, context.Context, <-chan struct{}) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if sw.remaining == 0 || src.failed() || sw.ctx.Err() != nil {
+		return nil, nil, nil
+	}
+
+	// Slow sources read one chunk at a time, leaving the rest to faster ones.
+	if src.reading > 0 && sw.slow(src) {
+		return nil, nil, sw.changed
+	}
+
+	var best *swarmChunk
+	for _, c := range sw.chunks {
+		if c.done || len(c.reads) > 0 || !sw.serves(src, c) {
+			continue
+		}
+		if !sw.rarestFirst {
+			best = c
+			break
+		}
+		if best == nil || sw.liveProviders(c) < sw.liveProviders(best) {
+			best = c
+		}
+	}
+
+	if best == nil {
+		best = sw.stealable(src)
+	}
+	if best == nil {
+		return nil, nil, sw.changed
+	}
+
+	ctx, cancel := context.WithCancel(sw.ctx)
+	if len(best.reads) == 0 {
+		best.started = time.Now()
+	}
+	best.reads[src] = cancel
+	src.reading++
+	return best, ctx, nil
+}
+
+// serves returns whether the source is assigned the chunk when it is not being read. The upstream is assigned only the
+// chunks that no peer being read from provides, once their providers are resolved. It must be called with the lock held.
+func (sw *swarm) serves(src *swarmSource, c *swarmChunk) bool {
+	if src.origin {
+		return c.resolved && sw.liveProviders(c) == 0
+	}
+	return slices.Contains(c.providers, src.info.ID)
+}
+
+// liveProviders returns the number of providers of the chunk being read from. It must be called with the lock held.
+func (sw *swarm) liveProviders(c *swarmChunk) int {
+	n := 0
+	for _, id := range c.providers {
+		if src, ok := sw.sources[id]; ok && !src.failed() {
+			n++
+		}
+	}
+	return n
+}
+
+// stealable returns the chunk that the source should race the read of, the one read the longest by a single other
+// source for longer than swarmSlowFactor times the time the source is expected to take. A constrained upstream does not
+// race peers. It must be called with the lock held.
+func (sw *swarm) stealable(src *swarmSource) *swarmChunk {
+	if src.origin && sw.rarestFirst {
+		return nil
+	}
+
+	expected := sw.expected(src)
+	if expected <= 0 {
+		return nil
+	}
+
+	var victim *swarmChunk
+	var longest time.Duration
+	for _, c := range sw.chunks {
+		if _, reading := c.reads[src]; c.done || len(c.reads) != 1 || reading {
+			continue
+		}
+		if !src.origin && !slices.Contains(c.providers, src.info.ID) {
+			continue
+		}
+
+		if elapsed := time.Since(c.started); elapsed > swarmSlowFactor*expected && elapsed > longest {
+			victim, longest = c, elapsed
+		}
+	}
+	return victim
+}
+
+// expected returns the time the source is expected to take to read a chunk: its own average if it has read one, or
+// else the typical average of the sources. It must be called with the lock held.
+func (sw *swarm) expected(src *swarmSource) time.Duration {
+	if src.avg > 0 {
+		return src.avg
+	}
+	return sw.typical()
+}
+
+// typical returns the median of the average read durations of the sources, or zero if none has read a chunk.
+// It must be called with the lock held.
+func (sw *swarm) typical() time.Duration {
+	var avgs []time.Duration
+	for _, src := range sw.sources {
+		if src.avg > 0 && !src.failed() {
+			avgs = append(avgs, src.avg)
+		}
+	}
+	if sw.origin.avg > 0 {
+		avgs = append(avgs, sw.origin.avg)
+	}
+	if len(avgs) == 0 {
+		return 0
+	}
+
+	slices.Sort(avgs)
+	return avgs[len(avgs)/2]
+}
+
+// slow returns whether the source takes more than swarmSlowFactor times the typical time to read a chunk.
+// The upstream is never slow, since it is the only source of some chunks. It must be called with the lock held.
+func (sw *swarm) slow(src *swarmSource) bool {
+	if src.origin || src.avg <= 0 {
+		return false
+	}
+	return src.avg > swarmSlowFactor*sw.typical()
+}
+
+// read reads the chunk from the source, and returns the source that served it. The upstream is read through the
+// closest super-peer that serves the chunk, if any, so that it is read from the upstream once for all nodes.
+func (sw *swarm) read(ctx context.Context, src *swarmSource, c *swarmChunk) ([]byte, string, error) {
+	buf := make([]byte, c.count)
+	key := files.FileChunkKey(sw.name, c.offset, int64(sw.store.blockSize))
+
+	source := metrics.SourcePeer
+	var err error
+	if src.origin {
+		source, err = sw.readUpstream(ctx, key, buf, c.offset)
+	} else {
+		_, err = sw.reader.PreadPeer(ctx, src.info, key, buf, c.offset)
+	}
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	return buf, source, nil
+}
+
+// readUpstream reads the chunk with the key at the offset from the closest super-peer that serves it, or else from the
+// upstream, and returns the source that served it.
+func (sw *swarm) readUpstream(ctx context.Context, key string, buf []byte, offset int64) (string, error) {
+	for _, p := range sw.store.router.SuperPeers() {
+		if _, err := sw.reader.PreadPeer(ctx, p, key, buf, offset); err == nil || err == io.EOF || ctx.Err() != nil {
+			return metrics.SourceSuperPeer, err
+		}
+	}
+
+	_, err := sw.reader.PreadOrigin(ctx, key, buf, offset)
+	return metrics.SourceUpstream, err
+}
+
+// finish records the result of reading the chunk from the source that took d, and caches and advertises the chunk if
+// the read is the first to succeed. The reads of the chunk that lost the race are cancelled. The bytes of the first
+// read are recorded as prefetched from the source that served them.
+func (sw *swarm) finish(src *swarmSource, c *swarmChunk, data []byte, source string, err error, d time.Duration) {
+	sw.lock.Lock()
+	if cancel, ok := c.reads[src]; ok {
+		cancel()
+		delete(c.reads, src)
+	}
+	src.reading--
+	sw.notify()
+
+	if c.done {
+		// Another source read the chunk first.
+		sw.lock.Unlock()
+		return
+	}
+
+	if err != nil {
+		sw.failed(src, c, err)
+		sw.lock.Unlock()
+		return
+	}
+
+	c.done = true
+	sw.remaining--
+	for _, cancel := range c.reads {
+		cancel()
+	}
+
+	src.failures = 0
+	if src.avg == 0 {
+		src.avg = d
+	} else {
+		src.avg = time.Duration(swarmDurationWeight*float64(d) + (1-swarmDurationWeight)*float64(src.avg))
+	}
+	sw.lock.Unlock()
+
+	sw.store.metricsRecorder.RecordBytesPrefetched(source, int64(len(data)))
+	if _, err := sw.store.cache.GetOrCreate(sw.name, c.offset, c.count, func() ([]byte, error) {
+		return data, nil
+	}); err != nil {
+		sw.reader.Log().Error().Err(err).Str("name", sw.name).Int64("offset", c.offset).Msg("swarm cache error")
+		return
+	}
+	sw.store.advertise(sw.name, c.offset)
+}
+
+// failed records that reading the chunk from the source failed. The chunk is no longer read from the peer, and a peer
+// that fails repeatedly is replaced by a provider on standby. A chunk the upstream fails to read is given up on, and is
+// read again when it is requested. It must be called with the lock held.
+func (sw *swarm) failed(src *swarmSource, c *swarmChunk, err error) {
+	log := sw.reader.Log().Warn().Err(err).Str("name", sw.name).Int64("offset", c.offset)
+
+	if src.origin {
+		if len(c.reads) == 0 {
+			log.Msg("swarm upstream read failed, giving up on chunk")
+			c.done = true
+			sw.remaining--
+		}
+		return
+	}
+
+	c.providers = slices.DeleteFunc(c.providers, func(id peer.ID) bool { return id == src.info.ID })
+	src.failures++
+	log.Str("peer", src.info.HttpHost).Int("failures", src.failures).Msg("swarm peer read failed")
+
+	if src.failed() && len(sw.standby) > 0 {
+		p := sw.standby[0]
+		sw.standby = sw.standby[1:]
+		sw.addSource(p)
+	}
+}
+
+// notify wakes up the idle workers. It must be called with the lock held.
+func (sw *swarm) notify() {
+	close(sw.changed)
+	sw.changed = make(chan struct{})
+}
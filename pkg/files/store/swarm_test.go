@@ -0,0 +1,266 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azure/peerd/pkg/discovery/routing"
+	"github.com/azure/peerd/pkg/discovery/routing/mocks"
+	"github.com/azure/peerd/pkg/files"
+	"github.com/azure/peerd/pkg/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/rs/zerolog"
+)
+
+const (
+	swarmTestName = "swarm-test"
+
+	// swarmTestChunks is the number of chunks of the test file.
+	swarmTestChunks = 8
+)
+
+func TestSwarmSpreadsChunks(t *testing.T) {
+	s := newSwarmStore(t, []string{"peer-1", "peer-2"}, swarmTestChunks)
+	r := newSwarmReader(map[peer.ID]time.Duration{"peer-1": 20 * time.Millisecond, "peer-2": 20 * time.Millisecond}, nil)
+
+	newSwarm(s, swarmTestName, r).run(context.Background(), int64(len(r.data)))
+
+	expectCached(t, s, r.data)
+	if r.count("peer-1") == 0 || r.count("peer-2") == 0 {
+		t.Errorf("expected reads from both peers, got: %v, %v", r.count("peer-1"), r.count("peer-2"))
+	}
+	if got := r.count(""); got != 0 {
+		t.Errorf("expected: %v, got: %v", 0, got)
+	}
+}
+
+func TestSwarmFallsBackToUpstream(t *testing.T) {
+	// The first half of the chunks is provided by a failing peer, the rest by none.
+	s := newSwarmStore(t, []string{"peer-1"}, 4)
+	r := newSwarmReader(nil, map[peer.ID]bool{"peer-1": true})
+
+	newSwarm(s, swarmTestName, r).run(context.Background(), int64(len(r.data)))
+
+	expectCached(t, s, r.data)
+	if got := r.count(""); got != swarmTestChunks {
+		t.Errorf("expected: %v, got: %v", swarmTestChunks, got)
+	}
+}
+
+func TestSwarmRebalancesSlowSource(t *testing.T) {
+	s := newSwarmStore(t, []string{"peer-1", "peer-2"}, swarmTestChunks)
+	r := newSwarmReader(map[peer.ID]time.Duration{"peer-1": 10 * time.Second, "peer-2": 5 * time.Millisecond}, nil)
+
+	start := time.Now()
+	newSwarm(s, swarmTestName, r).run(context.Background(), int64(len(r.data)))
+
+	expectCached(t, s, r.data)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the chunks read by the slow peer to be raced, took: %v", elapsed)
+	}
+}
+
+func TestSwarmsShareOriginSlots(t *testing.T) {
+	s := newSwarmStore(t, nil, 0)
+	s.originSlots = make(chan struct{}, 2)
+	r := newSwarmReader(nil, nil)
+	r.originDelay = 10 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"swarm-a", "swarm-b", "swarm-c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newSwarm(s, name, r).run(context.Background(), int64(len(r.data)))
+		}()
+	}
+	wg.Wait()
+
+	if got := r.count(""); got != 3*swarmTestChunks {
+		t.Errorf("expected: %v, got: %v", 3*swarmTestChunks, got)
+	}
+	if r.maxOrigin > cap(s.originSlots) {
+		t.Errorf("expected at most %v concurrent upstream reads, got: %v", cap(s.originSlots), r.maxOrigin)
+	}
+}
+
+func TestSwarmNext(t *testing.T) {
+	s := newSwarmStore(t, nil, 0)
+
+	fast := &swarmSource{info: routing.PeerInfo{ID: "peer-1"}, avg: 10 * time.Millisecond}
+	slow := &swarmSource{info: routing.PeerInfo{ID: "peer-2"}, avg: time.Second, reading: 1}
+	other := &swarmSource{info: routing.PeerInfo{ID: "peer-3"}, avg: 10 * time.Millisecond}
+
+	newTestSwarm := func(rarestFirst bool) *swarm {
+		sw := newSwarm(s, swarmTestName, newSwarmReader(nil, nil))
+		sw.ctx = context.Background()
+		sw.rarestFirst = rarestFirst
+		sw.sources = map[peer.ID]*swarmSource{"peer-1": fast, "peer-2": slow, "peer-3": other}
+		sw.chunks = []*swarmChunk{
+			{offset: 0, providers: []peer.ID{"peer-1", "peer-2", "peer-3"}, resolved: true, reads: map[*swarmSource]context.CancelFunc{}},
+			{offset: 4, providers: []peer.ID{"peer-1"}, resolved: true, reads: map[*swarmSource]context.CancelFunc{}},
+			{offset: 8, providers: []peer.ID{"peer-1", "peer-2"}, resolved: true, reads: map[*swarmSource]context.CancelFunc{slow: func() {}}, started: time.Now().Add(-time.Second)},
+			{offset: 12, resolved: true, reads: map[*swarmSource]context.CancelFunc{}},
+		}
+		sw.remaining = len(sw.chunks)
+		return sw
+	}
+
+	for _, tc := range []struct {
+		name        string
+		rarestFirst bool
+		src         *swarmSource
+		expected    int64
+	}{
+		{name: "in order", src: fast, expected: 0},
+		{name: "rarest first", rarestFirst: true, src: fast, expected: 4},
+		{name: "upstream without providers", src: newSwarm(s, swarmTestName, nil).origin, expected: 12},
+		// The slow source is already reading a chunk.
+		{name: "slow source", src: slow, expected: -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := int64(-1)
+			if c, _, _ := newTestSwarm(tc.rarestFirst).next(tc.src); c != nil {
+				got = c.offset
+			}
+			if got != tc.expected {
+				t.Errorf("expected: %v, got: %v", tc.expected, got)
+			}
+		})
+	}
+
+	// An idle source races the chunk held up by the slow source.
+	sw := newTestSwarm(false)
+	sw.chunks = sw.chunks[2:3]
+	sw.remaining = 1
+	if c, _, _ := sw.next(fast); c == nil || c.offset != 8 {
+		t.Errorf("expected chunk %v to be raced, got: %v", 8, c)
+	}
+	if c, _, _ := sw.next(other); c != nil {
+		t.Errorf("expected no chunk for a source that does not provide it, got: %v", c.offset)
+	}
+}
+
+// newSwarmStore creates a store whose router resolves the first chunks of the test file to the peers.
+func newSwarmStore(t *testing.T, peers []string, chunks int) *store {
+	resolver := map[string][]string{}
+	for i := range chunks {
+		offset := int64(i * files.CacheBlockSize)
+		resolver[files.FileChunkKey(swarmTestName, offset, int64(files.CacheBlockSize))] = peers
+	}
+
+	ctx, cancel := context.WithCancel(ctxWithMetrics)
+	t.Cleanup(cancel)
+
+	s, err := NewFilesStore(ctx, mocks.NewMockRouter(resolver), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*store)
+}
+
+// expectCached checks that every chunk of the test file is cached with the data.
+func expectCached(t *testing.T, s *store, expected []byte) {
+	size := files.CacheBlockSize
+	for off := 0; off < len(expected); off += size {
+		data, err := s.cache.GetOrCreate(swarmTestName, int64(off), size, func() ([]byte, error) {
+			return nil, errors.New("not cached")
+		})
+		if err != nil {
+			t.Errorf("expected chunk %v to be cached: %v", off, err)
+		} else if !bytes.Equal(data, expected[off:off+size]) {
+			t.Errorf("expected chunk %v to match", off)
+		}
+	}
+}
+
+// swarmReader reads the test file from peers that take the configured time or fail, and from the upstream.
+type swarmReader struct {
+	data   []byte
+	delays map[peer.ID]time.Duration
+	fail   map[peer.ID]bool
+
+	// originDelay is the time a read from the upstream takes.
+	originDelay time.Duration
+
+	lock  sync.Mutex
+	reads map[peer.ID]int
+
+	// origin and maxOrigin are the number of reads from the upstream in progress, and the most at once.
+	origin, maxOrigin int
+}
+
+// newSwarmReader creates a reader of a test file of swarmTestChunks chunks with the delays and failures of peers.
+func newSwarmReader(delays map[peer.ID]time.Duration, fail map[peer.ID]bool) *swarmReader {
+	data := make([]byte, swarmTestChunks*files.CacheBlockSize)
+	_, _ = rand.Read(data)
+	return &swarmReader{data: data, delays: delays, fail: fail, reads: map[peer.ID]int{}}
+}
+
+// count returns the number of reads from the peer, or from the upstream for an empty ID.
+func (r *swarmReader) count(id peer.ID) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reads[id]
+}
+
+// FstatRemote implements reader.Reader.
+func (r *swarmReader) FstatRemote() (int64, error) {
+	return int64(len(r.data)), nil
+}
+
+// Log implements reader.Reader.
+func (r *swarmReader) Log() *zerolog.Logger {
+	l := zerolog.Nop()
+	return &l
+}
+
+// PreadRemote implements reader.Reader.
+func (r *swarmReader) PreadRemote(buf []byte, offset int64) (int, string, error) {
+	return copy(buf, r.data[offset:]), metrics.SourceUpstream, nil
+}
+
+// PreadPeer implements reader.Reader.
+func (r *swarmReader) PreadPeer(ctx context.Context, p routing.PeerInfo, key string, buf []byte, offset int64) (int, error) {
+	r.lock.Lock()
+	r.reads[p.ID]++
+	r.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(r.delays[p.ID]):
+	}
+
+	if r.fail[p.ID] {
+		return 0, fmt.Errorf("peer %v failed", p.ID)
+	}
+	n, _, err := r.PreadRemote(buf, offset)
+	return n, err
+}
+
+// PreadOrigin implements reader.Reader.
+func (r *swarmReader) PreadOrigin(ctx context.Context, key string, buf []byte, offset int64) (int, error) {
+	r.lock.Lock()
+	r.reads[""]++
+	r.origin++
+	r.maxOrigin = max(r.maxOrigin, r.origin)
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		r.origin--
+		r.lock.Unlock()
+	}()
+
+	time.Sleep(r.originDelay)
+	n, _, err := r.PreadRemote(buf, offset)
+	return n, err
+}
@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/azure/peerd/pkg/discovery/routing"
+	filesStore "github.com/azure/peerd/pkg/files/store"
+	"github.com/gin-gonic/gin"
+)
+
+// AdminHandler creates a handler for the admin API, which is served next to the metrics and not to peers.
+func AdminHandler(ctx context.Context, r routing.Router, fs filesStore.FilesStore) (http.Handler, error) {
+	engine := newEngine(ctx)
+	engine.GET("/admin/cache/quotas", cacheQuotasHandler(fs))
+	engine.GET("/admin/peers", peersHandler(r))
+	return engine, nil
+}
+
+// cacheQuotasHandler is a handler function for the /admin/cache/quotas API
+// @Summary Get the usage of the cache quota groups
+// @Success 200 {array} object "The usage of each quota group"
+// @Failure 404 {string} string "Quotas are disabled"
+// @Router /admin/cache/quotas [get]
+func cacheQuotasHandler(fs filesStore.FilesStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		usage := fs.CacheUsage()
+		if usage == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	}
+}
+
+// peerStats are the measurements of a peer, as served by the /admin/peers API.
+type peerStats struct {
+	ID                 string  `json:"id"`
+	Region             string  `json:"region,omitempty"`
+	Zone               string  `json:"zone,omitempty"`
+	NodePool           string  `json:"nodePool,omitempty"`
+	RttMs              float64 `json:"rttMs"`
+	ThroughputMiBps    float64 `json:"throughputMiBps"`
+	ExpectedTransferMs float64 `json:"expectedTransferMs"`
+}
+
+// peersHandler is a handler function for the /admin/peers API
+// @Summary Get the known peers, in the order they are preferred as providers
+// @Success 200 {array} object "The measurements of each peer"
+// @Router /admin/peers [get]
+func peersHandler(r routing.Router) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		peers := []peerStats{}
+		for _, s := range r.PeerStats() {
+			peers = append(peers, peerStats{
+				ID:                 s.ID.String(),
+				Region:             s.Topology.Region,
+				Zone:               s.Topology.Zone,
+				NodePool:           s.Topology.NodePool,
+				RttMs:              float64(s.Rtt) / float64(time.Millisecond),
+				ThroughputMiBps:    s.Throughput / (1024 * 1024),
+				ExpectedTransferMs: float64(s.ExpectedTransfer) / float64(time.Millisecond),
+			})
+		}
+		c.JSON(http.StatusOK, peers)
+	}
+}
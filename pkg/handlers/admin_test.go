@@ -0,0 +1,97 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/azure/peerd/pkg/cache"
+	"github.com/azure/peerd/pkg/discovery/routing/mocks"
+	"github.com/azure/peerd/pkg/files/store"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestCacheQuotasHandler(t *testing.T) {
+	prev := cache.Quotas
+	defer func() { cache.Quotas = prev }()
+
+	tests := []struct {
+		name       string
+		config     cache.QuotaConfig
+		wantStatus int
+		wantGroups int
+	}{
+		{name: "disabled", wantStatus: http.StatusNotFound},
+		{
+			name:       "enabled",
+			config:     cache.QuotaConfig{Groups: []cache.QuotaGroup{{Name: "models", Hard: 1 << 30}}},
+			wantStatus: http.StatusOK,
+			wantGroups: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache.Quotas = tt.config
+
+			mr := mocks.NewMockRouter(map[string][]string{})
+			mfs, err := store.NewMockStore(ctxWithMetrics, mr, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h, err := AdminHandler(ctxWithMetrics, mr, mfs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			h.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/cache/quotas", nil))
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("expected: %v, got: %v", tt.wantStatus, recorder.Code)
+			}
+
+			if tt.wantStatus == http.StatusOK {
+				var usage []cache.GroupUsage
+				if err := json.Unmarshal(recorder.Body.Bytes(), &usage); err != nil {
+					t.Fatal(err)
+				} else if len(usage) != tt.wantGroups {
+					t.Errorf("expected %v groups, got %v", tt.wantGroups, usage)
+				}
+			}
+		})
+	}
+}
+
+func TestPeersHandler(t *testing.T) {
+	mr := mocks.NewMockRouter(map[string][]string{})
+	mr.ReportTransfer("peer-1", 1024, time.Millisecond)
+
+	mfs, err := store.NewMockStore(ctxWithMetrics, mr, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := AdminHandler(ctxWithMetrics, mr, mfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/peers", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, recorder.Code)
+	}
+
+	var peers []peerStats
+	if err := json.Unmarshal(recorder.Body.Bytes(), &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].ID != peer.ID("peer-1").String() {
+		t.Errorf("expected: %v, got: %v", []string{peer.ID("peer-1").String()}, peers)
+	}
+}
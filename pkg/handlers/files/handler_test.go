@@ -34,7 +34,7 @@ func TestPartialContentResponseInP2PMode(t *testing.T) {
 	}
 	expRange := fmt.Sprintf("bytes=%v-%v", 12, 100)
 	req.Header.Set("Range", expRange)
-	req.Header.Set(pcontext.P2PHeaderKey, "true")
+	req.Header.Set(pcontext.HopsHeaderKey, "1")
 
 	expD := "sha256:d18c7a64c5158179bdee531a663c5b487de57ff17cff3af29a51c7e70b491d9d"
 
@@ -89,7 +89,7 @@ func TestNotFoundInP2PMode(t *testing.T) {
 	}
 	expRange := fmt.Sprintf("bytes=%v-%v", files.CacheBlockSize, files.CacheBlockSize+172)
 	req.Header.Set("Range", expRange)
-	req.Header.Set(pcontext.P2PHeaderKey, "true")
+	req.Header.Set(pcontext.HopsHeaderKey, "1")
 
 	// Create a new context with the request.
 	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
@@ -99,7 +99,7 @@ func TestNotFoundInP2PMode(t *testing.T) {
 	}
 
 	store.PrefetchWorkers = 0 // turn off prefetching
-	s, err := store.NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), testFileCachePath)
+	s, err := store.NewFilesStore(ctxWithMetrics, mocks.NewMockRouter(make(map[string][]string)), t.TempDir())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,7 +122,7 @@ func TestFill(t *testing.T) {
 	}
 	expRange := fmt.Sprintf("bytes=%v-%v", files.CacheBlockSize, files.CacheBlockSize+172)
 	req.Header.Set("Range", expRange)
-	req.Header.Set(pcontext.P2PHeaderKey, "true")
+	req.Header.Set(pcontext.HopsHeaderKey, "1")
 
 	expD := "sha256:d18c7a64c5158179bdee531a663c5b487de57ff17cff3af29a51c7e70b491d9d"
 	expK := fmt.Sprintf("%v_%v", expD, files.CacheBlockSize)
@@ -23,6 +23,7 @@ func Handler(ctx context.Context, r routing.Router, fs filesStore.FilesStore) (h
 
 	engine := newEngine(ctx)
 	registerRoutes(engine, fileHandler)
+	engine.GET(routing.AvailabilityPath+":name", availabilityHandler(fs))
 
 	return engine, nil
 }
@@ -85,3 +86,20 @@ func registerRoutes(engine *gin.Engine, f gin.HandlerFunc) {
 func fileHandler(c *gin.Context) {
 	fh.Handle(pcontext.FromContext(c))
 }
+
+// availabilityHandler is a handler function for the /chunks API
+// @Summary Get the byte ranges of a blob that are cached
+// @Param name path string true "The name of the blob"
+// @Success 200 {object} object "The size of the blob and the cached byte ranges"
+// @Failure 404 {string} string "Not Found"
+// @Router /chunks/{name} [get]
+func availabilityHandler(fs filesStore.FilesStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a := fs.Availability(c.Param("name"))
+		if len(a.Ranges) == 0 {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, a)
+	}
+}
@@ -4,14 +4,17 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/azure/peerd/pkg/discovery/routing"
 	"github.com/azure/peerd/pkg/discovery/routing/mocks"
 	"github.com/azure/peerd/pkg/files/store"
 	"github.com/azure/peerd/pkg/metrics"
 	"github.com/gin-gonic/gin"
+	"github.com/opencontainers/go-digest"
 )
 
 var (
@@ -162,3 +165,43 @@ func TestRegisterRoutes(t *testing.T) {
 		})
 	}
 }
+
+func TestAvailabilityHandler(t *testing.T) {
+	mr := mocks.NewMockRouter(map[string][]string{})
+	mfs, err := store.NewMockStore(ctxWithMetrics, mr, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := digest.FromString("cached").String()
+	if _, err := mfs.Cache().GetOrCreate(name, 0, 10, func() ([]byte, error) {
+		return make([]byte, 10), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := Handler(ctxWithMetrics, mr, mfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", routing.AvailabilityPath+name, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected: %v, got: %v", http.StatusOK, recorder.Code)
+	}
+
+	var a routing.Availability
+	if err := json.Unmarshal(recorder.Body.Bytes(), &a); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Holds(0) {
+		t.Errorf("expected the cached chunk to be held, got: %v", a.Ranges)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", routing.AvailabilityPath+digest.FromString("missing").String(), nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected: %v, got: %v", http.StatusNotFound, recorder.Code)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package k8s
+
+import (
+	"context"
+)
+
+// SuperPeerLabel is the label of the nodes whose peerd runs as a super-peer, with the value "true".
+var SuperPeerLabel = "peerd.azure.com/super-peer"
+
+// IsSuperPeerNode returns whether the node this process runs on is labelled to run as a super-peer.
+func IsSuperPeerNode(ctx context.Context, k *ClientSet) (bool, error) {
+	node, err := currentNode(ctx, k)
+	if err != nil {
+		return false, err
+	}
+
+	return node.Labels[SuperPeerLabel] == "true", nil
+}
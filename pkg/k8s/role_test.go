@@ -0,0 +1,47 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestIsSuperPeerNode(t *testing.T) {
+	cs := &ClientSet{
+		Interface: fake.NewSimpleClientset(
+			&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{SuperPeerLabel: "true"}}},
+			&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2", Labels: map[string]string{SuperPeerLabel: "false"}}},
+			&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+		),
+		Name: "peerd-abcde",
+	}
+
+	for _, tc := range []struct {
+		nodeName string
+		expected bool
+	}{
+		{nodeName: "node-1", expected: true},
+		{nodeName: "node-2", expected: false},
+		{nodeName: "node-3", expected: false},
+	} {
+		t.Setenv("NODE_NAME", tc.nodeName)
+
+		got, err := IsSuperPeerNode(context.Background(), cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.expected {
+			t.Errorf("%v: expected: %v, got: %v", tc.nodeName, tc.expected, got)
+		}
+	}
+
+	t.Setenv("NODE_NAME", "")
+	if _, err := IsSuperPeerNode(context.Background(), cs); err == nil {
+		t.Error("expected error for unknown node")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package k8s
+
+import (
+	"context"
+	"os"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ZoneLabel is the well-known label of the zone of a node.
+	ZoneLabel = "topology.kubernetes.io/zone"
+
+	// RegionLabel is the well-known label of the region of a node.
+	RegionLabel = "topology.kubernetes.io/region"
+)
+
+// NodePoolLabel is the label of the node pool of a node.
+var NodePoolLabel = "kubernetes.azure.com/agentpool"
+
+// Topology is the location of a node in the cluster.
+// Empty fields are unknown.
+type Topology struct {
+	Region   string `json:"region,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	NodePool string `json:"nodePool,omitempty"`
+}
+
+// NodeTopology returns the topology of the node this process runs on, from the labels of the node.
+func NodeTopology(ctx context.Context, k *ClientSet) (Topology, error) {
+	node, err := currentNode(ctx, k)
+	if err != nil {
+		return Topology{}, err
+	}
+
+	return Topology{
+		Region:   node.Labels[RegionLabel],
+		Zone:     node.Labels[ZoneLabel],
+		NodePool: node.Labels[NodePoolLabel],
+	}, nil
+}
+
+// currentNode returns the node this process runs on.
+// In a pod, the node is named by the NODE_NAME environment variable, otherwise it is the name of the client set.
+func currentNode(ctx context.Context, k *ClientSet) (*v1.Node, error) {
+	name := os.Getenv("NODE_NAME")
+	if name == "" {
+		name = k.Name
+	}
+
+	return k.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeTopology(t *testing.T) {
+	cs := &ClientSet{
+		Interface: fake.NewSimpleClientset(
+			&v1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name: "node-1",
+				Labels: map[string]string{
+					RegionLabel:   "eastus",
+					ZoneLabel:     "eastus-1",
+					NodePoolLabel: "pool1",
+				},
+			}},
+			&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		),
+		Name: "peerd-abcde",
+	}
+
+	for _, tc := range []struct {
+		name        string
+		nodeName    string
+		expected    Topology
+		expectedErr bool
+	}{
+		{
+			name:     "labelled node",
+			nodeName: "node-1",
+			expected: Topology{Region: "eastus", Zone: "eastus-1", NodePool: "pool1"},
+		},
+		{
+			name:     "unlabelled node",
+			nodeName: "node-2",
+		},
+		{
+			name:        "client set name",
+			expectedErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("NODE_NAME", tc.nodeName)
+
+			got, err := NodeTopology(context.Background(), cs)
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected: %v, got: %v", tc.expected, got)
+			}
+		})
+	}
+}
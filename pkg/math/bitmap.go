@@ -0,0 +1,103 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package math
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Bitmap is a growable set of non-negative integers, such as the indexes of the segments of a file.
+type Bitmap struct {
+	words []uint64
+}
+
+// Set adds i to the bitmap.
+func (b *Bitmap) Set(i int64) {
+	w := int(i / 64)
+	if w >= len(b.words) {
+		b.words = append(b.words, make([]uint64, w-len(b.words)+1)...)
+	}
+	b.words[w] |= 1 << (uint64(i) % 64)
+}
+
+// Clear removes i from the bitmap.
+func (b *Bitmap) Clear(i int64) {
+	if w := int(i / 64); w < len(b.words) {
+		b.words[w] &^= 1 << (uint64(i) % 64)
+	}
+}
+
+// Test reports whether i is in the bitmap.
+func (b *Bitmap) Test(i int64) bool {
+	w := int(i / 64)
+	return i >= 0 && w < len(b.words) && b.words[w]&(1<<(uint64(i)%64)) != 0
+}
+
+// Count returns the number of integers in the bitmap.
+func (b *Bitmap) Count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// All returns the integers in the bitmap in ascending order.
+func (b *Bitmap) All() []int64 {
+	var all []int64
+	for i, w := range b.words {
+		for w != 0 {
+			all = append(all, int64(i*64+bits.TrailingZeros64(w)))
+			w &= w - 1
+		}
+	}
+	return all
+}
+
+// Covers reports whether the bitmap contains the index of every segment of s, where the index of a segment is its
+// aligned offset divided by the step.
+func (b *Bitmap) Covers(s Segments) bool {
+	covered := true
+	for seg := range s.All() {
+		// Drain the channel so that the producer exits.
+		if covered && !b.Test(seg.Index/int64(s.step)) {
+			covered = false
+		}
+	}
+	return covered
+}
+
+// MarshalBinary encodes the bitmap as a little-endian count of words followed by the words.
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	n := len(b.words)
+	for n > 0 && b.words[n-1] == 0 {
+		n--
+	}
+
+	buf := make([]byte, 4+8*n)
+	binary.LittleEndian.PutUint32(buf, uint32(n))
+	for i, w := range b.words[:n] {
+		binary.LittleEndian.PutUint64(buf[4+8*i:], w)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a bitmap encoded by MarshalBinary.
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("bitmap too short: %d bytes", len(data))
+	}
+
+	n := int(binary.LittleEndian.Uint32(data))
+	if len(data) != 4+8*n {
+		return fmt.Errorf("bitmap of %d words has %d bytes", n, len(data))
+	}
+
+	b.words = make([]uint64, n)
+	for i := range b.words {
+		b.words[i] = binary.LittleEndian.Uint64(data[4+8*i:])
+	}
+	return nil
+}
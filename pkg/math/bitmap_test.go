@@ -0,0 +1,80 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package math
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+	var b Bitmap
+	for _, i := range []int64{0, 3, 64, 200} {
+		b.Set(i)
+	}
+	b.Clear(3)
+	b.Clear(1000)
+
+	if got := b.All(); !slices.Equal(got, []int64{0, 64, 200}) {
+		t.Errorf("expected: %v, got: %v", []int64{0, 64, 200}, got)
+	}
+	if b.Count() != 3 {
+		t.Errorf("expected: %v, got: %v", 3, b.Count())
+	}
+	if b.Test(3) || b.Test(-1) || b.Test(1000) || !b.Test(64) {
+		t.Errorf("unexpected membership: %v", b.All())
+	}
+}
+
+func TestBitmapMarshal(t *testing.T) {
+	var b Bitmap
+	b.Set(1)
+	b.Set(130)
+	b.Set(500)
+	b.Clear(500)
+
+	data, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4+8*3 {
+		t.Errorf("expected trailing empty words to be trimmed, got %v bytes", len(data))
+	}
+
+	var got Bitmap
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.All(), b.All()) {
+		t.Errorf("expected: %v, got: %v", b.All(), got.All())
+	}
+
+	if err := got.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("expected error for truncated bitmap")
+	}
+}
+
+func TestBitmapCovers(t *testing.T) {
+	var b Bitmap
+	b.Set(0)
+	b.Set(1)
+	b.Set(3)
+
+	for _, tc := range []struct {
+		offset, count, size int64
+		expected            bool
+	}{
+		{offset: 0, count: 8, size: 8, expected: true},
+		{offset: 0, count: 16, size: 10, expected: false},
+		{offset: 13, count: 3, size: 16, expected: true},
+		{offset: 7, count: 4, size: 16, expected: false},
+	} {
+		s, err := NewSegments(tc.offset, 4, tc.count, tc.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.Covers(s); got != tc.expected {
+			t.Errorf("offset %v count %v: expected: %v, got: %v", tc.offset, tc.count, tc.expected, got)
+		}
+	}
+}
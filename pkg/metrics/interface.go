@@ -11,6 +11,38 @@ import (
 
 type ctxKey struct{}
 
+// Tiers of the cache hierarchy.
+const (
+	// TierFiles is the on-disk cache of file chunks.
+	TierFiles = "files"
+
+	// TierMetadata is the in-memory cache of file sizes.
+	TierMetadata = "metadata"
+
+	// TierPeer is the set of peers that may serve a chunk missed by the local caches.
+	TierPeer = "peer"
+)
+
+// Sources of served and prefetched bytes.
+const (
+	SourceCache     = "cache"
+	SourcePeer      = "peer"
+	SourceSuperPeer = "super-peer"
+	SourceUpstream  = "upstream"
+)
+
+// Reasons for failing to fill the cache.
+const (
+	// FillFailureFetch indicates that the content could not be fetched.
+	FillFailureFetch = "fetch"
+
+	// FillFailureWrite indicates that the fetched content could not be written to disk.
+	FillFailureWrite = "write"
+
+	// FillFailureSize indicates that the fetched content did not have the expected size.
+	FillFailureSize = "size"
+)
+
 // Metrics defines an interface to collect p2p metrics.
 type Metrics interface {
 	// RecordRequest records the time it takes to process a request.
@@ -24,6 +56,45 @@ type Metrics interface {
 
 	// RecordUpstreamResponse records the time it takes for an upstream to respond for a key.
 	RecordUpstreamResponse(hostname, key, op string, duration float64, count int64)
+
+	// RecordCacheEviction records the eviction of a cache entry by the given policy for the given reason.
+	RecordCacheEviction(policy, reason string)
+
+	// RecordCacheGroupUsage records the number of bytes cached for the given quota group.
+	RecordCacheGroupUsage(group string, bytes int64)
+
+	// RecordCacheHit records a lookup that was served by the given tier.
+	RecordCacheHit(tier string)
+
+	// RecordCacheMiss records a lookup that the given tier could not serve.
+	RecordCacheMiss(tier string)
+
+	// RecordCacheFillFailure records a failure to fill the cache for the given reason.
+	RecordCacheFillFailure(reason string)
+
+	// RecordBytesServed records bytes served to a client that were read from the given source: the cache, or a peer,
+	// super-peer or the upstream for bytes that were missing from the cache.
+	RecordBytesServed(source string, bytes int64)
+
+	// RecordBytesPrefetched records bytes of a chunk prefetched into the cache from the given source: a peer, super-peer
+	// or the upstream.
+	RecordBytesPrefetched(source string, bytes int64)
+
+	// RecordProvideQueueDepth records the number of keys waiting to be advertised.
+	RecordProvideQueueDepth(depth int)
+
+	// RecordProvide records the time it takes to advertise a batch of keys.
+	RecordProvide(duration float64, keys int)
+
+	// RecordProvideDropped records a key that was not queued for advertisement because the queue was full.
+	RecordProvideDropped()
+
+	// RecordHedge records a read from a peer that was slow and raced by a read from the given source, a peer or the
+	// upstream.
+	RecordHedge(source string)
+
+	// RecordHedgeWin records a race won by the read from the given source that hedged a slow read from a peer.
+	RecordHedgeWin(source string)
 }
 
 // WithContext returns a new context with a metrics recorder.
@@ -36,7 +107,11 @@ func WithContext(ctx context.Context, name, prefix string) (context.Context, err
 	return context.WithValue(ctx, ctxKey{}, pm), nil
 }
 
-// FromContext returns the metrics recorder from the context.
+// FromContext returns the metrics recorder from the context, or a recorder that discards all metrics if the context has
+// none.
 func FromContext(ctx context.Context) Metrics {
-	return ctx.Value(ctxKey{}).(*promMetrics)
+	if m, ok := ctx.Value(ctxKey{}).(*promMetrics); ok {
+		return m
+	}
+	return nopMetrics{}
 }
@@ -36,3 +36,10 @@ func TestFromContext(t *testing.T) {
 		t.Fatal("expected non-nil metrics")
 	}
 }
+
+func TestFromContextWithoutMetrics(t *testing.T) {
+	m := FromContext(context.Background())
+	if _, ok := m.(nopMetrics); !ok {
+		t.Errorf("expected: %T, got: %T", nopMetrics{}, m)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package metrics
+
+// nopMetrics is a metrics collector that discards all metrics.
+type nopMetrics struct{}
+
+var _ Metrics = nopMetrics{}
+
+// RecordRequest implements Metrics.
+func (nopMetrics) RecordRequest(method, handler string, duration float64) {}
+
+// RecordPeerDiscovery implements Metrics.
+func (nopMetrics) RecordPeerDiscovery(ip string, duration float64) {}
+
+// RecordPeerResponse implements Metrics.
+func (nopMetrics) RecordPeerResponse(ip, key, op string, duration float64, count int64) {}
+
+// RecordUpstreamResponse implements Metrics.
+func (nopMetrics) RecordUpstreamResponse(hostname, key, op string, duration float64, count int64) {}
+
+// RecordCacheEviction implements Metrics.
+func (nopMetrics) RecordCacheEviction(policy, reason string) {}
+
+// RecordCacheGroupUsage implements Metrics.
+func (nopMetrics) RecordCacheGroupUsage(group string, bytes int64) {}
+
+// RecordCacheHit implements Metrics.
+func (nopMetrics) RecordCacheHit(tier string) {}
+
+// RecordCacheMiss implements Metrics.
+func (nopMetrics) RecordCacheMiss(tier string) {}
+
+// RecordCacheFillFailure implements Metrics.
+func (nopMetrics) RecordCacheFillFailure(reason string) {}
+
+// RecordBytesServed implements Metrics.
+func (nopMetrics) RecordBytesServed(source string, bytes int64) {}
+
+// RecordBytesPrefetched implements Metrics.
+func (nopMetrics) RecordBytesPrefetched(source string, bytes int64) {}
+
+// RecordProvideQueueDepth implements Metrics.
+func (nopMetrics) RecordProvideQueueDepth(depth int) {}
+
+// RecordProvide implements Metrics.
+func (nopMetrics) RecordProvide(duration float64, keys int) {}
+
+// RecordProvideDropped implements Metrics.
+func (nopMetrics) RecordProvideDropped() {}
+
+// RecordHedge implements Metrics.
+func (nopMetrics) RecordHedge(source string) {}
+
+// RecordHedgeWin implements Metrics.
+func (nopMetrics) RecordHedgeWin(source string) {}
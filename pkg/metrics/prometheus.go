@@ -14,6 +14,19 @@ type promMetrics struct {
 	peerDiscoveryDuration *prometheus.HistogramVec
 	peerResponseSpeed     *prometheus.HistogramVec
 	upstreamResponseSpeed *prometheus.HistogramVec
+	cacheEvictions        *prometheus.CounterVec
+	cacheGroupUsage       *prometheus.GaugeVec
+	cacheHits             *prometheus.CounterVec
+	cacheMisses           *prometheus.CounterVec
+	cacheFillFailures     *prometheus.CounterVec
+	bytesServed           *prometheus.CounterVec
+	bytesPrefetched       *prometheus.CounterVec
+	provideQueueDepth     *prometheus.GaugeVec
+	provideDuration       *prometheus.HistogramVec
+	providedKeys          *prometheus.CounterVec
+	provideDropped        *prometheus.CounterVec
+	hedges                *prometheus.CounterVec
+	hedgeWins             *prometheus.CounterVec
 }
 
 var _ Metrics = &promMetrics{}
@@ -43,6 +56,79 @@ func (m *promMetrics) RecordUpstreamResponse(hostname string, key string, op str
 	m.upstreamResponseSpeed.WithLabelValues(m.name, hostname, op).Observe(bps / float64(1024*1024))
 }
 
+// RecordCacheEviction records the eviction of a cache entry.
+// It increments the Prometheus counter for the given policy and reason.
+func (m *promMetrics) RecordCacheEviction(policy string, reason string) {
+	m.cacheEvictions.WithLabelValues(m.name, policy, reason).Inc()
+}
+
+// RecordCacheGroupUsage records the number of bytes cached for a quota group.
+// It sets the Prometheus gauge for the given group.
+func (m *promMetrics) RecordCacheGroupUsage(group string, bytes int64) {
+	m.cacheGroupUsage.WithLabelValues(m.name, group).Set(float64(bytes))
+}
+
+// RecordCacheHit records a lookup served by a cache tier.
+// It increments the Prometheus counter for the given tier.
+func (m *promMetrics) RecordCacheHit(tier string) {
+	m.cacheHits.WithLabelValues(m.name, tier).Inc()
+}
+
+// RecordCacheMiss records a lookup that a cache tier could not serve.
+// It increments the Prometheus counter for the given tier.
+func (m *promMetrics) RecordCacheMiss(tier string) {
+	m.cacheMisses.WithLabelValues(m.name, tier).Inc()
+}
+
+// RecordCacheFillFailure records a failure to fill the cache.
+// It increments the Prometheus counter for the given reason.
+func (m *promMetrics) RecordCacheFillFailure(reason string) {
+	m.cacheFillFailures.WithLabelValues(m.name, reason).Inc()
+}
+
+// RecordBytesServed records bytes served to a client from a source.
+// It adds the bytes to the Prometheus counter for the given source.
+func (m *promMetrics) RecordBytesServed(source string, bytes int64) {
+	m.bytesServed.WithLabelValues(m.name, source).Add(float64(bytes))
+}
+
+// RecordBytesPrefetched records bytes prefetched from a source.
+// It adds the bytes to the Prometheus counter for the given source.
+func (m *promMetrics) RecordBytesPrefetched(source string, bytes int64) {
+	m.bytesPrefetched.WithLabelValues(m.name, source).Add(float64(bytes))
+}
+
+// RecordProvideQueueDepth records the number of keys waiting to be advertised.
+// It sets the Prometheus gauge.
+func (m *promMetrics) RecordProvideQueueDepth(depth int) {
+	m.provideQueueDepth.WithLabelValues(m.name).Set(float64(depth))
+}
+
+// RecordProvide records the duration of advertising a batch of keys.
+// It updates the Prometheus histogram and adds the keys to the counter of advertised keys.
+func (m *promMetrics) RecordProvide(duration float64, keys int) {
+	m.provideDuration.WithLabelValues(m.name).Observe(duration)
+	m.providedKeys.WithLabelValues(m.name).Add(float64(keys))
+}
+
+// RecordProvideDropped records a key dropped from the advertisement queue.
+// It increments the Prometheus counter.
+func (m *promMetrics) RecordProvideDropped() {
+	m.provideDropped.WithLabelValues(m.name).Inc()
+}
+
+// RecordHedge records a slow read from a peer raced by a read from a source.
+// It increments the Prometheus counter for the given source.
+func (m *promMetrics) RecordHedge(source string) {
+	m.hedges.WithLabelValues(m.name, source).Inc()
+}
+
+// RecordHedgeWin records a race won by the hedging read from a source.
+// It increments the Prometheus counter for the given source.
+func (m *promMetrics) RecordHedgeWin(source string) {
+	m.hedgeWins.WithLabelValues(m.name, source).Inc()
+}
+
 // NewPromMetrics creates a new instance of promMetrics.
 func NewPromMetrics(reg prometheus.Registerer, name, prefix string) *promMetrics {
 
@@ -74,11 +160,103 @@ func NewPromMetrics(reg prometheus.Registerer, name, prefix string) *promMetrics
 	}, []string{"self", "hostname", "op"})
 	reg.MustRegister(upstreamResponseDurationHist)
 
+	cacheEvictionsCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_cache_evictions_total",
+		Help: "Number of entries evicted from the files cache.",
+	}, []string{"self", "policy", "reason"})
+	reg.MustRegister(cacheEvictionsCounter)
+
+	cacheGroupUsageGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_cache_group_usage_bytes",
+		Help: "Number of bytes cached for each quota group.",
+	}, []string{"self", "group"})
+	reg.MustRegister(cacheGroupUsageGauge)
+
+	cacheHitsCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_cache_hits_total",
+		Help: "Number of lookups served by each cache tier.",
+	}, []string{"self", "tier"})
+	reg.MustRegister(cacheHitsCounter)
+
+	cacheMissesCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_cache_misses_total",
+		Help: "Number of lookups each cache tier could not serve.",
+	}, []string{"self", "tier"})
+	reg.MustRegister(cacheMissesCounter)
+
+	cacheFillFailuresCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_cache_fill_failures_total",
+		Help: "Number of failures to fill the files cache.",
+	}, []string{"self", "reason"})
+	reg.MustRegister(cacheFillFailuresCounter)
+
+	bytesServedCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_bytes_served_total",
+		Help: "Number of bytes served to clients from the cache, peers and upstreams.",
+	}, []string{"self", "source"})
+	reg.MustRegister(bytesServedCounter)
+
+	bytesPrefetchedCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_bytes_prefetched_total",
+		Help: "Number of bytes prefetched into the cache from peers and upstreams.",
+	}, []string{"self", "source"})
+	reg.MustRegister(bytesPrefetchedCounter)
+
+	provideQueueDepthGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prefix + "_provide_queue_depth",
+		Help: "Number of keys waiting to be advertised.",
+	}, []string{"self"})
+	reg.MustRegister(provideQueueDepthGauge)
+
+	provideDurationHist := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prefix + "_provide_duration_seconds",
+		Help:    "Duration of advertising a batch of keys in seconds.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"self"})
+	reg.MustRegister(provideDurationHist)
+
+	providedKeysCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_provided_keys_total",
+		Help: "Number of keys advertised.",
+	}, []string{"self"})
+	reg.MustRegister(providedKeysCounter)
+
+	provideDroppedCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_provide_dropped_total",
+		Help: "Number of keys not advertised because the advertisement queue was full.",
+	}, []string{"self"})
+	reg.MustRegister(provideDroppedCounter)
+
+	hedgesCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_hedged_reads_total",
+		Help: "Number of slow reads from peers raced by a read from another peer or the upstream.",
+	}, []string{"self", "source"})
+	reg.MustRegister(hedgesCounter)
+
+	hedgeWinsCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prefix + "_hedge_wins_total",
+		Help: "Number of races won by the read that hedged a slow read from a peer.",
+	}, []string{"self", "source"})
+	reg.MustRegister(hedgeWinsCounter)
+
 	return &promMetrics{
 		name:                  name,
 		requestDuration:       requestDurationHist,
 		peerDiscoveryDuration: peerDiscoveryDurationHist,
 		peerResponseSpeed:     peerResponseDurationHist,
 		upstreamResponseSpeed: upstreamResponseDurationHist,
+		cacheEvictions:        cacheEvictionsCounter,
+		cacheGroupUsage:       cacheGroupUsageGauge,
+		cacheHits:             cacheHitsCounter,
+		cacheMisses:           cacheMissesCounter,
+		cacheFillFailures:     cacheFillFailuresCounter,
+		bytesServed:           bytesServedCounter,
+		bytesPrefetched:       bytesPrefetchedCounter,
+		provideQueueDepth:     provideQueueDepthGauge,
+		provideDuration:       provideDurationHist,
+		providedKeys:          providedKeysCounter,
+		provideDropped:        provideDroppedCounter,
+		hedges:                hedgesCounter,
+		hedgeWins:             hedgeWinsCounter,
 	}
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestPromMetrics_RecordPeerDiscovery(t *testing.T) {
@@ -173,3 +174,189 @@ func TestPromMetrics_RecordUpstreamResponse(t *testing.T) {
 		t.Errorf("unexpected metric result:\n%s", err)
 	}
 }
+
+func TestPromMetrics_RecordCacheEviction(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordCacheEviction("lru", "capacity")
+	m.RecordCacheEviction("lru", "capacity")
+	m.RecordCacheEviction("lru", "expired")
+
+	expected := `
+		# HELP peerd_cache_evictions_total Number of entries evicted from the files cache.
+		# TYPE peerd_cache_evictions_total counter
+		peerd_cache_evictions_total{policy="lru",reason="capacity",self="test"} 2
+		peerd_cache_evictions_total{policy="lru",reason="expired",self="test"} 1
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "peerd_cache_evictions_total"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+}
+
+func TestPromMetrics_RecordCacheGroupUsage(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordCacheGroupUsage("models", 100)
+	m.RecordCacheGroupUsage("models", 50)
+	m.RecordCacheGroupUsage("default", 10)
+
+	expected := `
+		# HELP peerd_cache_group_usage_bytes Number of bytes cached for each quota group.
+		# TYPE peerd_cache_group_usage_bytes gauge
+		peerd_cache_group_usage_bytes{group="default",self="test"} 10
+		peerd_cache_group_usage_bytes{group="models",self="test"} 50
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "peerd_cache_group_usage_bytes"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+}
+
+func TestPromMetrics_RecordCacheAccess(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordCacheHit(TierFiles)
+	m.RecordCacheHit(TierFiles)
+	m.RecordCacheMiss(TierFiles)
+	m.RecordCacheMiss(TierPeer)
+
+	expected := `
+		# HELP peerd_cache_hits_total Number of lookups served by each cache tier.
+		# TYPE peerd_cache_hits_total counter
+		peerd_cache_hits_total{self="test",tier="files"} 2
+		# HELP peerd_cache_misses_total Number of lookups each cache tier could not serve.
+		# TYPE peerd_cache_misses_total counter
+		peerd_cache_misses_total{self="test",tier="files"} 1
+		peerd_cache_misses_total{self="test",tier="peer"} 1
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "peerd_cache_hits_total", "peerd_cache_misses_total"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+}
+
+func TestPromMetrics_RecordCacheFillFailure(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordCacheFillFailure(FillFailureFetch)
+	m.RecordCacheFillFailure(FillFailureWrite)
+	m.RecordCacheFillFailure(FillFailureFetch)
+
+	expected := `
+		# HELP peerd_cache_fill_failures_total Number of failures to fill the files cache.
+		# TYPE peerd_cache_fill_failures_total counter
+		peerd_cache_fill_failures_total{reason="fetch",self="test"} 2
+		peerd_cache_fill_failures_total{reason="write",self="test"} 1
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "peerd_cache_fill_failures_total"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+}
+
+func TestPromMetrics_RecordBytesServed(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordBytesServed(SourceCache, 100)
+	m.RecordBytesServed(SourceCache, 28)
+	m.RecordBytesServed(SourcePeer, 64)
+	m.RecordBytesServed(SourceUpstream, 1)
+
+	expected := `
+		# HELP peerd_bytes_served_total Number of bytes served to clients from the cache, peers and upstreams.
+		# TYPE peerd_bytes_served_total counter
+		peerd_bytes_served_total{self="test",source="cache"} 128
+		peerd_bytes_served_total{self="test",source="peer"} 64
+		peerd_bytes_served_total{self="test",source="upstream"} 1
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "peerd_bytes_served_total"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+}
+
+func TestPromMetrics_RecordBytesPrefetched(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordBytesPrefetched(SourcePeer, 64)
+	m.RecordBytesPrefetched(SourceSuperPeer, 32)
+	m.RecordBytesPrefetched(SourcePeer, 64)
+
+	expected := `
+		# HELP peerd_bytes_prefetched_total Number of bytes prefetched into the cache from peers and upstreams.
+		# TYPE peerd_bytes_prefetched_total counter
+		peerd_bytes_prefetched_total{self="test",source="peer"} 128
+		peerd_bytes_prefetched_total{self="test",source="super-peer"} 32
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "peerd_bytes_prefetched_total"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+}
+
+func TestPromMetrics_RecordProvide(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordProvideQueueDepth(7)
+	m.RecordProvideQueueDepth(3)
+	m.RecordProvide(0.5, 10)
+	m.RecordProvide(1.5, 2)
+	m.RecordProvideDropped()
+
+	expected := `
+		# HELP peerd_provide_queue_depth Number of keys waiting to be advertised.
+		# TYPE peerd_provide_queue_depth gauge
+		peerd_provide_queue_depth{self="test"} 3
+		# HELP peerd_provided_keys_total Number of keys advertised.
+		# TYPE peerd_provided_keys_total counter
+		peerd_provided_keys_total{self="test"} 12
+		# HELP peerd_provide_dropped_total Number of keys not advertised because the advertisement queue was full.
+		# TYPE peerd_provide_dropped_total counter
+		peerd_provide_dropped_total{self="test"} 1
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"peerd_provide_queue_depth", "peerd_provided_keys_total", "peerd_provide_dropped_total"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+
+	var h dto.Metric
+	if err := m.provideDuration.WithLabelValues("test").(prometheus.Histogram).Write(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h.GetHistogram().GetSampleCount() != 2 || h.GetHistogram().GetSampleSum() != 2 {
+		t.Errorf("expected 2 samples summing to 2, got %v summing to %v", h.GetHistogram().GetSampleCount(), h.GetHistogram().GetSampleSum())
+	}
+}
+
+func TestPromMetrics_RecordHedge(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewPromMetrics(reg, "test", "peerd")
+
+	m.RecordHedge(SourcePeer)
+	m.RecordHedge(SourcePeer)
+	m.RecordHedge(SourceUpstream)
+	m.RecordHedgeWin(SourceUpstream)
+
+	expected := `
+		# HELP peerd_hedged_reads_total Number of slow reads from peers raced by a read from another peer or the upstream.
+		# TYPE peerd_hedged_reads_total counter
+		peerd_hedged_reads_total{self="test",source="peer"} 2
+		peerd_hedged_reads_total{self="test",source="upstream"} 1
+		# HELP peerd_hedge_wins_total Number of races won by the read that hedged a slow read from a peer.
+		# TYPE peerd_hedge_wins_total counter
+		peerd_hedge_wins_total{self="test",source="upstream"} 1
+	`
+
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "peerd_hedged_reads_total", "peerd_hedge_wins_total"); err != nil {
+		t.Errorf("unexpected metric result:\n%s", err)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package peernet
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog"
+)
+
+// HTTP3 enables the HTTP/3 peer data path: requests to peers are sent over QUIC, to the UDP port of the same number as
+// their HTTPS port, and fall back to HTTP/1.1 over TCP for peers that do not answer over QUIC.
+var HTTP3 = false
+
+const (
+	// http3HandshakeTimeout bounds the QUIC handshake with a peer, after which the request falls back to TCP.
+	http3HandshakeTimeout = 500 * time.Millisecond
+
+	// http3FallbackTtl is how long a peer that did not answer over QUIC is reached over TCP only.
+	http3FallbackTtl = time.Minute
+
+	// http3IdleTtl is how long the HTTP/3 transport of a peer is kept after its last request before it is closed, along
+	// with its QUIC connection and UDP socket.
+	http3IdleTtl = 2 * time.Minute
+)
+
+// http3Transports holds the HTTP/3 transports of peers, which are reused so that requests to a peer share its QUIC
+// connection, and the hosts that fell back to TCP.
+type http3Transports struct {
+	lock       sync.Mutex
+	transports map[peer.ID]*peerTransport
+	fallback   map[string]time.Time
+}
+
+// peerTransport is the HTTP/3 transport of a peer, with the requests in flight over it and when the last one finished.
+type peerTransport struct {
+	*http3.Transport
+	active int
+	used   time.Time
+}
+
+// newHTTP3Transports creates an empty set of HTTP/3 transports.
+func newHTTP3Transports() *http3Transports {
+	return &http3Transports{transports: map[peer.ID]*peerTransport{}, fallback: map[string]time.Time{}}
+}
+
+// acquire returns the HTTP/3 transport for the peer, creating it with the TLS config if needed, and holds it until
+// release is called. The transports of other peers that have been idle for http3IdleTtl are closed.
+func (h *http3Transports) acquire(pid peer.ID, tlsConfig *tls.Config) *peerTransport {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.evictIdle(time.Now())
+
+	t, ok := h.transports[pid]
+	if !ok {
+		t = &peerTransport{Transport: &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: http3HandshakeTimeout},
+		}}
+		h.transports[pid] = t
+	}
+	t.active++
+	return t
+}
+
+// release marks a request over the transport as finished.
+func (h *http3Transports) release(t *peerTransport) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	t.active--
+	t.used = time.Now()
+}
+
+// evictIdle closes and removes the transports without requests in flight that have been idle for http3IdleTtl.
+// The lock must be held.
+func (h *http3Transports) evictIdle(now time.Time) {
+	for pid, t := range h.transports {
+		if t.active == 0 && now.Sub(t.used) >= http3IdleTtl {
+			t.Close()
+			delete(h.transports, pid)
+		}
+	}
+}
+
+// closeIdleConnections closes the idle connections of the HTTP/3 transport for the peer, if any.
+func (h *http3Transports) closeIdleConnections(pid peer.ID) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if t, ok := h.transports[pid]; ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// usable returns whether the host is reached over QUIC: it has not fallen back to TCP recently.
+func (h *http3Transports) usable(host string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	until, ok := h.fallback[host]
+	if ok && !time.Now().Before(until) {
+		delete(h.fallback, host)
+		return true
+	}
+	return !ok
+}
+
+// fallBack records that the host is reached over TCP only, for http3FallbackTtl.
+func (h *http3Transports) fallBack(host string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.fallback[host] = time.Now().Add(http3FallbackTtl)
+}
+
+// fallbackTransport sends requests over HTTP/3, and over TCP to hosts that do not answer over QUIC.
+type fallbackTransport struct {
+	pid        peer.ID
+	tlsConfig  *tls.Config
+	tcp        *http.Transport
+	transports *http3Transports
+}
+
+var _ http.RoundTripper = &fallbackTransport{}
+
+// RoundTrip implements http.RoundTripper.
+// A request without a body that fails over QUIC is retried over TCP, and the host is reached over TCP until it is
+// tried again after http3FallbackTtl. The HTTP/3 transport of the peer is held until the response body is closed.
+func (f *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || !f.transports.usable(req.URL.Host) {
+		return f.tcp.RoundTrip(req)
+	}
+
+	h3 := f.transports.acquire(f.pid, f.tlsConfig)
+	resp, err := h3.RoundTrip(req)
+	if err == nil {
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { f.transports.release(h3) }}
+		return resp, nil
+	}
+	f.transports.release(h3)
+	if req.Context().Err() != nil || (req.Body != nil && req.Body != http.NoBody) {
+		return resp, err
+	}
+
+	zerolog.Ctx(req.Context()).Debug().Err(err).Str("host", req.URL.Host).Msg("http3 request failed, falling back to tcp")
+	f.transports.fallBack(req.URL.Host)
+	return f.tcp.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of both transports.
+func (f *fallbackTransport) CloseIdleConnections() {
+	f.transports.closeIdleConnections(f.pid)
+	f.tcp.CloseIdleConnections()
+}
+
+// releaseBody is a response body that releases the transport it was read over once closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// Close implements io.Closer.
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,291 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+package peernet
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3Disabled(t *testing.T) {
+	defer func(h bool) { HTTP3 = h }(HTTP3)
+	HTTP3 = false
+
+	n, err := New(newTestHost(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := n.RoundTripperFor("test-peer").(*http.Transport); !ok {
+		t.Errorf("expected a tcp transport, got: %T", n.RoundTripperFor("test-peer"))
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	defer func(h bool) { HTTP3 = h }(HTTP3)
+	HTTP3 = true
+
+	server, client := newTestHost(t), newTestHost(t)
+	url := startTestPeer(t, server, []byte("content"), true)
+
+	n, err := New(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		resp, body := get(t, n.HTTPClientFor(server.ID()), url)
+		if resp.Proto != "HTTP/3.0" {
+			t.Errorf("expected: %v, got: %v", "HTTP/3.0", resp.Proto)
+		}
+		if string(body) != "content" {
+			t.Errorf("expected: %v, got: %v", "content", string(body))
+		}
+	}
+
+	// Requests to the peer share its transport, and so its QUIC connection.
+	if got := len(n.(*network).http3.transports); got != 1 {
+		t.Errorf("expected: %v, got: %v", 1, got)
+	}
+}
+
+func TestHTTP3Fallback(t *testing.T) {
+	defer func(h bool) { HTTP3 = h }(HTTP3)
+	HTTP3 = true
+
+	server, client := newTestHost(t), newTestHost(t)
+	url := startTestPeer(t, server, []byte("content"), false)
+
+	n, err := New(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer does not listen over QUIC, so the request falls back to TCP.
+	resp, body := get(t, n.HTTPClientFor(server.ID()), url)
+	if resp.Proto != "HTTP/1.1" {
+		t.Errorf("expected: %v, got: %v", "HTTP/1.1", resp.Proto)
+	}
+	if string(body) != "content" {
+		t.Errorf("expected: %v, got: %v", "content", string(body))
+	}
+
+	// The peer is then reached over TCP without trying QUIC again.
+	host := resp.Request.URL.Host
+	if n.(*network).http3.usable(host) {
+		t.Errorf("expected %v to fall back to tcp", host)
+	}
+	start := time.Now()
+	get(t, n.HTTPClientFor(server.ID()), url)
+	if d := time.Since(start); d >= http3HandshakeTimeout {
+		t.Errorf("expected the request to skip quic, took: %v", d)
+	}
+
+	// The peer is tried over QUIC again after a while.
+	n.(*network).http3.fallback[host] = time.Now()
+	if !n.(*network).http3.usable(host) {
+		t.Errorf("expected %v to be tried over quic again", host)
+	}
+}
+
+func TestHTTP3EvictsIdleTransports(t *testing.T) {
+	defer func(h bool) { HTTP3 = h }(HTTP3)
+	HTTP3 = true
+
+	server, client := newTestHost(t), newTestHost(t)
+	url := startTestPeer(t, server, []byte("content"), true)
+
+	n, err := New(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := n.(*network).http3
+
+	// The transport is held while the response body is open.
+	resp, err := n.HTTPClientFor(server.ID()).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := h.transports[server.ID()]
+	idle.used = time.Now().Add(-http3IdleTtl)
+	h.release(h.acquire("other-peer", nil))
+	if _, ok := h.transports[server.ID()]; !ok {
+		t.Errorf("expected the transport with a request in flight to be kept")
+	}
+
+	// Once the body is closed, the transport is closed after it has been idle for http3IdleTtl.
+	resp.Body.Close()
+	if got := idle.active; got != 0 {
+		t.Errorf("expected: %v, got: %v", 0, got)
+	}
+	h.release(h.acquire("other-peer", nil))
+	if _, ok := h.transports[server.ID()]; !ok {
+		t.Errorf("expected the recently used transport to be kept")
+	}
+
+	idle.used = time.Now().Add(-http3IdleTtl)
+	h.release(h.acquire("other-peer", nil))
+	if _, ok := h.transports[server.ID()]; ok {
+		t.Errorf("expected the idle transport to be evicted")
+	}
+
+	// A new transport is created for the peer when it is requested again.
+	resp, body := get(t, n.HTTPClientFor(server.ID()), url)
+	if resp.Proto != "HTTP/3.0" || string(body) != "content" {
+		t.Errorf("expected: %v %v, got: %v %v", "HTTP/3.0", "content", resp.Proto, string(body))
+	}
+}
+
+// BenchmarkPeerTransfer compares the throughput and tail latency of downloading chunks from a peer over HTTP/1.1 and TCP
+// with those over HTTP/3 and QUIC. Every request uses a new client, as peer reads do, so that the cost of setting up a
+// connection to the peer is included.
+func BenchmarkPeerTransfer(b *testing.B) {
+	content := make([]byte, 1024*1024)
+	if _, err := rand.Read(content); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		http3 bool
+	}{
+		{name: "tcp"},
+		{name: "http3", http3: true},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			defer func(h bool) { HTTP3 = h }(HTTP3)
+			HTTP3 = tc.http3
+
+			server, client := newTestHost(b), newTestHost(b)
+			url := startTestPeer(b, server, content, true)
+
+			n, err := New(client)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var lock sync.Mutex
+			var durations []time.Duration
+
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					start := time.Now()
+					rt := n.RoundTripperFor(server.ID())
+					_, body, err := fetch(&http.Client{Transport: rt}, url)
+					if err != nil {
+						b.Error(err)
+					} else if len(body) != len(content) {
+						b.Errorf("expected: %v, got: %v", len(content), len(body))
+					}
+					if tcp, ok := rt.(*http.Transport); ok {
+						tcp.CloseIdleConnections()
+					}
+
+					lock.Lock()
+					durations = append(durations, time.Since(start))
+					lock.Unlock()
+				}
+			})
+			b.StopTimer()
+
+			slices.Sort(durations)
+			b.ReportMetric(float64(durations[len(durations)*99/100].Microseconds())/1000, "p99-ms")
+		})
+	}
+}
+
+// newTestHost creates a libp2p host that does not listen, whose identity authenticates the test peers.
+func newTestHost(t testing.TB) host.Host {
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// startTestPeer serves the content over HTTPS with the identity of the host on a loopback port, and over HTTP/3 on the
+// UDP port of the same number if quic is true. It returns the URL of the content.
+func startTestPeer(t testing.TB, h host.Host, content []byte, quic bool) string {
+	n, err := New(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(content))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler, TLSConfig: n.DefaultTLSConfig()}
+	go func() {
+		if err := srv.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() { srv.Close() })
+
+	if quic {
+		conn, err := net.ListenPacket("udp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		h3Srv := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(n.DefaultTLSConfig())}
+		go func() {
+			if err := h3Srv.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				t.Error(err)
+			}
+		}()
+		t.Cleanup(func() {
+			h3Srv.Close()
+			conn.Close()
+		})
+	}
+
+	return fmt.Sprintf("https://%s/content", ln.Addr())
+}
+
+// fetch gets the URL with the client, and returns the response and its body.
+func fetch(c *http.Client, url string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// get fetches the URL with the client, failing the test on error.
+func get(t *testing.T, c *http.Client, url string) (*http.Response, []byte) {
+	resp, body, err := fetch(c, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
@@ -43,6 +43,9 @@ type network struct {
 	id               *libp2ptls.Identity
 	defaultTLSConfig *tls.Config
 	defaultTransport *http.Transport
+
+	// http3 holds the HTTP/3 transports of peers, or is nil if the HTTP/3 peer data path is disabled.
+	http3 *http3Transports
 }
 
 var _ Network = &network{}
@@ -61,7 +64,7 @@ func (n *network) HTTPClientFor(pid peer.ID) *http.Client {
 	}
 
 	return &http.Client{
-		Transport: n.transportFor(pid),
+		Transport: n.roundTripperFor(pid),
 		Timeout:   defaultTimeout,
 	}
 }
@@ -74,7 +77,23 @@ func (n *network) RoundTripperFor(pid peer.ID) http.RoundTripper {
 		return n.defaultTransport
 	}
 
-	return n.transportFor(pid)
+	return n.roundTripperFor(pid)
+}
+
+// roundTripperFor returns a round tripper for the given peer, which sends requests over HTTP/3 if enabled and falls
+// back to a single use TCP transport.
+func (n *network) roundTripperFor(pid peer.ID) http.RoundTripper {
+	tcp := n.transportFor(pid)
+	if n.http3 == nil {
+		return tcp
+	}
+
+	return &fallbackTransport{
+		pid:        pid,
+		tlsConfig:  tcp.TLSClientConfig,
+		tcp:        tcp,
+		transports: n.http3,
+	}
 }
 
 // transportFor returns a single use transport for outbound connection to the given peer.
@@ -119,9 +138,13 @@ func New(h host.Host) (Network, error) {
 		MaxConnsPerHost: 100,
 	}
 
-	return &network{
+	n := &network{
 		id:               id,
 		defaultTLSConfig: defaultTLSConfig,
 		defaultTransport: defaultTransport,
-	}, nil
+	}
+	if HTTP3 {
+		n.http3 = newHTTP3Transports()
+	}
+	return n, nil
 }